@@ -0,0 +1,553 @@
+/*
+Copyright 2015-2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gravitational/teleport/integrations/lib"
+	"github.com/gravitational/teleport/integrations/lib/backoff"
+	"github.com/gravitational/teleport/integrations/lib/logger"
+	"github.com/gravitational/trace"
+	"github.com/jonboulle/clockwork"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// App is the app structure
+type App struct {
+	// Fluentd represents the instance of Fluentd client, nil if fluentd-url is not set
+	Fluentd *FluentdClient
+	// EventWatcher represents the instance of TeleportEventWatcher, nil if the events are read from files
+	EventWatcher *TeleportEventsWatcher
+	// Files represents the instance of the file audit log reader, nil if the events are read from the Auth API
+	Files *FileEventsSource
+	// Source is the source the events are read from, EventWatcher or Files unless it is set before Run
+	Source EventSource
+	// Sinks are the destinations the events are sent to after Fluentd
+	Sinks []Sink
+	// Tail is the live tail endpoint, nil if tail-addr is not set
+	Tail *LiveTail
+	// Index is the local event index, nil if index-path is not set
+	Index *EventIndex
+	// Geo adds GeoIP data to the events, nil if no GeoIP databases are set
+	Geo *GeoEnricher
+	// State represents the instance of the persistent state
+	State *State
+	// SessionExporter represents the instance of session recordings exporter, nil if disabled
+	SessionExporter *SessionExporter
+	// LockRules represents the instance of auto-locking rule engine
+	LockRules *LockRuleEngine
+	// Sampler represents the instance of event type sampling and rate limiting policies
+	Sampler *EventSampler
+	// OTLP represents the instance of OTLP log records exporter, nil if disabled
+	OTLP *OTLPExporter
+	// Metrics is the registry the app metrics are registered on and served from. It can be replaced before Run
+	// to serve the metrics along with the metrics of the caller. Every app registers its own metrics, so the
+	// apps need separate registries.
+	Metrics *prometheus.Registry
+	// metricsLabels are added to the app metrics, they tell the apps sharing the registry apart
+	metricsLabels prometheus.Labels
+	// heartbeat tracks the forwarding progress reported by the heartbeat events
+	heartbeat *heartbeatCounter
+	// config is start command CLI config, replaced on reload
+	config atomic.Pointer[StartCmdConfig]
+	// eventsJob represents main audit log event consumer job
+	eventsJob *EventsJob
+	// sessionEventsJob represents session events consumer job
+	sessionEventsJob *SessionEventsJob
+	// draining is closed once the app is terminated, the jobs stop taking new work
+	draining chan struct{}
+	// drained is canceled once the drain phase is over, the work in progress is aborted
+	drained context.Context
+	// abort cancels drained
+	abort context.CancelFunc
+	// drainTimedOut is set if the drain timeout passed before the work in progress was done
+	drainTimedOut atomic.Bool
+	// ingestion is closed once the ingestion jobs are stopped, ingestionOnce creates it
+	ingestion     chan struct{}
+	ingestionOnce sync.Once
+	// reporters are the jobs sending the final reports once the ingestion jobs are stopped, the OTLP exporter
+	// is stopped after them
+	reporters sync.WaitGroup
+	// Process
+	*lib.Process
+}
+
+const (
+	// sendBackoffBase is an initial (minimum) backoff value.
+	sendBackoffBase = 1 * time.Second
+	// sendBackoffMax is a backoff threshold
+	sendBackoffMax = 10 * time.Second
+	// sendBackoffNumTries is the maximum number of backoff tries
+	sendBackoffNumTries = 5
+)
+
+// NewApp creates new app instance. The fetch batch size and concurrency are set to the defaults if they are not
+// set.
+func NewApp(c *StartCmdConfig) (*App, error) {
+	c.IngestConfig.SetDefaults()
+	if err := c.IngestConfig.Check(); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	app := &App{Metrics: prometheus.NewRegistry()}
+	app.config.Store(c)
+	app.draining = make(chan struct{})
+	app.drained, app.abort = context.WithCancel(context.Background())
+	app.heartbeat = newHeartbeatCounter(time.Now())
+
+	app.eventsJob = NewEventsJob(app)
+	app.sessionEventsJob = NewSessionEventsJob(app)
+
+	return app, nil
+}
+
+// Run initializes and runs a watcher and a callback server
+func (a *App) Run(ctx context.Context) error {
+	a.Process = lib.NewProcess(ctx)
+
+	err := a.init(ctx)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	a.OnTerminate(a.drain)
+
+	if a.Config().MetricsAddr != "" {
+		a.Spawn(a.serveMetrics)
+	}
+	if a.Tail != nil {
+		a.Spawn(a.serveLiveTail)
+	}
+	if a.Index != nil {
+		a.Spawn(a.pruneIndex)
+	}
+
+	a.reporters.Add(1)
+	a.Spawn(a.reportRateLimited)
+	if a.Config().HeartbeatInterval > 0 {
+		a.reporters.Add(1)
+		a.Spawn(a.sendHeartbeats)
+	}
+	if a.OTLP != nil {
+		a.Spawn(a.exportOTLP)
+	}
+	if a.Config().CheckpointInterval > 0 {
+		a.Spawn(a.flushCheckpoints)
+	}
+	a.SpawnCriticalJob(a.eventsJob)
+	a.SpawnCriticalJob(a.sessionEventsJob)
+	<-a.Process.Done()
+
+	// Save the progress kept in memory, the jobs are stopped so it won't change anymore
+	if a.State != nil {
+		if err := a.State.Flush(); err != nil {
+			logger.Get(ctx).WithError(err).Error("Failed to save ingestion progress")
+		}
+	}
+	if a.Index != nil {
+		if err := a.Index.Close(); err != nil {
+			logger.Get(ctx).WithError(err).Error("Failed to close event index")
+		}
+	}
+	a.abort()
+	a.reportPending(ctx)
+
+	return a.Err()
+}
+
+// Config returns the current start command configuration
+func (a *App) Config() *StartCmdConfig {
+	return a.config.Load()
+}
+
+// Err returns the error app finished with.
+func (a *App) Err() error {
+	return trace.NewAggregate(a.eventsJob.Err(), a.sessionEventsJob.Err())
+}
+
+// WaitReady waits for http and watcher service to start up.
+func (a *App) WaitReady(ctx context.Context) (bool, error) {
+	mainReady, err := a.eventsJob.WaitReady(ctx)
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+
+	sessionConsumerReady, err := a.sessionEventsJob.WaitReady(ctx)
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+
+	return mainReady && sessionConsumerReady, nil
+}
+
+// sendOtherDestinations sends the event payload to the OTLP receiver and the sinks
+func (a *App) sendOtherDestinations(ctx context.Context, e *TeleportEvent, payload []byte) error {
+	if a.OTLP != nil {
+		if err := a.OTLP.Export(ctx, e, payload); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+
+	for _, s := range a.Sinks {
+		if err := s.Send(ctx, e, payload); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+
+	return nil
+}
+
+// fluentdSentKey returns the dedup window key marking the event accepted by Fluentd while the other
+// destinations failed
+func fluentdSentKey(key string) string {
+	if key == "" {
+		return ""
+	}
+
+	return key + "/fluentd"
+}
+
+// SendEvent sends an event to fluentd. Shared method used by jobs.
+func (a *App) SendEvent(ctx context.Context, url string, e *TeleportEvent) error {
+	_, err := a.forwardEvent(ctx, url, e)
+	if lib.IsCanceled(err) {
+		return nil
+	}
+
+	return trace.Wrap(err)
+}
+
+// forwardEvent sends an event to every destination, returns false if the event is dropped by the event type
+// policies. The event already sent is not sent again, but it is reported as forwarded. Unlike SendEvent, the
+// event which sending is canceled is reported as an error, so it is neither counted nor its position saved.
+func (a *App) forwardEvent(ctx context.Context, url string, e *TeleportEvent) (bool, error) {
+	log := logger.Get(ctx)
+
+	if e.IdempotencyKey == "" {
+		e.IdempotencyKey = eventIdempotencyKey(e.ID, e.Event)
+	}
+
+	if a.Sampler != nil && !a.Sampler.Allow(e) {
+		log.WithFields(logrus.Fields{"id": e.ID, "type": e.Type}).Debug("Event dropped by event type policy")
+		return false, nil
+	}
+
+	if a.State != nil && a.State.IsEventSent(e.IdempotencyKey) {
+		log.WithFields(logrus.Fields{"id": e.ID, "type": e.Type, "key": e.IdempotencyKey}).Debug("Skipping duplicate event")
+		return true, nil
+	}
+
+	if a.Geo != nil {
+		if err := a.Geo.Enrich(ctx, e); err != nil {
+			return false, trace.Wrap(err)
+		}
+	}
+
+	if !a.Config().DryRun {
+		var payload []byte
+
+		backoff := backoff.NewDecorr(sendBackoffBase, sendBackoffMax, clockwork.NewRealClock())
+		backoffCount := sendBackoffNumTries
+
+		// The event accepted by Fluentd before the other destinations failed is not sent to Fluentd again
+		fluentdKey := fluentdSentKey(e.IdempotencyKey)
+		fluentdSent := a.State != nil && a.State.IsEventSent(fluentdKey)
+
+		for attempt := 1; ; attempt++ {
+			var err error
+			payload, err = a.eventPayload(e, attempt)
+			if err != nil {
+				return false, trace.Wrap(err)
+			}
+
+			if a.Fluentd == nil || fluentdSent {
+				break
+			}
+
+			err = a.Fluentd.Send(ctx, url, payload)
+			if err == nil {
+				fluentdSent = true
+				break
+			}
+
+			log.Error("Error sending event to fluentd: ", err)
+
+			bErr := backoff.Do(ctx)
+			if bErr != nil {
+				return false, trace.Wrap(err)
+			}
+
+			backoffCount--
+			if backoffCount < 0 {
+				return false, trace.Wrap(err)
+			}
+		}
+
+		if err := a.sendOtherDestinations(ctx, e, payload); err != nil {
+			if fluentdSent && a.State != nil {
+				if err := a.State.SetEventSent(fluentdKey); err != nil {
+					log.WithError(err).Error("Failed to save Fluentd delivery of the event")
+				}
+			}
+			return false, trace.Wrap(err)
+		}
+	}
+
+	if a.State != nil {
+		if err := a.State.SetEventSent(e.IdempotencyKey); err != nil {
+			return false, trace.Wrap(err)
+		}
+	}
+
+	fields := logrus.Fields{"id": e.ID, "type": e.Type, "ts": e.Time, "index": e.Index}
+	if e.SessionID != "" {
+		fields["sid"] = e.SessionID
+	}
+
+	log.WithFields(fields).Debug("Event sent")
+	log.WithField("event", e).Debug("Event dump")
+
+	return true, nil
+}
+
+// eventPayload returns the payload of the event delivery attempt, wrapped with the envelope if enabled
+func (a *App) eventPayload(e *TeleportEvent, attempt int) ([]byte, error) {
+	if !a.Config().Envelope {
+		return e.Payload()
+	}
+
+	return e.Envelope(a.Config().EventSource(), attempt, time.Now())
+}
+
+// init initializes application state
+func (a *App) init(ctx context.Context) error {
+	log := logger.Get(ctx)
+
+	a.Config().Dump(ctx)
+
+	s, err := NewState(a.Config())
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	err = a.setStartTime(ctx, s)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	var f *FluentdClient
+	if a.Config().FluentdURL != "" {
+		f, err = NewFluentdClient(&a.Config().FluentdConfig)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+	}
+
+	latestCursor, err := s.GetCursor()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	latestID, err := s.GetID()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	startTime, err := s.GetStartTime()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	var t *TeleportEventsWatcher
+	switch {
+	case a.Source != nil:
+		if a.Config().LockEnabled || a.Config().LockRulesFile != "" {
+			return trace.BadParameter("locking requires the Teleport events watcher and can not be used with a custom event source")
+		}
+		log.Info("Using custom event source")
+	case a.Config().TeleportDataDir != "":
+		a.Files, err = NewFileEventsSource(a.Config(), s, *startTime)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		a.Source = a.Files
+	default:
+		t, err = NewTeleportEventsWatcher(ctx, a.Config(), *startTime, latestCursor, latestID)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		a.Source = t
+	}
+
+	if a.Config().SessionExportDir != "" {
+		e, err := NewSessionExporter(&a.Config().SessionExportConfig)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		a.SessionExporter = e
+	}
+
+	if a.Config().OTLPEndpoint != "" && !a.Config().DryRun {
+		x, err := NewOTLPExporter(&a.Config().OTLPConfig)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		a.OTLP = x
+	}
+
+	if a.Config().TailAddr != "" {
+		a.Tail = NewLiveTail(a.Config)
+		a.Sinks = append(a.Sinks, a.Tail)
+	}
+
+	if a.Config().GeoIPDB != "" || a.Config().ASNDB != "" {
+		a.Geo, err = NewGeoEnricher(&a.Config().GeoConfig, clockwork.NewRealClock())
+		if err != nil {
+			return trace.Wrap(err)
+		}
+	}
+
+	if a.Config().IndexPath != "" {
+		a.Index, err = OpenEventIndex(a.Config().IndexPath)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		a.Sinks = append(a.Sinks, a.Index)
+	}
+
+	var rules []*LockRule
+	if a.Config().LockRulesFile != "" {
+		rules, err = LoadLockRules(a.Config().LockRulesFile)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		log.WithField("rules", len(rules)).Info("Loaded auto-locking rules")
+	}
+	a.LockRules = NewLockRuleEngine(rules, s, t, a.Config().DryRun)
+	a.Sampler = NewEventSampler(a.Config().EventPolicies, clockwork.NewRealClock())
+
+	a.State = s
+	a.Fluentd = f
+	a.EventWatcher = t
+
+	metrics := append(a.sessionEventsJob.metrics.collectors(), a.Sampler.collectors()...)
+	if a.OTLP != nil {
+		metrics = append(metrics, a.OTLP.collectors()...)
+	}
+	if a.Tail != nil {
+		metrics = append(metrics, a.Tail.collectors()...)
+	}
+	if err := registerMetrics(a.Metrics, a.metricsLabels, metrics); err != nil {
+		return trace.Wrap(err)
+	}
+
+	log.WithField("cursor", latestCursor).Info("Using initial cursor value")
+	log.WithField("id", latestID).Info("Using initial ID value")
+	log.WithField("value", startTime).Info("Using start time from state")
+
+	return nil
+}
+
+// setStartTime sets start time or fails if start time has changed from the last run
+func (a *App) setStartTime(ctx context.Context, s *State) error {
+	log := logger.Get(ctx)
+
+	prevStartTime, err := s.GetStartTime()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	if prevStartTime == nil {
+		log.WithField("value", a.Config().StartTime).Debug("Setting start time")
+
+		t := a.Config().StartTime
+		if t == nil {
+			now := time.Now().UTC().Truncate(time.Second)
+			t = &now
+		}
+
+		return s.SetStartTime(t)
+	}
+
+	// If there is a time saved in the state and this time does not equal to the time passed from CLI and a
+	// time was explicitly passed from CLI
+	if prevStartTime != nil && a.Config().StartTime != nil && *prevStartTime != *a.Config().StartTime {
+		return trace.Errorf("You can not change start time in the middle of ingestion. To restart the ingestion, rm -rf %v", a.Config().StorageDir)
+	}
+
+	return nil
+}
+
+// serveMetrics serves Prometheus metrics until the app is terminated
+func (a *App) serveMetrics(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	a.OnTerminate(func(_ context.Context) error {
+		cancel()
+		return nil
+	})
+
+	err := serveMetrics(ctx, a.Config().MetricsAddr, a.Metrics)
+	if err != nil {
+		logger.Get(ctx).WithError(err).Error("Metrics server failed")
+	}
+
+	return trace.Wrap(err)
+}
+
+// exportOTLP exports the queued OTLP log records until the app is terminated
+func (a *App) exportOTLP(ctx context.Context) error {
+	// The events forwarded during the drain and the final reports are exported too
+	exportCtx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-a.ingestionStopped():
+			a.reporters.Wait()
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+
+	return trace.Wrap(a.OTLP.Run(exportCtx))
+}
+
+// ingestionStopped returns the channel which is closed once the audit log and the session ingestion jobs are
+// stopped, after the drain phase
+func (a *App) ingestionStopped() <-chan struct{} {
+	a.ingestionOnce.Do(func() {
+		a.ingestion = make(chan struct{})
+		go func() {
+			<-a.eventsJob.Done()
+			<-a.sessionEventsJob.Done()
+			close(a.ingestion)
+		}()
+	})
+
+	return a.ingestion
+}
+
+// RegisterSession registers new session
+func (a *App) RegisterSession(ctx context.Context, e *TeleportEvent) {
+	log := logger.Get(ctx)
+	if err := a.sessionEventsJob.RegisterSession(ctx, e); err != nil {
+		log.Error("Registering session: ", err)
+	}
+}
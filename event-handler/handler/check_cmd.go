@@ -0,0 +1,420 @@
+// Copyright 2024 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gravitational/teleport/api/client"
+	"github.com/gravitational/teleport/api/client/proto"
+	auditlogpb "github.com/gravitational/teleport/api/gen/proto/go/teleport/auditlog/v1"
+	"github.com/gravitational/teleport/api/types"
+	"github.com/gravitational/teleport/integrations/lib/credentials"
+	"github.com/gravitational/trace"
+)
+
+const (
+	// checkEventType is the type of the test event sent to fluentd
+	checkEventType = "event_handler.check"
+
+	// checkLockName is the name of the lock the lock permissions are probed with, it never exists
+	checkLockName = lockNamePrefix + "preflight-check"
+
+	// checkSearchWindow is the time frame searched for the events
+	checkSearchWindow = 24 * time.Hour
+
+	// checkTimeout is the timeout of a single check
+	checkTimeout = 30 * time.Second
+)
+
+const (
+	// checkPass is the result of the successful check
+	checkPass = "PASS"
+	// checkFail is the result of the failed check
+	checkFail = "FAIL"
+	// checkSkip is the result of the check which was not run
+	checkSkip = "SKIP"
+)
+
+// checkClient is the Teleport client interface used by the check command
+type checkClient interface {
+	// Ping gets basic info about the auth server.
+	Ping(ctx context.Context) (proto.PingResponse, error)
+	// SearchUnstructuredEvents searches for events in the audit log and returns them using an unstructured representation (structpb.Struct).
+	SearchUnstructuredEvents(ctx context.Context, fromUTC, toUTC time.Time, namespace string, eventTypes []string, limit int, order types.EventOrder, startKey string) ([]*auditlogpb.EventUnstructured, string, error)
+	// StreamUnstructuredSessionEvents returns session events stream for a given session ID using an unstructured representation (structpb.Struct).
+	StreamUnstructuredSessionEvents(ctx context.Context, sessionID string, startIndex int64) (chan *auditlogpb.EventUnstructured, chan error)
+	// GetLocks gets all/in-force locks that match at least one of the targets when specified.
+	GetLocks(ctx context.Context, inForceOnly bool, targets ...types.LockTarget) ([]types.Lock, error)
+	// DeleteLock deletes a lock.
+	DeleteLock(ctx context.Context, name string) error
+}
+
+// checkSender is the fluentd client interface used by the check command
+type checkSender interface {
+	// Send sends the payload to the url
+	Send(ctx context.Context, url string, b []byte) error
+}
+
+// checkExporter is the OTLP exporter interface used by the check command
+type checkExporter interface {
+	// ExportNow exports the event right away
+	ExportNow(ctx context.Context, e *TeleportEvent, payload []byte) error
+}
+
+// checkResult is the result of a single check
+type checkResult struct {
+	// Name is the check name
+	Name string
+	// Result is PASS, FAIL or SKIP
+	Result string
+	// Details is the check outcome or the failure reason
+	Details string
+}
+
+// preflight runs the checks and collects their results
+type preflight struct {
+	// config is the checked configuration
+	config *StartCmdConfig
+	// results are the results of the checks run so far
+	results []checkResult
+}
+
+// run runs the check and records its result, returns true if the check passed
+func (p *preflight) run(ctx context.Context, name string, check func(ctx context.Context) (string, error)) bool {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	details, err := check(ctx)
+	if err != nil {
+		p.results = append(p.results, checkResult{Name: name, Result: checkFail, Details: err.Error()})
+		return false
+	}
+
+	p.results = append(p.results, checkResult{Name: name, Result: checkPass, Details: details})
+	return true
+}
+
+// skip records the check which was not run
+func (p *preflight) skip(name string, reason string) {
+	p.results = append(p.results, checkResult{Name: name, Result: checkSkip, Details: reason})
+}
+
+// Failed returns the number of the failed checks
+func (p *preflight) Failed() int {
+	var n int
+	for _, r := range p.results {
+		if r.Result == checkFail {
+			n++
+		}
+	}
+
+	return n
+}
+
+// Write writes the table of the check results to w
+func (p *preflight) Write(w io.Writer) {
+	t := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(t, "CHECK\tRESULT\tDETAILS")
+	for _, r := range p.results {
+		fmt.Fprintf(t, "%v\t%v\t%v\n", r.Name, r.Result, r.Details)
+	}
+	t.Flush()
+}
+
+// RunCheckCmd verifies the configuration, the credentials, the permissions and the destinations of every
+// configured cluster
+func RunCheckCmd(configs []*StartCmdConfig) error {
+	ctx := context.Background()
+
+	var failed int
+	for i, c := range configs {
+		if len(configs) > 1 {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Printf("Cluster %v\n", c.TeleportAddr)
+		}
+
+		p := &preflight{config: c}
+		p.checkAll(ctx)
+		p.Write(os.Stdout)
+
+		failed += p.Failed()
+	}
+
+	if failed > 0 {
+		return trace.Errorf("%v check(s) failed", failed)
+	}
+
+	return nil
+}
+
+// checkAll runs all the checks of the cluster
+func (p *preflight) checkAll(ctx context.Context) {
+	p.checkConfig(ctx)
+
+	client := p.checkCredentials(ctx)
+	if client != nil {
+		defer client.Close()
+		p.checkTeleport(ctx, client)
+	} else {
+		for _, name := range []string{"events read", "sessions read", "locks"} {
+			p.skip(name, "no Teleport connection")
+		}
+	}
+
+	fluentd, err := NewFluentdClient(&p.config.FluentdConfig)
+	if err != nil {
+		p.results = append(p.results, checkResult{Name: "fluentd client", Result: checkFail, Details: err.Error()})
+	} else {
+		p.checkFluentd(ctx, fluentd)
+	}
+
+	if p.config.OTLPEndpoint == "" {
+		return
+	}
+
+	otlp, err := NewOTLPExporter(&p.config.OTLPConfig)
+	if err != nil {
+		p.results = append(p.results, checkResult{Name: "otlp exporter", Result: checkFail, Details: err.Error()})
+		return
+	}
+	defer otlp.Close()
+
+	p.checkOTLP(ctx, otlp)
+}
+
+// checkConfig verifies the parts of the configuration which are read from the other files
+func (p *preflight) checkConfig(ctx context.Context) {
+	p.run(ctx, "configuration", func(context.Context) (string, error) {
+		if p.config.LockRulesFile == "" {
+			return "valid", nil
+		}
+
+		rules, err := LoadLockRules(p.config.LockRulesFile)
+		if err != nil {
+			return "", trace.Wrap(err)
+		}
+
+		return fmt.Sprintf("valid, %v lock rule(s) loaded", len(rules)), nil
+	})
+}
+
+// checkCredentials verifies that the credentials have not expired and connects to Teleport, returns nil if
+// the connection can not be established
+func (p *preflight) checkCredentials(ctx context.Context) *client.Client {
+	creds, err := teleportCredentials(ctx, &p.config.TeleportConfig)
+	if err != nil {
+		p.results = append(p.results, checkResult{Name: "credentials", Result: checkFail, Details: err.Error()})
+		p.skip("teleport connection", "no valid credentials")
+		return nil
+	}
+
+	ok := p.run(ctx, "credentials", func(context.Context) (string, error) {
+		valid, err := credentials.CheckIfExpired(creds)
+		switch {
+		case err != nil && !valid:
+			return "", trace.Wrap(err, "no valid credentials found, sign new credentials")
+		case err != nil:
+			return fmt.Sprintf("at least one credential is valid: %v", err), nil
+		default:
+			return "not expired", nil
+		}
+	})
+	if !ok {
+		p.skip("teleport connection", "no valid credentials")
+		return nil
+	}
+
+	clt, err := dialTeleport(ctx, &p.config.TeleportConfig, creds)
+	if err != nil {
+		p.results = append(p.results, checkResult{Name: "teleport connection", Result: checkFail, Details: err.Error()})
+		return nil
+	}
+
+	return clt
+}
+
+// checkTeleport verifies that Teleport is reachable and the role allows reading the events and the sessions
+// and managing the locks
+func (p *preflight) checkTeleport(ctx context.Context, client checkClient) {
+	ok := p.run(ctx, "teleport connection", func(ctx context.Context) (string, error) {
+		pong, err := client.Ping(ctx)
+		if err != nil {
+			return "", trace.Wrap(err)
+		}
+
+		return fmt.Sprintf("cluster %v, version %v", pong.ClusterName, pong.ServerVersion), nil
+	})
+	if !ok {
+		for _, name := range []string{"events read", "sessions read", "locks"} {
+			p.skip(name, "Teleport is not reachable")
+		}
+		return
+	}
+
+	p.run(ctx, "events read", func(ctx context.Context) (string, error) {
+		events, err := p.searchEvents(ctx, client, nil)
+		if err != nil {
+			return "", trace.Wrap(err)
+		}
+
+		return fmt.Sprintf("%v event(s) found in the last %v", len(events), checkSearchWindow), nil
+	})
+
+	p.checkSessions(ctx, client)
+	p.checkLocks(ctx, client)
+}
+
+// searchEvents searches for the latest event of the given types
+func (p *preflight) searchEvents(ctx context.Context, client checkClient, eventTypes []string) ([]*auditlogpb.EventUnstructured, error) {
+	now := time.Now().UTC()
+
+	events, _, err := client.SearchUnstructuredEvents(
+		ctx,
+		now.Add(-checkSearchWindow),
+		now,
+		"default",
+		eventTypes,
+		1,
+		types.EventOrderDescending,
+		"",
+	)
+
+	return events, trace.Wrap(err)
+}
+
+// checkSessions verifies that the role allows reading the session recordings by reading the first event of
+// the latest uploaded session
+func (p *preflight) checkSessions(ctx context.Context, client checkClient) {
+	events, err := p.searchEvents(ctx, client, []string{sessionEndType})
+	if err != nil {
+		p.results = append(p.results, checkResult{Name: "sessions read", Result: checkFail, Details: err.Error()})
+		return
+	}
+	if len(events) == 0 {
+		p.skip("sessions read", fmt.Sprintf("no sessions uploaded in the last %v", checkSearchWindow))
+		return
+	}
+
+	p.run(ctx, "sessions read", func(ctx context.Context) (string, error) {
+		e, err := NewTeleportEvent(events[0], "")
+		if err != nil {
+			return "", trace.Wrap(err)
+		}
+
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		chEvt, chErr := client.StreamUnstructuredSessionEvents(ctx, e.SessionID, 0)
+		select {
+		case err := <-chErr:
+			return "", trace.Wrap(err)
+		case <-chEvt:
+			return fmt.Sprintf("session %v is readable", e.SessionID), nil
+		case <-ctx.Done():
+			return "", trace.Wrap(ctx.Err())
+		}
+	})
+}
+
+// checkLocks verifies that the role allows listing and deleting the locks. The lock probed with does not
+// exist, so nothing is changed.
+func (p *preflight) checkLocks(ctx context.Context, client checkClient) {
+	if !p.config.LockEnabled && p.config.LockRulesFile == "" {
+		p.skip("locks", "locking is disabled")
+		return
+	}
+
+	p.run(ctx, "locks", func(ctx context.Context) (string, error) {
+		if _, err := client.GetLocks(ctx, false); err != nil {
+			return "", trace.Wrap(err)
+		}
+
+		err := client.DeleteLock(ctx, checkLockName)
+		if err != nil && !trace.IsNotFound(err) {
+			return "", trace.Wrap(err)
+		}
+
+		return "locks can be listed and deleted", nil
+	})
+}
+
+// checkFluentd sends the test event to every fluentd URL
+func (p *preflight) checkFluentd(ctx context.Context, fluentd checkSender) {
+	urls := []struct {
+		name string
+		url  string
+	}{
+		{"fluentd url", p.config.FluentdURL},
+		{"fluentd session url", p.config.FluentdSessionURL},
+	}
+
+	for _, u := range urls {
+		p.run(ctx, u.name, func(ctx context.Context) (string, error) {
+			b, err := newCheckEvent(time.Now().UTC())
+			if err != nil {
+				return "", trace.Wrap(err)
+			}
+
+			if err := fluentd.Send(ctx, u.url, b); err != nil {
+				return "", trace.Wrap(err)
+			}
+
+			return fmt.Sprintf("test event sent to %v", u.url), nil
+		})
+	}
+}
+
+// checkOTLP exports the test event to the OTLP receiver
+func (p *preflight) checkOTLP(ctx context.Context, otlp checkExporter) {
+	p.run(ctx, "otlp endpoint", func(ctx context.Context) (string, error) {
+		now := time.Now().UTC()
+		b, err := newCheckEvent(now)
+		if err != nil {
+			return "", trace.Wrap(err)
+		}
+
+		e := &TeleportEvent{Event: b, Type: checkEventType, Time: now}
+		if err := otlp.ExportNow(ctx, e, b); err != nil {
+			return "", trace.Wrap(err)
+		}
+
+		return fmt.Sprintf("test log record exported to %v", p.config.OTLPEndpoint), nil
+	})
+}
+
+// newCheckEvent returns the payload of the test event
+func newCheckEvent(now time.Time) ([]byte, error) {
+	id := uuid.NewString()
+
+	b, err := json.Marshal(map[string]interface{}{
+		"event":             checkEventType,
+		"uid":               id,
+		"time":              now,
+		idempotencyKeyField: id,
+		"message":           "Teleport event handler preflight check",
+	})
+
+	return b, trace.Wrap(err)
+}
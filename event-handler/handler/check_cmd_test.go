@@ -0,0 +1,205 @@
+// Copyright 2024 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gravitational/teleport/api/client/proto"
+	auditlogpb "github.com/gravitational/teleport/api/gen/proto/go/teleport/auditlog/v1"
+	"github.com/gravitational/teleport/api/types"
+	"github.com/gravitational/teleport/api/types/events"
+	"github.com/gravitational/trace"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeCheckClient is the Teleport client which denies the access to the configured resources
+type fakeCheckClient struct {
+	events      []*auditlogpb.EventUnstructured
+	denyEvents  bool
+	denySession bool
+	denyLocks   bool
+	streamedID  string
+	deletedLock string
+}
+
+func (c *fakeCheckClient) Ping(context.Context) (proto.PingResponse, error) {
+	return proto.PingResponse{ClusterName: "example.com", ServerVersion: "15.0.0"}, nil
+}
+
+func (c *fakeCheckClient) SearchUnstructuredEvents(_ context.Context, _, _ time.Time, _ string, eventTypes []string, limit int, _ types.EventOrder, _ string) ([]*auditlogpb.EventUnstructured, string, error) {
+	if c.denyEvents {
+		return nil, "", trace.AccessDenied("access to event denied")
+	}
+
+	var r []*auditlogpb.EventUnstructured
+	for _, e := range c.events {
+		if len(eventTypes) == 0 || eventTypes[0] == e.Type {
+			r = append(r, e)
+		}
+	}
+	if len(r) > limit {
+		r = r[:limit]
+	}
+
+	return r, "", nil
+}
+
+func (c *fakeCheckClient) StreamUnstructuredSessionEvents(_ context.Context, sessionID string, _ int64) (chan *auditlogpb.EventUnstructured, chan error) {
+	c.streamedID = sessionID
+
+	chEvt := make(chan *auditlogpb.EventUnstructured, 1)
+	chErr := make(chan error, 1)
+	if c.denySession {
+		chErr <- trace.AccessDenied("access to session denied")
+	} else {
+		chEvt <- &auditlogpb.EventUnstructured{Type: sessionStartType}
+	}
+
+	return chEvt, chErr
+}
+
+func (c *fakeCheckClient) GetLocks(context.Context, bool, ...types.LockTarget) ([]types.Lock, error) {
+	if c.denyLocks {
+		return nil, trace.AccessDenied("access to lock denied")
+	}
+	return nil, nil
+}
+
+func (c *fakeCheckClient) DeleteLock(_ context.Context, name string) error {
+	c.deletedLock = name
+	return trace.NotFound("lock %v is not found", name)
+}
+
+// fakeCheckSender records the payloads sent
+type fakeCheckSender struct {
+	sent map[string][]byte
+	fail string
+}
+
+func (s *fakeCheckSender) Send(_ context.Context, url string, b []byte) error {
+	if url == s.fail {
+		return trace.ConnectionProblem(nil, "connection refused")
+	}
+	s.sent[url] = b
+	return nil
+}
+
+// fakeCheckExporter records the events exported
+type fakeCheckExporter struct {
+	exported []*TeleportEvent
+	err      error
+}
+
+func (x *fakeCheckExporter) ExportNow(_ context.Context, e *TeleportEvent, _ []byte) error {
+	if x.err != nil {
+		return x.err
+	}
+	x.exported = append(x.exported, e)
+	return nil
+}
+
+// checkResults returns the results of the checks by name
+func checkResults(p *preflight) map[string]string {
+	r := make(map[string]string, len(p.results))
+	for _, c := range p.results {
+		r[c.Name] = c.Result
+	}
+	return r
+}
+
+func TestPreflightTeleport(t *testing.T) {
+	ctx := context.Background()
+
+	upload, err := eventToProto(&events.SessionUpload{
+		Metadata:        events.Metadata{ID: "upload", Type: sessionEndType, Time: time.Now()},
+		SessionMetadata: events.SessionMetadata{SessionID: "session-1"},
+	})
+	require.NoError(t, err)
+
+	client := &fakeCheckClient{events: []*auditlogpb.EventUnstructured{upload}}
+	p := &preflight{config: &StartCmdConfig{LockConfig: LockConfig{LockEnabled: true}}}
+	p.checkTeleport(ctx, client)
+
+	require.Equal(t, map[string]string{
+		"teleport connection": checkPass,
+		"events read":         checkPass,
+		"sessions read":       checkPass,
+		"locks":               checkPass,
+	}, checkResults(p))
+	require.Equal(t, "session-1", client.streamedID)
+	require.Equal(t, checkLockName, client.deletedLock)
+	require.Zero(t, p.Failed())
+
+	client = &fakeCheckClient{events: []*auditlogpb.EventUnstructured{upload}, denySession: true, denyLocks: true}
+	p = &preflight{config: &StartCmdConfig{LockConfig: LockConfig{LockRulesFile: "rules.toml"}}}
+	p.checkTeleport(ctx, client)
+
+	require.Equal(t, checkFail, checkResults(p)["sessions read"])
+	require.Equal(t, checkFail, checkResults(p)["locks"])
+	require.Equal(t, 2, p.Failed())
+
+	// Sessions can't be checked without uploads, locks are not checked if locking is disabled
+	client = &fakeCheckClient{denyEvents: true}
+	p = &preflight{config: &StartCmdConfig{}}
+	p.checkTeleport(ctx, client)
+
+	require.Equal(t, map[string]string{
+		"teleport connection": checkPass,
+		"events read":         checkFail,
+		"sessions read":       checkFail,
+		"locks":               checkSkip,
+	}, checkResults(p))
+
+	var buf bytes.Buffer
+	p.Write(&buf)
+	require.Contains(t, buf.String(), "access to event denied")
+}
+
+func TestPreflightFluentd(t *testing.T) {
+	sender := &fakeCheckSender{sent: make(map[string][]byte), fail: "https://sessions"}
+	p := &preflight{config: &StartCmdConfig{
+		FluentdConfig: FluentdConfig{FluentdURL: "https://events", FluentdSessionURL: "https://sessions"},
+	}}
+	p.checkFluentd(context.Background(), sender)
+
+	require.Equal(t, map[string]string{
+		"fluentd url":         checkPass,
+		"fluentd session url": checkFail,
+	}, checkResults(p))
+
+	var m map[string]interface{}
+	require.NoError(t, json.Unmarshal(sender.sent["https://events"], &m))
+	require.Equal(t, checkEventType, m["event"])
+	require.Equal(t, m["uid"], m[idempotencyKeyField])
+}
+
+func TestPreflightOTLP(t *testing.T) {
+	p := &preflight{config: &StartCmdConfig{OTLPConfig: OTLPConfig{OTLPEndpoint: "https://otlp"}}}
+	otlp := &fakeCheckExporter{}
+	p.checkOTLP(context.Background(), otlp)
+
+	require.Equal(t, map[string]string{"otlp endpoint": checkPass}, checkResults(p))
+	require.Len(t, otlp.exported, 1)
+	require.Equal(t, checkEventType, otlp.exported[0].Type)
+
+	p = &preflight{config: &StartCmdConfig{OTLPConfig: OTLPConfig{OTLPEndpoint: "https://otlp"}}}
+	p.checkOTLP(context.Background(), &fakeCheckExporter{err: trace.AccessDenied("unauthorized")})
+	require.Equal(t, map[string]string{"otlp endpoint": checkFail}, checkResults(p))
+}
@@ -0,0 +1,173 @@
+// Copyright 2024 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gravitational/teleport/integrations/lib/logger"
+	"github.com/gravitational/trace"
+)
+
+// checkpoint is the ingestion progress which is not saved to the storage yet. It is saved once every updates
+// have been made, and by Flush.
+type checkpoint struct {
+	// every is the number of updates after which the progress is saved, zero to save by Flush only
+	every int
+
+	// mu protects the fields below, sessions are ingested concurrently
+	mu sync.Mutex
+	// updates is the number of updates since the progress was saved
+	updates int
+	// id is the latest audit log event ID, nil if it has not changed
+	id *string
+	// cursor is the latest audit log cursor, nil if it has not changed
+	cursor *string
+	// sessions are the latest session indexes by session ID
+	sessions map[string]int64
+	// files are the latest audit log file read offsets by file name
+	files map[string]int64
+	// counts are the audit log events counted by bucket start time since the progress was saved
+	counts map[time.Time]EventCount
+}
+
+// newCheckpoint creates the checkpoint saving the progress every n updates
+func newCheckpoint(n int) *checkpoint {
+	return &checkpoint{
+		every:    n,
+		sessions: make(map[string]int64),
+		files:    make(map[string]int64),
+		counts:   make(map[time.Time]EventCount),
+	}
+}
+
+// SetPosition saves the ID and the cursor of the latest audit log event sent
+func (s *State) SetPosition(id, cursor string) error {
+	if s.checkpoint == nil {
+		if err := s.SetID(id); err != nil {
+			return trace.Wrap(err)
+		}
+		return trace.Wrap(s.SetCursor(cursor))
+	}
+
+	c := s.checkpoint
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.id, c.cursor = &id, &cursor
+
+	return trace.Wrap(s.update())
+}
+
+// update counts the update and saves the progress if it's due, c.mu must be held
+func (s *State) update() error {
+	s.checkpoint.updates++
+	if s.checkpoint.every == 0 || s.checkpoint.updates < s.checkpoint.every {
+		return nil
+	}
+
+	return trace.Wrap(s.flush())
+}
+
+// Flush saves the progress kept in memory to the storage
+func (s *State) Flush() error {
+	if s.checkpoint == nil {
+		return nil
+	}
+
+	s.checkpoint.mu.Lock()
+	defer s.checkpoint.mu.Unlock()
+
+	return trace.Wrap(s.flush())
+}
+
+// flush saves the progress, c.mu must be held. Sessions are saved before the audit log position: the session
+// registered by an event must not be lost if the position of the event is saved. Event counters are saved before
+// the position too: an event is never left uncounted, an interrupted save may count the events resent twice.
+func (s *State) flush() error {
+	c := s.checkpoint
+
+	for id, index := range c.sessions {
+		if err := s.writeSessionIndex(id, index); err != nil {
+			return trace.Wrap(err)
+		}
+		delete(c.sessions, id)
+	}
+
+	for file, offset := range c.files {
+		if err := s.writeFileOffset(file, offset); err != nil {
+			return trace.Wrap(err)
+		}
+		delete(c.files, file)
+	}
+
+	// The keys of the events sent are saved before the position, so the events sent again after an interrupted
+	// save are skipped
+	if s.dedup != nil {
+		if err := s.dedup.flush(); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+
+	for bucket, n := range c.counts {
+		if err := s.addEventCount(bucket, n); err != nil {
+			return trace.Wrap(err)
+		}
+		delete(c.counts, bucket)
+	}
+
+	if c.id != nil {
+		if err := s.SetID(*c.id); err != nil {
+			return trace.Wrap(err)
+		}
+		c.id = nil
+	}
+
+	if c.cursor != nil {
+		if err := s.SetCursor(*c.cursor); err != nil {
+			return trace.Wrap(err)
+		}
+		c.cursor = nil
+	}
+
+	c.updates = 0
+
+	return nil
+}
+
+// flushCheckpoints saves the ingestion progress every checkpoint interval and once the app is terminated
+func (a *App) flushCheckpoints(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	a.OnTerminate(func(_ context.Context) error {
+		cancel()
+		return nil
+	})
+
+	ticker := time.NewTicker(a.Config().CheckpointInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := a.State.Flush(); err != nil {
+				logger.Get(ctx).WithError(err).Error("Failed to save ingestion progress")
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2024 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestCheckpointEvents checks that the progress is saved every N updates and on Flush
+func TestCheckpointEvents(t *testing.T) {
+	setup(t)
+
+	c := *startC
+	c.CheckpointEvents = 3
+
+	state, err := NewState(&c)
+	require.NoError(t, err)
+
+	require.NoError(t, state.SetPosition("id-1", "cursor-1"))
+	require.NoError(t, state.SetSessionIndex("session-1", 5))
+
+	// Reads see the progress kept in memory
+	id, err := state.GetID()
+	require.NoError(t, err)
+	require.Equal(t, "id-1", id)
+	index, err := state.GetSessionIndex("session-1")
+	require.NoError(t, err)
+	require.Equal(t, int64(5), index)
+	sessions, err := state.GetSessions()
+	require.NoError(t, err)
+	require.Equal(t, map[string]int64{"session-1": 5}, sessions)
+
+	// Nothing is saved yet
+	saved, err := NewState(&c)
+	require.NoError(t, err)
+	id, err = saved.GetID()
+	require.NoError(t, err)
+	require.Empty(t, id)
+
+	// The third update saves the progress
+	require.NoError(t, state.SetPosition("id-2", "cursor-2"))
+	saved, err = NewState(&c)
+	require.NoError(t, err)
+	id, err = saved.GetID()
+	require.NoError(t, err)
+	require.Equal(t, "id-2", id)
+	cursor, err := saved.GetCursor()
+	require.NoError(t, err)
+	require.Equal(t, "cursor-2", cursor)
+	index, err = saved.GetSessionIndex("session-1")
+	require.NoError(t, err)
+	require.Equal(t, int64(5), index)
+
+	// The removed session is not saved back
+	require.NoError(t, state.SetSessionIndex("session-1", 6))
+	require.NoError(t, state.SetSessionIndex("session-2", 1))
+	require.NoError(t, state.RemoveSession("session-1"))
+	require.NoError(t, state.Flush())
+
+	saved, err = NewState(&c)
+	require.NoError(t, err)
+	sessions, err = saved.GetSessions()
+	require.NoError(t, err)
+	require.Equal(t, map[string]int64{"session-2": 1}, sessions)
+}
+
+// TestCheckpointInterval checks that the progress is saved on Flush only when the event count is not set
+func TestCheckpointInterval(t *testing.T) {
+	setup(t)
+
+	c := *startC
+	c.CheckpointInterval = 1
+
+	state, err := NewState(&c)
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, state.SetPosition("id", "cursor"))
+	}
+
+	saved, err := NewState(&c)
+	require.NoError(t, err)
+	cursor, err := saved.GetCursor()
+	require.NoError(t, err)
+	require.Empty(t, cursor)
+
+	require.NoError(t, state.Flush())
+
+	cursor, err = saved.GetCursor()
+	require.NoError(t, err)
+	require.Equal(t, "cursor", cursor)
+}
+
+// TestCheckpointQuarantine checks that the quarantined session kept in memory is not saved back by Flush
+func TestCheckpointQuarantine(t *testing.T) {
+	setup(t)
+
+	c := *startC
+	c.CheckpointEvents = 100
+
+	state, err := NewState(&c)
+	require.NoError(t, err)
+
+	require.NoError(t, state.SetSessionIndex("sid", 10))
+	require.NoError(t, state.QuarantineSession(QuarantinedSession{ID: "sid", Index: 10, Attempts: 3}))
+	require.NoError(t, state.Flush())
+
+	saved, err := NewState(&c)
+	require.NoError(t, err)
+	sessions, err := saved.GetSessions()
+	require.NoError(t, err)
+	require.Empty(t, sessions)
+
+	quarantined, err := saved.GetQuarantinedSessions()
+	require.NoError(t, err)
+	require.Len(t, quarantined, 1)
+}
+
+// TestCheckpointDedup checks that the dedup window slots are saved along with the progress
+func TestCheckpointDedup(t *testing.T) {
+	setup(t)
+
+	c := *startC
+	c.CheckpointEvents = 100
+	c.DedupWindow = 10
+
+	state, err := NewState(&c)
+	require.NoError(t, err)
+
+	require.NoError(t, state.SetEventSent("a"))
+	require.True(t, state.IsEventSent("a"))
+
+	saved, err := NewState(&c)
+	require.NoError(t, err)
+	require.False(t, saved.IsEventSent("a"))
+
+	require.NoError(t, state.Flush())
+
+	saved, err = NewState(&c)
+	require.NoError(t, err)
+	require.True(t, saved.IsEventSent("a"))
+}
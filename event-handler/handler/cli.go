@@ -0,0 +1,935 @@
+/*
+Copyright 2015-2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kong"
+	"github.com/gravitational/teleport/integrations/lib/logger"
+	"github.com/gravitational/teleport/integrations/lib/stringset"
+	"github.com/gravitational/trace"
+
+	"github.com/gravitational/teleport-plugins/event-handler/lib"
+)
+
+// FluentdConfig represents fluentd instance configuration
+type FluentdConfig struct {
+	// FluentdURL fluentd url for audit log events
+	FluentdURL string `help:"fluentd url" required:"true" env:"FDFWD_FLUENTD_URL"`
+
+	// FluentdSessionURL
+	FluentdSessionURL string `help:"fluentd session url" required:"true" env:"FDFWD_FLUENTD_SESSION_URL"`
+
+	// FluentdCert is a path to fluentd cert
+	FluentdCert string `help:"fluentd TLS certificate file" type:"existingfile" env:"FDWRD_FLUENTD_CERT"`
+
+	// FluentdKey is a path to fluentd key
+	FluentdKey string `help:"fluentd TLS key file" type:"existingfile" env:"FDWRD_FLUENTD_KEY"`
+
+	// FluentdCA is a path to fluentd CA
+	FluentdCA string `help:"fluentd TLS CA file" type:"existingfile" env:"FDWRD_FLUENTD_CA"`
+
+	// FluentdProxy is the proxy URL, HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment variables are used if empty
+	FluentdProxy string `help:"fluentd proxy URL, HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment variables are used if not set" env:"FDFWD_FLUENTD_PROXY"`
+
+	// FluentdHeaders are extra HTTP headers in Name=Value format
+	FluentdHeaders []string `name:"fluentd-header" help:"Extra HTTP header sent to fluentd in Name=Value format, can be repeated" env:"FDFWD_FLUENTD_HEADERS"`
+
+	// FluentdEnvHeaders are extra HTTP headers in Name=ENV_VAR format, the values are read from the environment
+	FluentdEnvHeaders []string `name:"fluentd-env-header" help:"Extra HTTP header sent to fluentd in Name=ENV_VAR format, the value is read from the environment variable" env:"FDFWD_FLUENTD_ENV_HEADERS"`
+
+	// FluentdBearerToken is the bearer token sent in Authorization header
+	FluentdBearerToken string `help:"Bearer token sent to fluentd in Authorization header" env:"FDFWD_FLUENTD_BEARER_TOKEN"`
+
+	// FluentdBasicAuthUser is the basic auth user name
+	FluentdBasicAuthUser string `help:"Basic auth user name sent to fluentd" env:"FDFWD_FLUENTD_BASIC_AUTH_USER"`
+
+	// FluentdBasicAuthPassword is the basic auth password
+	FluentdBasicAuthPassword string `help:"Basic auth password sent to fluentd" env:"FDFWD_FLUENTD_BASIC_AUTH_PASSWORD"`
+
+	// FluentdTimeout is the timeout of a single request
+	FluentdTimeout time.Duration `help:"fluentd request timeout" default:"30s" env:"FDFWD_FLUENTD_TIMEOUT"`
+
+	// FluentdCompression is the request body compression codec
+	FluentdCompression string `help:"Request body compression: none, gzip or zstd. Falls back to the next codec if fluentd rejects it" enum:"none,gzip,zstd" default:"none" env:"FDFWD_FLUENTD_COMPRESSION"`
+
+	// FluentdCompressionThreshold is the minimum size of the request body which is compressed
+	FluentdCompressionThreshold int `help:"Minimum request body size in bytes which is compressed" default:"1024" env:"FDFWD_FLUENTD_COMPRESSION_THRESHOLD"`
+}
+
+// Check validates fluentd client settings
+func (c *FluentdConfig) Check() error {
+	if c.FluentdBearerToken != "" && (c.FluentdBasicAuthUser != "" || c.FluentdBasicAuthPassword != "") {
+		return trace.BadParameter("fluentd-bearer-token and fluentd-basic-auth-* can not be used together")
+	}
+	if c.FluentdBasicAuthPassword != "" && c.FluentdBasicAuthUser == "" {
+		return trace.BadParameter("fluentd-basic-auth-password requires fluentd-basic-auth-user to be set")
+	}
+	if c.FluentdTimeout < 0 {
+		return trace.BadParameter("fluentd-timeout can not be negative")
+	}
+	if c.FluentdCompressionThreshold < 0 {
+		return trace.BadParameter("fluentd-compression-threshold can not be negative")
+	}
+	if c.FluentdProxy != "" {
+		u, err := url.Parse(c.FluentdProxy)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return trace.BadParameter("invalid fluentd-proxy %q, URL with scheme and host expected", c.FluentdProxy)
+		}
+	}
+
+	_, err := c.Headers()
+	return trace.Wrap(err)
+}
+
+// Headers returns extra HTTP headers sent to fluentd, including the ones sourced from the environment
+func (c *FluentdConfig) Headers() (http.Header, error) {
+	h := make(http.Header)
+
+	for _, v := range c.FluentdHeaders {
+		name, value, ok := strings.Cut(v, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, trace.BadParameter("invalid fluentd-header %q, Name=Value expected", v)
+		}
+		h.Add(strings.TrimSpace(name), value)
+	}
+
+	for _, v := range c.FluentdEnvHeaders {
+		name, env, ok := strings.Cut(v, "=")
+		if !ok || strings.TrimSpace(name) == "" || env == "" {
+			return nil, trace.BadParameter("invalid fluentd-env-header %q, Name=ENV_VAR expected", v)
+		}
+		value, ok := os.LookupEnv(env)
+		if !ok {
+			return nil, trace.BadParameter("environment variable %v of fluentd-env-header %v is not set", env, name)
+		}
+		h.Add(strings.TrimSpace(name), value)
+	}
+
+	return h, nil
+}
+
+// TeleportConfig is Teleport instance configuration
+type TeleportConfig struct {
+	// TeleportAddr is a Teleport addr
+	TeleportAddr string `help:"Teleport addr" env:"FDFWD_TELEPORT_ADDR" default:"localhost:3025"`
+
+	// TeleportIdentityFile is a path to Teleport identity file
+	TeleportIdentityFile string `help:"Teleport identity file" type:"existingfile" name:"teleport-identity" env:"FDFWD_TELEPORT_IDENTITY"`
+
+	// TeleportRefreshEnabled will reload the identity file from disk on the
+	// configured interval.
+	TeleportRefreshEnabled bool `help:"Configures the identity file to be reloaded from disk at a configured interval." env:"FDFWD_TELEPORT_REFRESH_ENABLED"`
+
+	// TeleportRefreshInterval is how often the identity file should
+	// be reloaded from disk.
+	TeleportRefreshInterval time.Duration `help:"Configures how often the identity file should be reloaded from disk." env:"FDFWD_TELEPORT_REFRESH_INTERVAL" default:"1m"`
+
+	// TeleportCA is a path to Teleport CA file
+	TeleportCA string `help:"Teleport TLS CA file" type:"existingfile" env:"FDFWD_TELEPORT_CA"`
+
+	// TeleportCert is a path to Teleport cert file
+	TeleportCert string `help:"Teleport TLS certificate file" type:"existingfile" env:"FDWRD_TELEPORT_CERT"`
+
+	// TeleportKey is a path to Teleport key file
+	TeleportKey string `help:"Teleport TLS key file" type:"existingfile" env:"FDFWD_TELEPORT_KEY"`
+
+	// TeleportDataDir is a path to Teleport data directory the events are read from instead of the Auth API
+	TeleportDataDir string `help:"Read events from the file audit log and session recordings of this Teleport data directory instead of the Auth API" type:"existingdir" env:"FDFWD_TELEPORT_DATA_DIR"`
+}
+
+// Check verifies that a valid configuration is set
+func (cfg *TeleportConfig) Check() error {
+	// The credentials are not used if the events are read from the data directory
+	if cfg.TeleportDataDir != "" {
+		return nil
+	}
+
+	provided := stringset.NewWithCap(3)
+	missing := stringset.NewWithCap(3)
+	if cfg.TeleportCert != "" {
+		provided.Add("`teleport.cert`")
+	} else {
+		missing.Add("`teleport.cert`")
+	}
+
+	if cfg.TeleportKey != "" {
+		provided.Add("`teleport.key`")
+	} else {
+		missing.Add("`teleport.key`")
+	}
+
+	if cfg.TeleportCA != "" {
+		provided.Add("`teleport.ca`")
+	} else {
+		missing.Add("`teleport.ca`")
+	}
+
+	if len(provided) > 0 && len(provided) < 3 {
+		return trace.BadParameter(
+			"configuration setting(s) %s are provided but setting(s) %s are missing",
+			strings.Join(provided.ToSlice(), ", "),
+			strings.Join(missing.ToSlice(), ", "),
+		)
+	}
+
+	if cfg.TeleportIdentityFile != "" && len(provided) != 0 {
+		return trace.BadParameter("configuration setting `identity` is mutually exclusive with the `cert`, `key` and `ca` settings")
+	}
+	if len(provided) == 0 && cfg.TeleportIdentityFile == "" {
+		return trace.BadParameter("neither `identity` file nor `cert`, `key` and `ca` files configured")
+	}
+	return nil
+}
+
+// IngestConfig ingestion configuration
+type IngestConfig struct {
+	// StorageDir is a path to dv storage dir
+	StorageDir string `help:"Storage directory" required:"true" env:"FDFWD_STORAGE" name:"storage"`
+
+	// BatchSize is a fetch batch size
+	BatchSize int `help:"Fetch batch size" default:"20" env:"FDFWD_BATCH" name:"batch"`
+
+	// Types are event types to log
+	Types []string `help:"Comma-separated list of event types to forward" env:"FDFWD_TYPES"`
+
+	// SkipEventTypesRaw are event types to skip
+	SkipEventTypesRaw []string `name:"skip-event-types" help:"Comma-separated list of event types to skip" env:"FDFWD_SKIP_EVENT_TYPES"`
+
+	// SkipEventTypes is a map generated from SkipEventTypesRaw
+	SkipEventTypes map[string]struct{} `kong:"-"`
+
+	// SkipSessionTypes are session event types to skip
+	SkipSessionTypesRaw []string `name:"skip-session-types" help:"Comma-separated list of session event types to skip" default:"print" env:"FDFWD_SKIP_SESSION_TYPES"`
+
+	// SkipSessionTypes is a map generated from SkipSessionTypes
+	SkipSessionTypes map[string]struct{} `kong:"-"`
+
+	// EventPoliciesRaw are per event type forwarding policies
+	EventPoliciesRaw []string `name:"event-policy" help:"Per event type forwarding policy: type=keep, type=sample:N (1 in N, by session) or type=rate:N (N per minute), can be repeated" env:"FDFWD_EVENT_POLICIES"`
+
+	// EventPolicies is a map generated from EventPoliciesRaw
+	EventPolicies map[string]EventPolicy `kong:"-"`
+
+	// StartTime is a time to start ingestion from
+	StartTime *time.Time `help:"Minimum event time in RFC3339 format" env:"FDFWD_START_TIME"`
+
+	// Timeout is the time poller will wait before the new request if there are no events in the queue
+	Timeout time.Duration `help:"Polling timeout" default:"5s" env:"FDFWD_TIMEOUT"`
+
+	// DryRun is the flag which simulates execution without sending events to fluentd
+	DryRun bool `help:"Events are read from Teleport, but are not sent to fluentd. Separate stroage is used. Debug flag."`
+
+	// ExitOnLastEvent exit when last event is processed
+	ExitOnLastEvent bool `help:"Exit when last event is processed"`
+
+	// Concurrency sets the number of concurrent sessions to ingest
+	Concurrency int `help:"Number of concurrent sessions" default:"5"`
+
+	// SessionMaxAttempts is the number of failed ingestion attempts after which a session is quarantined
+	SessionMaxAttempts int `help:"Number of failed ingestion attempts after which a session is quarantined, 0 to retry forever" default:"3" env:"FDFWD_SESSION_MAX_ATTEMPTS"`
+
+	// SessionSummary controls per-session summary records
+	SessionSummary string `help:"Emit a summary record per session: off, alongside raw session events, or instead of them (only)" enum:"off,alongside,only" default:"off" env:"FDFWD_SESSION_SUMMARY"`
+
+	// DedupWindow is the number of the latest sent events remembered to suppress duplicates
+	DedupWindow int `help:"Number of the latest sent event keys remembered to suppress duplicates, 0 to disable" default:"10000" env:"FDFWD_DEDUP_WINDOW"`
+
+	// Envelope wraps forwarded events with the delivery metadata
+	Envelope bool `help:"Wrap forwarded events in an envelope with the handler version, source, stream, position and delivery attempt" env:"FDFWD_ENVELOPE"`
+
+	// CheckpointEvents is the number of progress updates after which the progress is saved
+	CheckpointEvents int `help:"Save the ingestion progress every N events, 1 to save after every event, 0 to save on the checkpoint interval only" default:"1" env:"FDFWD_CHECKPOINT_EVENTS"`
+
+	// CheckpointInterval is the interval the progress is saved at
+	CheckpointInterval time.Duration `help:"Save the ingestion progress at this interval, 0 to disable" default:"0s" env:"FDFWD_CHECKPOINT_INTERVAL"`
+
+	// DrainTimeout is the time given to in-flight events and sessions to be sent on shutdown
+	DrainTimeout time.Duration `help:"Time given to in-flight events and sessions to be sent on shutdown, 0 to abort them immediately" default:"10s" env:"FDFWD_DRAIN_TIMEOUT"`
+
+	// HeartbeatInterval is the interval the heartbeat events are sent at
+	HeartbeatInterval time.Duration `help:"Send a heartbeat event reporting the forwarding progress at this interval, 0 to disable" default:"0s" env:"FDFWD_HEARTBEAT_INTERVAL"`
+}
+
+const (
+	// defaultBatchSize is the fetch batch size used if none is set
+	defaultBatchSize = 20
+	// defaultConcurrency is the number of concurrent sessions used if none is set
+	defaultConcurrency = 5
+)
+
+// SetDefaults sets the default fetch batch size and concurrency if they are not set
+func (c *IngestConfig) SetDefaults() {
+	if c.BatchSize == 0 {
+		c.BatchSize = defaultBatchSize
+	}
+	if c.Concurrency == 0 {
+		c.Concurrency = defaultConcurrency
+	}
+}
+
+// Check validates ingestion settings
+func (c *IngestConfig) Check() error {
+	if c.BatchSize < 1 {
+		return trace.BadParameter("batch must be positive")
+	}
+	if c.Concurrency < 1 {
+		return trace.BadParameter("concurrency must be positive")
+	}
+
+	return nil
+}
+
+// LockConfig represents locking configuration
+type LockConfig struct {
+	// LockEnabled represents locking enabled flag
+	LockEnabled bool `help:"Enable user auto-locking" name:"lock-enabled" default:"false" env:"FDFWD_LOCKING_ENABLED"`
+	// LockFailedAttemptsCount number of failed attempts which triggers locking
+	LockFailedAttemptsCount int `help:"Number of failed attempts in lock-period which triggers locking" name:"lock-failed-attempts-count" default:"3" env:"FDFWD_LOCKING_FAILED_ATTEMPTS"`
+	// LockPeriod represents rate limiting period
+	LockPeriod time.Duration `help:"Time period where lock-failed-attempts-count failed attempts will trigger locking" name:"lock-period" default:"1m" env:"FDFWD_LOCKING_PERIOD"`
+	// LockFor represents the duration of the new lock
+	LockFor time.Duration `help:"Time period for which user gets lock" name:"lock-for" env:"FDFWD_LOCKING_FOR"`
+	// LockRulesFile is a path to the TOML file with auto-locking rules
+	LockRulesFile string `help:"Path to the TOML file with auto-locking rules" name:"lock-rules-file" type:"existingfile" env:"FDFWD_LOCKING_RULES_FILE"`
+}
+
+// SessionExportConfig represents session recordings export configuration
+type SessionExportConfig struct {
+	// SessionExportDir is a path to the directory where asciicast session recordings are written to
+	SessionExportDir string `help:"Directory to export session recordings in asciicast v2 format to" name:"session-export-dir" env:"FDFWD_SESSION_EXPORT_DIR"`
+	// SessionExportURL is an object store URL the finished recordings are uploaded to
+	SessionExportURL string `help:"Object store URL to upload exported session recordings to, <url>/<session-id>.cast" name:"session-export-url" env:"FDFWD_SESSION_EXPORT_URL"`
+	// SessionExportTimeout is the timeout of a single recording upload
+	SessionExportTimeout time.Duration `help:"Session recording upload timeout" name:"session-export-timeout" default:"30s" env:"FDFWD_SESSION_EXPORT_TIMEOUT"`
+}
+
+// OTLPConfig represents OpenTelemetry logs export configuration
+type OTLPConfig struct {
+	// OTLPEndpoint is the OTLP receiver endpoint, OTLP export is disabled if empty
+	OTLPEndpoint string `help:"OTLP logs endpoint: http(s)://host:4318[/v1/logs] for http/protobuf, host:4317 for grpc. OTLP export is disabled if empty" name:"otlp-endpoint" env:"FDFWD_OTLP_ENDPOINT"`
+	// OTLPProtocol is the OTLP transport protocol
+	OTLPProtocol string `help:"OTLP protocol: http/protobuf or grpc" name:"otlp-protocol" enum:"http/protobuf,grpc" default:"http/protobuf" env:"FDFWD_OTLP_PROTOCOL"`
+	// OTLPHeaders are extra request headers in Name=Value format
+	OTLPHeaders []string `help:"Extra OTLP request header or gRPC metadata in Name=Value format, can be repeated" name:"otlp-header" env:"FDFWD_OTLP_HEADERS"`
+	// OTLPCA is a path to the CA the receiver certificate is verified with
+	OTLPCA string `help:"OTLP receiver TLS CA file, system roots are used if not set" name:"otlp-ca" type:"existingfile" env:"FDFWD_OTLP_CA"`
+	// OTLPInsecure disables TLS of the gRPC connection
+	OTLPInsecure bool `help:"Disable TLS of the OTLP gRPC connection" name:"otlp-insecure" env:"FDFWD_OTLP_INSECURE"`
+	// OTLPTimeout is the timeout of a single export request
+	OTLPTimeout time.Duration `help:"OTLP export request timeout" name:"otlp-timeout" default:"30s" env:"FDFWD_OTLP_TIMEOUT"`
+	// OTLPBatchSize is the maximum number of log records exported in one request
+	OTLPBatchSize int `help:"Maximum number of log records exported in one request" name:"otlp-batch-size" default:"512" env:"FDFWD_OTLP_BATCH_SIZE"`
+	// OTLPBatchDelay is the maximum time a log record waits for the batch to fill up
+	OTLPBatchDelay time.Duration `help:"Maximum time a log record waits before the batch is exported" name:"otlp-batch-delay" default:"1s" env:"FDFWD_OTLP_BATCH_DELAY"`
+	// OTLPQueueSize is the maximum number of log records waiting to be exported
+	OTLPQueueSize int `help:"Maximum number of log records waiting to be exported, forwarding pauses while the queue is full" name:"otlp-queue-size" default:"2048" env:"FDFWD_OTLP_QUEUE_SIZE"`
+}
+
+// Check validates OTLP export settings
+func (c *OTLPConfig) Check() error {
+	if c.OTLPEndpoint == "" {
+		return nil
+	}
+
+	if c.OTLPProtocol != otlpProtocolGRPC {
+		u, err := url.Parse(c.OTLPEndpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return trace.BadParameter("invalid otlp-endpoint %q, http(s) URL expected", c.OTLPEndpoint)
+		}
+	}
+	if c.OTLPTimeout <= 0 {
+		return trace.BadParameter("otlp-timeout must be positive")
+	}
+	if c.OTLPBatchSize < 1 || c.OTLPQueueSize < 1 {
+		return trace.BadParameter("otlp-batch-size and otlp-queue-size must be positive")
+	}
+	if c.OTLPBatchSize > c.OTLPQueueSize {
+		return trace.BadParameter("otlp-batch-size can not exceed otlp-queue-size")
+	}
+	if c.OTLPBatchDelay <= 0 {
+		return trace.BadParameter("otlp-batch-delay must be positive")
+	}
+
+	_, err := c.Headers()
+	return trace.Wrap(err)
+}
+
+// Headers returns extra OTLP request headers
+func (c *OTLPConfig) Headers() (http.Header, error) {
+	h := make(http.Header)
+
+	for _, v := range c.OTLPHeaders {
+		name, value, ok := strings.Cut(v, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, trace.BadParameter("invalid otlp-header %q, Name=Value expected", v)
+		}
+		h.Add(strings.TrimSpace(name), value)
+	}
+
+	return h, nil
+}
+
+// MetricsConfig represents metrics configuration
+type MetricsConfig struct {
+	// MetricsAddr is the address to serve Prometheus metrics on
+	MetricsAddr string `help:"Address to serve Prometheus metrics on, metrics are disabled if empty" env:"FDFWD_METRICS_ADDR"`
+}
+
+// TailConfig represents live tail endpoint configuration
+type TailConfig struct {
+	// TailAddr is the address to serve the live tail endpoint on
+	TailAddr string `help:"Address to serve the live tail endpoint on, the endpoint is disabled if empty" env:"FDFWD_TAIL_ADDR"`
+	// TailToken is the bearer token the live tail clients must present
+	TailToken string `help:"Bearer token the live tail clients must present" env:"FDFWD_TAIL_TOKEN"`
+	// TailBuffer is the number of events buffered for every live tail subscriber
+	TailBuffer int `help:"Number of events buffered for every live tail subscriber, events are dropped once it is full" default:"256" env:"FDFWD_TAIL_BUFFER"`
+	// TailCert is the TLS certificate file of the live tail endpoint
+	TailCert string `help:"Live tail endpoint TLS certificate file, required unless tail-addr is a loopback address" type:"existingfile" env:"FDFWD_TAIL_CERT"`
+	// TailKey is the TLS key file of the live tail endpoint
+	TailKey string `help:"Live tail endpoint TLS key file, required unless tail-addr is a loopback address" type:"existingfile" env:"FDFWD_TAIL_KEY"`
+}
+
+// TLS returns true if the live tail endpoint is served over TLS
+func (c *TailConfig) TLS() bool {
+	return c.TailCert != ""
+}
+
+// Check validates the live tail endpoint configuration
+func (c *TailConfig) Check() error {
+	if c.TailAddr == "" {
+		return nil
+	}
+
+	if c.TailToken == "" {
+		return trace.BadParameter("tail-addr requires tail-token to be set")
+	}
+
+	if c.TailBuffer < 1 {
+		return trace.BadParameter("tail-buffer must be positive")
+	}
+
+	if (c.TailCert == "") != (c.TailKey == "") {
+		return trace.BadParameter("tail-cert and tail-key must be set together")
+	}
+
+	if !c.TLS() && !isLoopbackAddr(c.TailAddr) {
+		return trace.BadParameter("tail-addr %v is not a loopback address, set tail-cert and tail-key to serve it over TLS", c.TailAddr)
+	}
+
+	return nil
+}
+
+// isLoopbackAddr returns true if the host of the given address is a loopback host
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// IndexConfig represents local event index configuration
+type IndexConfig struct {
+	// IndexPath is the path to the SQLite event index
+	IndexPath string `help:"Path to the SQLite event index, the index is disabled if empty" env:"FDFWD_INDEX_PATH"`
+	// IndexRetention is how long the events are kept in the index
+	IndexRetention time.Duration `help:"How long the events are kept in the index, 0 to keep them forever" default:"0s" env:"FDFWD_INDEX_RETENTION"`
+}
+
+// GeoConfig represents GeoIP enrichment configuration
+type GeoConfig struct {
+	// GeoIPDB is the path to the MaxMind City or Country database
+	GeoIPDB string `help:"Path to the MaxMind City or Country database (mmdb) to look up remote addresses in" name:"geoip-db" type:"existingfile" env:"FDFWD_GEOIP_DB"`
+	// ASNDB is the path to the MaxMind ASN database
+	ASNDB string `help:"Path to the MaxMind ASN database (mmdb) to look up remote addresses in" name:"asn-db" type:"existingfile" env:"FDFWD_ASN_DB"`
+}
+
+// StartCmdConfig is start command description
+type StartCmdConfig struct {
+	FluentdConfig
+	TeleportConfig
+	IngestConfig
+	LockConfig
+	SessionExportConfig
+	OTLPConfig
+	MetricsConfig
+	TailConfig
+	IndexConfig
+	GeoConfig
+}
+
+// ConfigureCmdConfig holds CLI options for teleport-event-handler configure
+type ConfigureCmdConfig struct {
+	// Out path and file prefix to put certificates into
+	Out string `arg:"true" help:"Output directory" type:"existingdir" required:"true"`
+
+	// Output is a mock arg for now, it specifies export target
+	Output string `help:"Export target service" type:"string" required:"true" default:"fluentd"`
+
+	// Addr is Teleport auth proxy instance address
+	Addr string `arg:"true" help:"Teleport auth proxy instance address" type:"string" required:"true" default:"localhost:3025"`
+
+	// CAName CA certificate and key name
+	CAName string `arg:"true" help:"CA certificate and key name" required:"true" default:"ca"`
+
+	// ServerName server certificate and key name
+	ServerName string `arg:"true" help:"Server certificate and key name" required:"true" default:"server"`
+
+	// ClientName client certificate and key name
+	ClientName string `arg:"true" help:"Client certificate and key name" required:"true" default:"client"`
+
+	// TTL is the CA, server and client certificate TTL, the CA is reused by rotate so it's long-lived
+	TTL time.Duration `help:"CA, server and client certificate TTL, use configure rotate to reissue the server and client certificates more often" required:"true" default:"87600h"`
+
+	CertKeyConfig
+}
+
+// ConfigureRotateCmdConfig holds CLI options for teleport-event-handler configure rotate
+type ConfigureRotateCmdConfig struct {
+	// Out is the directory with the existing CA, certificates are put there
+	Out string `arg:"true" help:"Output directory containing the existing CA" type:"existingdir" required:"true"`
+
+	// Addr is Teleport auth proxy instance address
+	Addr string `arg:"true" help:"Teleport auth proxy instance address" type:"string" required:"true" default:"localhost:3025"`
+
+	// CAName CA certificate and key name
+	CAName string `arg:"true" help:"CA certificate and key name" required:"true" default:"ca"`
+
+	// ServerName server certificate and key name
+	ServerName string `arg:"true" help:"Server certificate and key name" required:"true" default:"server"`
+
+	// ClientName client certificate and key name
+	ClientName string `arg:"true" help:"Client certificate and key name" required:"true" default:"client"`
+
+	// TTL is the server and client certificate TTL, limited by the CA expiry. It's shorter than the
+	// configure TTL since the CA is kept and only the certificates which are rotated regularly are reissued
+	TTL time.Duration `help:"Server and client certificate TTL, certificates never outlive the CA" required:"true" default:"2160h"`
+
+	CertKeyConfig
+}
+
+// CertKeyConfig holds the options of the generated certificates and keys
+type CertKeyConfig struct {
+	// DNSNames is a DNS subjectAltNames for server cert
+	DNSNames []string `help:"Certificate SAN hosts" default:"localhost"`
+
+	// HostNames is an IP subjectAltNames for server cert
+	IP []string `help:"Certificate SAN IPs"`
+
+	// KeyType is the private key type
+	KeyType string `help:"Private key type: rsa, ecdsa (P-256) or ed25519" enum:"rsa,ecdsa,ed25519" default:"rsa"`
+
+	// Length is RSA key length
+	Length int `help:"RSA key length" enum:"1024,2048,3072,4096" default:"4096"`
+}
+
+// ConfigureCmdsConfig holds CLI options for teleport-event-handler configure commands
+type ConfigureCmdsConfig struct {
+	// Generate is the generate certificates command, used when no subcommand is given
+	Generate ConfigureCmdConfig `cmd:"true" default:"withargs" help:"Generate mTLS certificates for Fluentd, the role and the configuration files"`
+
+	// Rotate is the rotate certificates command
+	Rotate ConfigureRotateCmdConfig `cmd:"true" help:"Reissue server and client certificates signed by the existing CA"`
+}
+
+// StorageCmdConfig holds CLI options of the commands which work with the plugin storage
+type StorageCmdConfig struct {
+	// StorageDir is a path to dv storage dir
+	StorageDir string `help:"Storage directory" required:"true" env:"FDFWD_STORAGE" name:"storage"`
+
+	// TeleportAddr is a Teleport addr, the storage is kept separately for every Teleport instance
+	TeleportAddr string `help:"Teleport addr" env:"FDFWD_TELEPORT_ADDR" default:"localhost:3025"`
+}
+
+// SessionsListCmdConfig holds CLI options for teleport-event-handler sessions list
+type SessionsListCmdConfig struct {
+	StorageCmdConfig
+}
+
+// SessionsRetryCmdConfig holds CLI options for teleport-event-handler sessions retry
+type SessionsRetryCmdConfig struct {
+	StorageCmdConfig
+
+	// IDs are the IDs of the quarantined sessions to retry
+	IDs []string `arg:"true" optional:"true" help:"IDs of the quarantined sessions to retry"`
+
+	// All retries all quarantined sessions
+	All bool `help:"Retry all quarantined sessions"`
+}
+
+// SessionsCmdConfig holds CLI options for teleport-event-handler sessions
+type SessionsCmdConfig struct {
+	// List is the list quarantined sessions command
+	List SessionsListCmdConfig `cmd:"true" help:"List quarantined sessions"`
+
+	// Retry is the retry quarantined sessions command
+	Retry SessionsRetryCmdConfig `cmd:"true" help:"Move quarantined sessions back to ingestion"`
+}
+
+// TeleportCmdConfig holds CLI options of the commands which connect to Teleport
+type TeleportCmdConfig struct {
+	TeleportConfig
+
+	// StorageDir is a path to dv storage dir, the events which triggered the locks are kept there
+	StorageDir string `help:"Storage directory, used to show the events which triggered the locks" env:"FDFWD_STORAGE" name:"storage"`
+}
+
+// LocksListCmdConfig holds CLI options for teleport-event-handler locks list
+type LocksListCmdConfig struct {
+	TeleportCmdConfig
+}
+
+// LocksShowCmdConfig holds CLI options for teleport-event-handler locks show
+type LocksShowCmdConfig struct {
+	TeleportCmdConfig
+
+	// Name is the lock name
+	Name string `arg:"true" help:"Lock name"`
+}
+
+// LocksReleaseCmdConfig holds CLI options for teleport-event-handler locks release
+type LocksReleaseCmdConfig struct {
+	TeleportCmdConfig
+
+	// Names are the names of the locks to release
+	Names []string `arg:"true" optional:"true" help:"Names of the locks to release"`
+
+	// All releases all the locks created by the plugin
+	All bool `help:"Release all locks created by the event handler"`
+
+	// OlderThan releases only the locks created earlier than this duration ago
+	OlderThan time.Duration `help:"Release only locks created earlier than this duration ago"`
+}
+
+// SearchCmdConfig holds CLI options for teleport-event-handler search
+type SearchCmdConfig struct {
+	// IndexPath is the path to the SQLite event index
+	IndexPath string `help:"Path to the SQLite event index" required:"true" type:"existingfile" env:"FDFWD_INDEX_PATH"`
+
+	// Types are the event types to return
+	Types []string `help:"Event type, can be repeated" name:"type"`
+
+	// User is the user name to return the events of
+	User string `help:"User name"`
+
+	// Cluster is the Teleport cluster name to return the events of
+	Cluster string `help:"Teleport cluster name"`
+
+	// SessionID is the session ID to return the events of
+	SessionID string `help:"Session ID" name:"session-id"`
+
+	// Login is the OS login to return the events of
+	Login string `help:"OS login"`
+
+	// From is the minimum event time
+	From *time.Time `help:"Minimum event time in RFC3339 format"`
+
+	// To is the maximum event time
+	To *time.Time `help:"Maximum event time in RFC3339 format, exclusive"`
+
+	// Since returns the events newer than this duration ago
+	Since time.Duration `help:"Return the events newer than this duration ago, can not be used with --from"`
+
+	// Limit is the maximum number of the events printed
+	Limit int `help:"Maximum number of the events printed, the newest first, 0 for no limit" default:"100"`
+
+	// JSON prints the full events
+	JSON bool `help:"Print the full events as JSON lines instead of the table" name:"json"`
+}
+
+// VerifyCmdConfig holds CLI options for teleport-event-handler verify
+type VerifyCmdConfig struct {
+	TeleportConfig
+
+	// StorageDir is a path to dv storage dir, the event counters are kept there
+	StorageDir string `help:"Storage directory" required:"true" env:"FDFWD_STORAGE" name:"storage"`
+
+	// Types are the event types forwarded, must match the start command
+	Types []string `help:"Comma-separated list of event types forwarded" env:"FDFWD_TYPES"`
+
+	// SkipEventTypesRaw are the event types skipped, must match the start command
+	SkipEventTypesRaw []string `name:"skip-event-types" help:"Comma-separated list of event types skipped" env:"FDFWD_SKIP_EVENT_TYPES"`
+
+	// From is the start of the verified time range
+	From *time.Time `help:"Start of the verified time range in RFC3339 format, rounded down to the hour"`
+
+	// To is the end of the verified time range
+	To *time.Time `help:"End of the verified time range in RFC3339 format, rounded down to the hour, exclusive. The current hour by default"`
+
+	// Since is the length of the verified time range if From is not set
+	Since time.Duration `help:"Verify the events newer than this duration ago, unless --from is set" default:"24h"`
+
+	// BatchSize is the number of the events fetched from Teleport at once
+	BatchSize int `help:"Fetch batch size" default:"500" name:"batch"`
+}
+
+// LocksCmdConfig holds CLI options for teleport-event-handler locks
+type LocksCmdConfig struct {
+	// List is the list locks command
+	List LocksListCmdConfig `cmd:"true" help:"List locks created by the event handler"`
+
+	// Show is the show lock command
+	Show LocksShowCmdConfig `cmd:"true" help:"Show lock created by the event handler and the events which triggered it"`
+
+	// Release is the release locks command
+	Release LocksReleaseCmdConfig `cmd:"true" help:"Remove locks created by the event handler"`
+}
+
+// CLI represents command structure
+type CLI struct {
+	// Config is the path to configuration file
+	Config kong.ConfigFlag `help:"Path to TOML configuration file" optional:"true" short:"c" type:"existingfile" env:"FDFWD_CONFIG"`
+
+	// Debug is a debug logging mode flag
+	Debug bool `help:"Debug logging" short:"d"`
+
+	// Version is the version print command
+	Version struct{} `cmd:"true" help:"Print plugin version"`
+
+	// Configure is the generate certificates command configuration
+	Configure ConfigureCmdsConfig `cmd:"true" help:"Generate mTLS certificates for Fluentd"`
+
+	// Start is the start command configuration
+	Start StartCmdConfig `cmd:"true" help:"Start log ingestion"`
+
+	// Check is the preflight check command configuration
+	Check StartCmdConfig `cmd:"true" help:"Verify configuration, credentials, permissions and Fluentd connectivity"`
+
+	// Sessions is the quarantined sessions management command configuration
+	Sessions SessionsCmdConfig `cmd:"true" help:"Manage quarantined sessions"`
+
+	// Locks is the lock management command configuration
+	Locks LocksCmdConfig `cmd:"true" help:"Manage locks created by the event handler"`
+
+	// Search is the event index search command configuration
+	Search SearchCmdConfig `cmd:"true" help:"Search the local event index"`
+
+	// Verify is the audit log export completeness verification command configuration
+	Verify VerifyCmdConfig `cmd:"true" help:"Compare the events forwarded per hour with the Teleport audit log"`
+}
+
+// Validate validates start command arguments and prints them to log
+func (c *StartCmdConfig) Validate() error {
+	if c.StartTime != nil {
+		t := c.StartTime.Truncate(time.Second)
+		c.StartTime = &t
+	}
+	if err := c.TeleportConfig.Check(); err != nil {
+		return trace.Wrap(err)
+	}
+	if err := c.FluentdConfig.Check(); err != nil {
+		return trace.Wrap(err)
+	}
+	if err := c.OTLPConfig.Check(); err != nil {
+		return trace.Wrap(err)
+	}
+	c.IngestConfig.SetDefaults()
+	if err := c.IngestConfig.Check(); err != nil {
+		return trace.Wrap(err)
+	}
+	c.SkipSessionTypes = lib.SliceToAnonymousMap(c.SkipSessionTypesRaw)
+	c.SkipEventTypes = lib.SliceToAnonymousMap(c.SkipEventTypesRaw)
+
+	policies, err := ParseEventPolicies(c.EventPoliciesRaw)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	c.EventPolicies = policies
+
+	if c.SessionExportURL != "" && c.SessionExportDir == "" {
+		return trace.BadParameter("session-export-url requires session-export-dir to be set")
+	}
+
+	if c.SessionExportURL != "" && c.SessionExportTimeout <= 0 {
+		return trace.BadParameter("session-export-timeout must be positive")
+	}
+
+	if c.DedupWindow < 0 {
+		return trace.BadParameter("dedup-window can not be negative")
+	}
+
+	if c.CheckpointEvents < 0 {
+		return trace.BadParameter("checkpoint-events can not be negative")
+	}
+
+	if c.CheckpointInterval < 0 {
+		return trace.BadParameter("checkpoint-interval can not be negative")
+	}
+
+	if c.DrainTimeout < 0 {
+		return trace.BadParameter("drain-timeout can not be negative")
+	}
+
+	if c.HeartbeatInterval < 0 {
+		return trace.BadParameter("heartbeat-interval can not be negative")
+	}
+
+	if err := c.TailConfig.Check(); err != nil {
+		return trace.Wrap(err)
+	}
+
+	if c.IndexRetention < 0 {
+		return trace.BadParameter("index-retention can not be negative")
+	}
+
+	if c.TeleportDataDir != "" && (c.LockEnabled || c.LockRulesFile != "") {
+		return trace.BadParameter("auto-locking requires the Auth API and can not be used with teleport-data-dir")
+	}
+
+	return nil
+}
+
+// EventSource returns the source the audit log events are read from: the Teleport address, or the URL of the
+// data directory if the events are read from files
+func (c *StartCmdConfig) EventSource() string {
+	if c.TeleportDataDir != "" {
+		return "file://" + c.TeleportDataDir
+	}
+
+	return c.TeleportAddr
+}
+
+// Dump dumps configuration values to the log
+func (c *StartCmdConfig) Dump(ctx context.Context) {
+	log := logger.Get(ctx)
+
+	// Log configuration variables
+	log.WithField("batch", c.BatchSize).Info("Using batch size")
+	log.WithField("types", c.Types).Info("Using type filter")
+	log.WithField("skip-event-types", c.SkipEventTypes).Info("Using type exclude filter")
+	log.WithField("types", c.SkipSessionTypes).Info("Skipping session events of type")
+	if len(c.EventPoliciesRaw) > 0 {
+		log.WithField("policies", c.EventPoliciesRaw).Info("Using event type policies")
+	}
+	if c.Envelope {
+		log.WithField("schema_version", envelopeSchemaVersion).Info("Wrapping events in the delivery envelope")
+	}
+	log.WithField("value", c.StartTime).Info("Using start time")
+	log.WithField("timeout", c.Timeout).Info("Using timeout")
+	log.WithField("url", c.FluentdURL).Info("Using Fluentd url")
+	log.WithField("url", c.FluentdSessionURL).Info("Using Fluentd session url")
+	log.WithField("ca", c.FluentdCA).Info("Using Fluentd ca")
+	log.WithField("cert", c.FluentdCert).Info("Using Fluentd cert")
+	log.WithField("key", c.FluentdKey).Info("Using Fluentd key")
+	log.WithField("timeout", c.FluentdTimeout).Info("Using Fluentd request timeout")
+
+	if c.FluentdProxy != "" {
+		log.WithField("proxy", c.FluentdProxy).Info("Using Fluentd proxy")
+	}
+	if len(c.FluentdHeaders) > 0 || len(c.FluentdEnvHeaders) > 0 {
+		log.WithField("count", len(c.FluentdHeaders)+len(c.FluentdEnvHeaders)).Info("Sending extra headers to Fluentd")
+	}
+	if c.FluentdCompression != "" && c.FluentdCompression != compressionNone {
+		log.WithField("compression", c.FluentdCompression).WithField("threshold", c.FluentdCompressionThreshold).Info("Compressing Fluentd requests")
+	}
+	if c.FluentdBearerToken != "" {
+		log.Info("Using Fluentd bearer token auth")
+	}
+	if c.FluentdBasicAuthUser != "" {
+		log.WithField("user", c.FluentdBasicAuthUser).Info("Using Fluentd basic auth")
+	}
+
+	if c.TeleportDataDir != "" {
+		log.WithField("dir", c.TeleportDataDir).Info("Reading events from Teleport data directory")
+	}
+	if c.TeleportIdentityFile != "" {
+		log.WithField("file", c.TeleportIdentityFile).Info("Using Teleport identity file")
+	}
+	if c.TeleportRefreshEnabled {
+		log.WithField("interval", c.TeleportRefreshInterval).Info("Using Teleport identity file refresh")
+	}
+
+	if c.TeleportKey != "" {
+		log.WithField("addr", c.TeleportAddr).Info("Using Teleport addr")
+		log.WithField("ca", c.TeleportCA).Info("Using Teleport CA")
+		log.WithField("cert", c.TeleportCert).Info("Using Teleport cert")
+		log.WithField("key", c.TeleportKey).Info("Using Teleport key")
+	}
+
+	if c.OTLPEndpoint != "" {
+		log.WithField("endpoint", c.OTLPEndpoint).WithField("protocol", c.OTLPProtocol).Info("Exporting events as OTLP log records")
+	}
+
+	if c.LockEnabled {
+		log.WithField("count", c.LockFailedAttemptsCount).WithField("period", c.LockPeriod).Info("Auto-locking enabled")
+	}
+
+	if c.LockRulesFile != "" {
+		log.WithField("file", c.LockRulesFile).Info("Using auto-locking rules")
+	}
+
+	if c.SessionMaxAttempts > 0 {
+		log.WithField("attempts", c.SessionMaxAttempts).Info("Quarantining sessions after failed attempts")
+	}
+
+	if c.DedupWindow > 0 {
+		log.WithField("size", c.DedupWindow).Info("Suppressing duplicate events")
+	}
+
+	if c.CheckpointEvents > 1 || c.CheckpointInterval > 0 {
+		log.WithField("events", c.CheckpointEvents).WithField("interval", c.CheckpointInterval).Info("Coalescing ingestion progress checkpoints")
+	}
+
+	if c.HeartbeatInterval > 0 {
+		log.WithField("interval", c.HeartbeatInterval).Info("Sending heartbeat events")
+	}
+
+	if c.MetricsAddr != "" {
+		log.WithField("addr", c.MetricsAddr).Info("Serving metrics")
+	}
+
+	if c.TailAddr != "" {
+		log.WithField("addr", c.TailAddr).WithField("buffer", c.TailBuffer).WithField("tls", c.TLS()).Info("Serving live tail")
+	}
+
+	if c.IndexPath != "" {
+		log.WithField("path", c.IndexPath).WithField("retention", c.IndexRetention).Info("Indexing events")
+	}
+
+	if c.GeoIPDB != "" || c.ASNDB != "" {
+		log.WithField("geoip-db", c.GeoIPDB).WithField("asn-db", c.ASNDB).Info("Enriching remote addresses")
+	}
+
+	if c.SessionSummary != sessionSummaryOff {
+		log.WithField("mode", c.SessionSummary).Info("Emitting session summary records")
+	}
+
+	if c.SessionExportDir != "" {
+		log.WithField("dir", c.SessionExportDir).Info("Exporting session recordings")
+	}
+	if c.SessionExportURL != "" {
+		log.WithField("url", c.SessionExportURL).Info("Uploading session recordings")
+	}
+
+	if c.DryRun {
+		log.Warn("Dry run! Events are not sent to Fluentd. Separate storage is used.")
+	}
+}
@@ -0,0 +1,202 @@
+/*
+Copyright 2015-2023 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kong"
+	"github.com/stretchr/testify/require"
+)
+
+// StartCmdConfig is mostly to test that the TOML file parsing works as
+// expected.
+func TestStartCmdConfig(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name string
+		args []string
+
+		want StartCmdConfig
+	}{
+		{
+			name: "standard",
+			args: []string{"start", "--config", "testdata/config.toml"},
+			want: StartCmdConfig{
+				FluentdConfig: FluentdConfig{
+					FluentdURL:                  "https://localhost:8888/test.log",
+					FluentdSessionURL:           "https://localhost:8888/session",
+					FluentdCert:                 path.Join(wd, "testdata", "fake-file"),
+					FluentdKey:                  path.Join(wd, "testdata", "fake-file"),
+					FluentdCA:                   path.Join(wd, "testdata", "fake-file"),
+					FluentdTimeout:              30 * time.Second,
+					FluentdCompression:          "none",
+					FluentdCompressionThreshold: 1024,
+				},
+				TeleportConfig: TeleportConfig{
+					TeleportAddr:            "localhost:3025",
+					TeleportIdentityFile:    path.Join(wd, "testdata", "fake-file"),
+					TeleportRefreshEnabled:  true,
+					TeleportRefreshInterval: 2 * time.Minute,
+				},
+				IngestConfig: IngestConfig{
+					StorageDir:          "./storage",
+					BatchSize:           20,
+					SkipEventTypes:      map[string]struct{}{},
+					SkipSessionTypesRaw: []string{"print"},
+					SkipSessionTypes: map[string]struct{}{
+						"print": {},
+					},
+					EventPolicies:      map[string]EventPolicy{},
+					Timeout:            10 * time.Second,
+					Concurrency:        5,
+					SessionMaxAttempts: 3,
+					SessionSummary:     "off",
+					DedupWindow:        10000,
+					CheckpointEvents:   1,
+					DrainTimeout:       10 * time.Second,
+				},
+				LockConfig: LockConfig{
+					LockFailedAttemptsCount: 3,
+					LockPeriod:              time.Minute,
+				},
+				SessionExportConfig: SessionExportConfig{
+					SessionExportTimeout: 30 * time.Second,
+				},
+				OTLPConfig: OTLPConfig{
+					OTLPProtocol:   otlpProtocolHTTP,
+					OTLPTimeout:    30 * time.Second,
+					OTLPBatchSize:  512,
+					OTLPBatchDelay: time.Second,
+					OTLPQueueSize:  2048,
+				},
+				TailConfig: TailConfig{
+					TailBuffer: 256,
+				},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cli := CLI{}
+			parser, err := kong.New(
+				&cli,
+				kong.UsageOnError(),
+				kong.Configuration(KongTOMLResolver),
+				kong.Name(PluginName),
+				kong.Description(PluginDescription),
+			)
+			require.NoError(t, err)
+			_, err = parser.Parse(tc.args)
+			require.NoError(t, err)
+
+			require.Equal(t, tc.want, cli.Start)
+		})
+	}
+}
+
+// TestMultiClusterConfig tests that the settings of every [[teleport]] block are resolved
+func TestMultiClusterConfig(t *testing.T) {
+	n, err := CountClusterBlocks("testdata/multi-cluster.toml")
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	n, err = CountClusterBlocks("testdata/config.toml")
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+
+	configs := make([]*StartCmdConfig, 0, 2)
+	for i := 0; i < 2; i++ {
+		cli := CLI{}
+		parser, err := kong.New(
+			&cli,
+			kong.Configuration(NewKongTOMLClusterResolver(i)),
+			kong.Name(PluginName),
+			kong.Description(PluginDescription),
+		)
+		require.NoError(t, err)
+		_, err = parser.Parse([]string{"start", "--config", "testdata/multi-cluster.toml"})
+		require.NoError(t, err)
+
+		configs = append(configs, &cli.Start)
+	}
+
+	east, west := configs[0], configs[1]
+
+	require.Equal(t, "east.example.com:3025", east.TeleportAddr)
+	require.False(t, east.TeleportRefreshEnabled)
+	require.Empty(t, east.Types)
+	require.Equal(t, map[string]struct{}{"session.print": {}}, east.SkipEventTypes)
+	require.Equal(t, "https://localhost:8888/test.log", east.FluentdURL)
+
+	require.Equal(t, "west.example.com:3025", west.TeleportAddr)
+	require.True(t, west.TeleportRefreshEnabled)
+	require.Equal(t, []string{"user.login"}, west.Types)
+	require.Empty(t, west.SkipEventTypes)
+	require.Equal(t, "https://localhost:8888/west.log", west.FluentdURL)
+	require.Equal(t, "https://localhost:8888/west-session", west.FluentdSessionURL)
+
+	// Settings which are not defined per cluster are shared
+	require.Equal(t, 20, west.BatchSize)
+	require.Equal(t, east.FluentdCA, west.FluentdCA)
+
+	require.NoError(t, checkClusterConfigs(configs))
+	require.Error(t, checkClusterConfigs([]*StartCmdConfig{east, east}))
+
+	// The index is opened by one cluster only
+	east.IndexPath, west.IndexPath = "index.db", "./index.db"
+	require.Error(t, checkClusterConfigs(configs))
+	west.IndexPath = "west.db"
+	require.NoError(t, checkClusterConfigs(configs))
+
+	// Live tail is served per cluster
+	east.TailAddr, west.TailAddr = "127.0.0.1:8081", "127.0.0.1:8081"
+	require.Error(t, checkClusterConfigs(configs))
+
+	// The clusters reading the audit log files share the default address, they are told apart by the data
+	// directories
+	east.TeleportAddr, west.TeleportAddr = "localhost:3025", "localhost:3025"
+	east.TailAddr, west.TailAddr = "", ""
+	east.TeleportDataDir, west.TeleportDataDir = "/var/lib/teleport-east", "/var/lib/teleport-west"
+	require.NoError(t, checkClusterConfigs(configs))
+	west.TeleportDataDir = "/var/lib/teleport-east/"
+	require.Error(t, checkClusterConfigs(configs))
+}
+
+// TestConfigureCmdConfig tests that configure generates certificates unless the subcommand is given
+func TestConfigureCmdConfig(t *testing.T) {
+	for _, tc := range []struct {
+		args    []string
+		command string
+	}{
+		{args: []string{"configure", ".", "example.com:3025", "--key-type", "ecdsa"}, command: "configure generate"},
+		{args: []string{"configure", "rotate", ".", "example.com:3025", "--key-type", "ecdsa"}, command: "configure rotate"},
+	} {
+		cli := CLI{}
+		parser, err := kong.New(&cli, kong.Name(PluginName))
+		require.NoError(t, err)
+		ctx, err := parser.Parse(tc.args)
+		require.NoError(t, err)
+		require.Contains(t, ctx.Command(), tc.command)
+	}
+}
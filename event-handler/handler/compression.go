@@ -0,0 +1,125 @@
+// Copyright 2024 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"sync"
+
+	"github.com/gravitational/trace"
+	"github.com/klauspost/compress/zstd"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// compressionNone disables request body compression
+	compressionNone = "none"
+	// compressionGzip is gzip request body compression
+	compressionGzip = "gzip"
+	// compressionZstd is zstd request body compression
+	compressionZstd = "zstd"
+)
+
+// compressionFallback is the codec used when the receiver does not support the codec
+var compressionFallback = map[string]string{
+	compressionZstd: compressionGzip,
+	compressionGzip: compressionNone,
+}
+
+// payloadCompressor compresses request bodies with the negotiated codec. The codec starts with the configured
+// one and falls back to the next one every time the receiver rejects it.
+type payloadCompressor struct {
+	// threshold is the minimum size of the payload which is compressed
+	threshold int
+
+	// mu protects codec
+	mu sync.RWMutex
+	// codec is the current codec
+	codec string
+
+	// zstdOnce initializes zstdEncoder on first use
+	zstdOnce sync.Once
+	// zstdEncoder is the zstd encoder, safe for concurrent EncodeAll calls
+	zstdEncoder *zstd.Encoder
+	// zstdErr is the zstd encoder initialization error
+	zstdErr error
+}
+
+// newPayloadCompressor creates the compressor
+func newPayloadCompressor(codec string, threshold int) *payloadCompressor {
+	if codec == "" {
+		codec = compressionNone
+	}
+
+	return &payloadCompressor{codec: codec, threshold: threshold}
+}
+
+// Compress compresses the payload if it's not smaller than the threshold. Returns the body and the
+// Content-Encoding value, empty if the payload is sent as is.
+func (p *payloadCompressor) Compress(b []byte) ([]byte, string, error) {
+	p.mu.RLock()
+	codec := p.codec
+	p.mu.RUnlock()
+
+	if codec == compressionNone || len(b) < p.threshold {
+		return b, "", nil
+	}
+
+	switch codec {
+	case compressionGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(b); err != nil {
+			return nil, "", trace.Wrap(err)
+		}
+		if err := w.Close(); err != nil {
+			return nil, "", trace.Wrap(err)
+		}
+		return buf.Bytes(), codec, nil
+	case compressionZstd:
+		p.zstdOnce.Do(func() {
+			p.zstdEncoder, p.zstdErr = zstd.NewWriter(nil)
+		})
+		if p.zstdErr != nil {
+			return nil, "", trace.Wrap(p.zstdErr)
+		}
+		return p.zstdEncoder.EncodeAll(b, nil), codec, nil
+	default:
+		return nil, "", trace.BadParameter("unsupported compression %v", codec)
+	}
+}
+
+// Reject switches to the fallback codec after the receiver has rejected the codec. Returns false if there is
+// no fallback.
+func (p *payloadCompressor) Reject(codec string) bool {
+	fallback, ok := compressionFallback[codec]
+	if !ok {
+		return false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Another request has switched the codec already
+	if p.codec != codec {
+		return true
+	}
+
+	log.WithField("compression", codec).WithField("fallback", fallback).Warn("Fluentd does not support compression, falling back")
+	p.codec = fallback
+
+	return true
+}
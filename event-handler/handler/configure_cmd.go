@@ -14,7 +14,7 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
-package main
+package handler
 
 import (
 	"bytes"
@@ -28,6 +28,7 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/gravitational/trace"
 
@@ -79,6 +80,9 @@ type ConfigureCmd struct {
 
 	// mtls is the struct with generated mTLS certificates
 	mtls *MTLSCerts
+
+	// rotate is true if server and client certificates are reissued using the existing CA
+	rotate bool
 }
 
 var (
@@ -117,7 +121,49 @@ const (
 
 // RunConfigureCmd initializes and runs configure command
 func RunConfigureCmd(cfg *ConfigureCmdConfig) error {
-	c := ConfigureCmd{
+	c := newConfigureCmd(cfg)
+
+	g, err := GenerateMTLSCerts(cfg.DNSNames, cfg.IP, cfg.TTL, cfg.KeyType, cfg.Length)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	c.mtls = g
+
+	return c.Run()
+}
+
+// RunConfigureRotateCmd initializes and runs configure rotate command
+func RunConfigureRotateCmd(cfg *ConfigureRotateCmdConfig) error {
+	c := newConfigureCmd(&ConfigureCmdConfig{
+		Out:           cfg.Out,
+		Addr:          cfg.Addr,
+		CAName:        cfg.CAName,
+		ServerName:    cfg.ServerName,
+		ClientName:    cfg.ClientName,
+		TTL:           cfg.TTL,
+		CertKeyConfig: cfg.CertKeyConfig,
+	})
+	c.rotate = true
+
+	ca, err := ReadKeyPairFile(c.caCertPath, c.caKeyPath)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	g, err := RotateMTLSCerts(ca, cfg.DNSNames, cfg.IP, cfg.TTL, cfg.KeyType, cfg.Length)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	c.mtls = g
+
+	return c.Run()
+}
+
+// newConfigureCmd creates configure command with the output paths set
+func newConfigureCmd(cfg *ConfigureCmdConfig) *ConfigureCmd {
+	return &ConfigureCmd{
 		ConfigureCmdConfig: cfg,
 		caCertPath:         path.Join(cfg.Out, cfg.CAName) + ".crt",
 		caKeyPath:          path.Join(cfg.Out, cfg.CAName) + ".key",
@@ -129,15 +175,6 @@ func RunConfigureCmd(cfg *ConfigureCmdConfig) error {
 		fluentdConfPath:    path.Join(cfg.Out, fluentdConfFileName),
 		confPath:           path.Join(cfg.Out, confFileName),
 	}
-
-	g, err := GenerateMTLSCerts(cfg.DNSNames, cfg.IP, cfg.TTL, cfg.Length)
-	if err != nil {
-		return trace.Wrap(err)
-	}
-
-	c.mtls = g
-
-	return c.Run()
 }
 
 // Run runs the generator
@@ -160,12 +197,19 @@ func (c *ConfigureCmd) Run() error {
 
 	// Print paths to generated fluentd certificate files
 	paths := []string{c.caCertPath, c.caKeyPath, c.serverCertPath, c.serverKeyPath, c.clientCertPath, c.clientKeyPath}
+	if c.rotate {
+		paths = paths[2:]
+	}
 	paths, err = c.cleanupPaths(paths...)
 	if err != nil {
 		return trace.Wrap(err)
 	}
 
-	c.printStep("Generated mTLS Fluentd certificates %v", strings.Join(paths, ", "))
+	if c.rotate {
+		c.printStep("Reissued mTLS Fluentd certificates %v, valid until %v", strings.Join(paths, ", "), c.mtls.serverCert.NotAfter.UTC().Format(time.RFC3339))
+	} else {
+		c.printStep("Generated mTLS Fluentd certificates %v", strings.Join(paths, ", "))
+	}
 
 	// Write role definition file
 	err = c.writeRoleDef()
@@ -253,17 +297,19 @@ func (c *ConfigureCmd) cleanupPath(arg string) (string, error) {
 	return p[0], nil
 }
 
-// Generates fluentd certificates
+// Generates fluentd certificates. CA is kept as is on rotation.
 func (c *ConfigureCmd) genCerts(pwd string) error {
-	ok := c.askOverwrite(c.caKeyPath)
-	if ok {
-		err := c.mtls.CACert.WriteFile(c.caCertPath, c.caKeyPath, "")
-		if err != nil {
-			return trace.Wrap(err)
+	if !c.rotate {
+		ok := c.askOverwrite(c.caKeyPath)
+		if ok {
+			err := c.mtls.CACert.WriteFile(c.caCertPath, c.caKeyPath, "")
+			if err != nil {
+				return trace.Wrap(err)
+			}
 		}
 	}
 
-	ok = c.askOverwrite(c.serverKeyPath)
+	ok := c.askOverwrite(c.serverKeyPath)
 	if ok {
 		err := c.mtls.ServerCert.WriteFile(c.serverCertPath, c.serverKeyPath, pwd)
 		if err != nil {
@@ -379,8 +425,13 @@ func (c *ConfigureCmd) writeConf() error {
 	return c.writeFile(c.confPath, b.Bytes())
 }
 
-// askOverwrite asks question if the user wants to overwrite specified file if it exists
+// askOverwrite asks question if the user wants to overwrite specified file if it exists. Server and client
+// certificates are always overwritten on rotation.
 func (c *ConfigureCmd) askOverwrite(path string) bool {
+	if c.rotate && (path == c.serverKeyPath || path == c.clientKeyPath) {
+		return true
+	}
+
 	_, err := os.Stat(path)
 	if !os.IsNotExist(err) {
 		return lib.AskYesNo(fmt.Sprintf("Do you want to overwrite %s", path))
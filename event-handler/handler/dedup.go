@@ -0,0 +1,174 @@
+// Copyright 2024 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gravitational/trace"
+	"github.com/peterbourgon/diskv/v3"
+)
+
+// dedupEntry is the idempotency key of the sent event stored in the dedup window slot
+type dedupEntry struct {
+	// Seq is the sequence number of the entry, used to restore the order of the entries on load
+	Seq uint64 `json:"seq"`
+	// Key is the idempotency key
+	Key string `json:"key"`
+}
+
+// dedupWindow remembers the idempotency keys of the latest sent events. It is a ring buffer of the fixed size:
+// every slot is stored separately, so adding a key costs a single small write. With coalesced checkpoints the
+// slots are kept in memory and saved along with the progress.
+type dedupWindow struct {
+	// mu protects the fields below, events are sent concurrently
+	mu sync.Mutex
+	// dv is a diskv instance
+	dv *diskv.Diskv
+	// slots are the keys in the ring buffer order
+	slots []string
+	// keys is the set of the keys in the window
+	keys map[string]int
+	// seq is the sequence number of the next entry
+	seq uint64
+	// pending are the slots not saved yet by slot number, nil if every slot is saved once it is added
+	pending map[int][]byte
+}
+
+// loadDedupWindow loads the dedup window of the given size from the storage. The slots of the buffered window
+// are saved by flush only.
+func loadDedupWindow(dv *diskv.Diskv, size int, buffered bool) (*dedupWindow, error) {
+	w := &dedupWindow{
+		dv:    dv,
+		slots: make([]string, size),
+		keys:  make(map[string]int, size),
+	}
+	if buffered {
+		w.pending = make(map[int][]byte)
+	}
+
+	var entries []dedupEntry
+	for name := range dv.KeysPrefix(dedupPrefix, nil) {
+		slot, err := strconv.Atoi(strings.TrimPrefix(name, dedupPrefix))
+		if err != nil {
+			continue
+		}
+
+		// The window was shrunk, the slot is not used anymore
+		if slot >= size {
+			if err := dv.Erase(name); err != nil {
+				return nil, trace.Wrap(err)
+			}
+			continue
+		}
+
+		b, err := dv.Read(name)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+
+		var e dedupEntry
+		if err := json.Unmarshal(b, &e); err != nil {
+			return nil, trace.Wrap(err)
+		}
+
+		entries = append(entries, e)
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Seq < entries[j].Seq })
+
+	for _, e := range entries {
+		w.put(e)
+	}
+
+	return w, nil
+}
+
+// Has returns true if the key is in the window
+func (w *dedupWindow) Has(key string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	_, ok := w.keys[key]
+	return ok
+}
+
+// Add adds the key to the window, evicting the oldest key if the window is full
+func (w *dedupWindow) Add(key string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, ok := w.keys[key]; ok {
+		return nil
+	}
+
+	e := dedupEntry{Seq: w.seq, Key: key}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	if w.pending != nil {
+		w.pending[w.slot(e.Seq)] = b
+	} else if err := w.dv.Write(dedupKey(w.slot(e.Seq)), b); err != nil {
+		return trace.Wrap(err)
+	}
+
+	w.put(e)
+
+	return nil
+}
+
+// flush saves the slots kept in memory
+func (w *dedupWindow) flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for slot, b := range w.pending {
+		if err := w.dv.Write(dedupKey(slot), b); err != nil {
+			return trace.Wrap(err)
+		}
+		delete(w.pending, slot)
+	}
+
+	return nil
+}
+
+// put puts the entry to its slot in memory
+func (w *dedupWindow) put(e dedupEntry) {
+	slot := w.slot(e.Seq)
+
+	if prev := w.slots[slot]; prev != "" && w.keys[prev] == slot {
+		delete(w.keys, prev)
+	}
+
+	w.slots[slot] = e.Key
+	w.keys[e.Key] = slot
+	w.seq = e.Seq + 1
+}
+
+// slot returns the ring buffer slot of the entry with the given sequence number
+func (w *dedupWindow) slot(seq uint64) int {
+	return int(seq % uint64(len(w.slots)))
+}
+
+// dedupKey returns the storage key of the dedup window slot
+func dedupKey(slot int) string {
+	return dedupPrefix + strconv.Itoa(slot)
+}
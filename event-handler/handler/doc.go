@@ -0,0 +1,35 @@
+// Copyright 2024 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package handler implements the Teleport event handler: it reads the audit log and session events from Teleport,
+filters and enriches them, and sends them to Fluentd and the other configured destinations.
+
+The event-handler binary is a thin CLI around this package. Other programs can embed the pipeline:
+
+	c := &handler.StartCmdConfig{...}
+	app, err := handler.NewApp(c)
+	if err != nil {
+		return err
+	}
+	app.Sinks = append(app.Sinks, mySink)
+	return app.Run(ctx)
+
+Fluentd is used only if FluentdURL is set. Setting App.Source before Run replaces the Teleport events watcher
+with a custom EventSource, and App.Sinks receive every event sent. The position in the audit log, the session
+progress and the sent events are kept in StorageDir the same way as for the CLI. The metrics are registered on
+App.Metrics, which can be replaced before Run to serve them along with the metrics of the program. Every App
+has its own metrics, so the Apps embedded in one program need separate registries.
+*/
+package handler
@@ -0,0 +1,116 @@
+// Copyright 2024 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+	"time"
+
+	"github.com/gravitational/teleport/integrations/lib/logger"
+)
+
+// drain starts the drain phase once the app is terminated: the jobs stop taking new work, and the work in
+// progress is aborted once the drain timeout passes
+func (a *App) drain(ctx context.Context) error {
+	log := logger.Get(ctx)
+
+	close(a.draining)
+	if a.Source != nil {
+		a.Source.Drain()
+	}
+
+	timeout := a.Config().DrainTimeout
+	if timeout <= 0 {
+		a.abort()
+		return nil
+	}
+
+	log.WithField("timeout", timeout).Info("Draining in-flight events and sessions")
+
+	done := a.Process.Done()
+	go func() {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+			log.Warn("Drain timeout exceeded, aborting in-flight events and sessions")
+			a.drainTimedOut.Store(true)
+			a.abort()
+		case <-done:
+		}
+	}()
+
+	return nil
+}
+
+// isDraining returns true if the app is terminated and the jobs must not take new work
+func (a *App) isDraining() bool {
+	select {
+	case <-a.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// drainContext returns the context which is canceled once the drain phase is over
+func (a *App) drainContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(a.drained, cancel)
+
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// reportPending logs the progress left to be resumed on the next start
+func (a *App) reportPending(ctx context.Context) {
+	log := logger.Get(ctx)
+
+	if a.State == nil {
+		return
+	}
+
+	// drained is always canceled by now, the flag tells whether the drain timeout passed
+	if a.drainTimedOut.Load() {
+		log.Warn("Drain phase was not completed in time")
+	}
+
+	cursor, err := a.State.GetCursor()
+	if err != nil {
+		log.WithError(err).Error("Failed to read the audit log position")
+		return
+	}
+	id, err := a.State.GetID()
+	if err != nil {
+		log.WithError(err).Error("Failed to read the audit log position")
+		return
+	}
+
+	sessions, err := a.State.GetSessions()
+	if err != nil {
+		log.WithError(err).Error("Failed to read pending sessions")
+		return
+	}
+
+	for id, index := range sessions {
+		log.WithField("id", id).WithField("index", index).Info("Session ingestion will be resumed on the next start")
+	}
+
+	log.WithField("cursor", cursor).WithField("id", id).WithField("sessions", len(sessions)).
+		Info("Stopped, progress is saved")
+}
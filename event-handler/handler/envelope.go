@@ -0,0 +1,116 @@
+// Copyright 2024 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"github.com/gravitational/trace"
+)
+
+const (
+	// envelopeSchemaVersion is the version of the envelope format, bumped on incompatible changes
+	envelopeSchemaVersion = 1
+
+	// streamAudit is the stream of the audit log events
+	streamAudit = "audit"
+	// streamSession is the stream of the session recording events
+	streamSession = "session"
+
+	// envelopeEventField is the envelope field holding the raw event payload
+	envelopeEventField = `,"event":`
+)
+
+// eventEnvelope is the delivery metadata the forwarded event is wrapped with, the event is the last field
+type eventEnvelope struct {
+	// SchemaVersion is the envelope format version
+	SchemaVersion int `json:"schema_version"`
+	// Handler is the handler which forwarded the event
+	Handler envelopeHandler `json:"handler"`
+	// Source is the address of the Teleport cluster the event was read from
+	Source string `json:"source"`
+	// Stream is audit or session
+	Stream string `json:"stream"`
+	// EventID is the event ID
+	EventID string `json:"event_id"`
+	// EventType is the event type
+	EventType string `json:"event_type"`
+	// SessionID is the ID of the session the event belongs to
+	SessionID string `json:"session_id,omitempty"`
+	// SessionIndex is the index of the event within the session, set for the session stream only
+	SessionIndex *int64 `json:"session_index,omitempty"`
+	// Cursor is the audit log page cursor the event was read at
+	Cursor string `json:"cursor,omitempty"`
+	// IdempotencyKey is the stable event key, the same event always gets the same key
+	IdempotencyKey string `json:"idempotency_key"`
+	// Attempt is the delivery attempt number, starting from 1
+	Attempt int `json:"attempt"`
+	// ForwardedAt is the time the event was sent
+	ForwardedAt time.Time `json:"forwarded_at"`
+}
+
+// envelopeHandler is the handler build information
+type envelopeHandler struct {
+	// Version is the handler version
+	Version string `json:"version"`
+	// Gitref is the handler git reference
+	Gitref string `json:"gitref,omitempty"`
+}
+
+// Envelope returns the event wrapped with the delivery metadata. The event payload is kept as is.
+func (e *TeleportEvent) Envelope(source string, attempt int, now time.Time) ([]byte, error) {
+	if !json.Valid(e.Event) {
+		return nil, trace.BadParameter("event payload is not valid JSON")
+	}
+
+	stream := e.Stream
+	if stream == "" {
+		stream = streamAudit
+	}
+
+	env := eventEnvelope{
+		SchemaVersion:  envelopeSchemaVersion,
+		Handler:        envelopeHandler{Version: Version, Gitref: Gitref},
+		Source:         source,
+		Stream:         stream,
+		EventID:        e.ID,
+		EventType:      e.Type,
+		SessionID:      eventSessionID(e),
+		Cursor:         e.Cursor,
+		IdempotencyKey: e.IdempotencyKey,
+		Attempt:        attempt,
+		ForwardedAt:    now.UTC(),
+	}
+	if stream == streamSession && e.Type != sessionSummaryType {
+		index := e.Index
+		env.SessionIndex = &index
+	}
+
+	b, err := json.Marshal(env)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	// The payload is appended as is: json.Marshal would compact and escape it
+	r := make([]byte, 0, len(b)+len(e.Event)+len(envelopeEventField)+1)
+	r = append(r, b[:len(b)-1]...)
+	r = append(r, envelopeEventField...)
+	r = append(r, bytes.TrimSpace(e.Event)...)
+	r = append(r, '}')
+
+	return r, nil
+}
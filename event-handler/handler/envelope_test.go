@@ -0,0 +1,68 @@
+// Copyright 2024 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvelope(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	raw := `{"event":"user.login","uid":"id-1","user":"<alice>",   "sid":""}`
+
+	e := &TeleportEvent{ID: "id-1", Type: loginType, Cursor: "cursor-1", Event: []byte(raw), IdempotencyKey: "id-1"}
+	b, err := e.Envelope("teleport.example.com:443", 2, now)
+	require.NoError(t, err)
+
+	var env struct {
+		eventEnvelope
+		Raw json.RawMessage `json:"event"`
+	}
+	require.NoError(t, json.Unmarshal(b, &env))
+	require.Equal(t, envelopeSchemaVersion, env.SchemaVersion)
+	require.Equal(t, Version, env.Handler.Version)
+	require.Equal(t, "teleport.example.com:443", env.Source)
+	require.Equal(t, streamAudit, env.Stream)
+	require.Equal(t, "id-1", env.EventID)
+	require.Equal(t, "cursor-1", env.Cursor)
+	require.Equal(t, "id-1", env.IdempotencyKey)
+	require.Equal(t, 2, env.Attempt)
+	require.Equal(t, now, env.ForwardedAt)
+	require.Nil(t, env.SessionIndex)
+	// The payload is kept byte for byte
+	require.Equal(t, raw, string(env.Raw))
+
+	e = &TeleportEvent{ID: "id-2", Type: printType, Index: 0, Event: []byte(`{"event":"print"}`), Stream: streamSession}
+	e.SetSessionIdempotencyKey("session-1")
+	e.SessionID = "session-1"
+	b, err = e.Envelope("teleport.example.com:443", 1, now)
+	require.NoError(t, err)
+
+	var m map[string]interface{}
+	require.NoError(t, json.Unmarshal(b, &m))
+	require.Equal(t, streamSession, m["stream"])
+	require.Equal(t, "session-1", m["session_id"])
+	require.Equal(t, "session-1:0", m["idempotency_key"])
+	// Zero index is still reported for the session events
+	require.Equal(t, float64(0), m["session_index"])
+	require.NotContains(t, m, "cursor")
+
+	_, err = (&TeleportEvent{Event: []byte("{")}).Envelope("", 1, now)
+	require.Error(t, err)
+}
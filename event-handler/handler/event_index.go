@@ -0,0 +1,266 @@
+// Copyright 2024 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gravitational/teleport/integrations/lib/logger"
+	"github.com/gravitational/trace"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	// indexPruneInterval is how often the events older than the index retention are deleted
+	indexPruneInterval = time.Hour
+	// indexBusyTimeout is how long a query waits for the index locked by another connection, the search command
+	// reads the index while the handler writes it
+	indexBusyTimeout = 5 * time.Second
+)
+
+// indexSchema creates the index tables. The event key is the idempotency key, so the events sent again after a
+// restart are indexed once.
+const indexSchema = `
+CREATE TABLE IF NOT EXISTS events (
+	key        TEXT PRIMARY KEY,
+	time       INTEGER NOT NULL,
+	type       TEXT NOT NULL,
+	user       TEXT NOT NULL DEFAULT '',
+	cluster    TEXT NOT NULL DEFAULT '',
+	session_id TEXT NOT NULL DEFAULT '',
+	login      TEXT NOT NULL DEFAULT '',
+	event      TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS events_time ON events (time);
+CREATE INDEX IF NOT EXISTS events_type_time ON events (type, time);
+CREATE INDEX IF NOT EXISTS events_user_time ON events (user, time);
+CREATE INDEX IF NOT EXISTS events_session_id ON events (session_id);
+`
+
+// EventIndex is the local SQLite index of the events sent, it is a Sink
+type EventIndex struct {
+	// db is the index database
+	db *sql.DB
+}
+
+// IndexedEvent is the event found in the index
+type IndexedEvent struct {
+	// Time is the event time
+	Time time.Time
+	// Type is the event type
+	Type string
+	// User is the user the event belongs to
+	User string
+	// Cluster is the Teleport cluster name
+	Cluster string
+	// SessionID is the session ID, empty for the events which are not related to a session
+	SessionID string
+	// Login is the OS login
+	Login string
+	// Event is the event JSON
+	Event json.RawMessage
+}
+
+// IndexQuery is the event index search query, empty fields match any event
+type IndexQuery struct {
+	// Types are the event types
+	Types []string
+	// User is the user name
+	User string
+	// Cluster is the Teleport cluster name
+	Cluster string
+	// SessionID is the session ID
+	SessionID string
+	// Login is the OS login
+	Login string
+	// From is the minimum event time, inclusive
+	From time.Time
+	// To is the maximum event time, exclusive
+	To time.Time
+	// Limit is the maximum number of the events returned, the newest events are returned first
+	Limit int
+}
+
+// OpenEventIndex opens the event index, the database file is created if it does not exist
+func OpenEventIndex(path string) (*EventIndex, error) {
+	params := url.Values{
+		"_pragma": {
+			"busy_timeout(" + strconv.FormatInt(indexBusyTimeout.Milliseconds(), 10) + ")",
+			"journal_mode(WAL)",
+			"synchronous(NORMAL)",
+		},
+	}
+
+	db, err := sql.Open("sqlite", path+"?"+params.Encode())
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	if _, err := db.Exec(indexSchema); err != nil {
+		db.Close()
+		return nil, trace.Wrap(err, "failed to open event index %v", path)
+	}
+
+	return &EventIndex{db: db}, nil
+}
+
+// Close closes the index
+func (x *EventIndex) Close() error {
+	return trace.Wrap(x.db.Close())
+}
+
+// Send adds the event to the index
+func (x *EventIndex) Send(ctx context.Context, e *TeleportEvent, _ []byte) error {
+	var fields struct {
+		Time      time.Time `json:"time"`
+		User      string    `json:"user"`
+		Cluster   string    `json:"cluster_name"`
+		SessionID string    `json:"sid"`
+		Login     string    `json:"login"`
+	}
+	if err := json.Unmarshal(e.Event, &fields); err != nil {
+		return trace.Wrap(err)
+	}
+
+	ts := e.Time
+	if ts.IsZero() {
+		ts = fields.Time
+	}
+	sid := e.SessionID
+	if sid == "" {
+		sid = fields.SessionID
+	}
+
+	_, err := x.db.ExecContext(ctx,
+		`INSERT OR IGNORE INTO events (key, time, type, user, cluster, session_id, login, event) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.IdempotencyKey, ts.UnixNano(), e.Type, fields.User, fields.Cluster, sid, fields.Login, string(e.Event),
+	)
+
+	return trace.Wrap(err)
+}
+
+// Search returns the events matching the query, the newest first
+func (x *EventIndex) Search(ctx context.Context, q IndexQuery) ([]IndexedEvent, error) {
+	var where []string
+	var args []interface{}
+
+	if len(q.Types) > 0 {
+		where = append(where, "type IN ("+strings.TrimSuffix(strings.Repeat("?, ", len(q.Types)), ", ")+")")
+		for _, t := range q.Types {
+			args = append(args, t)
+		}
+	}
+	for _, f := range []struct{ column, value string }{
+		{"user", q.User},
+		{"cluster", q.Cluster},
+		{"session_id", q.SessionID},
+		{"login", q.Login},
+	} {
+		if f.value != "" {
+			where = append(where, f.column+" = ?")
+			args = append(args, f.value)
+		}
+	}
+	if !q.From.IsZero() {
+		where = append(where, "time >= ?")
+		args = append(args, q.From.UnixNano())
+	}
+	if !q.To.IsZero() {
+		where = append(where, "time < ?")
+		args = append(args, q.To.UnixNano())
+	}
+
+	query := "SELECT time, type, user, cluster, session_id, login, event FROM events"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY time DESC, rowid DESC"
+	if q.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, q.Limit)
+	}
+
+	rows, err := x.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	defer rows.Close()
+
+	var r []IndexedEvent
+	for rows.Next() {
+		var e IndexedEvent
+		var ts int64
+		var event string
+		if err := rows.Scan(&ts, &e.Type, &e.User, &e.Cluster, &e.SessionID, &e.Login, &event); err != nil {
+			return nil, trace.Wrap(err)
+		}
+		e.Time = time.Unix(0, ts).UTC()
+		e.Event = json.RawMessage(event)
+		r = append(r, e)
+	}
+
+	return r, trace.Wrap(rows.Err())
+}
+
+// Prune deletes the events older than the given time and returns the number of the events deleted
+func (x *EventIndex) Prune(ctx context.Context, before time.Time) (int64, error) {
+	res, err := x.db.ExecContext(ctx, "DELETE FROM events WHERE time < ?", before.UnixNano())
+	if err != nil {
+		return 0, trace.Wrap(err)
+	}
+
+	n, err := res.RowsAffected()
+	return n, trace.Wrap(err)
+}
+
+// pruneIndex deletes the events older than the index retention from the index until the app is terminated, the
+// events are kept forever if the retention is 0
+func (a *App) pruneIndex(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	a.OnTerminate(func(_ context.Context) error {
+		cancel()
+		return nil
+	})
+
+	log := logger.Get(ctx)
+
+	ticker := time.NewTicker(indexPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		if retention := a.Config().IndexRetention; retention > 0 {
+			n, err := a.Index.Prune(ctx, time.Now().Add(-retention))
+			if err != nil && !errors.Is(err, context.Canceled) {
+				log.WithError(err).Error("Failed to prune event index")
+			}
+			if n > 0 {
+				log.WithField("count", n).Debug("Pruned event index")
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
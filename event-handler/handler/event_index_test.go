@@ -0,0 +1,112 @@
+// Copyright 2024 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newIndexedEvent creates the event sent to the index
+func newIndexedEvent(key, typ string, ts time.Time, fields string) *TeleportEvent {
+	return &TeleportEvent{
+		Event:          []byte(`{"event":"` + typ + `","time":"` + ts.Format(time.RFC3339) + `",` + fields + `}`),
+		Type:           typ,
+		Time:           ts,
+		IdempotencyKey: key,
+	}
+}
+
+func TestEventIndex(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	x, err := OpenEventIndex(filepath.Join(t.TempDir(), "index.db"))
+	require.NoError(t, err)
+	defer x.Close()
+
+	for _, e := range []*TeleportEvent{
+		newIndexedEvent("1", "user.login", now.Add(-48*time.Hour), `"user":"alice","cluster_name":"east"`),
+		newIndexedEvent("2", "session.start", now.Add(-time.Hour), `"user":"alice","login":"root","sid":"s1","cluster_name":"east"`),
+		newIndexedEvent("3", "user.login", now.Add(-time.Minute), `"user":"bob","cluster_name":"west"`),
+		// The event sent again after a restart is indexed once
+		newIndexedEvent("3", "user.login", now.Add(-time.Minute), `"user":"bob","cluster_name":"west"`),
+	} {
+		require.NoError(t, x.Send(ctx, e, nil))
+	}
+
+	events, err := x.Search(ctx, IndexQuery{})
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+	require.Equal(t, "bob", events[0].User)
+	require.Equal(t, now.Add(-time.Minute), events[0].Time)
+
+	events, err = x.Search(ctx, IndexQuery{User: "alice", From: now.Add(-24 * time.Hour)})
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.Equal(t, IndexedEvent{
+		Time:      now.Add(-time.Hour),
+		Type:      "session.start",
+		User:      "alice",
+		Cluster:   "east",
+		SessionID: "s1",
+		Login:     "root",
+		Event:     events[0].Event,
+	}, events[0])
+	require.JSONEq(t, `{"event":"session.start","time":"2024-01-01T23:00:00Z","user":"alice","login":"root","sid":"s1","cluster_name":"east"}`, string(events[0].Event))
+
+	events, err = x.Search(ctx, IndexQuery{Types: []string{"user.login"}, To: now.Add(-time.Hour), Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.Equal(t, "alice", events[0].User)
+
+	events, err = x.Search(ctx, IndexQuery{Limit: 1})
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+
+	n, err := x.Prune(ctx, now.Add(-24*time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, int64(1), n)
+
+	events, err = x.Search(ctx, IndexQuery{})
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+
+	var buf bytes.Buffer
+	require.NoError(t, printIndexedEvents(events, &buf))
+	require.Contains(t, buf.String(), "TIME")
+	require.Contains(t, buf.String(), "session.start")
+
+	buf.Reset()
+	require.NoError(t, printIndexedEventsJSON(events[:1], &buf))
+	require.Equal(t, string(events[0].Event)+"\n", buf.String())
+}
+
+func TestSearchCmdQuery(t *testing.T) {
+	now := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	from := now.Add(-time.Hour)
+
+	q, err := (&SearchCmdConfig{User: "alice", Since: time.Hour, Limit: 5}).Query(now)
+	require.NoError(t, err)
+	require.Equal(t, IndexQuery{User: "alice", From: from, Limit: 5}, q)
+
+	_, err = (&SearchCmdConfig{From: &from, Since: time.Hour}).Query(now)
+	require.Error(t, err)
+}
@@ -0,0 +1,366 @@
+// Copyright 2024 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gravitational/teleport/integrations/lib/logger"
+	"github.com/gravitational/trace"
+	"github.com/jonboulle/clockwork"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// eventPolicyKeep forwards all the events of the type
+	eventPolicyKeep = "keep"
+	// eventPolicySample forwards 1 in N events of the type, sampled by session ID
+	eventPolicySample = "sample"
+	// eventPolicyRate forwards at most N events of the type per minute
+	eventPolicyRate = "rate"
+
+	// rateLimitedType is the type of the synthetic event which reports the events dropped by rate limits
+	rateLimitedType = "event_handler.rate_limited"
+
+	// rateLimitWindow is the period the rate limits are set for
+	rateLimitWindow = time.Minute
+
+	// rateLimitedFlushInterval is how often the dropped events are reported
+	rateLimitedFlushInterval = 10 * time.Second
+)
+
+// EventPolicy is the forwarding policy of the event type
+type EventPolicy struct {
+	// Mode is keep, sample or rate
+	Mode string
+	// N is 1-in-N for sample and events per minute for rate policies
+	N int
+}
+
+// ParseEventPolicies parses the list of type=keep, type=sample:N and type=rate:N policies
+func ParseEventPolicies(raw []string) (map[string]EventPolicy, error) {
+	policies := make(map[string]EventPolicy, len(raw))
+
+	for _, v := range raw {
+		eventType, spec, ok := strings.Cut(v, "=")
+		eventType = strings.TrimSpace(eventType)
+		if !ok || eventType == "" {
+			return nil, trace.BadParameter("invalid event policy %q, type=policy expected", v)
+		}
+		if _, ok := policies[eventType]; ok {
+			return nil, trace.BadParameter("event policy for %v is set more than once", eventType)
+		}
+
+		mode, n, hasN := strings.Cut(strings.TrimSpace(spec), ":")
+		p := EventPolicy{Mode: mode}
+
+		switch mode {
+		case eventPolicyKeep:
+			if hasN {
+				return nil, trace.BadParameter("invalid event policy %q, keep does not take a value", v)
+			}
+		case eventPolicySample, eventPolicyRate:
+			var err error
+			p.N, err = strconv.Atoi(n)
+			if !hasN || err != nil || p.N < 1 {
+				return nil, trace.BadParameter("invalid event policy %q, %v:N with positive N expected", v, mode)
+			}
+		default:
+			return nil, trace.BadParameter("invalid event policy %q, keep, sample:N or rate:N expected", v)
+		}
+
+		policies[eventType] = p
+	}
+
+	return policies, nil
+}
+
+// tokenBucket is the rate limit of a single event type
+type tokenBucket struct {
+	// tokens is the number of events which can be forwarded
+	tokens float64
+	// updatedAt is the time tokens were refilled last time
+	updatedAt time.Time
+	// dropped is the number of events dropped since the last report
+	dropped int
+	// droppedSince is the time the first unreported event was dropped
+	droppedSince time.Time
+}
+
+// EventSampler applies per event type policies to the events being forwarded
+type EventSampler struct {
+	// clock is used to refill the buckets
+	clock clockwork.Clock
+
+	// mu protects the fields below, events are sent concurrently
+	mu sync.Mutex
+	// policies are the policies by event type
+	policies map[string]EventPolicy
+	// buckets are the rate limit buckets by event type
+	buckets map[string]*tokenBucket
+	// dropped counts events dropped by the policies
+	dropped *prometheus.CounterVec
+}
+
+// NewEventSampler creates new EventSampler
+func NewEventSampler(policies map[string]EventPolicy, clock clockwork.Clock) *EventSampler {
+	s := &EventSampler{
+		clock:   clock,
+		buckets: make(map[string]*tokenBucket),
+		dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "events_dropped_total",
+			Help:      "Number of events dropped by event type sampling and rate limit policies",
+		}, []string{"type", "policy"}),
+	}
+	s.SetPolicies(policies)
+
+	return s
+}
+
+// collectors returns the collectors of the sampler metrics
+func (s *EventSampler) collectors() []prometheus.Collector {
+	return []prometheus.Collector{s.dropped}
+}
+
+// SetPolicies replaces the policies. The buckets of the types which are still rate limited are kept.
+func (s *EventSampler) SetPolicies(policies map[string]EventPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.policies = policies
+	for eventType, b := range s.buckets {
+		if p, ok := policies[eventType]; (!ok || p.Mode != eventPolicyRate) && b.dropped == 0 {
+			delete(s.buckets, eventType)
+		}
+	}
+}
+
+// Allow returns true if the event should be forwarded
+func (s *EventSampler) Allow(e *TeleportEvent) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.policies[e.Type]
+	if !ok || e.Type == rateLimitedType {
+		return true
+	}
+
+	switch p.Mode {
+	case eventPolicySample:
+		if s.sampled(e, p.N) {
+			return true
+		}
+	case eventPolicyRate:
+		if s.take(e.Type, p.N) {
+			return true
+		}
+	default:
+		return true
+	}
+
+	s.dropped.WithLabelValues(e.Type, p.Mode).Inc()
+
+	return false
+}
+
+// sampled returns true if the event is in the 1-in-n sample. All the events of a session are either sampled
+// or not, events which do not belong to a session are sampled by their key.
+func (s *EventSampler) sampled(e *TeleportEvent, n int) bool {
+	key := eventSessionID(e)
+	if key == "" {
+		key = e.IdempotencyKey
+	}
+	if key == "" {
+		key = e.ID
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(key))
+
+	return h.Sum64()%uint64(n) == 0
+}
+
+// take takes a token from the bucket of the event type, returns false if the bucket is empty
+func (s *EventSampler) take(eventType string, n int) bool {
+	now := s.clock.Now()
+
+	b, ok := s.buckets[eventType]
+	if !ok {
+		b = &tokenBucket{tokens: float64(n), updatedAt: now}
+		s.buckets[eventType] = b
+	}
+
+	// Refill n tokens per window, the bucket holds at most n tokens
+	b.tokens += float64(n) * now.Sub(b.updatedAt).Seconds() / rateLimitWindow.Seconds()
+	if b.tokens > float64(n) {
+		b.tokens = float64(n)
+	}
+	b.updatedAt = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true
+	}
+
+	if b.dropped == 0 {
+		b.droppedSince = now
+	}
+	b.dropped++
+
+	return false
+}
+
+// Overflow returns the synthetic events reporting the events dropped by rate limits since the last call
+func (s *EventSampler) Overflow() ([]*TeleportEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock.Now().UTC()
+
+	types := make([]string, 0, len(s.buckets))
+	for eventType, b := range s.buckets {
+		if b.dropped > 0 {
+			types = append(types, eventType)
+		}
+	}
+	sort.Strings(types)
+
+	events := make([]*TeleportEvent, 0, len(types))
+	for _, eventType := range types {
+		b := s.buckets[eventType]
+
+		e, err := newRateLimitedEvent(eventType, s.policies[eventType].N, b.dropped, b.droppedSince.UTC(), now)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		events = append(events, e)
+
+		b.dropped = 0
+	}
+
+	return events, nil
+}
+
+// rateLimitedEvent is the payload of the synthetic event which reports the events dropped by rate limits
+type rateLimitedEvent struct {
+	// Event is the synthetic event type
+	Event string `json:"event"`
+	// UID is the event ID
+	UID string `json:"uid"`
+	// Time is the report time
+	Time time.Time `json:"time"`
+	// LimitedEvent is the type of the dropped events
+	LimitedEvent string `json:"limited_event"`
+	// Limit is the number of events forwarded per minute
+	Limit int `json:"limit_per_minute"`
+	// Dropped is the number of events dropped
+	Dropped int `json:"dropped"`
+	// Since is the time the first reported event was dropped
+	Since time.Time `json:"since"`
+}
+
+// newRateLimitedEvent creates the synthetic event which reports the events dropped by rate limits
+func newRateLimitedEvent(eventType string, limit, dropped int, since, now time.Time) (*TeleportEvent, error) {
+	id := fmt.Sprintf("%v-%v-%v", rateLimitedType, eventType, since.UnixNano())
+
+	b, err := json.Marshal(rateLimitedEvent{
+		Event:        rateLimitedType,
+		UID:          id,
+		Time:         now,
+		LimitedEvent: eventType,
+		Limit:        limit,
+		Dropped:      dropped,
+		Since:        since,
+	})
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	return &TeleportEvent{
+		Event:          b,
+		ID:             id,
+		Type:           rateLimitedType,
+		Time:           now,
+		IdempotencyKey: id,
+	}, nil
+}
+
+// eventSessionID returns the ID of the session the event belongs to, empty if there is none
+func eventSessionID(e *TeleportEvent) string {
+	if e.SessionID != "" {
+		return e.SessionID
+	}
+
+	var v struct {
+		SessionID string `json:"sid"`
+	}
+	if err := json.Unmarshal(e.Event, &v); err != nil {
+		return ""
+	}
+
+	return v.SessionID
+}
+
+// reportRateLimited periodically sends the synthetic events which report the events dropped by rate limits, and
+// once more after the ingestion jobs are stopped
+func (a *App) reportRateLimited(ctx context.Context) error {
+	defer a.reporters.Done()
+
+	ticker := time.NewTicker(rateLimitedFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-a.ingestionStopped():
+			// Report the events dropped since the last tick, including the events dropped during the drain
+			if err := a.sendRateLimited(ctx); err != nil {
+				logger.Get(ctx).WithError(err).Error("Failed to report rate limited events")
+			}
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+
+		if err := a.sendRateLimited(ctx); err != nil {
+			logger.Get(ctx).WithError(err).Error("Failed to report rate limited events")
+		}
+	}
+}
+
+// sendRateLimited sends the synthetic events which report the events dropped by rate limits
+func (a *App) sendRateLimited(ctx context.Context) error {
+	events, err := a.Sampler.Overflow()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	for _, e := range events {
+		if err := a.SendEvent(ctx, a.Config().FluentdURL, e); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+
+	return nil
+}
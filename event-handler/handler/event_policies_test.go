@@ -0,0 +1,111 @@
+// Copyright 2024 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseEventPolicies(t *testing.T) {
+	policies, err := ParseEventPolicies([]string{"session.network=sample:10", "kube.request=rate:600", "disk = keep"})
+	require.NoError(t, err)
+	require.Equal(t, map[string]EventPolicy{
+		"session.network": {Mode: eventPolicySample, N: 10},
+		"kube.request":    {Mode: eventPolicyRate, N: 600},
+		"disk":            {Mode: eventPolicyKeep},
+	}, policies)
+
+	for _, raw := range []string{"disk", "=keep", "disk=drop", "disk=sample", "disk=sample:0", "disk=rate:x", "disk=keep:1"} {
+		_, err := ParseEventPolicies([]string{raw})
+		require.Error(t, err, raw)
+	}
+
+	_, err = ParseEventPolicies([]string{"disk=keep", "disk=rate:1"})
+	require.Error(t, err)
+}
+
+// newPolicyTestEvent creates an event which belongs to the session
+func newPolicyTestEvent(t *testing.T, eventType, sid string, n int) *TeleportEvent {
+	b, err := json.Marshal(map[string]interface{}{"event": eventType, "sid": sid})
+	require.NoError(t, err)
+
+	return &TeleportEvent{Event: b, Type: eventType, ID: fmt.Sprintf("%v-%v", sid, n), IdempotencyKey: fmt.Sprintf("%v:%v", sid, n)}
+}
+
+func TestEventSampler(t *testing.T) {
+	clock := clockwork.NewFakeClockAt(time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC))
+	sampler := NewEventSampler(map[string]EventPolicy{
+		"session.network": {Mode: eventPolicySample, N: 4},
+		"kube.request":    {Mode: eventPolicyRate, N: 3},
+		"disk":            {Mode: eventPolicyKeep},
+	}, clock)
+
+	// Sessions are either sampled or not as a whole
+	sampled := 0
+	for i := 0; i < 400; i++ {
+		sid := fmt.Sprintf("session-%v", i)
+		allowed := sampler.Allow(newPolicyTestEvent(t, "session.network", sid, 0))
+		for n := 1; n < 3; n++ {
+			require.Equal(t, allowed, sampler.Allow(newPolicyTestEvent(t, "session.network", sid, n)))
+		}
+		if allowed {
+			sampled++
+		}
+	}
+	require.InDelta(t, 100, sampled, 40)
+
+	require.True(t, sampler.Allow(newPolicyTestEvent(t, "disk", "s", 0)))
+	require.True(t, sampler.Allow(newPolicyTestEvent(t, "session.start", "s", 0)))
+
+	// Rate limit
+	for n := 0; n < 5; n++ {
+		require.Equal(t, n < 3, sampler.Allow(newPolicyTestEvent(t, "kube.request", "", n)))
+	}
+
+	events, err := sampler.Overflow()
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.Equal(t, rateLimitedType, events[0].Type)
+
+	var overflow rateLimitedEvent
+	require.NoError(t, json.Unmarshal(events[0].Event, &overflow))
+	require.Equal(t, "kube.request", overflow.LimitedEvent)
+	require.Equal(t, 2, overflow.Dropped)
+	require.Equal(t, 3, overflow.Limit)
+
+	// Dropped events are reported once
+	events, err = sampler.Overflow()
+	require.NoError(t, err)
+	require.Empty(t, events)
+
+	// The bucket refills over time
+	clock.Advance(20 * time.Second)
+	require.True(t, sampler.Allow(newPolicyTestEvent(t, "kube.request", "", 5)))
+	require.False(t, sampler.Allow(newPolicyTestEvent(t, "kube.request", "", 6)))
+
+	// Policies can be replaced at runtime
+	sampler.SetPolicies(nil)
+	require.True(t, sampler.Allow(newPolicyTestEvent(t, "kube.request", "", 7)))
+
+	events, err = sampler.Overflow()
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+}
@@ -0,0 +1,34 @@
+// Copyright 2024 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+
+	auditlogpb "github.com/gravitational/teleport/api/gen/proto/go/teleport/auditlog/v1"
+)
+
+// EventSource is the source of the audit log and session events
+type EventSource interface {
+	// Events returns the audit log events starting after the saved position, and the error channel
+	Events(ctx context.Context) (chan *TeleportEvent, chan error)
+	// StreamUnstructuredSessionEvents returns the events of the session starting from the index, and the
+	// error channel. The events channel is closed once all the events are sent.
+	StreamUnstructuredSessionEvents(ctx context.Context, id string, index int64) (chan *auditlogpb.EventUnstructured, chan error)
+	// Drain makes Events stop once the events already read are sent
+	Drain()
+	// SetConfig replaces the configuration
+	SetConfig(c *StartCmdConfig)
+}
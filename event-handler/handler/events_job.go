@@ -12,23 +12,26 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package handler
 
 import (
 	"context"
+	"time"
 
 	"github.com/gravitational/teleport/integrations/lib"
 	"github.com/gravitational/teleport/integrations/lib/logger"
 	"github.com/gravitational/trace"
-	limiter "github.com/sethvargo/go-limiter"
-	"github.com/sethvargo/go-limiter/memorystore"
+)
+
+const (
+	// failedLoginLockKeyPrefix is the auto-locking counter key prefix of failed logins
+	failedLoginLockKeyPrefix = "failed-login/"
 )
 
 // EventsJob incapsulates audit log event consumption logic
 type EventsJob struct {
 	lib.ServiceJob
 	app *App
-	rl  limiter.Store
 }
 
 // NewEventsJob creates new EventsJob structure
@@ -42,22 +45,10 @@ func NewEventsJob(app *App) *EventsJob {
 func (j *EventsJob) run(ctx context.Context) error {
 	log := logger.Get(ctx)
 
-	// Create cancellable context which handles app termination
-	ctx, cancel := context.WithCancel(ctx)
-	j.app.Process.OnTerminate(func(_ context.Context) error {
-		cancel()
-		return nil
-	})
-
-	store, err := memorystore.New(&memorystore.Config{
-		Tokens:   uint64(j.app.Config.LockFailedAttemptsCount),
-		Interval: j.app.Config.LockPeriod,
-	})
-	if err != nil {
-		return trace.Wrap(err)
-	}
-
-	j.rl = store
+	// The watcher stops fetching new events once the app is terminated, the context is canceled once the
+	// events fetched are sent or the drain timeout passes
+	ctx, cancel := j.app.drainContext(ctx)
+	defer cancel()
 
 	j.SetReady(true)
 
@@ -88,7 +79,7 @@ func (j *EventsJob) run(ctx context.Context) error {
 func (j *EventsJob) runPolling(ctx context.Context) error {
 	log := logger.Get(ctx)
 
-	evtCh, errCh := j.app.EventWatcher.Events(ctx)
+	evtCh, errCh := j.app.Source.Events(ctx)
 
 	for {
 		select {
@@ -115,7 +106,7 @@ func (j *EventsJob) runPolling(ctx context.Context) error {
 // handleEvent processes an event
 func (j *EventsJob) handleEvent(ctx context.Context, evt *TeleportEvent) error {
 	// Send event to Teleport
-	err := j.sendEvent(ctx, evt)
+	forwarded, err := j.sendEvent(ctx, evt)
 	if err != nil {
 		return trace.Wrap(err)
 	}
@@ -133,43 +124,82 @@ func (j *EventsJob) handleEvent(ctx context.Context, evt *TeleportEvent) error {
 		}
 	}
 
-	// Save last event id and cursor to disk
-	if err := j.app.State.SetID(evt.ID); err != nil {
+	// Evaluate auto-locking rules
+	err = j.app.LockRules.Process(ctx, evt)
+	if err != nil {
 		return trace.Wrap(err)
 	}
-	if err := j.app.State.SetCursor(evt.Cursor); err != nil {
+
+	// Count the event before its position is saved, the counters are compared with the audit log by verify
+	if err := j.app.State.AddEventCount(evt.Time, forwarded); err != nil {
+		return trace.Wrap(err)
+	}
+	j.app.heartbeat.Add(evt, forwarded)
+
+	// Save last event position
+	if j.app.Files != nil {
+		err = j.app.Files.SavePosition(evt)
+	} else {
+		err = j.app.State.SetPosition(evt.ID, evt.Cursor)
+	}
+	if err != nil {
 		return trace.Wrap(err)
 	}
 
 	return nil
 }
 
-// sendEvent sends an event to Teleport
-func (j *EventsJob) sendEvent(ctx context.Context, evt *TeleportEvent) error {
-	return j.app.SendEvent(ctx, j.app.Config.FluentdURL, evt)
+// sendEvent sends an event to Teleport, returns false if the event is dropped by the event type policies
+func (j *EventsJob) sendEvent(ctx context.Context, evt *TeleportEvent) (bool, error) {
+	return j.app.forwardEvent(ctx, j.app.Config().FluentdURL, evt)
 }
 
 // TryLockUser locks user if they exceeded failed attempts
 func (j *EventsJob) TryLockUser(ctx context.Context, evt *TeleportEvent) error {
-	if !j.app.Config.LockEnabled || j.app.Config.DryRun {
+	if !j.app.Config().LockEnabled || j.app.Config().DryRun {
 		return nil
 	}
 
 	log := logger.Get(ctx)
 
-	_, _, _, ok, err := j.rl.Take(ctx, evt.FailedLoginData.Login)
+	// Failed attempts are counted in the persistent state, so they survive restarts. Event time is used
+	// instead of the wall clock, and replayed events are not counted twice.
+	ts := evt.Time
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+
+	key := failedLoginLockKeyPrefix + evt.FailedLoginData.Login
+	e := LockEvent{ID: evt.ID, Type: evt.Type, Time: ts}
+	events, err := j.app.State.AddLockEvent(key, e, j.app.Config().LockPeriod)
 	if err != nil {
 		return trace.Wrap(err)
 	}
-	if ok {
+	if len(events) <= j.app.Config().LockFailedAttemptsCount {
 		return nil
 	}
 
-	err = j.app.EventWatcher.UpsertLock(ctx, evt.FailedLoginData.User, evt.FailedLoginData.Login, j.app.Config.LockFor)
+	err = j.app.EventWatcher.UpsertLock(ctx, evt.FailedLoginData.User, evt.FailedLoginData.Login, j.app.Config().LockFor)
 	if err != nil {
 		return trace.Wrap(err)
 	}
 
+	err = j.app.State.SetLockRecord(LockRecord{
+		Name:      failedLoginLockName(evt.FailedLoginData.User, evt.FailedLoginData.Login),
+		Rule:      failedLoginLockRule,
+		Key:       key,
+		CreatedAt: time.Now().UTC(),
+		Events:    events,
+	})
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	// The counter is reset once the lock is created, like the counters of the lock rules
+	if err := j.app.State.ResetLockEvents(key); err != nil {
+		return trace.Wrap(err)
+	}
+
 	log.WithField("data", evt.FailedLoginData).Info("User login is locked")
 
 	return nil
@@ -14,9 +14,10 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
-package main
+package handler
 
 import (
+	"compress/gzip"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
@@ -26,10 +27,12 @@ import (
 	"net/http/httptest"
 	"os"
 	"path"
+	"sync"
 	"time"
 
 	"github.com/gravitational/teleport/integrations/lib/logger"
 	"github.com/gravitational/trace"
+	"github.com/klauspost/compress/zstd"
 )
 
 type FakeFluentd struct {
@@ -43,6 +46,13 @@ type FakeFluentd struct {
 
 	server     *httptest.Server
 	chMessages chan string
+
+	// mu protects the fields below
+	mu sync.Mutex
+	// encodings are the supported Content-Encoding values, all are supported if nil
+	encodings map[string]struct{}
+	// receivedEncodings are Content-Encoding values of the accepted requests
+	receivedEncodings []string
 }
 
 const (
@@ -74,7 +84,7 @@ func NewFakeFluentd() (*FakeFluentd, error) {
 
 // writeCerts generates and writes temporary mTLS keys
 func (f *FakeFluentd) writeCerts() error {
-	g, err := GenerateMTLSCerts([]string{"localhost"}, []string{}, time.Hour, 1024)
+	g, err := GenerateMTLSCerts([]string{"localhost"}, []string{}, time.Hour, keyTypeRSA, 1024)
 	if err != nil {
 		return trace.Wrap(err)
 	}
@@ -151,9 +161,69 @@ func (f *FakeFluentd) GetURL() string {
 	return f.server.URL
 }
 
+// SetEncodings sets the supported Content-Encoding values, requests with other encodings are rejected
+func (f *FakeFluentd) SetEncodings(encodings ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.encodings = make(map[string]struct{}, len(encodings))
+	for _, e := range encodings {
+		f.encodings[e] = struct{}{}
+	}
+}
+
+// GetEncodings returns Content-Encoding values of the accepted requests, empty string for uncompressed ones
+func (f *FakeFluentd) GetEncodings() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]string(nil), f.receivedEncodings...)
+}
+
+// decodeBody returns the request body reader which decodes Content-Encoding, false if the encoding is
+// not supported
+func (f *FakeFluentd) decodeBody(r *http.Request) (io.Reader, bool, error) {
+	encoding := r.Header.Get("Content-Encoding")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.encodings[encoding]; f.encodings != nil && encoding != "" && !ok {
+		return nil, false, nil
+	}
+	f.receivedEncodings = append(f.receivedEncodings, encoding)
+
+	switch encoding {
+	case "":
+		return r.Body, true, nil
+	case compressionGzip:
+		gr, err := gzip.NewReader(r.Body)
+		return gr, true, trace.Wrap(err)
+	case compressionZstd:
+		zr, err := zstd.NewReader(r.Body)
+		if err != nil {
+			return nil, true, trace.Wrap(err)
+		}
+		return zr.IOReadCloser(), true, nil
+	default:
+		return nil, false, nil
+	}
+}
+
 // Respond is the response function
 func (f *FakeFluentd) Respond(w http.ResponseWriter, r *http.Request) {
-	req, err := io.ReadAll(r.Body)
+	body, ok, err := f.decodeBody(r)
+	if !ok {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		logger.Standard().WithError(err).Error("FakeFluentd Respond() failed to decode body")
+		fmt.Fprintln(w, "NOK")
+		return
+	}
+
+	req, err := io.ReadAll(body)
 	if err != nil {
 		logger.Standard().WithError(err).Error("FakeFluentd Respond() failed to read body")
 		fmt.Fprintln(w, "NOK")
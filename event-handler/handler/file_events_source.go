@@ -0,0 +1,404 @@
+// Copyright 2024 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	auditlogpb "github.com/gravitational/teleport/api/gen/proto/go/teleport/auditlog/v1"
+	apievents "github.com/gravitational/teleport/api/types/events"
+	"github.com/gravitational/teleport/integrations/lib/logger"
+	"github.com/gravitational/trace"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// auditLogDir is the audit log directory within the Teleport data directory
+	auditLogDir = "log"
+	// auditLogExt is the audit log file extension
+	auditLogExt = ".log"
+	// auditLogTimeFormat is the format of the audit log file name, the time the file was created at
+	auditLogTimeFormat = "2006-01-02.15:04:05"
+	// recordingsDir is the session recordings directory within the audit log directory
+	recordingsDir = "records"
+	// recordingExt is the session recording file extension
+	recordingExt = ".tar"
+)
+
+// FileEventsSource reads the events from the file audit log and the session recordings of the Teleport data
+// directory. The read offset of every audit log file is saved to the state.
+type FileEventsSource struct {
+	// dir is the audit log directory
+	dir string
+	// state is the persistent state the file offsets are saved to
+	state *State
+	// offsets are the read offsets by audit log file name, relative to dir
+	offsets map[string]int64
+	// config is the start command config, replaced on reload
+	config atomic.Pointer[StartCmdConfig]
+	// startTime is event time frame start
+	startTime time.Time
+	// drain is closed once the source must stop reading new events
+	drain chan struct{}
+	// drainOnce closes drain
+	drainOnce sync.Once
+}
+
+// auditLogFile is the audit log file name along with the time it was created at
+type auditLogFile struct {
+	// name is the file name relative to the audit log directory
+	name string
+	// time is the time the file was created at
+	time time.Time
+}
+
+// NewFileEventsSource creates the source reading events from the Teleport data directory
+func NewFileEventsSource(c *StartCmdConfig, state *State, startTime time.Time) (*FileEventsSource, error) {
+	offsets, err := state.GetFileOffsets()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	s := &FileEventsSource{
+		dir:       filepath.Join(c.TeleportDataDir, auditLogDir),
+		state:     state,
+		offsets:   offsets,
+		startTime: startTime,
+		drain:     make(chan struct{}),
+	}
+	s.config.Store(c)
+
+	return s, nil
+}
+
+// SetConfig replaces the configuration, it is used starting from the next event
+func (s *FileEventsSource) SetConfig(c *StartCmdConfig) {
+	s.config.Store(c)
+}
+
+// Drain makes Events stop instead of reading the next event
+func (s *FileEventsSource) Drain() {
+	s.drainOnce.Do(func() {
+		close(s.drain)
+	})
+}
+
+// draining returns true if the source must stop reading new events
+func (s *FileEventsSource) draining() bool {
+	select {
+	case <-s.drain:
+		return true
+	default:
+		return false
+	}
+}
+
+// Events returns the events of the audit log files, starting from the saved offsets. The files are read in
+// the order they were created, and are checked for new events every timeout.
+func (s *FileEventsSource) Events(ctx context.Context) (chan *TeleportEvent, chan error) {
+	ch := make(chan *TeleportEvent)
+	e := make(chan error, 1)
+
+	go func() {
+		defer close(ch)
+		defer close(e)
+
+		log := logger.Get(ctx)
+
+		for {
+			n, err := s.readFiles(ctx, ch)
+			if err != nil {
+				e <- trace.Wrap(err)
+				return
+			}
+
+			if s.draining() {
+				log.Info("Stopped reading events")
+				return
+			}
+
+			if n > 0 {
+				continue
+			}
+
+			if s.config.Load().ExitOnLastEvent {
+				log.Info("All events are processed, exiting...")
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				e <- ctx.Err()
+				return
+			case <-s.drain:
+			case <-time.After(s.config.Load().Timeout):
+			}
+		}
+	}()
+
+	return ch, e
+}
+
+// readFiles sends the events appended to the audit log files since the last read, returns the number of
+// events sent
+func (s *FileEventsSource) readFiles(ctx context.Context, ch chan<- *TeleportEvent) (int, error) {
+	files, err := s.files(ctx)
+	if err != nil {
+		return 0, trace.Wrap(err)
+	}
+
+	var sent int
+	for _, f := range files {
+		n, err := s.readFile(ctx, ch, f.name)
+		sent += n
+		if err != nil {
+			return sent, trace.Wrap(err)
+		}
+	}
+
+	return sent, nil
+}
+
+// files returns the audit log files in the order they were created
+func (s *FileEventsSource) files(ctx context.Context) ([]auditLogFile, error) {
+	var files []auditLogFile
+
+	// The auth server writes to the log directory, or to its own subdirectory if the storage is shared
+	for _, pattern := range []string{"*" + auditLogExt, filepath.Join("*", "*"+auditLogExt)} {
+		paths, err := filepath.Glob(filepath.Join(s.dir, pattern))
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+
+		for _, path := range paths {
+			// The current file symlink duplicates the file it points to
+			fi, err := os.Lstat(path)
+			if err != nil {
+				return nil, trace.ConvertSystemError(err)
+			}
+			if !fi.Mode().IsRegular() {
+				continue
+			}
+
+			t, err := time.Parse(auditLogTimeFormat, strings.TrimSuffix(filepath.Base(path), auditLogExt))
+			if err != nil {
+				logger.Get(ctx).WithField("file", path).Debug("Skipping file which is not an audit log file")
+				continue
+			}
+
+			name, err := filepath.Rel(s.dir, path)
+			if err != nil {
+				return nil, trace.Wrap(err)
+			}
+
+			files = append(files, auditLogFile{name: filepath.ToSlash(name), time: t})
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].time.Equal(files[j].time) {
+			return files[i].name < files[j].name
+		}
+		return files[i].time.Before(files[j].time)
+	})
+
+	return files, nil
+}
+
+// readFile sends the events appended to the audit log file since the last read. A line which is not
+// terminated yet is read once it's complete.
+func (s *FileEventsSource) readFile(ctx context.Context, ch chan<- *TeleportEvent, name string) (int, error) {
+	f, err := os.Open(filepath.Join(s.dir, filepath.FromSlash(name)))
+	// The file could be removed by the audit log retention
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, trace.ConvertSystemError(err)
+	}
+	defer f.Close()
+
+	offset := s.offsets[name]
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, trace.ConvertSystemError(err)
+	}
+
+	var sent int
+	r := bufio.NewReader(f)
+	for !s.draining() {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return sent, nil
+		}
+		if err != nil {
+			return sent, trace.ConvertSystemError(err)
+		}
+
+		offset += int64(len(line))
+		s.offsets[name] = offset
+
+		evt, err := s.newEvent(line, name, offset)
+		if err != nil {
+			return sent, trace.Wrap(err, "reading %v at offset %v", name, offset-int64(len(line)))
+		}
+		if evt == nil {
+			continue
+		}
+
+		select {
+		case ch <- evt:
+			sent++
+		case <-ctx.Done():
+			return sent, ctx.Err()
+		}
+	}
+
+	return sent, nil
+}
+
+// newEvent converts the audit log line to the event, returns nil if the event must be skipped
+func (s *FileEventsSource) newEvent(line []byte, name string, offset int64) (*TeleportEvent, error) {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return nil, nil
+	}
+
+	data := &structpb.Struct{}
+	if err := data.UnmarshalJSON(line); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	fields := data.GetFields()
+	eventType := fields["event"].GetStringValue()
+
+	c := s.config.Load()
+	if len(c.Types) > 0 && !slices.Contains(c.Types, eventType) {
+		return nil, nil
+	}
+	if _, ok := c.SkipEventTypes[eventType]; ok {
+		return nil, nil
+	}
+
+	eventTime, err := time.Parse(time.RFC3339Nano, fields["time"].GetStringValue())
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if eventTime.Before(s.startTime) {
+		return nil, nil
+	}
+
+	e := &auditlogpb.EventUnstructured{
+		Type:         eventType,
+		Id:           fields["uid"].GetStringValue(),
+		Index:        int64(fields["ei"].GetNumberValue()),
+		Time:         timestamppb.New(eventTime),
+		Unstructured: data,
+	}
+
+	evt, err := NewTeleportEvent(e, fileCursor(name, offset))
+	return evt, trace.Wrap(err)
+}
+
+// StreamUnstructuredSessionEvents streams the events of the session recording starting from the index
+func (s *FileEventsSource) StreamUnstructuredSessionEvents(ctx context.Context, id string, index int64) (chan *auditlogpb.EventUnstructured, chan error) {
+	ch := make(chan *auditlogpb.EventUnstructured)
+	e := make(chan error, 1)
+
+	go func() {
+		f, err := os.Open(filepath.Join(s.dir, recordingsDir, id+recordingExt))
+		if err != nil {
+			e <- trace.ConvertSystemError(err)
+			return
+		}
+		defer f.Close()
+
+		r := newSessionRecordingReader(f)
+
+		for {
+			evt, err := r.Read()
+			if errors.Is(err, io.EOF) {
+				close(ch)
+				return
+			}
+			if err != nil {
+				e <- trace.Wrap(err)
+				return
+			}
+
+			if evt.GetIndex() < index {
+				continue
+			}
+
+			u, err := apievents.ToUnstructured(evt)
+			if err != nil {
+				e <- trace.Wrap(err)
+				return
+			}
+
+			select {
+			case ch <- u:
+			case <-ctx.Done():
+				e <- ctx.Err()
+				return
+			}
+		}
+	}()
+
+	return ch, e
+}
+
+// SavePosition saves the read offset of the audit log file the event was read from
+func (s *FileEventsSource) SavePosition(evt *TeleportEvent) error {
+	name, offset, err := parseFileCursor(evt.Cursor)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	return trace.Wrap(s.state.SetFileOffset(name, offset))
+}
+
+// fileCursor returns the cursor of the event read from the audit log file, the offset is the end of the event
+func fileCursor(name string, offset int64) string {
+	return name + ":" + strconv.FormatInt(offset, 10)
+}
+
+// parseFileCursor returns the audit log file name and the offset of the cursor
+func parseFileCursor(cursor string) (string, int64, error) {
+	i := strings.LastIndex(cursor, ":")
+	if i < 0 {
+		return "", 0, trace.BadParameter("invalid audit log file cursor %q", cursor)
+	}
+
+	offset, err := strconv.ParseInt(cursor[i+1:], 10, 64)
+	if err != nil {
+		return "", 0, trace.BadParameter("invalid audit log file cursor %q", cursor)
+	}
+
+	return cursor[:i], offset, nil
+}
@@ -0,0 +1,184 @@
+// Copyright 2024 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	apievents "github.com/gravitational/teleport/api/types/events"
+	"github.com/stretchr/testify/require"
+)
+
+// newFileEventsSourceConfig creates the config reading the events from the data directory
+func newFileEventsSourceConfig(t *testing.T, dataDir string) *StartCmdConfig {
+	return &StartCmdConfig{
+		TeleportConfig: TeleportConfig{TeleportDataDir: dataDir},
+		IngestConfig: IngestConfig{
+			StorageDir:      t.TempDir(),
+			ExitOnLastEvent: true,
+			SkipEventTypes:  map[string]struct{}{"cert.create": {}},
+		},
+	}
+}
+
+// readFileEvents reads all the events of the source
+func readFileEvents(t *testing.T, s *FileEventsSource) []*TeleportEvent {
+	chEvt, chErr := s.Events(context.Background())
+
+	var r []*TeleportEvent
+	for evt := range chEvt {
+		r = append(r, evt)
+	}
+	require.NoError(t, <-chErr)
+
+	return r
+}
+
+func TestFileEventsSource(t *testing.T) {
+	dataDir := t.TempDir()
+	dir := filepath.Join(dataDir, auditLogDir)
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "auth-1"), 0755))
+
+	first := filepath.Join(dir, "auth-1", "2024-01-01.00:00:00.log")
+	require.NoError(t, os.WriteFile(first, []byte(
+		`{"event":"user.login","uid":"1","time":"2024-01-01T00:00:01Z","user":"alice","success":true}`+"\n"+
+			`{"event":"cert.create","uid":"2","time":"2024-01-01T00:00:02Z"}`+"\n"+
+			`{"event":"session.start","uid":"3","time":"2024-01-01T00:00:03Z","ei":0,"sid":"s1"}`+"\n",
+	), 0644))
+	second := filepath.Join(dir, "auth-1", "2024-01-02.00:00:00.log")
+	require.NoError(t, os.WriteFile(second, []byte(
+		`{"event":"user.create","uid":"4","time":"2024-01-02T00:00:01Z"}`+"\n"+
+			`{"event":"user.delete","uid":"5",`,
+	), 0644))
+	// The current file symlink is not read twice
+	require.NoError(t, os.Symlink(second, filepath.Join(dir, "events.log")))
+
+	c := newFileEventsSourceConfig(t, dataDir)
+	state, err := NewState(c)
+	require.NoError(t, err)
+
+	s, err := NewFileEventsSource(c, state, time.Time{})
+	require.NoError(t, err)
+
+	// The skipped event and the incomplete line are not sent
+	events := readFileEvents(t, s)
+	require.Len(t, events, 3)
+	require.Equal(t, "1", events[0].ID)
+	require.Equal(t, loginType, events[0].Type)
+	require.Equal(t, "3", events[1].ID)
+	require.Equal(t, "4", events[2].ID)
+	require.Equal(t, time.Date(2024, 1, 2, 0, 0, 1, 0, time.UTC), events[2].Time)
+
+	// The position of the events sent is saved, the last one is not
+	require.NoError(t, s.SavePosition(events[0]))
+	require.NoError(t, s.SavePosition(events[1]))
+
+	f, err := os.OpenFile(second, os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteString(`"time":"2024-01-02T00:00:02Z"}` + "\n")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// The source is resumed from the saved offsets
+	s, err = NewFileEventsSource(c, state, time.Time{})
+	require.NoError(t, err)
+
+	events = readFileEvents(t, s)
+	require.Len(t, events, 2)
+	require.Equal(t, "4", events[0].ID)
+	require.Equal(t, "5", events[1].ID)
+
+	offsets, err := state.GetFileOffsets()
+	require.NoError(t, err)
+	require.Len(t, offsets, 1)
+	require.Contains(t, offsets, "auth-1/2024-01-01.00:00:00.log")
+}
+
+// writeSessionRecording writes the events as the session recording, every event is written to a separate part
+func writeSessionRecording(t *testing.T, path string, events ...apievents.AuditEvent) {
+	var b bytes.Buffer
+
+	for _, evt := range events {
+		oneof, err := apievents.ToOneOf(evt)
+		require.NoError(t, err)
+		msg, err := oneof.Marshal()
+		require.NoError(t, err)
+
+		var part bytes.Buffer
+		zw := gzip.NewWriter(&part)
+		require.NoError(t, binary.Write(zw, binary.BigEndian, uint32(len(msg))))
+		_, err = zw.Write(msg)
+		require.NoError(t, err)
+		require.NoError(t, zw.Close())
+
+		padding := 3
+		require.NoError(t, binary.Write(&b, binary.BigEndian, []uint64{recordingProtoVersion, uint64(part.Len()), uint64(padding)}))
+		b.Write(part.Bytes())
+		b.Write(make([]byte, padding))
+	}
+
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, os.WriteFile(path, b.Bytes(), 0644))
+}
+
+func TestFileEventsSourceSession(t *testing.T) {
+	dataDir := t.TempDir()
+	print := func(index int64) apievents.AuditEvent {
+		return &apievents.SessionPrint{
+			Metadata:   apievents.Metadata{Type: printType, Index: index},
+			Data:       []byte("ls"),
+			Offset:     index,
+			ChunkIndex: index,
+		}
+	}
+	writeSessionRecording(t, filepath.Join(dataDir, auditLogDir, recordingsDir, "s1"+recordingExt),
+		print(0), print(1), print(1), print(2))
+
+	c := newFileEventsSourceConfig(t, dataDir)
+	state, err := NewState(c)
+	require.NoError(t, err)
+	s, err := NewFileEventsSource(c, state, time.Time{})
+	require.NoError(t, err)
+
+	chEvt, chErr := s.StreamUnstructuredSessionEvents(context.Background(), "s1", 1)
+
+	var indexes []int64
+	for {
+		select {
+		case err := <-chErr:
+			require.NoError(t, err)
+		case evt, ok := <-chEvt:
+			if !ok {
+				// The duplicated event is skipped
+				require.Equal(t, []int64{1, 2}, indexes)
+
+				_, chErr = s.StreamUnstructuredSessionEvents(context.Background(), "unknown", 0)
+				require.Error(t, <-chErr)
+				return
+			}
+			require.Equal(t, printType, evt.Type)
+			indexes = append(indexes, evt.Index)
+		case <-time.After(time.Second):
+			t.Fatal("No events received within deadline")
+		}
+	}
+}
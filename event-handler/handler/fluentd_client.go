@@ -0,0 +1,391 @@
+/*
+Copyright 2015-2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	tlib "github.com/gravitational/teleport/integrations/lib"
+	"github.com/gravitational/trace"
+	"github.com/jonboulle/clockwork"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// httpTimeout is the maximum HTTP timeout
+	httpTimeout = 30 * time.Second
+	// certReloadInterval is how often the certificate files are checked for changes
+	certReloadInterval = 10 * time.Second
+)
+
+// FluentdClient represents Fluentd client
+type FluentdClient struct {
+	// client HTTP client to send requests
+	client *http.Client
+	// transport is the client transport, idle connections are closed once certificates change
+	transport *fluentdTransport
+	// certs are the client key pair and CA pool
+	certs *fluentdCerts
+	// headers are extra headers sent with every request
+	headers http.Header
+	// bearerToken is the bearer token sent in Authorization header
+	bearerToken string
+	// basicAuthUser and basicAuthPassword are the basic auth credentials
+	basicAuthUser, basicAuthPassword string
+	// timeout is the timeout of a single request, 0 means no timeout
+	timeout time.Duration
+	// compressor compresses request bodies
+	compressor *payloadCompressor
+}
+
+// NewFluentdClient creates new FluentdClient
+func NewFluentdClient(c *FluentdConfig) (*FluentdClient, error) {
+	if (c.FluentdCert != "") != (c.FluentdKey != "") {
+		return nil, trace.BadParameter("both fluentd_cert and fluentd_key should be specified")
+	}
+
+	if err := c.Check(); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	headers, err := c.Headers()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	certs, err := newFluentdCerts(c, clockwork.NewRealClock())
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if c.FluentdProxy != "" {
+		u, err := url.Parse(c.FluentdProxy)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		proxy = http.ProxyURL(u)
+	}
+
+	tlsConfig := &tls.Config{}
+	if c.FluentdCert != "" {
+		tlsConfig.GetClientCertificate = certs.getClientCertificate
+	}
+
+	transport := &fluentdTransport{
+		proxy:      proxy,
+		tlsConfig:  tlsConfig,
+		certs:      certs,
+		verify:     c.FluentdCA != "",
+		transports: make(map[string]*http.Transport),
+	}
+
+	return &FluentdClient{
+		client:            &http.Client{Transport: transport},
+		transport:         transport,
+		certs:             certs,
+		headers:           headers,
+		bearerToken:       c.FluentdBearerToken,
+		basicAuthUser:     c.FluentdBasicAuthUser,
+		basicAuthPassword: c.FluentdBasicAuthPassword,
+		timeout:           c.FluentdTimeout,
+		compressor:        newPayloadCompressor(c.FluentdCompression, c.FluentdCompressionThreshold),
+	}, nil
+}
+
+// fluentdCerts holds Fluentd client key pair and CA pool. They are reloaded from disk once the files change,
+// so the rotated certificates are picked up by the next TLS handshake.
+type fluentdCerts struct {
+	// certPath, keyPath and caPath are the paths of the certificate files
+	certPath, keyPath, caPath string
+	// clock is used to throttle the checks
+	clock clockwork.Clock
+
+	// mu protects the fields below
+	mu sync.RWMutex
+	// cert is the client key pair
+	cert *tls.Certificate
+	// pool is the CA pool
+	pool *x509.CertPool
+	// contents is the contents of the files the key pair and the pool were loaded from
+	contents [][]byte
+	// checkedAt is the time the files were checked last time
+	checkedAt time.Time
+}
+
+// newFluentdCerts loads Fluentd certificates
+func newFluentdCerts(c *FluentdConfig, clock clockwork.Clock) (*fluentdCerts, error) {
+	f := &fluentdCerts{
+		certPath: c.FluentdCert,
+		keyPath:  c.FluentdKey,
+		caPath:   c.FluentdCA,
+		clock:    clock,
+	}
+
+	if _, err := f.reload(); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	return f, nil
+}
+
+// maybeReload reloads the certificates if the check interval has passed and the files have changed. Returns
+// true if the certificates were reloaded. Incomplete or invalid files are reported and the current certificates
+// are kept until the next check.
+func (f *fluentdCerts) maybeReload() bool {
+	f.mu.Lock()
+	due := f.clock.Since(f.checkedAt) >= certReloadInterval
+	if due {
+		f.checkedAt = f.clock.Now()
+	}
+	f.mu.Unlock()
+
+	if !due {
+		return false
+	}
+
+	reloaded, err := f.reload()
+	if err != nil {
+		log.WithError(err).Warn("Failed to reload Fluentd certificates, the current certificates are kept")
+		return false
+	}
+
+	if reloaded {
+		log.Info("Reloaded Fluentd certificates")
+	}
+
+	return reloaded
+}
+
+// reload reads the certificate files and replaces the key pair and the pool if the files have changed
+func (f *fluentdCerts) reload() (bool, error) {
+	contents := make([][]byte, 3)
+	for i, path := range []string{f.certPath, f.keyPath, f.caPath} {
+		if path == "" {
+			continue
+		}
+
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return false, trace.ConvertSystemError(err)
+		}
+		contents[i] = b
+	}
+
+	f.mu.RLock()
+	changed := false
+	for i := range contents {
+		if f.contents == nil || !bytes.Equal(contents[i], f.contents[i]) {
+			changed = true
+		}
+	}
+	f.mu.RUnlock()
+
+	if !changed {
+		return false, nil
+	}
+
+	var cert *tls.Certificate
+	if f.certPath != "" {
+		c, err := tls.X509KeyPair(contents[0], contents[1])
+		if err != nil {
+			return false, trace.Wrap(err)
+		}
+		cert = &c
+	}
+
+	var pool *x509.CertPool
+	if f.caPath != "" {
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(contents[2]) {
+			return false, trace.BadParameter("no certificates found in %v", f.caPath)
+		}
+	}
+
+	f.mu.Lock()
+	f.cert, f.pool, f.contents = cert, pool, contents
+	f.checkedAt = f.clock.Now()
+	f.mu.Unlock()
+
+	return true, nil
+}
+
+// getClientCertificate returns the current client key pair
+func (f *fluentdCerts) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.cert, nil
+}
+
+// verifyConnection verifies the server certificate chain against the current CA pool, and the certificate
+// against the host of the Fluentd URL. The host is passed explicitly since the server name of the connection
+// state is empty if the host is an IP address.
+func (f *fluentdCerts) verifyConnection(cs tls.ConnectionState, host string) error {
+	if len(cs.PeerCertificates) == 0 {
+		return trace.AccessDenied("Fluentd did not present a certificate")
+	}
+
+	f.mu.RLock()
+	pool := f.pool
+	f.mu.RUnlock()
+
+	opts := x509.VerifyOptions{
+		DNSName:       host,
+		Roots:         pool,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return trace.Wrap(err)
+}
+
+// fluentdTransport routes the requests to the transport of the Fluentd host. The transports are kept per host,
+// so the server certificate is verified against the host the connection is made to.
+type fluentdTransport struct {
+	// proxy returns the proxy URL of the request
+	proxy func(*http.Request) (*url.URL, error)
+	// tlsConfig is the TLS configuration shared by the transports
+	tlsConfig *tls.Config
+	// certs are the client key pair and CA pool
+	certs *fluentdCerts
+	// verify is true if the server certificate is verified against the CA pool of certs
+	verify bool
+
+	// mu protects transports
+	mu sync.Mutex
+	// transports are the transports by the host and port
+	transports map[string]*http.Transport
+}
+
+// RoundTrip sends the request with the transport of the request host
+func (t *fluentdTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.get(req.URL).RoundTrip(req)
+}
+
+// get returns the transport of the URL host, creating it if needed
+func (t *fluentdTransport) get(u *url.URL) *http.Transport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if transport, ok := t.transports[u.Host]; ok {
+		return transport
+	}
+
+	tlsConfig := t.tlsConfig.Clone()
+	if t.verify {
+		// The chain is verified against the current CA pool in VerifyConnection
+		host := u.Hostname()
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			return t.certs.verifyConnection(cs, host)
+		}
+	}
+
+	transport := &http.Transport{
+		Proxy:           t.proxy,
+		TLSClientConfig: tlsConfig,
+	}
+	t.transports[u.Host] = transport
+
+	return transport
+}
+
+// CloseIdleConnections closes the idle connections of all the transports
+func (t *fluentdTransport) CloseIdleConnections() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, transport := range t.transports {
+		transport.CloseIdleConnections()
+	}
+}
+
+// Send sends event to fluentd
+func (f *FluentdClient) Send(ctx context.Context, url string, b []byte) error {
+	log.WithField("json", string(b)).Debug("JSON to send")
+
+	// Connections established with the previous certificates are not reused
+	if f.certs.maybeReload() {
+		f.transport.CloseIdleConnections()
+	}
+
+	reqCtx := ctx
+	if f.timeout > 0 {
+		var cancel context.CancelFunc
+		reqCtx, cancel = context.WithTimeout(ctx, f.timeout)
+		defer cancel()
+	}
+
+	body, encoding, err := f.compressor.Compress(b)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	req, err := http.NewRequestWithContext(reqCtx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	for name, values := range f.headers {
+		req.Header[name] = values
+	}
+	if req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	switch {
+	case f.bearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+f.bearerToken)
+	case f.basicAuthUser != "":
+		req.SetBasicAuth(f.basicAuthUser, f.basicAuthPassword)
+	}
+
+	r, err := f.client.Do(req)
+	if err != nil {
+		// err returned by client.Do() would never have status canceled
+		if tlib.IsCanceled(ctx.Err()) {
+			return trace.Wrap(ctx.Err())
+		}
+
+		return trace.Wrap(err)
+	}
+	defer r.Body.Close()
+
+	// The receiver does not support the codec, the event is resent with the fallback one
+	if r.StatusCode == http.StatusUnsupportedMediaType && encoding != "" && f.compressor.Reject(encoding) {
+		return f.Send(ctx, url, b)
+	}
+
+	if r.StatusCode != http.StatusOK {
+		return trace.Errorf("Failed to send event to fluentd (HTTP %v)", r.StatusCode)
+	}
+
+	return nil
+}
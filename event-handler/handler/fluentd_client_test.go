@@ -0,0 +1,266 @@
+// Copyright 2024 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFluentdCertsReload(t *testing.T) {
+	td := t.TempDir()
+	c := &FluentdConfig{
+		FluentdCA:   path.Join(td, "ca.crt"),
+		FluentdCert: path.Join(td, "client.crt"),
+		FluentdKey:  path.Join(td, "client.key"),
+	}
+
+	certs, err := GenerateMTLSCerts([]string{"localhost"}, []string{"127.0.0.1"}, time.Hour, keyTypeECDSA, 0)
+	require.NoError(t, err)
+	require.NoError(t, certs.CACert.WriteFile(c.FluentdCA, path.Join(td, "ca.key"), ""))
+	require.NoError(t, certs.ClientCert.WriteFile(c.FluentdCert, c.FluentdKey, ""))
+
+	clock := clockwork.NewFakeClock()
+	f, err := newFluentdCerts(c, clock)
+	require.NoError(t, err)
+
+	cert, err := f.getClientCertificate(nil)
+	require.NoError(t, err)
+	require.Equal(t, certs.ClientCert.Certificate, cert.Certificate[0])
+
+	rotated, err := RotateMTLSCerts(certs.CACert, []string{"localhost"}, []string{"127.0.0.1"}, time.Hour, keyTypeEd25519, 0)
+	require.NoError(t, err)
+	require.NoError(t, rotated.ClientCert.WriteFile(c.FluentdCert, c.FluentdKey, ""))
+
+	// Files are not checked more often than the interval
+	require.False(t, f.maybeReload())
+
+	clock.Advance(certReloadInterval)
+	require.True(t, f.maybeReload())
+	cert, err = f.getClientCertificate(nil)
+	require.NoError(t, err)
+	require.Equal(t, rotated.ClientCert.Certificate, cert.Certificate[0])
+
+	// The key pair is kept if the files are written partially
+	certPEM, _, err := certs.ClientCert.EncodeToMemory("")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(c.FluentdCert, certPEM, perms))
+
+	clock.Advance(certReloadInterval)
+	require.False(t, f.maybeReload())
+	cert, err = f.getClientCertificate(nil)
+	require.NoError(t, err)
+	require.Equal(t, rotated.ClientCert.Certificate, cert.Certificate[0])
+}
+
+func TestFluentdClientCAReload(t *testing.T) {
+	fd, err := NewFakeFluentd()
+	require.NoError(t, err)
+	fd.Start()
+	t.Cleanup(fd.Close)
+
+	c := fd.GetClientConfig()
+	client, err := NewFluentdClient(&c)
+	require.NoError(t, err)
+	clock := clockwork.NewFakeClock()
+	client.certs.clock = clock
+
+	ctx := context.Background()
+	require.NoError(t, client.Send(ctx, fd.GetURL(), []byte(`{"n":1}`)))
+	msg, err := fd.GetMessage(ctx)
+	require.NoError(t, err)
+	require.Contains(t, msg, `"n":1`)
+
+	caPEM, err := os.ReadFile(c.FluentdCA)
+	require.NoError(t, err)
+
+	// Fluentd server certificate is not trusted once CA bundle is replaced
+	other, err := GenerateMTLSCerts([]string{"localhost"}, []string{"127.0.0.1"}, time.Hour, keyTypeECDSA, 0)
+	require.NoError(t, err)
+	require.NoError(t, other.CACert.WriteFile(c.FluentdCA, path.Join(t.TempDir(), "ca.key"), ""))
+
+	clock.Advance(certReloadInterval)
+	require.Error(t, client.Send(ctx, fd.GetURL(), []byte(`{"n":2}`)))
+
+	require.NoError(t, os.WriteFile(c.FluentdCA, caPEM, perms))
+
+	clock.Advance(certReloadInterval)
+	require.NoError(t, client.Send(ctx, fd.GetURL(), []byte(`{"n":3}`)))
+	msg, err = fd.GetMessage(ctx)
+	require.NoError(t, err)
+	require.Contains(t, msg, `"n":3`)
+}
+
+// TestFluentdClientVerifyHost tests that the Fluentd certificate is verified against the IP address of the URL
+func TestFluentdClientVerifyHost(t *testing.T) {
+	td := t.TempDir()
+	c := &FluentdConfig{FluentdCA: path.Join(td, "ca.crt")}
+	certPath, keyPath := path.Join(td, "server.crt"), path.Join(td, "server.key")
+
+	// The server certificate is not issued for 127.0.0.1
+	certs, err := GenerateMTLSCerts([]string{"localhost"}, []string{"10.0.0.5"}, time.Hour, keyTypeECDSA, 0)
+	require.NoError(t, err)
+	require.NoError(t, certs.CACert.WriteFile(c.FluentdCA, path.Join(td, "ca.key"), ""))
+	require.NoError(t, certs.ServerCert.WriteFile(certPath, keyPath, ""))
+
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	require.NoError(t, err)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	client, err := NewFluentdClient(c)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	require.Error(t, client.Send(ctx, server.URL, []byte(`{}`)))
+	require.NoError(t, client.Send(ctx, "https://localhost:"+u.Port(), []byte(`{}`)))
+}
+
+func TestFluentdClientRequest(t *testing.T) {
+	t.Setenv("TEST_FLUENTD_TENANT", "tenant-1")
+
+	requests := make(chan *http.Request, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+	}))
+	t.Cleanup(target.Close)
+
+	// Plain HTTP requests through the proxy carry the absolute target URL
+	proxied := make(chan string, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied <- r.URL.String()
+		requests <- r
+	}))
+	t.Cleanup(proxy.Close)
+
+	ctx := context.Background()
+
+	client, err := NewFluentdClient(&FluentdConfig{
+		FluentdHeaders:     []string{"X-Scope=audit", "Content-Type=application/x-ndjson"},
+		FluentdEnvHeaders:  []string{"X-Tenant=TEST_FLUENTD_TENANT"},
+		FluentdBearerToken: "token",
+	})
+	require.NoError(t, err)
+	require.NoError(t, client.Send(ctx, target.URL, []byte(`{}`)))
+
+	r := <-requests
+	require.Equal(t, "audit", r.Header.Get("X-Scope"))
+	require.Equal(t, "tenant-1", r.Header.Get("X-Tenant"))
+	require.Equal(t, "application/x-ndjson", r.Header.Get("Content-Type"))
+	require.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+
+	client, err = NewFluentdClient(&FluentdConfig{
+		FluentdProxy:             proxy.URL,
+		FluentdBasicAuthUser:     "user",
+		FluentdBasicAuthPassword: "password",
+	})
+	require.NoError(t, err)
+	require.NoError(t, client.Send(ctx, target.URL+"/test.log", []byte(`{}`)))
+
+	require.Equal(t, target.URL+"/test.log", <-proxied)
+	r = <-requests
+	require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+	user, password, ok := r.BasicAuth()
+	require.True(t, ok)
+	require.Equal(t, "user", user)
+	require.Equal(t, "password", password)
+
+	// Requests which take longer than the timeout fail
+	done := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	t.Cleanup(slow.Close)
+	t.Cleanup(func() { close(done) })
+
+	client, err = NewFluentdClient(&FluentdConfig{FluentdTimeout: 50 * time.Millisecond})
+	require.NoError(t, err)
+	require.Error(t, client.Send(ctx, slow.URL, []byte(`{}`)))
+}
+
+func TestFluentdConfigCheck(t *testing.T) {
+	for _, c := range []FluentdConfig{
+		{FluentdHeaders: []string{"X-Scope"}},
+		{FluentdEnvHeaders: []string{"X-Tenant=TEST_FLUENTD_MISSING_VARIABLE"}},
+		{FluentdBearerToken: "token", FluentdBasicAuthUser: "user"},
+		{FluentdBasicAuthPassword: "password"},
+		{FluentdProxy: "proxy:3128"},
+		{FluentdTimeout: -time.Second},
+	} {
+		require.Error(t, c.Check(), "%+v", c)
+	}
+}
+
+func TestFluentdClientCompression(t *testing.T) {
+	fd, err := NewFakeFluentd()
+	require.NoError(t, err)
+	fd.Start()
+	t.Cleanup(fd.Close)
+
+	ctx := context.Background()
+	large := []byte(`{"data":"` + strings.Repeat("a", 2048) + `"}`)
+
+	send := func(t *testing.T, client *FluentdClient, b []byte) {
+		require.NoError(t, client.Send(ctx, fd.GetURL(), b))
+		msg, err := fd.GetMessage(ctx)
+		require.NoError(t, err)
+		require.Equal(t, string(b), msg)
+	}
+
+	for _, codec := range []string{compressionGzip, compressionZstd} {
+		c := fd.GetClientConfig()
+		c.FluentdCompression = codec
+		c.FluentdCompressionThreshold = 1024
+		client, err := NewFluentdClient(&c)
+		require.NoError(t, err)
+
+		// Events smaller than the threshold are sent as is
+		send(t, client, []byte(`{"n":1}`))
+		send(t, client, large)
+	}
+	require.Equal(t, []string{"", compressionGzip, "", compressionZstd}, fd.GetEncodings())
+
+	// Client falls back to the codec supported by the receiver
+	fd.SetEncodings(compressionGzip)
+	c := fd.GetClientConfig()
+	c.FluentdCompression = compressionZstd
+	client, err := NewFluentdClient(&c)
+	require.NoError(t, err)
+
+	send(t, client, large)
+	send(t, client, large)
+	require.Equal(t, []string{compressionGzip, compressionGzip}, fd.GetEncodings()[4:])
+
+	fd.SetEncodings()
+	send(t, client, large)
+	require.Equal(t, []string{""}, fd.GetEncodings()[6:])
+}
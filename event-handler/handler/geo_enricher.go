@@ -0,0 +1,310 @@
+// Copyright 2024 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gravitational/teleport/integrations/lib/logger"
+	"github.com/gravitational/trace"
+	"github.com/jonboulle/clockwork"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+const (
+	// geoField is the name of the field the enrichment is added to the event in
+	geoField = "geo"
+	// geoReloadInterval is how often the database files are checked for changes
+	geoReloadInterval = 10 * time.Second
+)
+
+// nonGlobalNetworks are the special-purpose networks which addresses are not globally reachable, see the IANA IPv4
+// and IPv6 Special-Purpose Address Registries. The addresses of these networks are never looked up.
+var nonGlobalNetworks = mustParseCIDRs(
+	"0.0.0.0/8",       // this network
+	"10.0.0.0/8",      // private use
+	"100.64.0.0/10",   // shared address space (CGNAT)
+	"127.0.0.0/8",     // loopback
+	"169.254.0.0/16",  // link local
+	"172.16.0.0/12",   // private use
+	"192.0.0.0/24",    // IETF protocol assignments
+	"192.0.2.0/24",    // documentation (TEST-NET-1)
+	"192.88.99.0/24",  // deprecated 6to4 relay anycast
+	"192.168.0.0/16",  // private use
+	"198.18.0.0/15",   // benchmarking
+	"198.51.100.0/24", // documentation (TEST-NET-2)
+	"203.0.113.0/24",  // documentation (TEST-NET-3)
+	"224.0.0.0/4",     // multicast
+	"240.0.0.0/4",     // reserved and limited broadcast
+	"::/128",          // unspecified
+	"::1/128",         // loopback
+	"64:ff9b:1::/48",  // local-use IPv4/IPv6 translation
+	"100::/64",        // discard-only
+	"2001::/23",       // IETF protocol assignments
+	"2001:db8::/32",   // documentation
+	"2002::/16",       // 6to4
+	"3fff::/20",       // documentation
+	"5f00::/16",       // segment routing SIDs
+	"fc00::/7",        // unique local
+	"fe80::/10",       // link local
+	"ff00::/8",        // multicast
+)
+
+// GeoEnricher adds the country, city and ASN of the remote address to the events. The addresses are looked up in
+// the local MaxMind DB (mmdb) files, which are reloaded once they change on disk.
+type GeoEnricher struct {
+	// city is the City or Country database
+	city *geoDatabase
+	// asn is the ASN database
+	asn *geoDatabase
+}
+
+// geoDatabase is the MaxMind DB file reloaded once it changes
+type geoDatabase struct {
+	// path is the database file path
+	path string
+	// clock is used to throttle the checks
+	clock clockwork.Clock
+
+	// mu protects the fields below
+	mu sync.RWMutex
+	// reader is the loaded database
+	reader *maxminddb.Reader
+	// modTime and size identify the loaded file version
+	modTime time.Time
+	size    int64
+	// checkedAt is the time the file was checked last time
+	checkedAt time.Time
+}
+
+// NewGeoEnricher creates new GeoEnricher, the databases which paths are empty are not used
+func NewGeoEnricher(c *GeoConfig, clock clockwork.Clock) (*GeoEnricher, error) {
+	g := &GeoEnricher{}
+
+	for _, db := range []struct {
+		path string
+		dst  **geoDatabase
+	}{
+		{c.GeoIPDB, &g.city},
+		{c.ASNDB, &g.asn},
+	} {
+		if db.path == "" {
+			continue
+		}
+
+		d := &geoDatabase{path: db.path, clock: clock, checkedAt: clock.Now()}
+		if _, err := d.reload(); err != nil {
+			return nil, trace.Wrap(err, "failed to load %v", db.path)
+		}
+		*db.dst = d
+	}
+
+	return g, nil
+}
+
+// Enrich adds the geo object to the event if it has the public remote address found in the databases. Lookup
+// failures are logged and the event is left as is.
+func (g *GeoEnricher) Enrich(ctx context.Context, e *TeleportEvent) error {
+	var fields struct {
+		Remote string `json:"addr.remote"`
+	}
+	if err := json.Unmarshal(e.Event, &fields); err != nil {
+		return trace.Wrap(err)
+	}
+
+	ip := parseRemoteIP(fields.Remote)
+	if ip == nil || !isGlobalIP(ip) {
+		return nil
+	}
+
+	geo := make(map[string]interface{})
+	if r := g.city.get(ctx); r != nil {
+		if err := lookupCity(r, ip, geo); err != nil {
+			logger.Get(ctx).WithError(err).WithField("db", g.city.path).Warn("Failed to look up remote address")
+		}
+	}
+	if r := g.asn.get(ctx); r != nil {
+		if err := lookupASN(r, ip, geo); err != nil {
+			logger.Get(ctx).WithError(err).WithField("db", g.asn.path).Warn("Failed to look up remote address")
+		}
+	}
+	if len(geo) == 0 {
+		return nil
+	}
+
+	event, err := addPayloadField(e.Event, geoField, geo)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	e.Event = event
+
+	return nil
+}
+
+// parseRemoteIP returns the IP of the host:port or host address, nil if it is not an IP address
+func parseRemoteIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	return net.ParseIP(host)
+}
+
+// isGlobalIP returns true if the IP address is globally reachable
+func isGlobalIP(ip net.IP) bool {
+	for _, n := range nonGlobalNetworks {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// mustParseCIDRs parses the list of networks in CIDR notation, panics if a network is invalid
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, n)
+	}
+
+	return networks
+}
+
+// geoCityRecord is the part of the City or Country database record added to the events
+type geoCityRecord struct {
+	Country struct {
+		ISOCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"country"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+}
+
+// geoASNRecord is the ASN database record
+type geoASNRecord struct {
+	Number       uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+// lookupCity adds the country and the city of the IP address to geo
+func lookupCity(r *maxminddb.Reader, ip net.IP, geo map[string]interface{}) error {
+	var record geoCityRecord
+	if err := r.Lookup(ip, &record); err != nil {
+		return trace.Wrap(err)
+	}
+
+	if v := record.Country.ISOCode; v != "" {
+		geo["country"] = v
+	}
+	if v := record.Country.Names["en"]; v != "" {
+		geo["country_name"] = v
+	}
+	if v := record.City.Names["en"]; v != "" {
+		geo["city"] = v
+	}
+
+	return nil
+}
+
+// lookupASN adds the autonomous system of the IP address to geo
+func lookupASN(r *maxminddb.Reader, ip net.IP, geo map[string]interface{}) error {
+	var record geoASNRecord
+	if err := r.Lookup(ip, &record); err != nil {
+		return trace.Wrap(err)
+	}
+
+	if record.Number != 0 {
+		geo["asn"] = record.Number
+	}
+	if record.Organization != "" {
+		geo["as_org"] = record.Organization
+	}
+
+	return nil
+}
+
+// get returns the current database, reloading it if the check interval has passed and the file has changed. A
+// file which can not be loaded is reported and the current database is kept until the next check.
+func (d *geoDatabase) get(ctx context.Context) *maxminddb.Reader {
+	if d == nil {
+		return nil
+	}
+
+	d.mu.Lock()
+	due := d.clock.Since(d.checkedAt) >= geoReloadInterval
+	if due {
+		d.checkedAt = d.clock.Now()
+	}
+	d.mu.Unlock()
+
+	if due {
+		reloaded, err := d.reload()
+		if err != nil {
+			logger.Get(ctx).WithError(err).WithField("db", d.path).Warn("Failed to reload GeoIP database, the current database is kept")
+		}
+		if reloaded {
+			logger.Get(ctx).WithField("db", d.path).Info("Reloaded GeoIP database")
+		}
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.reader
+}
+
+// reload reads the database file if it has changed since the last load
+func (d *geoDatabase) reload() (bool, error) {
+	info, err := os.Stat(d.path)
+	if err != nil {
+		return false, trace.ConvertSystemError(err)
+	}
+
+	d.mu.RLock()
+	changed := d.reader == nil || !info.ModTime().Equal(d.modTime) || info.Size() != d.size
+	d.mu.RUnlock()
+
+	if !changed {
+		return false, nil
+	}
+
+	b, err := os.ReadFile(d.path)
+	if err != nil {
+		return false, trace.ConvertSystemError(err)
+	}
+
+	r, err := maxminddb.FromBytes(b)
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+
+	d.mu.Lock()
+	d.reader, d.modTime, d.size = r, info.ModTime(), info.Size()
+	d.mu.Unlock()
+
+	return true, nil
+}
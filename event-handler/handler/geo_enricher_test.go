@@ -0,0 +1,326 @@
+// Copyright 2024 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	// mmdbMetadataMarker starts the metadata section at the end of the MaxMind DB file
+	mmdbMetadataMarker = "\xab\xcd\xefMaxMind.com"
+	// mmdbDataSeparatorSize is the size of the zero separator between the search tree and the data section
+	mmdbDataSeparatorSize = 16
+)
+
+// MaxMind DB data section field types, see https://maxmind.github.io/MaxMind-DB/
+const (
+	mmdbTypeExtended = iota
+	mmdbTypePointer
+	mmdbTypeString
+	mmdbTypeDouble
+	mmdbTypeBytes
+	mmdbTypeUint16
+	mmdbTypeUint32
+	mmdbTypeMap
+	mmdbTypeInt32
+	mmdbTypeUint64
+	mmdbTypeUint128
+	mmdbTypeArray
+	mmdbTypeContainer
+	mmdbTypeEndMarker
+	mmdbTypeBool
+	mmdbTypeFloat
+)
+
+// mmdbWriter writes the MaxMind DB files for tests
+type mmdbWriter struct {
+	// ipVersion is the database IP version
+	ipVersion int
+	// recordSize is the search tree record size
+	recordSize int
+	// nodes are the search tree nodes, the records are node indexes, -1 for empty records and -2-i for data i
+	nodes [][2]int
+	// data are the values of the networks
+	data []interface{}
+	// strings are the offsets of the strings written, the repeated strings are written as pointers
+	strings map[string]int
+}
+
+// newMMDBWriter creates the writer of the database with the given IP version and record size
+func newMMDBWriter(ipVersion, recordSize int) *mmdbWriter {
+	return &mmdbWriter{ipVersion: ipVersion, recordSize: recordSize, nodes: [][2]int{{-1, -1}}}
+}
+
+// insert adds the network with the value to the search tree
+func (w *mmdbWriter) insert(t *testing.T, cidr string, value interface{}) {
+	_, network, err := net.ParseCIDR(cidr)
+	require.NoError(t, err)
+
+	ip := network.IP
+	ones, _ := network.Mask.Size()
+	if w.ipVersion == 6 && len(ip) == net.IPv4len {
+		ip = append(make(net.IP, 12), ip...)
+		ones += 96
+	}
+
+	w.data = append(w.data, value)
+	node := 0
+	for i := 0; i < ones; i++ {
+		bit := int(ip[i/8]>>(7-i%8)) & 1
+		if i == ones-1 {
+			w.nodes[node][bit] = -2 - (len(w.data) - 1)
+			break
+		}
+		if w.nodes[node][bit] < 0 {
+			w.nodes = append(w.nodes, [2]int{-1, -1})
+			w.nodes[node][bit] = len(w.nodes) - 1
+		}
+		node = w.nodes[node][bit]
+	}
+}
+
+// control appends the control bytes of the value of the given type and size
+func (w *mmdbWriter) control(b []byte, typ int, size int) []byte {
+	var ext []byte
+	ctrl := byte(typ << 5)
+	if typ > 7 {
+		ctrl = 0
+		ext = []byte{byte(typ - 7)}
+	}
+
+	switch {
+	case size < 29:
+		b = append(b, ctrl|byte(size))
+		return append(b, ext...)
+	case size < 285:
+		b = append(b, ctrl|29)
+		b = append(b, ext...)
+		return append(b, byte(size-29))
+	default:
+		b = append(b, ctrl|30)
+		b = append(b, ext...)
+		return binary.BigEndian.AppendUint16(b, uint16(size-285))
+	}
+}
+
+// encode appends the encoded value to b
+func (w *mmdbWriter) encode(b []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case string:
+		if offset, ok := w.strings[v]; ok && w.strings != nil {
+			return append(b, byte(mmdbTypePointer<<5)|byte(offset>>8), byte(offset))
+		}
+		if w.strings != nil && len(b) < 2048 {
+			w.strings[v] = len(b)
+		}
+		b = w.control(b, mmdbTypeString, len(v))
+		return append(b, v...)
+	case float64:
+		b = w.control(b, mmdbTypeDouble, 8)
+		return binary.BigEndian.AppendUint64(b, math.Float64bits(v))
+	case uint32:
+		b = w.control(b, mmdbTypeUint32, 4)
+		return binary.BigEndian.AppendUint32(b, v)
+	case uint16:
+		b = w.control(b, mmdbTypeUint16, 2)
+		return binary.BigEndian.AppendUint16(b, v)
+	case bool:
+		if v {
+			return w.control(b, mmdbTypeBool, 1)
+		}
+		return w.control(b, mmdbTypeBool, 0)
+	case []interface{}:
+		b = w.control(b, mmdbTypeArray, len(v))
+		for _, e := range v {
+			b = w.encode(b, e)
+		}
+		return b
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		b = w.control(b, mmdbTypeMap, len(v))
+		for _, k := range keys {
+			b = w.encode(b, k)
+			b = w.encode(b, v[k])
+		}
+		return b
+	default:
+		panic("unsupported value")
+	}
+}
+
+// bytes returns the database file contents
+func (w *mmdbWriter) bytes() []byte {
+	w.strings = make(map[string]int)
+
+	var data []byte
+	offsets := make([]int, len(w.data))
+	for i, v := range w.data {
+		offsets[i] = len(data)
+		data = w.encode(data, v)
+	}
+
+	nodeCount := len(w.nodes)
+	record := func(r int) uint32 {
+		switch {
+		case r == -1:
+			return uint32(nodeCount)
+		case r < -1:
+			return uint32(nodeCount + mmdbDataSeparatorSize + offsets[-2-r])
+		default:
+			return uint32(r)
+		}
+	}
+
+	var b []byte
+	for _, n := range w.nodes {
+		l, r := record(n[0]), record(n[1])
+		switch w.recordSize {
+		case 24:
+			b = append(b, byte(l>>16), byte(l>>8), byte(l), byte(r>>16), byte(r>>8), byte(r))
+		case 28:
+			b = append(b, byte(l>>16), byte(l>>8), byte(l), byte(l>>24)<<4|byte(r>>24)&0x0f, byte(r>>16), byte(r>>8), byte(r))
+		default:
+			b = binary.BigEndian.AppendUint32(b, l)
+			b = binary.BigEndian.AppendUint32(b, r)
+		}
+	}
+	b = append(b, make([]byte, mmdbDataSeparatorSize)...)
+	b = append(b, data...)
+
+	w.strings = nil
+	b = append(b, mmdbMetadataMarker...)
+	return w.encode(b, map[string]interface{}{
+		"node_count":                  uint32(nodeCount),
+		"record_size":                 uint16(w.recordSize),
+		"ip_version":                  uint16(w.ipVersion),
+		"database_type":               "Test",
+		"binary_format_major_version": uint16(2),
+		"languages":                   []interface{}{"en"},
+	})
+}
+
+// writeTestGeoDatabases writes the City and ASN databases to the directory
+func writeTestGeoDatabases(t *testing.T, dir string, city string) (string, string) {
+	cityDB := newMMDBWriter(6, 28)
+	cityDB.insert(t, "8.8.0.0/16", map[string]interface{}{
+		"country":  map[string]interface{}{"iso_code": "US", "names": map[string]interface{}{"en": "United States"}},
+		"city":     map[string]interface{}{"names": map[string]interface{}{"en": city}},
+		"location": map[string]interface{}{"latitude": 37.4, "longitude": -122.1},
+	})
+	cityDB.insert(t, "2a00:1450::/32", map[string]interface{}{
+		"country": map[string]interface{}{"iso_code": "NL", "names": map[string]interface{}{"en": "Netherlands"}},
+	})
+	cityPath := filepath.Join(dir, "city.mmdb")
+	require.NoError(t, os.WriteFile(cityPath, cityDB.bytes(), 0644))
+
+	asnDB := newMMDBWriter(4, 24)
+	asnDB.insert(t, "8.8.8.0/24", map[string]interface{}{
+		"autonomous_system_number":       uint32(15169),
+		"autonomous_system_organization": "GOOGLE",
+	})
+	asnPath := filepath.Join(dir, "asn.mmdb")
+	require.NoError(t, os.WriteFile(asnPath, asnDB.bytes(), 0644))
+
+	return cityPath, asnPath
+}
+
+func TestGeoEnricher(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	cityPath, asnPath := writeTestGeoDatabases(t, dir, "Mountain View")
+
+	clock := clockwork.NewFakeClock()
+	g, err := NewGeoEnricher(&GeoConfig{GeoIPDB: cityPath, ASNDB: asnPath}, clock)
+	require.NoError(t, err)
+
+	enrich := func(addr string) map[string]interface{} {
+		e := &TeleportEvent{Event: []byte(`{"event":"user.login","addr.remote":"` + addr + `"}`)}
+		require.NoError(t, g.Enrich(ctx, e))
+
+		var fields map[string]interface{}
+		require.NoError(t, json.Unmarshal(e.Event, &fields))
+		require.Equal(t, "user.login", fields["event"])
+
+		geo, _ := fields[geoField].(map[string]interface{})
+		return geo
+	}
+
+	require.Equal(t, map[string]interface{}{
+		"country":      "US",
+		"country_name": "United States",
+		"city":         "Mountain View",
+		"asn":          float64(15169),
+		"as_org":       "GOOGLE",
+	}, enrich("8.8.8.8:51234"))
+	require.Equal(t, map[string]interface{}{"country": "NL", "country_name": "Netherlands"}, enrich("[2a00:1450::1]:22"))
+
+	// Not globally reachable, unknown and missing addresses are skipped
+	require.Nil(t, enrich("10.0.0.1:22"))
+	require.Nil(t, enrich("127.0.0.1"))
+	require.Nil(t, enrich("100.64.1.1:22"))
+	require.Nil(t, enrich("[fd00::1]:22"))
+	require.Nil(t, enrich("1.1.1.1:22"))
+	require.Nil(t, enrich(""))
+
+	// The database is reloaded once it changes on disk
+	writeTestGeoDatabases(t, dir, "Sunnyvale")
+	require.NoError(t, os.Chtimes(cityPath, time.Now(), time.Now().Add(time.Minute)))
+	require.Equal(t, "Mountain View", enrich("8.8.8.8")["city"])
+	clock.Advance(geoReloadInterval)
+	require.Equal(t, "Sunnyvale", enrich("8.8.8.8")["city"])
+
+	// A broken file is not loaded
+	require.NoError(t, os.WriteFile(cityPath, []byte("partial"), 0644))
+	clock.Advance(geoReloadInterval)
+	require.Equal(t, "Sunnyvale", enrich("8.8.8.8")["city"])
+}
+
+func TestIsGlobalIP(t *testing.T) {
+	for addr, global := range map[string]bool{
+		"8.8.8.8":         true,
+		"100.63.255.255":  true,
+		"100.64.0.1":      false,
+		"100.127.255.255": false,
+		"192.0.2.1":       false,
+		"198.18.0.1":      false,
+		"224.0.0.1":       false,
+		"255.255.255.255": false,
+		"::ffff:10.0.0.1": false,
+		"2a00:1450::1":    true,
+		"2001:db8::1":     false,
+		"fe80::1":         false,
+		"::1":             false,
+	} {
+		require.Equal(t, global, isGlobalIP(net.ParseIP(addr)), addr)
+	}
+}
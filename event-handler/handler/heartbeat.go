@@ -0,0 +1,185 @@
+// Copyright 2024 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gravitational/teleport/integrations/lib/logger"
+	"github.com/gravitational/trace"
+)
+
+const (
+	// heartbeatType is the type of the synthetic event which reports the forwarding progress
+	heartbeatType = "event_handler.heartbeat"
+)
+
+// heartbeatEvent is the payload of the synthetic event which reports the forwarding progress
+type heartbeatEvent struct {
+	// Event is the synthetic event type
+	Event string `json:"event"`
+	// UID is the event ID
+	UID string `json:"uid"`
+	// Time is the report time
+	Time time.Time `json:"time"`
+	// Cursor is the cursor of the latest audit log event forwarded
+	Cursor string `json:"cursor"`
+	// LastEventID is the ID of the latest audit log event forwarded
+	LastEventID string `json:"last_event_id"`
+	// EventsForwarded is the number of the audit log events forwarded since the previous heartbeat
+	EventsForwarded int64 `json:"events_forwarded"`
+	// EventsDropped is the number of the audit log events dropped by the event type policies since the previous
+	// heartbeat
+	EventsDropped int64 `json:"events_dropped"`
+	// NewestEventTime is the time of the newest audit log event forwarded since start, omitted if there is none
+	NewestEventTime *time.Time `json:"newest_event_time,omitempty"`
+	// Since is the time of the previous heartbeat or the start time
+	Since time.Time `json:"since"`
+}
+
+// heartbeatCounter tracks the audit log forwarding progress reported by the heartbeat events
+type heartbeatCounter struct {
+	// mu protects the fields below
+	mu sync.Mutex
+	// cursor is the cursor of the latest event
+	cursor string
+	// id is the ID of the latest event
+	id string
+	// count is the number of the events forwarded and dropped since the previous heartbeat
+	count EventCount
+	// newest is the time of the newest event
+	newest time.Time
+	// since is the time of the previous heartbeat
+	since time.Time
+}
+
+// newHeartbeatCounter creates the counter started at the given time
+func newHeartbeatCounter(now time.Time) *heartbeatCounter {
+	return &heartbeatCounter{since: now.UTC()}
+}
+
+// Add counts the audit log event forwarded or dropped by the event type policies
+func (h *heartbeatCounter) Add(e *TeleportEvent, forwarded bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.cursor, h.id = e.Cursor, e.ID
+	if !forwarded {
+		h.count.Dropped++
+		return
+	}
+
+	h.count.Forwarded++
+	if e.Time.After(h.newest) {
+		h.newest = e.Time
+	}
+}
+
+// Heartbeat returns the heartbeat event reporting the progress along with the numbers of the events it reports.
+// The counter is not reset until the event is sent.
+func (h *heartbeatCounter) Heartbeat(now time.Time) (*TeleportEvent, EventCount, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now = now.UTC()
+	id := fmt.Sprintf("%v-%v", heartbeatType, now.UnixNano())
+
+	payload := heartbeatEvent{
+		Event:           heartbeatType,
+		UID:             id,
+		Time:            now,
+		Cursor:          h.cursor,
+		LastEventID:     h.id,
+		EventsForwarded: h.count.Forwarded,
+		EventsDropped:   h.count.Dropped,
+		Since:           h.since,
+	}
+	if !h.newest.IsZero() {
+		newest := h.newest.UTC()
+		payload.NewestEventTime = &newest
+	}
+
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return nil, EventCount{}, trace.Wrap(err)
+	}
+
+	return &TeleportEvent{
+		Event:          b,
+		ID:             id,
+		Type:           heartbeatType,
+		Time:           now,
+		IdempotencyKey: id,
+	}, h.count, nil
+}
+
+// Sent resets the counter once the heartbeat reporting n events is sent at the given time. The events handled in
+// the meantime are reported by the next heartbeat.
+func (h *heartbeatCounter) Sent(n EventCount, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.count.Forwarded -= n.Forwarded
+	h.count.Dropped -= n.Dropped
+	h.since = now.UTC()
+}
+
+// sendHeartbeats sends the heartbeat event every heartbeat interval, and once more after the ingestion jobs are
+// stopped
+func (a *App) sendHeartbeats(ctx context.Context) error {
+	defer a.reporters.Done()
+
+	ticker := time.NewTicker(a.Config().HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-a.ingestionStopped():
+			// Report the events forwarded since the last tick, including the events forwarded during the drain
+			if err := a.sendHeartbeat(ctx); err != nil {
+				logger.Get(ctx).WithError(err).Error("Failed to send heartbeat")
+			}
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+
+		if err := a.sendHeartbeat(ctx); err != nil {
+			logger.Get(ctx).WithError(err).Error("Failed to send heartbeat")
+		}
+	}
+}
+
+// sendHeartbeat sends the heartbeat event to every destination
+func (a *App) sendHeartbeat(ctx context.Context) error {
+	now := time.Now()
+
+	e, n, err := a.heartbeat.Heartbeat(now)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	if err := a.SendEvent(ctx, a.Config().FluentdURL, e); err != nil {
+		return trace.Wrap(err)
+	}
+	a.heartbeat.Sent(n, now)
+
+	return nil
+}
@@ -0,0 +1,195 @@
+// Copyright 2024 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeartbeatCounter(t *testing.T) {
+	start := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	h := newHeartbeatCounter(start)
+
+	heartbeat := func(now time.Time) (heartbeatEvent, EventCount) {
+		e, n, err := h.Heartbeat(now)
+		require.NoError(t, err)
+		require.Equal(t, heartbeatType, e.Type)
+		require.Equal(t, e.ID, e.IdempotencyKey)
+
+		var payload heartbeatEvent
+		require.NoError(t, json.Unmarshal(e.Event, &payload))
+		require.Equal(t, e.ID, payload.UID)
+		return payload, n
+	}
+
+	// The heartbeat is sent even if nothing is forwarded
+	payload, n := heartbeat(start.Add(time.Minute))
+	require.Zero(t, n)
+	require.Nil(t, payload.NewestEventTime)
+	require.Equal(t, start, payload.Since)
+
+	newest := start.Add(-time.Hour)
+	h.Add(&TeleportEvent{ID: "1", Cursor: "c1", Time: newest}, true)
+	h.Add(&TeleportEvent{ID: "2", Cursor: "c2", Time: newest.Add(-time.Minute)}, true)
+	// The dropped events move the position, but are not reported as forwarded
+	h.Add(&TeleportEvent{ID: "3", Cursor: "c3", Time: newest.Add(time.Minute)}, false)
+
+	payload, n = heartbeat(start.Add(time.Minute))
+	require.Equal(t, EventCount{Forwarded: 2, Dropped: 1}, n)
+	require.Equal(t, heartbeatEvent{
+		Event:           heartbeatType,
+		UID:             payload.UID,
+		Time:            start.Add(time.Minute),
+		Cursor:          "c3",
+		LastEventID:     "3",
+		EventsForwarded: 2,
+		EventsDropped:   1,
+		NewestEventTime: &newest,
+		Since:           start,
+	}, payload)
+
+	// The events forwarded while the heartbeat is sent are reported next time
+	h.Add(&TeleportEvent{ID: "4", Cursor: "c4", Time: newest.Add(time.Minute)}, true)
+	h.Sent(n, start.Add(time.Minute))
+
+	payload, n = heartbeat(start.Add(2 * time.Minute))
+	require.Equal(t, EventCount{Forwarded: 1}, n)
+	require.Equal(t, "c4", payload.Cursor)
+	require.Equal(t, newest.Add(time.Minute), *payload.NewestEventTime)
+	require.Equal(t, start.Add(time.Minute), payload.Since)
+}
+
+func TestAppHeartbeat(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	c := &StartCmdConfig{
+		TeleportConfig: TeleportConfig{TeleportAddr: "localhost:3025"},
+		IngestConfig: IngestConfig{
+			StorageDir:        t.TempDir(),
+			BatchSize:         20,
+			Concurrency:       1,
+			CheckpointEvents:  1,
+			HeartbeatInterval: time.Hour,
+			// The event type policy drops every user.update event
+			EventPolicies: map[string]EventPolicy{"user.update": {Mode: eventPolicySample, N: math.MaxInt32}},
+		},
+	}
+
+	app, err := NewApp(c)
+	require.NoError(t, err)
+
+	ts := time.Date(2024, 1, 2, 10, 30, 0, 0, time.UTC)
+	sink := &recordingSink{}
+	app.Source = &staticEventSource{events: []*TeleportEvent{
+		{Event: []byte(`{"event":"user.create","uid":"1"}`), ID: "1", Cursor: "c1", Type: "user.create", Time: ts},
+		{Event: []byte(`{"event":"user.update","uid":"3"}`), ID: "3", Cursor: "c3", Type: "user.update", Time: ts.Add(time.Minute)},
+		{Event: []byte(`{"event":"user.delete","uid":"2"}`), ID: "2", Cursor: "c2", Type: "user.delete", Time: ts.Add(time.Hour)},
+	}}
+	app.Sinks = []Sink{sink}
+
+	require.NoError(t, app.Run(ctx))
+
+	// The final heartbeat is sent on shutdown, after the drain
+	require.Len(t, sink.payloads, 3)
+
+	var payload heartbeatEvent
+	require.NoError(t, json.Unmarshal(sink.payloads[2], &payload))
+	require.Equal(t, heartbeatType, payload.Event)
+	require.Equal(t, "c2", payload.Cursor)
+	require.Equal(t, "2", payload.LastEventID)
+	require.Equal(t, int64(2), payload.EventsForwarded)
+	require.Equal(t, int64(1), payload.EventsDropped)
+	require.Equal(t, ts.Add(time.Hour), *payload.NewestEventTime)
+
+	counts, err := app.State.GetEventCounts(ts.Add(-time.Hour), ts.Add(2*time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, map[time.Time]EventCount{
+		ts.Truncate(time.Hour):                {Forwarded: 1, Dropped: 1},
+		ts.Truncate(time.Hour).Add(time.Hour): {Forwarded: 1},
+	}, counts)
+}
+
+// drainingEventSource terminates the app once the events are read, and returns the late event on drain
+type drainingEventSource struct {
+	staticEventSource
+	app  *App
+	late *TeleportEvent
+	ch   chan *TeleportEvent
+}
+
+// Events returns the events and terminates the app, the channel is closed on drain
+func (s *drainingEventSource) Events(ctx context.Context) (chan *TeleportEvent, chan error) {
+	s.ch = make(chan *TeleportEvent, len(s.events)+1)
+	for _, e := range s.events {
+		s.ch <- e
+	}
+	go s.app.Terminate()
+
+	return s.ch, make(chan error)
+}
+
+// Drain returns the late event and closes the channel
+func (s *drainingEventSource) Drain() {
+	s.ch <- s.late
+	close(s.ch)
+}
+
+func TestAppHeartbeatAfterDrain(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	c := &StartCmdConfig{
+		TeleportConfig: TeleportConfig{TeleportAddr: "localhost:3025"},
+		IngestConfig: IngestConfig{
+			StorageDir:        t.TempDir(),
+			BatchSize:         20,
+			Concurrency:       1,
+			CheckpointEvents:  1,
+			DrainTimeout:      time.Minute,
+			HeartbeatInterval: time.Hour,
+		},
+	}
+
+	app, err := NewApp(c)
+	require.NoError(t, err)
+
+	sink := &recordingSink{}
+	app.Source = &drainingEventSource{
+		staticEventSource: staticEventSource{events: []*TeleportEvent{
+			{Event: []byte(`{"event":"user.create","uid":"1"}`), ID: "1", Cursor: "c1", Type: "user.create"},
+		}},
+		app:  app,
+		late: &TeleportEvent{Event: []byte(`{"event":"user.delete","uid":"2"}`), ID: "2", Cursor: "c2", Type: "user.delete"},
+	}
+	app.Sinks = []Sink{sink}
+
+	require.NoError(t, app.Run(ctx))
+
+	// The final heartbeat is sent after the drain, and counts the event forwarded during the drain
+	require.Len(t, sink.payloads, 3)
+
+	var payload heartbeatEvent
+	require.NoError(t, json.Unmarshal(sink.payloads[2], &payload))
+	require.Equal(t, heartbeatType, payload.Event)
+	require.Equal(t, "c2", payload.Cursor)
+	require.Equal(t, int64(2), payload.EventsForwarded)
+}
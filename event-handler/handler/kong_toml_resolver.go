@@ -0,0 +1,112 @@
+/*
+Copyright 2015-2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"io"
+	"strings"
+
+	"github.com/alecthomas/kong"
+	"github.com/gravitational/trace"
+	"github.com/pelletier/go-toml"
+)
+
+const (
+	// fdPrefix contains section name which will be prepended with "forward."
+	fdPrefix = "fluentd"
+
+	// forwardPrefix contains prefix which must be prepended to "fluentd" section
+	forwardPrefix = "forward"
+
+	// teleportPrefix contains section name of the Teleport settings, [[teleport]] blocks define several clusters
+	teleportPrefix = "teleport"
+)
+
+// KongTOMLResolver is the kong resolver function for toml configuration file. If the file contains
+// several [[teleport]] blocks, the first one is used.
+func KongTOMLResolver(r io.Reader) (kong.Resolver, error) {
+	return NewKongTOMLClusterResolver(0)(r)
+}
+
+// NewKongTOMLClusterResolver returns the kong resolver function for toml configuration file which
+// resolves the settings of the cluster defined by the [[teleport]] block with the given index.
+// Settings defined within the block take precedence over the top-level ones.
+func NewKongTOMLClusterResolver(cluster int) kong.ConfigurationLoader {
+	return func(r io.Reader) (kong.Resolver, error) {
+		config, err := toml.LoadReader(r)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+
+		var block *toml.Tree
+		if blocks := clusterBlocks(config); len(blocks) > 0 {
+			if cluster >= len(blocks) {
+				return nil, trace.BadParameter("cluster %v is not defined in the configuration file", cluster)
+			}
+			block = blocks[cluster]
+		}
+
+		// ResolverFunc reads configuration variables from the external source, TOML file in this case
+		var f kong.ResolverFunc = func(context *kong.Context, parent *kong.Path, flag *kong.Flag) (interface{}, error) {
+			name := flag.Name
+
+			if block != nil {
+				value := resolveTOMLValue(block, strings.TrimPrefix(name, teleportPrefix+"-"))
+				// Teleport connection settings are never shared between clusters
+				if value != nil || strings.HasPrefix(name, teleportPrefix+"-") {
+					return value, nil
+				}
+			}
+
+			return resolveTOMLValue(config, name), nil
+		}
+
+		return f, nil
+	}
+}
+
+// resolveTOMLValue returns the value of the flag from the TOML tree, nil if it is not set
+func resolveTOMLValue(config *toml.Tree, name string) interface{} {
+	if strings.HasPrefix(name, fdPrefix) {
+		name = strings.Join([]string{forwardPrefix, fdPrefix, name[len(fdPrefix)+1:]}, ".")
+	}
+
+	value := config.Get(name)
+	valueWithinSection := config.Get(strings.ReplaceAll(name, "-", "."))
+
+	if valueWithinSection != nil {
+		return valueWithinSection
+	}
+
+	return value
+}
+
+// clusterBlocks returns [[teleport]] blocks of the configuration file, nil if there are none
+func clusterBlocks(config *toml.Tree) []*toml.Tree {
+	blocks, _ := config.Get(teleportPrefix).([]*toml.Tree)
+	return blocks
+}
+
+// CountClusterBlocks returns the number of [[teleport]] blocks in the configuration file
+func CountClusterBlocks(path string) (int, error) {
+	config, err := toml.LoadFile(path)
+	if err != nil {
+		return 0, trace.Wrap(err)
+	}
+
+	return len(clusterBlocks(config)), nil
+}
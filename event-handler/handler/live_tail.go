@@ -0,0 +1,406 @@
+// Copyright 2024 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/gravitational/teleport/integrations/lib/logger"
+	"github.com/gravitational/trace"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// liveTailPath is the path the live tail clients subscribe on
+	liveTailPath = "/events"
+	// liveTailKeepAlive is how often an idle subscriber connection is pinged
+	liveTailKeepAlive = 15 * time.Second
+	// liveTailWriteTimeout is the timeout of a single write to the subscriber, slower subscribers are disconnected
+	liveTailWriteTimeout = 10 * time.Second
+	// liveTailShutdownTimeout is the live tail server graceful shutdown timeout
+	liveTailShutdownTimeout = 5 * time.Second
+	// liveTailDroppedEvent is the type of the notice sent to the subscriber which dropped events
+	liveTailDroppedEvent = "tail.dropped"
+)
+
+// LiveTail streams the events sent to the local subscribers as Server-Sent Events or WebSocket messages. It is a
+// Sink: every subscriber has a buffer, and the events are dropped for the subscriber once it is full, so a slow
+// subscriber never blocks the ingestion.
+type LiveTail struct {
+	// config returns the current configuration
+	config func() *StartCmdConfig
+	// upgrader upgrades WebSocket connections
+	upgrader websocket.Upgrader
+	// mu protects subscribers
+	mu sync.RWMutex
+	// subscribers are the connected subscribers
+	subscribers map[*tailSubscriber]struct{}
+	// subscribersGauge is the number of connected subscribers
+	subscribersGauge prometheus.Gauge
+	// dropped counts events dropped for slow subscribers
+	dropped prometheus.Counter
+}
+
+// tailSubscriber is the connected live tail client
+type tailSubscriber struct {
+	// filter is the event fields the events must match, any of the values for every field
+	filter map[string][]string
+	// ch is the buffer of the events to send
+	ch chan []byte
+	// dropped is the number of events dropped since the last notice
+	dropped atomic.Uint64
+}
+
+// NewLiveTail creates new LiveTail
+func NewLiveTail(config func() *StartCmdConfig) *LiveTail {
+	return &LiveTail{
+		config:      config,
+		subscribers: make(map[*tailSubscriber]struct{}),
+		subscribersGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "live_tail_subscribers",
+			Help:      "Number of connected live tail subscribers",
+		}),
+		dropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "live_tail_dropped_total",
+			Help:      "Number of events dropped for slow live tail subscribers",
+		}),
+	}
+}
+
+// collectors returns the collectors of the live tail metrics
+func (t *LiveTail) collectors() []prometheus.Collector {
+	return []prometheus.Collector{t.subscribersGauge, t.dropped}
+}
+
+// Send passes the event to the subscribers which filter it matches, it never blocks
+func (t *LiveTail) Send(ctx context.Context, e *TeleportEvent, payload []byte) error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var fields map[string]interface{}
+	for s := range t.subscribers {
+		if len(s.filter) > 0 {
+			if fields == nil {
+				if err := json.Unmarshal(e.Event, &fields); err != nil {
+					return trace.Wrap(err)
+				}
+			}
+			if !s.matches(fields) {
+				continue
+			}
+		}
+
+		select {
+		case s.ch <- payload:
+		default:
+			s.dropped.Add(1)
+			t.dropped.Inc()
+		}
+	}
+
+	return nil
+}
+
+// matches returns true if the event fields match the subscriber filter
+func (s *tailSubscriber) matches(fields map[string]interface{}) bool {
+	for name, values := range s.filter {
+		value, ok := lookupEventField(fields, name)
+		if !ok {
+			return false
+		}
+
+		matched := false
+		for _, v := range values {
+			if v == fieldString(value) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+// droppedNotice returns the notice about the events dropped since the last one, nil if there are none
+func (s *tailSubscriber) droppedNotice() []byte {
+	n := s.dropped.Swap(0)
+	if n == 0 {
+		return nil
+	}
+
+	return []byte(fmt.Sprintf(`{"event":%q,"count":%d}`, liveTailDroppedEvent, n))
+}
+
+// subscribe registers the subscriber
+func (t *LiveTail) subscribe(filter map[string][]string) *tailSubscriber {
+	s := &tailSubscriber{
+		filter: filter,
+		ch:     make(chan []byte, t.config().TailBuffer),
+	}
+
+	t.mu.Lock()
+	t.subscribers[s] = struct{}{}
+	t.mu.Unlock()
+	t.subscribersGauge.Inc()
+
+	return s
+}
+
+// unsubscribe removes the subscriber
+func (t *LiveTail) unsubscribe(s *tailSubscriber) {
+	t.mu.Lock()
+	delete(t.subscribers, s)
+	t.mu.Unlock()
+	t.subscribersGauge.Dec()
+}
+
+// ServeHTTP authenticates the client and streams the events matching the query parameters, as WebSocket
+// messages if the client requests the upgrade and as Server-Sent Events otherwise
+func (t *LiveTail) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != liveTailPath {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if !t.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	log := logger.Get(r.Context()).WithField("remote", r.RemoteAddr)
+	filter := map[string][]string(r.URL.Query())
+
+	s := t.subscribe(filter)
+	defer t.unsubscribe(s)
+
+	log.WithField("filter", filter).Info("Live tail subscriber connected")
+
+	var err error
+	if websocket.IsWebSocketUpgrade(r) {
+		err = t.serveWebSocket(w, r, s)
+	} else {
+		err = t.serveSSE(w, r, s)
+	}
+
+	if err != nil && !errors.Is(err, context.Canceled) {
+		log.WithError(err).Info("Live tail subscriber disconnected")
+		return
+	}
+	log.Info("Live tail subscriber disconnected")
+}
+
+// authorized returns true if the request carries the configured bearer token
+func (t *LiveTail) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+
+	expected := t.config().TailToken
+	return expected != "" && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+// serveSSE streams the events as Server-Sent Events
+func (t *LiveTail) serveSSE(w http.ResponseWriter, r *http.Request, s *tailSubscriber) error {
+	rc := http.NewResponseController(w)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	write := func(b []byte) error {
+		if err := rc.SetWriteDeadline(time.Now().Add(liveTailWriteTimeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return trace.Wrap(err)
+		}
+		if _, err := w.Write(b); err != nil {
+			return trace.Wrap(err)
+		}
+		return trace.Wrap(rc.Flush())
+	}
+
+	if err := write([]byte(": connected\n\n")); err != nil {
+		return trace.Wrap(err)
+	}
+
+	ticker := time.NewTicker(liveTailKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case payload := <-s.ch:
+			var b []byte
+			if notice := s.droppedNotice(); notice != nil {
+				b = sseMessage(b, liveTailDroppedEvent, notice)
+			}
+			if err := write(sseMessage(b, "", payload)); err != nil {
+				return trace.Wrap(err)
+			}
+
+		case <-ticker.C:
+			if err := write([]byte(": ping\n\n")); err != nil {
+				return trace.Wrap(err)
+			}
+
+		case <-r.Context().Done():
+			return r.Context().Err()
+		}
+	}
+}
+
+// sseMessage appends the Server-Sent Event to b, every payload line is sent as a separate data field
+func sseMessage(b []byte, event string, payload []byte) []byte {
+	if event != "" {
+		b = append(b, "event: "...)
+		b = append(b, event...)
+		b = append(b, '\n')
+	}
+	for _, line := range bytes.Split(payload, []byte("\n")) {
+		b = append(b, "data: "...)
+		b = append(b, line...)
+		b = append(b, '\n')
+	}
+
+	return append(b, '\n')
+}
+
+// serveWebSocket streams the events as WebSocket text messages
+func (t *LiveTail) serveWebSocket(w http.ResponseWriter, r *http.Request, s *tailSubscriber) error {
+	conn, err := t.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already replied with the error
+		return trace.Wrap(err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	// Control frames are processed by the reader, the messages sent by the client are ignored
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	write := func(messageType int, b []byte) error {
+		if err := conn.SetWriteDeadline(time.Now().Add(liveTailWriteTimeout)); err != nil {
+			return trace.Wrap(err)
+		}
+		return trace.Wrap(conn.WriteMessage(messageType, b))
+	}
+
+	ticker := time.NewTicker(liveTailKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case payload := <-s.ch:
+			if notice := s.droppedNotice(); notice != nil {
+				if err := write(websocket.TextMessage, notice); err != nil {
+					return trace.Wrap(err)
+				}
+			}
+			if err := write(websocket.TextMessage, payload); err != nil {
+				return trace.Wrap(err)
+			}
+
+		case <-ticker.C:
+			if err := write(websocket.PingMessage, nil); err != nil {
+				return trace.Wrap(err)
+			}
+
+		case <-ctx.Done():
+			msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "")
+			_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+			return ctx.Err()
+		}
+	}
+}
+
+// serveLiveTail serves the live tail endpoint until the context is canceled, over TLS if the certificate is set
+func serveLiveTail(ctx context.Context, c TailConfig, t *LiveTail) error {
+	server := &http.Server{
+		Addr:              c.TailAddr,
+		Handler:           t,
+		ReadHeaderTimeout: httpTimeout,
+		// The subscriber connections are closed once the context is canceled
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), liveTailShutdownTimeout)
+		defer cancel()
+
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			logger.Get(ctx).WithError(err).Warn("Failed to shut down live tail server")
+		}
+	}()
+
+	logger.Get(ctx).WithField("addr", c.TailAddr).WithField("tls", c.TLS()).Info("Serving live tail")
+
+	var err error
+	if c.TLS() {
+		err = server.ListenAndServeTLS(c.TailCert, c.TailKey)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+
+	return trace.Wrap(err)
+}
+
+// serveLiveTail serves the live tail endpoint until the app is terminated
+func (a *App) serveLiveTail(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	a.OnTerminate(func(_ context.Context) error {
+		cancel()
+		return nil
+	})
+
+	err := serveLiveTail(ctx, a.Config().TailConfig, a.Tail)
+	if err != nil {
+		logger.Get(ctx).WithError(err).Error("Live tail server failed")
+	}
+
+	return trace.Wrap(err)
+}
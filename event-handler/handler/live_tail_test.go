@@ -0,0 +1,154 @@
+// Copyright 2024 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestLiveTail creates the live tail with the given subscriber buffer size
+func newTestLiveTail(buffer int) *LiveTail {
+	c := &StartCmdConfig{TailConfig: TailConfig{TailAddr: "127.0.0.1:0", TailToken: "secret", TailBuffer: buffer}}
+	return NewLiveTail(func() *StartCmdConfig { return c })
+}
+
+// newTailEvent creates the event of the given type and user
+func newTailEvent(typ, user string) *TeleportEvent {
+	return &TeleportEvent{Event: []byte(`{"event":"` + typ + `","user":"` + user + `"}`), Type: typ}
+}
+
+// sendTailEvent sends the event to the live tail using the event itself as the payload
+func sendTailEvent(t *testing.T, tail *LiveTail, e *TeleportEvent) {
+	require.NoError(t, tail.Send(context.Background(), e, e.Event))
+}
+
+func TestLiveTailAuth(t *testing.T) {
+	server := httptest.NewServer(newTestLiveTail(1))
+	defer server.Close()
+
+	for _, header := range []string{"", "Bearer wrong", "secret"} {
+		req, err := http.NewRequest(http.MethodGet, server.URL+liveTailPath, nil)
+		require.NoError(t, err)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusUnauthorized, resp.StatusCode, header)
+	}
+}
+
+func TestLiveTailSSE(t *testing.T) {
+	tail := newTestLiveTail(10)
+	server := httptest.NewServer(tail)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+liveTailPath+"?event=user.login&user=alice&user=bob", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer secret")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	sendTailEvent(t, tail, newTailEvent("user.create", "alice"))
+	sendTailEvent(t, tail, newTailEvent("user.login", "mallory"))
+	sendTailEvent(t, tail, newTailEvent("user.login", "bob"))
+
+	r := bufio.NewReader(resp.Body)
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		if strings.HasPrefix(line, "data: ") {
+			require.Equal(t, `data: {"event":"user.login","user":"bob"}`+"\n", line)
+			break
+		}
+	}
+}
+
+func TestLiveTailWebSocket(t *testing.T) {
+	tail := newTestLiveTail(10)
+	server := httptest.NewServer(tail)
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + liveTailPath + "?event=session.start"
+	conn, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Authorization": {"Bearer secret"}})
+	require.NoError(t, err)
+	defer conn.Close()
+	resp.Body.Close()
+
+	sendTailEvent(t, tail, newTailEvent("user.login", "alice"))
+	sendTailEvent(t, tail, newTailEvent("session.start", "alice"))
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	typ, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	require.Equal(t, websocket.TextMessage, typ)
+	require.Equal(t, `{"event":"session.start","user":"alice"}`, string(msg))
+}
+
+func TestLiveTailSlowSubscriber(t *testing.T) {
+	tail := newTestLiveTail(1)
+	s := tail.subscribe(nil)
+	defer tail.unsubscribe(s)
+
+	// Send never blocks, the events which do not fit the buffer are dropped
+	for i := 0; i < 3; i++ {
+		sendTailEvent(t, tail, newTailEvent("user.login", "alice"))
+	}
+	require.Len(t, s.ch, 1)
+
+	require.Equal(t, `{"event":"tail.dropped","count":2}`, string(s.droppedNotice()))
+	require.Nil(t, s.droppedNotice())
+}
+
+func TestTailConfigCheck(t *testing.T) {
+	for _, c := range []TailConfig{
+		{},
+		{TailAddr: "127.0.0.1:8081", TailToken: "secret", TailBuffer: 1},
+		{TailAddr: "[::1]:8081", TailToken: "secret", TailBuffer: 1},
+		{TailAddr: "localhost:8081", TailToken: "secret", TailBuffer: 1},
+		{TailAddr: ":8081", TailToken: "secret", TailBuffer: 1, TailCert: "tail.crt", TailKey: "tail.key"},
+	} {
+		require.NoError(t, c.Check(), "%+v", c)
+	}
+
+	for _, c := range []TailConfig{
+		{TailAddr: "127.0.0.1:8081", TailBuffer: 1},
+		{TailAddr: "127.0.0.1:8081", TailToken: "secret"},
+		{TailAddr: "127.0.0.1:8081", TailToken: "secret", TailBuffer: 1, TailCert: "tail.crt"},
+		{TailAddr: ":8081", TailToken: "secret", TailBuffer: 1},
+		{TailAddr: "0.0.0.0:8081", TailToken: "secret", TailBuffer: 1},
+		{TailAddr: "10.0.0.1:8081", TailToken: "secret", TailBuffer: 1},
+	} {
+		require.Error(t, c.Check(), "%+v", c)
+	}
+}
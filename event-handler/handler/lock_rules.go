@@ -0,0 +1,492 @@
+// Copyright 2024 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gravitational/teleport/api/types"
+	"github.com/gravitational/teleport/integrations/lib/logger"
+	"github.com/gravitational/trace"
+	"github.com/pelletier/go-toml"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// lockTargetUser locks the Teleport user
+	lockTargetUser = "user"
+	// lockTargetRole locks the Teleport role
+	lockTargetRole = "role"
+	// lockTargetLogin locks the OS login
+	lockTargetLogin = "login"
+	// lockTargetNode locks the node by its server ID
+	lockTargetNode = "node"
+	// lockTargetMFADevice locks the MFA device by its UUID
+	lockTargetMFADevice = "mfa_device"
+	// lockTargetAccessRequest locks the access request by its ID
+	lockTargetAccessRequest = "access_request"
+
+	// defaultLockRuleMessage is the lock message used when the rule does not define one
+	defaultLockRuleMessage = "Locked by event-handler rule {{.Rule}}: {{.Count}} matching events within {{.Window}}"
+
+	// lockEventsPruneInterval is how often, in the event time, the counters out of their windows are removed
+	lockEventsPruneInterval = 10 * time.Minute
+)
+
+// defaultLockTargetFields maps lock targets to the event fields holding the target value by default
+var defaultLockTargetFields = map[string]string{
+	lockTargetUser:          "user",
+	lockTargetLogin:         "login",
+	lockTargetNode:          "server_id",
+	lockTargetAccessRequest: "id",
+}
+
+// LockRule represents a declarative auto-locking rule: Threshold events matching Filter within Window,
+// grouped by GroupBy fields, lock the Target
+type LockRule struct {
+	// Name is the rule name
+	Name string `toml:"name"`
+	// Types is the list of event types the rule applies to, all types if empty
+	Types []string `toml:"types"`
+	// Filter maps event field names to the expected values, a list value matches any of its elements
+	Filter map[string]interface{} `toml:"filter"`
+	// Threshold is the number of matching events which triggers the action
+	Threshold int `toml:"threshold"`
+	// Window is the sliding time window matching events are counted in
+	Window string `toml:"window"`
+	// GroupBy is the list of event fields matching events are counted by
+	GroupBy []string `toml:"group_by"`
+	// Target is the lock target kind: user, role, login, node, mfa_device or access_request
+	Target string `toml:"target"`
+	// TargetField is the event field holding the lock target value
+	TargetField string `toml:"target_field"`
+	// Message is the lock message template
+	Message string `toml:"message"`
+	// TTL is the lock duration, the lock never expires if empty
+	TTL string `toml:"ttl"`
+	// Allow is the list of target values or users which are never locked (break-glass accounts)
+	Allow []string `toml:"allow"`
+	// DryRun makes the rule only log matches
+	DryRun bool `toml:"dry_run"`
+
+	// window is the parsed Window
+	window time.Duration
+	// ttl is the parsed TTL
+	ttl time.Duration
+	// types is the set of event types
+	types map[string]struct{}
+	// allow is the set of allowlisted values
+	allow map[string]struct{}
+	// message is the parsed Message template
+	message *template.Template
+}
+
+// lockRulesFile represents the lock rules file structure
+type lockRulesFile struct {
+	// Rules is the list of rules
+	Rules []*LockRule `toml:"rule"`
+}
+
+// lockMessageData is passed to the lock message template
+type lockMessageData struct {
+	// Rule is the rule name
+	Rule string
+	// Target is the lock target value
+	Target string
+	// Count is the number of matching events
+	Count int
+	// Window is the rule time window
+	Window time.Duration
+	// Event is the event which triggered the action
+	Event map[string]interface{}
+}
+
+// LoadLockRules reads lock rules from TOML file
+func LoadLockRules(path string) ([]*LockRule, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	var f lockRulesFile
+	if err := toml.Unmarshal(b, &f); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	names := make(map[string]struct{}, len(f.Rules))
+	for _, r := range f.Rules {
+		if err := r.CheckAndSetDefaults(); err != nil {
+			return nil, trace.Wrap(err)
+		}
+		if _, ok := names[r.Name]; ok {
+			return nil, trace.BadParameter("duplicate lock rule name %q", r.Name)
+		}
+		names[r.Name] = struct{}{}
+	}
+
+	return f.Rules, nil
+}
+
+// CheckAndSetDefaults validates the rule and sets default values
+func (r *LockRule) CheckAndSetDefaults() error {
+	if r.Name == "" {
+		return trace.BadParameter("lock rule name is required")
+	}
+	if r.Threshold <= 0 {
+		return trace.BadParameter("lock rule %q: threshold must be positive", r.Name)
+	}
+
+	var err error
+
+	if r.Window == "" {
+		return trace.BadParameter("lock rule %q: window is required", r.Name)
+	}
+	r.window, err = time.ParseDuration(r.Window)
+	if err != nil {
+		return trace.BadParameter("lock rule %q: invalid window: %v", r.Name, err)
+	}
+
+	if r.TTL != "" {
+		r.ttl, err = time.ParseDuration(r.TTL)
+		if err != nil {
+			return trace.BadParameter("lock rule %q: invalid ttl: %v", r.Name, err)
+		}
+	}
+
+	switch r.Target {
+	case lockTargetUser, lockTargetRole, lockTargetLogin, lockTargetNode, lockTargetMFADevice, lockTargetAccessRequest:
+	default:
+		return trace.BadParameter("lock rule %q: unknown target %q", r.Name, r.Target)
+	}
+	if r.TargetField == "" {
+		r.TargetField = defaultLockTargetFields[r.Target]
+	}
+	if r.TargetField == "" {
+		return trace.BadParameter("lock rule %q: target_field is required for target %q", r.Name, r.Target)
+	}
+
+	if r.Message == "" {
+		r.Message = defaultLockRuleMessage
+	}
+	r.message, err = template.New(r.Name).Option("missingkey=zero").Parse(r.Message)
+	if err != nil {
+		return trace.BadParameter("lock rule %q: invalid message: %v", r.Name, err)
+	}
+
+	r.types = make(map[string]struct{}, len(r.Types))
+	for _, t := range r.Types {
+		r.types[t] = struct{}{}
+	}
+	r.allow = make(map[string]struct{}, len(r.Allow))
+	for _, a := range r.Allow {
+		r.allow[a] = struct{}{}
+	}
+
+	return nil
+}
+
+// Matches returns true if the event matches rule types and filter
+func (r *LockRule) Matches(typ string, fields map[string]interface{}) bool {
+	if len(r.types) > 0 {
+		if _, ok := r.types[typ]; !ok {
+			return false
+		}
+	}
+
+	for name, expected := range r.Filter {
+		value, ok := lookupEventField(fields, name)
+		if !ok || !matchFilterValue(expected, value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// groupKey returns the counter key of the event group
+func (r *LockRule) groupKey(fields map[string]interface{}) string {
+	parts := make([]string, 0, len(r.GroupBy)+2)
+	parts = append(parts, "rule", r.Name)
+	for _, name := range r.GroupBy {
+		v, _ := lookupEventField(fields, name)
+		parts = append(parts, fieldString(v))
+	}
+
+	return strings.Join(parts, "/")
+}
+
+// isAllowed returns true if the target or the user of the event is allowlisted
+func (r *LockRule) isAllowed(target string, fields map[string]interface{}) bool {
+	if _, ok := r.allow[target]; ok {
+		return true
+	}
+
+	user, _ := lookupEventField(fields, "user")
+	_, ok := r.allow[fieldString(user)]
+
+	return ok
+}
+
+// lockTarget builds Teleport lock target
+func (r *LockRule) lockTarget(value string) types.LockTarget {
+	switch r.Target {
+	case lockTargetRole:
+		return types.LockTarget{Role: value}
+	case lockTargetLogin:
+		return types.LockTarget{Login: value}
+	case lockTargetNode:
+		return types.LockTarget{ServerID: value}
+	case lockTargetMFADevice:
+		return types.LockTarget{MFADevice: value}
+	case lockTargetAccessRequest:
+		return types.LockTarget{AccessRequest: value}
+	default:
+		return types.LockTarget{User: value}
+	}
+}
+
+// lockName returns the name of the lock created by the rule
+func (r *LockRule) lockName(value string) string {
+	return lockNamePrefix + strings.ReplaceAll(fmt.Sprintf("%v-%v-%v", r.Name, r.Target, value), "/", "-")
+}
+
+// lookupEventField returns the event field value. Teleport uses dots in some field names (addr.remote),
+// so the literal name is tried first and then the name is treated as a dot-separated path.
+func lookupEventField(fields map[string]interface{}, name string) (interface{}, bool) {
+	if v, ok := fields[name]; ok {
+		return v, true
+	}
+
+	var current interface{} = fields
+	for _, part := range strings.Split(name, ".") {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		current, ok = m[part]
+		if !ok {
+			return nil, false
+		}
+	}
+
+	return current, true
+}
+
+// matchFilterValue returns true if the value matches the expected filter value, a list matches any of its elements
+func matchFilterValue(expected interface{}, value interface{}) bool {
+	if list, ok := expected.([]interface{}); ok {
+		for _, e := range list {
+			if matchFilterValue(e, value) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return fieldString(expected) == fieldString(value)
+}
+
+// fieldString converts the event field value to string
+func fieldString(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// lockRuleStore counts matching events within a sliding window and keeps the records of the created locks,
+// State implements it
+type lockRuleStore interface {
+	// AddLockEvent records the event and returns the events recorded for the key within the window
+	AddLockEvent(key string, e LockEvent, window time.Duration) ([]LockEvent, error)
+	// ResetLockEvents forgets the events recorded for the key
+	ResetLockEvents(key string) error
+	// PruneLockEvents forgets the keys which events are all out of their windows at the given time
+	PruneLockEvents(now time.Time) (int, error)
+	// SetLockRecord saves the record of the created lock
+	SetLockRecord(r LockRecord) error
+}
+
+// LockRuleLocker creates Teleport locks
+type LockRuleLocker interface {
+	// UpsertLockTarget creates or updates the lock created by the rule
+	UpsertLockTarget(ctx context.Context, name string, rule string, target types.LockTarget, message string, ttl time.Duration) error
+}
+
+// LockRuleEngine evaluates lock rules against audit log events
+type LockRuleEngine struct {
+	// mu protects rules
+	mu sync.RWMutex
+	// rules is the list of rules
+	rules []*LockRule
+	// store counts the matching events and keeps the records of the created locks
+	store lockRuleStore
+	// locker creates locks
+	locker LockRuleLocker
+	// dryRun makes all rules only log matches
+	dryRun bool
+	// pruneMu protects prunedAt
+	pruneMu sync.Mutex
+	// prunedAt is the event time the counters were pruned at
+	prunedAt time.Time
+}
+
+// NewLockRuleEngine creates new LockRuleEngine
+func NewLockRuleEngine(rules []*LockRule, store lockRuleStore, locker LockRuleLocker, dryRun bool) *LockRuleEngine {
+	return &LockRuleEngine{
+		rules:  rules,
+		store:  store,
+		locker: locker,
+		dryRun: dryRun,
+	}
+}
+
+// SetRules replaces the rules, event counters of the rules with the same names are kept
+func (e *LockRuleEngine) SetRules(rules []*LockRule) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.rules = rules
+}
+
+// Process evaluates the rules against the event and runs the actions of the triggered rules
+func (e *LockRuleEngine) Process(ctx context.Context, evt *TeleportEvent) error {
+	e.mu.RLock()
+	rules := e.rules
+	e.mu.RUnlock()
+
+	ts := evt.Time
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+
+	// The failed login counters are pruned here as well, so it runs without any rules too
+	e.prune(ctx, ts)
+
+	if len(rules) == 0 {
+		return nil
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(evt.Event, &fields); err != nil {
+		return trace.Wrap(err)
+	}
+
+	for _, r := range rules {
+		if !r.Matches(evt.Type, fields) {
+			continue
+		}
+
+		key := r.groupKey(fields)
+		events, err := e.store.AddLockEvent(key, LockEvent{ID: evt.ID, Type: evt.Type, Time: ts}, r.window)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		if len(events) < r.Threshold {
+			continue
+		}
+
+		// The counter is reset once the action succeeds, so the replayed event triggers it again otherwise
+		if err := e.apply(ctx, r, key, fields, events); err != nil {
+			return trace.Wrap(err)
+		}
+
+		if err := e.store.ResetLockEvents(key); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+
+	return nil
+}
+
+// prune removes the counters which events are all out of their windows at the event time ts, the rule and the
+// failed login counters alike. The counters of the event groups which are not seen again would be kept forever
+// otherwise.
+func (e *LockRuleEngine) prune(ctx context.Context, ts time.Time) {
+	e.pruneMu.Lock()
+	defer e.pruneMu.Unlock()
+
+	if ts.Before(e.prunedAt.Add(lockEventsPruneInterval)) {
+		return
+	}
+
+	n, err := e.store.PruneLockEvents(ts)
+	if err != nil {
+		logger.Get(ctx).WithError(err).Error("Failed to prune auto-locking counters")
+		return
+	}
+	e.prunedAt = ts
+
+	if n > 0 {
+		logger.Get(ctx).WithField("count", n).Debug("Pruned auto-locking counters")
+	}
+}
+
+// apply runs the action of the triggered rule, key is the counter key of the rule and the event group
+func (e *LockRuleEngine) apply(ctx context.Context, r *LockRule, key string, fields map[string]interface{}, events []LockEvent) error {
+	v, _ := lookupEventField(fields, r.TargetField)
+	target := fieldString(v)
+
+	l := logger.Get(ctx).WithFields(log.Fields{"rule": r.Name, "target": r.Target, "value": target, "count": len(events)})
+
+	if target == "" {
+		l.WithField("field", r.TargetField).Warn("Lock rule triggered, but the event has no lock target value")
+		return nil
+	}
+
+	if r.isAllowed(target, fields) {
+		l.Info("Lock rule triggered for allowlisted target, skipping")
+		return nil
+	}
+
+	var message strings.Builder
+	err := r.message.Execute(&message, lockMessageData{
+		Rule:   r.Name,
+		Target: target,
+		Count:  len(events),
+		Window: r.window,
+		Event:  fields,
+	})
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	if r.DryRun || e.dryRun {
+		l.WithField("message", message.String()).Info("Lock rule triggered (dry run)")
+		return nil
+	}
+
+	name := r.lockName(target)
+	err = e.locker.UpsertLockTarget(ctx, name, r.Name, r.lockTarget(target), message.String(), r.ttl)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	err = e.store.SetLockRecord(LockRecord{Name: name, Rule: r.Name, Key: key, CreatedAt: time.Now().UTC(), Events: events})
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	l.Info("Lock rule triggered, target is locked")
+
+	return nil
+}
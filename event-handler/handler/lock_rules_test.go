@@ -0,0 +1,198 @@
+// Copyright 2024 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gravitational/teleport/api/types"
+	"github.com/stretchr/testify/require"
+)
+
+// mockLocker records the locks created by the rule engine
+type mockLocker struct {
+	locks map[string]types.LockTarget
+	msgs  map[string]string
+}
+
+func (m *mockLocker) UpsertLockTarget(_ context.Context, name string, _ string, target types.LockTarget, message string, _ time.Duration) error {
+	m.locks[name] = target
+	m.msgs[name] = message
+	return nil
+}
+
+// writeLockRules writes the rules file and loads it
+func writeLockRules(t *testing.T, rules string) []*LockRule {
+	path := filepath.Join(t.TempDir(), "rules.toml")
+	require.NoError(t, os.WriteFile(path, []byte(rules), 0600))
+
+	r, err := LoadLockRules(path)
+	require.NoError(t, err)
+
+	return r
+}
+
+// newRuleEvent creates an audit log event used by rule engine tests
+func newRuleEvent(t *testing.T, typ string, ts time.Time, fields map[string]interface{}) *TeleportEvent {
+	fields["event"] = typ
+	b, err := json.Marshal(fields)
+	require.NoError(t, err)
+
+	return &TeleportEvent{Type: typ, Time: ts, Event: b}
+}
+
+func TestLockRuleEngine(t *testing.T) {
+	rules := writeLockRules(t, `
+[[rule]]
+name = "failed-logins"
+types = ["user.login"]
+threshold = 3
+window = "1m"
+group_by = ["user"]
+target = "user"
+message = "{{.Target}} locked after {{.Count}} failed logins from {{index .Event \"addr.remote\"}}"
+ttl = "1h"
+allow = ["admin"]
+[rule.filter]
+success = false
+method = ["local", "sso"]
+
+[[rule]]
+name = "exec-on-node"
+types = ["exec"]
+threshold = 1
+window = "1m"
+target = "node"
+dry_run = true
+`)
+	require.Len(t, rules, 2)
+
+	locker := &mockLocker{locks: map[string]types.LockTarget{}, msgs: map[string]string{}}
+	setup(t)
+	state, err := NewState(startC)
+	require.NoError(t, err)
+
+	engine := NewLockRuleEngine(rules, state, locker, false)
+	ctx := context.Background()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	failedLogin := func(user string, ts time.Time) *TeleportEvent {
+		return newRuleEvent(t, "user.login", ts, map[string]interface{}{
+			"user": user, "success": false, "method": "local", "addr.remote": "10.0.0.1:1234",
+		})
+	}
+
+	// Events outside the window are not counted
+	require.NoError(t, engine.Process(ctx, failedLogin("alice", start)))
+	require.NoError(t, engine.Process(ctx, failedLogin("alice", start.Add(30*time.Second))))
+	require.NoError(t, engine.Process(ctx, failedLogin("alice", start.Add(2*time.Minute))))
+	require.Empty(t, locker.locks)
+
+	// Events are grouped by user
+	require.NoError(t, engine.Process(ctx, failedLogin("bob", start.Add(2*time.Minute))))
+	require.NoError(t, engine.Process(ctx, failedLogin("alice", start.Add(150*time.Second))))
+	require.Empty(t, locker.locks)
+
+	// Filter mismatch is not counted
+	require.NoError(t, engine.Process(ctx, newRuleEvent(t, "user.login", start.Add(150*time.Second), map[string]interface{}{
+		"user": "alice", "success": true, "method": "local",
+	})))
+	require.Empty(t, locker.locks)
+
+	require.NoError(t, engine.Process(ctx, failedLogin("alice", start.Add(160*time.Second))))
+	require.Len(t, locker.locks, 1)
+
+	name := lockNamePrefix + "failed-logins-user-alice"
+	require.Equal(t, types.LockTarget{User: "alice"}, locker.locks[name])
+	require.Equal(t, "alice locked after 3 failed logins from 10.0.0.1:1234", locker.msgs[name])
+
+	record, err := state.GetLockRecord(name)
+	require.NoError(t, err)
+	require.Equal(t, "failed-logins", record.Rule)
+	require.Equal(t, "rule/failed-logins/alice", record.Key)
+	require.Len(t, record.Events, 3)
+
+	// Allowlisted users are never locked
+	for i := 0; i < 3; i++ {
+		require.NoError(t, engine.Process(ctx, failedLogin("admin", start.Add(3*time.Minute))))
+	}
+	require.Len(t, locker.locks, 1)
+
+	// Dry run rules only log matches
+	require.NoError(t, engine.Process(ctx, newRuleEvent(t, "exec", start, map[string]interface{}{"server_id": "node-1"})))
+	require.Len(t, locker.locks, 1)
+
+	// The counters out of the rule windows are removed as the events go on
+	countKeys := func() int {
+		var n int
+		for range state.dv.KeysPrefix(lockEventsPrefix, nil) {
+			n++
+		}
+		return n
+	}
+	require.Equal(t, 1, countKeys())
+	require.NoError(t, engine.Process(ctx, failedLogin("carol", start.Add(time.Hour))))
+	require.Equal(t, 1, countKeys())
+
+	// The failed login counters are kept within their own window, and pruned without any rules
+	engine.SetRules(nil)
+	_, err = state.AddLockEvent(failedLoginLockKeyPrefix+"root", LockEvent{ID: "login-1", Time: start.Add(time.Hour)}, 2*time.Hour)
+	require.NoError(t, err)
+	require.NoError(t, engine.Process(ctx, failedLogin("dave", start.Add(2*time.Hour))))
+	require.Equal(t, 1, countKeys())
+	require.NoError(t, engine.Process(ctx, failedLogin("dave", start.Add(3*time.Hour+time.Minute))))
+	require.Zero(t, countKeys())
+}
+
+func TestLockRuleValidation(t *testing.T) {
+	for _, r := range []*LockRule{
+		{Threshold: 1, Window: "1m", Target: "user"},
+		{Name: "r", Window: "1m", Target: "user"},
+		{Name: "r", Threshold: 1, Window: "1x", Target: "user"},
+		{Name: "r", Threshold: 1, Window: "1m", Target: "cluster"},
+		{Name: "r", Threshold: 1, Window: "1m", Target: "role"},
+		{Name: "r", Threshold: 1, Window: "1m", Target: "user", Message: "{{"},
+	} {
+		require.Error(t, r.CheckAndSetDefaults())
+	}
+
+	r := &LockRule{Name: "r", Threshold: 1, Window: "1m", Target: "node"}
+	require.NoError(t, r.CheckAndSetDefaults())
+	require.Equal(t, "server_id", r.TargetField)
+	require.Equal(t, types.LockTarget{ServerID: "id"}, r.lockTarget("id"))
+}
+
+func TestLookupEventField(t *testing.T) {
+	fields := map[string]interface{}{
+		"addr.remote": "10.0.0.1",
+		"identity":    map[string]interface{}{"user": "alice"},
+	}
+
+	v, ok := lookupEventField(fields, "addr.remote")
+	require.True(t, ok)
+	require.Equal(t, "10.0.0.1", v)
+
+	v, ok = lookupEventField(fields, "identity.user")
+	require.True(t, ok)
+	require.Equal(t, "alice", v)
+
+	_, ok = lookupEventField(fields, "identity.login")
+	require.False(t, ok)
+}
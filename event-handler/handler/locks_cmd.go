@@ -0,0 +1,332 @@
+// Copyright 2024 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gravitational/teleport/api/types"
+	"github.com/gravitational/trace"
+)
+
+// locksClient is the Teleport client interface used by the lock management commands
+type locksClient interface {
+	// GetLocks gets all/in-force locks that match at least one of the targets when specified.
+	GetLocks(ctx context.Context, inForceOnly bool, targets ...types.LockTarget) ([]types.Lock, error)
+	// DeleteLock deletes a lock.
+	DeleteLock(ctx context.Context, name string) error
+}
+
+// Validate validates Teleport connection settings
+func (c *TeleportCmdConfig) Validate() error {
+	return trace.Wrap(c.TeleportConfig.Check())
+}
+
+// NewState opens the plugin state, returns nil if the storage directory is not configured
+func (c *TeleportCmdConfig) NewState() (*State, error) {
+	if c.StorageDir == "" {
+		return nil, nil
+	}
+
+	s, err := NewState(&StartCmdConfig{
+		TeleportConfig: TeleportConfig{TeleportAddr: c.TeleportAddr},
+		IngestConfig:   IngestConfig{StorageDir: c.StorageDir},
+	})
+
+	return s, trace.Wrap(err)
+}
+
+// RunLocksListCmd prints the locks created by the plugin
+func RunLocksListCmd(c *LocksListCmdConfig) error {
+	ctx := context.Background()
+
+	client, err := newTeleportClient(ctx, &c.TeleportConfig)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer client.Close()
+
+	s, err := c.NewState()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	return trace.Wrap(listHandlerLocks(ctx, client, s, os.Stdout))
+}
+
+// RunLocksShowCmd prints the lock created by the plugin along with the events which triggered it
+func RunLocksShowCmd(c *LocksShowCmdConfig) error {
+	ctx := context.Background()
+
+	client, err := newTeleportClient(ctx, &c.TeleportConfig)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer client.Close()
+
+	s, err := c.NewState()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	return trace.Wrap(showHandlerLock(ctx, client, s, c.Name, os.Stdout))
+}
+
+// RunLocksReleaseCmd removes the locks created by the plugin
+func RunLocksReleaseCmd(c *LocksReleaseCmdConfig) error {
+	if !c.All && c.OlderThan == 0 && len(c.Names) == 0 {
+		return trace.BadParameter("specify names of the locks to release, --all or --older-than")
+	}
+
+	ctx := context.Background()
+
+	client, err := newTeleportClient(ctx, &c.TeleportConfig)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer client.Close()
+
+	s, err := c.NewState()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	return trace.Wrap(releaseHandlerLocks(ctx, client, s, c.Names, c.OlderThan, time.Now(), os.Stdout))
+}
+
+// isHandlerLock returns true if the lock was created by the plugin
+func isHandlerLock(l types.Lock) bool {
+	if strings.HasPrefix(l.GetName(), lockNamePrefix) {
+		return true
+	}
+
+	_, ok := l.GetStaticLabels()[lockRuleLabel]
+
+	return ok
+}
+
+// getHandlerLocks returns the locks created by the plugin sorted by name
+func getHandlerLocks(ctx context.Context, client locksClient) ([]types.Lock, error) {
+	locks, err := client.GetLocks(ctx, false)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	var r []types.Lock
+	for _, l := range locks {
+		if isHandlerLock(l) {
+			r = append(r, l)
+		}
+	}
+
+	sort.Slice(r, func(i, j int) bool { return r[i].GetName() < r[j].GetName() })
+
+	return r, nil
+}
+
+// getLockRecord returns the lock record, nil if the state is not available or there is no record
+func getLockRecord(s *State, name string) (*LockRecord, error) {
+	if s == nil {
+		return nil, nil
+	}
+
+	r, err := s.GetLockRecord(name)
+	return r, trace.Wrap(err)
+}
+
+// formatLockTime formats lock time for the command output
+func formatLockTime(t *time.Time, zero string) string {
+	if t == nil || t.IsZero() {
+		return zero
+	}
+
+	return t.UTC().Format(time.RFC3339)
+}
+
+// lockCreatedAt returns the lock creation time, taken from the lock record if the lock does not have one
+func lockCreatedAt(l types.Lock, r *LockRecord) time.Time {
+	t := l.CreatedAt()
+	if t.IsZero() && r != nil {
+		t = r.CreatedAt
+	}
+
+	return t
+}
+
+// listHandlerLocks writes the table of the locks created by the plugin to w
+func listHandlerLocks(ctx context.Context, client locksClient, s *State, w io.Writer) error {
+	locks, err := getHandlerLocks(ctx, client)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	if len(locks) == 0 {
+		fmt.Fprintln(w, "No locks created by the event handler")
+		return nil
+	}
+
+	t := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(t, "NAME\tRULE\tTARGET\tCREATED\tEXPIRES\tEVENTS")
+	for _, l := range locks {
+		r, err := getLockRecord(s, l.GetName())
+		if err != nil {
+			return trace.Wrap(err)
+		}
+
+		events := "-"
+		if r != nil {
+			events = fmt.Sprint(len(r.Events))
+		}
+
+		created := lockCreatedAt(l, r)
+		fmt.Fprintf(t, "%v\t%v\t%v\t%v\t%v\t%v\n",
+			l.GetName(),
+			l.GetStaticLabels()[lockRuleLabel],
+			l.Target().String(),
+			formatLockTime(&created, "-"),
+			formatLockTime(l.LockExpiry(), "never"),
+			events,
+		)
+	}
+
+	return trace.Wrap(t.Flush())
+}
+
+// showHandlerLock writes the lock details and the events which triggered it to w
+func showHandlerLock(ctx context.Context, client locksClient, s *State, name string, w io.Writer) error {
+	locks, err := getHandlerLocks(ctx, client)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	var lock types.Lock
+	for _, l := range locks {
+		if l.GetName() == name {
+			lock = l
+			break
+		}
+	}
+	if lock == nil {
+		return trace.NotFound("lock %v created by the event handler is not found", name)
+	}
+
+	r, err := getLockRecord(s, name)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	created := lockCreatedAt(lock, r)
+
+	t := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(t, "Name:\t%v\n", lock.GetName())
+	fmt.Fprintf(t, "Rule:\t%v\n", lock.GetStaticLabels()[lockRuleLabel])
+	fmt.Fprintf(t, "Target:\t%v\n", lock.Target().String())
+	fmt.Fprintf(t, "Message:\t%v\n", lock.Message())
+	fmt.Fprintf(t, "Created:\t%v\n", formatLockTime(&created, "-"))
+	fmt.Fprintf(t, "Expires:\t%v\n", formatLockTime(lock.LockExpiry(), "never"))
+	fmt.Fprintf(t, "In force:\t%v\n", lock.IsInForce(time.Now()))
+	if err := t.Flush(); err != nil {
+		return trace.Wrap(err)
+	}
+
+	if r == nil {
+		fmt.Fprintln(w, "\nTriggering events are unknown")
+		return nil
+	}
+
+	fmt.Fprintln(w, "\nTriggering events:")
+	t = tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(t, "ID\tTYPE\tTIME")
+	for _, e := range r.Events {
+		fmt.Fprintf(t, "%v\t%v\t%v\n", e.ID, e.Type, formatLockTime(&e.Time, "-"))
+	}
+
+	return trace.Wrap(t.Flush())
+}
+
+// releaseHandlerLocks removes the locks created by the plugin along with their records and auto-locking counters.
+// If names are empty, all the locks are removed.
+// If olderThan is set, only the locks created before now-olderThan are removed.
+func releaseHandlerLocks(ctx context.Context, client locksClient, s *State, names []string, olderThan time.Duration, now time.Time, w io.Writer) error {
+	locks, err := getHandlerLocks(ctx, client)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	byName := make(map[string]types.Lock, len(locks))
+	for _, l := range locks {
+		byName[l.GetName()] = l
+	}
+
+	if len(names) == 0 {
+		names = make([]string, 0, len(locks))
+		for _, l := range locks {
+			names = append(names, l.GetName())
+		}
+	}
+
+	var errs []error
+	for _, name := range names {
+		l, ok := byName[name]
+		if !ok {
+			errs = append(errs, trace.NotFound("lock %v created by the event handler is not found", name))
+			continue
+		}
+
+		r, err := getLockRecord(s, name)
+		if err != nil {
+			errs = append(errs, trace.Wrap(err))
+			continue
+		}
+
+		if olderThan > 0 {
+			created := lockCreatedAt(l, r)
+			if created.IsZero() || created.After(now.Add(-olderThan)) {
+				continue
+			}
+		}
+
+		if err := client.DeleteLock(ctx, name); err != nil {
+			errs = append(errs, trace.Wrap(err))
+			continue
+		}
+
+		// The events counted while the target was locked must not lock it again right away
+		if r != nil && r.Key != "" {
+			if err := s.ResetLockEvents(r.Key); err != nil {
+				errs = append(errs, trace.Wrap(err))
+				continue
+			}
+		}
+
+		if s != nil {
+			if err := s.RemoveLockRecord(name); err != nil {
+				errs = append(errs, trace.Wrap(err))
+				continue
+			}
+		}
+
+		fmt.Fprintf(w, "Lock %v is released\n", name)
+	}
+
+	return trace.NewAggregate(errs...)
+}
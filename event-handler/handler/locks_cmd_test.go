@@ -0,0 +1,136 @@
+// Copyright 2024 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gravitational/teleport/api/types"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeLocksClient keeps locks in memory
+type fakeLocksClient struct {
+	locks map[string]types.Lock
+}
+
+func (c *fakeLocksClient) GetLocks(_ context.Context, _ bool, _ ...types.LockTarget) ([]types.Lock, error) {
+	var r []types.Lock
+	for _, l := range c.locks {
+		r = append(r, l)
+	}
+	return r, nil
+}
+
+func (c *fakeLocksClient) DeleteLock(_ context.Context, name string) error {
+	delete(c.locks, name)
+	return nil
+}
+
+// newTestLock creates a lock created at the given time
+func newTestLock(t *testing.T, name string, labels map[string]string, createdAt time.Time) types.Lock {
+	l, err := types.NewLock(name, types.LockSpecV2{
+		Target:    types.LockTarget{User: "alice"},
+		CreatedAt: createdAt,
+	})
+	require.NoError(t, err)
+	l.SetStaticLabels(labels)
+
+	return l
+}
+
+func TestHandlerLocks(t *testing.T) {
+	setup(t)
+
+	state, err := NewState(startC)
+	require.NoError(t, err)
+
+	now := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	client := &fakeLocksClient{locks: map[string]types.Lock{}}
+	for _, l := range []types.Lock{
+		newTestLock(t, lockNamePrefix+"alice-root", nil, now.Add(-48*time.Hour)),
+		newTestLock(t, "custom", map[string]string{lockRuleLabel: "exec"}, now.Add(-time.Hour)),
+		newTestLock(t, "manual", nil, now.Add(-48*time.Hour)),
+	} {
+		client.locks[l.GetName()] = l
+	}
+
+	ctx := context.Background()
+
+	// The lock record is created by the failed login auto-locking
+	app := &App{State: state, EventWatcher: newTeleportEventWatcher(t, &mockTeleportEventWatcher{})}
+	app.config.Store(&StartCmdConfig{LockConfig: LockConfig{LockEnabled: true, LockFailedAttemptsCount: 1, LockPeriod: time.Hour}})
+	j := &EventsJob{app: app}
+	failedLogin := func(id string) *TeleportEvent {
+		evt := &TeleportEvent{ID: id, Type: loginType, Time: now, IsFailedLogin: true}
+		evt.FailedLoginData.User = "alice"
+		evt.FailedLoginData.Login = "root"
+		return evt
+	}
+	require.NoError(t, j.TryLockUser(ctx, failedLogin("evt-0")))
+	require.NoError(t, j.TryLockUser(ctx, failedLogin("evt-1")))
+
+	r, err := state.GetLockRecord(lockNamePrefix + "alice-root")
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	require.Equal(t, failedLoginLockKeyPrefix+"root", r.Key)
+
+	// The event counted while the target is locked
+	require.NoError(t, j.TryLockUser(ctx, failedLogin("evt-2")))
+
+	var out bytes.Buffer
+	require.NoError(t, listHandlerLocks(ctx, client, state, &out))
+	require.Contains(t, out.String(), lockNamePrefix+"alice-root")
+	require.Contains(t, out.String(), "custom")
+	require.NotContains(t, out.String(), "manual")
+
+	out.Reset()
+	require.NoError(t, showHandlerLock(ctx, client, state, lockNamePrefix+"alice-root", &out))
+	require.Contains(t, out.String(), "evt-1")
+	require.Contains(t, out.String(), "evt-0")
+
+	// Locks not created by the handler are never touched
+	require.Error(t, showHandlerLock(ctx, client, state, "manual", &out))
+	require.Error(t, releaseHandlerLocks(ctx, client, state, []string{"manual"}, 0, now, &out))
+	require.Contains(t, client.locks, "manual")
+
+	// Only the locks older than a day are released
+	require.NoError(t, releaseHandlerLocks(ctx, client, state, nil, 24*time.Hour, now, &out))
+	require.NotContains(t, client.locks, lockNamePrefix+"alice-root")
+	require.Contains(t, client.locks, "custom")
+	require.Contains(t, client.locks, "manual")
+
+	r, err = state.GetLockRecord(lockNamePrefix + "alice-root")
+	require.NoError(t, err)
+	require.Nil(t, r)
+
+	// The counter of the released lock starts over, so the next failed login does not lock the user again
+	require.NoError(t, j.TryLockUser(ctx, failedLogin("evt-3")))
+	r, err = state.GetLockRecord(lockNamePrefix + "alice-root")
+	require.NoError(t, err)
+	require.Nil(t, r)
+
+	require.NoError(t, releaseHandlerLocks(ctx, client, state, nil, 0, now, &out))
+	require.Equal(t, []string{"manual"}, func() []string {
+		var names []string
+		for name := range client.locks {
+			names = append(names, name)
+		}
+		return names
+	}())
+}
@@ -0,0 +1,134 @@
+// Copyright 2024 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gravitational/teleport/integrations/lib/logger"
+	"github.com/gravitational/trace"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	// metricsNamespace is the namespace of the plugin metrics
+	metricsNamespace = "teleport_event_handler"
+
+	// metricsShutdownTimeout is the metrics server graceful shutdown timeout
+	metricsShutdownTimeout = 5 * time.Second
+)
+
+// sessionMetrics are the session ingestion metrics of the app
+type sessionMetrics struct {
+	// ingestFailures counts sessions which ingestion failed after all retries
+	ingestFailures prometheus.Counter
+	// quarantinedTotal counts sessions moved to quarantine
+	quarantinedTotal prometheus.Counter
+	// quarantined is the number of sessions currently in quarantine
+	quarantined prometheus.Gauge
+}
+
+// newSessionMetrics creates new sessionMetrics
+func newSessionMetrics() *sessionMetrics {
+	return &sessionMetrics{
+		ingestFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "session_ingest_failures_total",
+			Help:      "Number of session ingestion attempts which failed after all retries",
+		}),
+		quarantinedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "sessions_quarantined_total",
+			Help:      "Number of sessions moved to quarantine",
+		}),
+		quarantined: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "sessions_quarantined",
+			Help:      "Number of sessions currently in quarantine",
+		}),
+	}
+}
+
+// collectors returns the collectors of the metrics
+func (m *sessionMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.ingestFailures, m.quarantinedTotal, m.quarantined}
+}
+
+// registerMetrics registers the app metrics along with the Go runtime and process metrics on r. The runtime
+// metrics registered already are skipped, so the apps of several clusters can share the registry. The app
+// metrics are registered with the labels telling the apps apart, they can't be registered twice.
+func registerMetrics(r prometheus.Registerer, labels prometheus.Labels, metrics []prometheus.Collector) error {
+	for _, m := range []prometheus.Collector{
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	} {
+		var registered prometheus.AlreadyRegisteredError
+		err := r.Register(m)
+		if errors.As(err, &registered) {
+			continue
+		}
+		if err != nil {
+			return trace.Wrap(err)
+		}
+	}
+
+	if len(labels) > 0 {
+		r = prometheus.WrapRegistererWith(labels, r)
+	}
+	for _, m := range metrics {
+		if err := r.Register(m); err != nil {
+			return trace.Wrap(err, "app metrics are registered already, every app needs its own registry")
+		}
+	}
+
+	return nil
+}
+
+// serveMetrics serves Prometheus metrics gathered by g on the given address until the context is canceled
+func serveMetrics(ctx context.Context, addr string, g prometheus.Gatherer) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(g, promhttp.HandlerOpts{}))
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: httpTimeout,
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), metricsShutdownTimeout)
+		defer cancel()
+
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			logger.Get(ctx).WithError(err).Warn("Failed to shut down metrics server")
+		}
+	}()
+
+	logger.Get(ctx).WithField("addr", addr).Info("Serving metrics")
+
+	err := server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+
+	return trace.Wrap(err)
+}
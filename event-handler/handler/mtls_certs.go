@@ -14,9 +14,13 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
-package main
+package handler
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
@@ -29,6 +33,15 @@ import (
 	"github.com/gravitational/trace"
 )
 
+const (
+	// keyTypeRSA is the RSA private key type
+	keyTypeRSA = "rsa"
+	// keyTypeECDSA is the ECDSA P-256 private key type
+	keyTypeECDSA = "ecdsa"
+	// keyTypeEd25519 is the Ed25519 private key type
+	keyTypeEd25519 = "ed25519"
+)
+
 // MTLSCerts is the result for mTLS struct generator
 type MTLSCerts struct {
 	// caCert is a CA certificate struct used to generate mTLS CA cert and private key
@@ -48,19 +61,66 @@ type MTLSCerts struct {
 // keyPair is the pair of certificate and private key
 type keyPair struct {
 	// PrivateKey represents certificate private key
-	PrivateKey *rsa.PrivateKey
+	PrivateKey crypto.Signer
 	// Certificate represents certificate
 	Certificate []byte
 }
 
 // GenerateMTLSCerts creates new MTLS certificate generator
-func GenerateMTLSCerts(dnsNames []string, ips []string, ttl time.Duration, length int) (*MTLSCerts, error) {
+func GenerateMTLSCerts(dnsNames []string, ips []string, ttl time.Duration, keyType string, length int) (*MTLSCerts, error) {
 	notBefore := time.Now()
 	notAfter := notBefore.Add(ttl)
 
-	caDistinguishedName := pkix.Name{
-		CommonName: "CA",
+	c, err := newMTLSCerts(pkix.Name{CommonName: "CA"}, dnsNames, ips, notBefore, notAfter)
+	if err != nil {
+		return nil, trace.Wrap(err)
 	}
+
+	// Run the generator
+	err = c.generate(keyType, length)
+	if err != nil {
+		return c, err
+	}
+
+	return c, nil
+}
+
+// RotateMTLSCerts reissues server and client certificates signed by the existing CA. Certificates do not
+// outlive the CA.
+func RotateMTLSCerts(ca *keyPair, dnsNames []string, ips []string, ttl time.Duration, keyType string, length int) (*MTLSCerts, error) {
+	caCert, err := x509.ParseCertificate(ca.Certificate)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	notBefore := time.Now()
+	if !notBefore.Before(caCert.NotAfter) {
+		return nil, trace.BadParameter("CA certificate has expired at %v, run configure to generate new CA", caCert.NotAfter)
+	}
+
+	notAfter := notBefore.Add(ttl)
+	if notAfter.After(caCert.NotAfter) {
+		notAfter = caCert.NotAfter
+	}
+
+	c, err := newMTLSCerts(caCert.Subject, dnsNames, ips, notBefore, notAfter)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	c.caCert = *caCert
+	c.CACert = ca
+
+	err = c.generateLeafs(keyType, length)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	return c, nil
+}
+
+// newMTLSCerts creates the generator with CA, server and client certificate templates
+func newMTLSCerts(caDistinguishedName pkix.Name, dnsNames []string, ips []string, notBefore, notAfter time.Time) (*MTLSCerts, error) {
 	serverDistinguishedName := pkix.Name{
 		CommonName: "Server",
 	}
@@ -127,12 +187,6 @@ func GenerateMTLSCerts(dnsNames []string, ips []string, ttl time.Duration, lengt
 		return nil, trace.Wrap(err)
 	}
 
-	// Run the generator
-	err = c.generate(length)
-	if err != nil {
-		return c, err
-	}
-
 	return c, nil
 }
 
@@ -161,20 +215,25 @@ func (c MTLSCerts) appendSANs(cert *x509.Certificate, dnsNames []string, ips []s
 }
 
 // Generate generates CA, server and client certificates
-func (c *MTLSCerts) generate(length int) error {
-	caPK, caCertBytes, err := c.genCertAndPK(length, &c.caCert, nil, nil)
+func (c *MTLSCerts) generate(keyType string, length int) error {
+	caPK, caCertBytes, err := c.genCertAndPK(keyType, length, &c.caCert, nil, nil)
 	if err != nil {
 		return trace.Wrap(err)
 	}
 	c.CACert = &keyPair{caPK, caCertBytes}
 
-	serverPK, serverCertBytes, err := c.genCertAndPK(length, &c.serverCert, &c.caCert, caPK)
+	return trace.Wrap(c.generateLeafs(keyType, length))
+}
+
+// generateLeafs generates server and client certificates signed by the CA
+func (c *MTLSCerts) generateLeafs(keyType string, length int) error {
+	serverPK, serverCertBytes, err := c.genCertAndPK(keyType, length, &c.serverCert, &c.caCert, c.CACert.PrivateKey)
 	if err != nil {
 		return trace.Wrap(err)
 	}
 	c.ServerCert = &keyPair{serverPK, serverCertBytes}
 
-	clientPK, clientCertBytes, err := c.genCertAndPK(length, &c.clientCert, &c.caCert, caPK)
+	clientPK, clientCertBytes, err := c.genCertAndPK(keyType, length, &c.clientCert, &c.caCert, c.CACert.PrivateKey)
 	if err != nil {
 		return trace.Wrap(err)
 	}
@@ -184,9 +243,9 @@ func (c *MTLSCerts) generate(length int) error {
 }
 
 // genCertAndPK generates and returns certificate and primary key
-func (c *MTLSCerts) genCertAndPK(length int, cert *x509.Certificate, parent *x509.Certificate, signer *rsa.PrivateKey) (*rsa.PrivateKey, []byte, error) {
+func (c *MTLSCerts) genCertAndPK(keyType string, length int, cert *x509.Certificate, parent *x509.Certificate, signer crypto.Signer) (crypto.Signer, []byte, error) {
 	// Generate PK
-	pk, err := rsa.GenerateKey(rand.Reader, length)
+	pk, err := generatePrivateKey(keyType, length)
 	if err != nil {
 		return nil, nil, trace.Wrap(err)
 	}
@@ -204,7 +263,7 @@ func (c *MTLSCerts) genCertAndPK(length int, cert *x509.Certificate, parent *x50
 	}
 
 	// Generate and sign cert
-	certBytes, err := x509.CreateCertificate(rand.Reader, cert, p, &pk.PublicKey, s)
+	certBytes, err := x509.CreateCertificate(rand.Reader, cert, p, pk.Public(), s)
 	if err != nil {
 		return nil, nil, trace.Wrap(err)
 	}
@@ -212,11 +271,109 @@ func (c *MTLSCerts) genCertAndPK(length int, cert *x509.Certificate, parent *x50
 	return pk, certBytes, nil
 }
 
+// generatePrivateKey generates the private key of the given type, length is used for RSA keys only
+func generatePrivateKey(keyType string, length int) (crypto.Signer, error) {
+	switch keyType {
+	case keyTypeRSA, "":
+		pk, err := rsa.GenerateKey(rand.Reader, length)
+		return pk, trace.Wrap(err)
+	case keyTypeECDSA:
+		pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		return pk, trace.Wrap(err)
+	case keyTypeEd25519:
+		_, pk, err := ed25519.GenerateKey(rand.Reader)
+		return pk, trace.Wrap(err)
+	default:
+		return nil, trace.BadParameter("unsupported key type %v", keyType)
+	}
+}
+
+// marshalPrivateKey returns the PEM block of the private key
+func marshalPrivateKey(pk crypto.Signer) (*pem.Block, error) {
+	switch k := pk.(type) {
+	case *rsa.PrivateKey:
+		return &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}, nil
+	case *ecdsa.PrivateKey:
+		b, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		return &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}, nil
+	default:
+		b, err := x509.MarshalPKCS8PrivateKey(k)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		return &pem.Block{Type: "PRIVATE KEY", Bytes: b}, nil
+	}
+}
+
+// parsePrivateKey parses the unencrypted PEM encoded private key
+func parsePrivateKey(b []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, trace.BadParameter("private key is not PEM encoded")
+	}
+
+	//nolint:staticcheck // deprecated, but private keys are encrypted this way because of fluentd requirements
+	if x509.IsEncryptedPEMBlock(block) {
+		return nil, trace.BadParameter("private key is encrypted")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		pk, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		return pk, trace.Wrap(err)
+	case "EC PRIVATE KEY":
+		pk, err := x509.ParseECPrivateKey(block.Bytes)
+		return pk, trace.Wrap(err)
+	}
+
+	pk, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	signer, ok := pk.(crypto.Signer)
+	if !ok {
+		return nil, trace.BadParameter("unsupported private key type %T", pk)
+	}
+
+	return signer, nil
+}
+
+// ReadKeyPairFile reads the certificate and the unencrypted private key
+func ReadKeyPairFile(certPath, keyPath string) (*keyPair, error) {
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, trace.ConvertSystemError(err)
+	}
+
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, trace.BadParameter("%v is not a PEM encoded certificate", certPath)
+	}
+
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, trace.ConvertSystemError(err)
+	}
+
+	pk, err := parsePrivateKey(keyPEM)
+	if err != nil {
+		return nil, trace.Wrap(err, "reading %v", keyPath)
+	}
+
+	return &keyPair{pk, block.Bytes}, nil
+}
+
 // EncodeToMemory returns PEM config of certificate and private key
 func (c *keyPair) EncodeToMemory(pwd string) ([]byte, []byte, error) {
-	var err error
+	pkBlock, err := marshalPrivateKey(c.PrivateKey)
+	if err != nil {
+		return nil, nil, trace.Wrap(err)
+	}
 
-	pkBlock := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(c.PrivateKey)}
 	bytesPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Certificate})
 
 	// Encrypt with passphrase
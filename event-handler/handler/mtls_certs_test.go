@@ -0,0 +1,138 @@
+/*
+Copyright 2015-2022 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateClientCertFile(t *testing.T) {
+	td := t.TempDir()
+	cp := "client.crt"
+	kp := "client.key"
+
+	// Generate certs in memory
+	certs, err := GenerateMTLSCerts([]string{"localhost"}, nil, time.Second, keyTypeRSA, 1024)
+	require.NoError(t, err)
+	require.NotNil(t, certs.caCert.Issuer)
+	require.NotNil(t, certs.clientCert.Issuer)
+	require.NotNil(t, certs.serverCert.Issuer)
+	// don't be self-signed
+	require.NotEqual(t, certs.serverCert.Issuer, certs.serverCert.Subject)
+	require.NotEqual(t, certs.clientCert.Issuer, certs.clientCert.Subject)
+	// leaf certs should have SANs
+	require.NotEmpty(t, certs.serverCert.DNSNames)
+	require.NotEmpty(t, certs.clientCert.DNSNames)
+	// leaf certs should be issued by the CA
+	require.Equal(t, certs.serverCert.Issuer, certs.caCert.Subject)
+	require.Equal(t, certs.clientCert.Issuer, certs.caCert.Subject)
+
+	// make sure leaf certs are not CA certs
+	require.NotEqual(t, certs.caCert.Subject.CommonName, certs.clientCert.Subject.CommonName, "CA and client certs should be different")
+	require.NotEqual(t, certs.caCert.Subject.CommonName, certs.serverCert.Subject.CommonName, "CA and server certs should be different")
+
+	// leaf certs should have SAN
+	require.NotEmpty(t, certs.serverCert.DNSNames)
+	require.NotEmpty(t, certs.clientCert.DNSNames)
+	// server leaf cert should have SAN DNS:localhost
+	require.Equal(t, "localhost", certs.serverCert.DNSNames[0])
+
+	// Write the cert to the tempdir
+	err = certs.ClientCert.WriteFile(path.Join(td, cp), path.Join(td, kp), ".")
+	require.NoError(t, err)
+	f, err := os.Open(path.Join(td, cp))
+	require.NoError(t, err)
+	b, err := io.ReadAll(f)
+	require.NoError(t, err)
+	der, _ := pem.Decode(b)
+	rc, err := x509.ParseCertificate(der.Bytes)
+	require.NoError(t, err)
+	require.Equal(t, certs.clientCert.Issuer.CommonName, rc.Issuer.CommonName)
+}
+
+func TestGenerateKeyTypes(t *testing.T) {
+	for _, keyType := range []string{keyTypeRSA, keyTypeECDSA, keyTypeEd25519} {
+		t.Run(keyType, func(t *testing.T) {
+			td := t.TempDir()
+
+			certs, err := GenerateMTLSCerts([]string{"localhost"}, []string{"127.0.0.1"}, time.Hour, keyType, 1024)
+			require.NoError(t, err)
+
+			// Keys are readable by the Fluentd client
+			err = certs.ClientCert.WriteFile(path.Join(td, "client.crt"), path.Join(td, "client.key"), "")
+			require.NoError(t, err)
+			_, err = tls.LoadX509KeyPair(path.Join(td, "client.crt"), path.Join(td, "client.key"))
+			require.NoError(t, err)
+
+			// Server key is encrypted with the password
+			err = certs.ServerCert.WriteFile(path.Join(td, "server.crt"), path.Join(td, "server.key"), "secret")
+			require.NoError(t, err)
+			_, err = ReadKeyPairFile(path.Join(td, "server.crt"), path.Join(td, "server.key"))
+			require.Error(t, err)
+
+			verifyLeafCert(t, certs.CACert, certs.ServerCert, x509.ExtKeyUsageServerAuth)
+		})
+	}
+}
+
+func TestRotateMTLSCerts(t *testing.T) {
+	td := t.TempDir()
+	caCertPath, caKeyPath := path.Join(td, "ca.crt"), path.Join(td, "ca.key")
+
+	certs, err := GenerateMTLSCerts([]string{"localhost"}, []string{"127.0.0.1"}, 48*time.Hour, keyTypeECDSA, 0)
+	require.NoError(t, err)
+	require.NoError(t, certs.CACert.WriteFile(caCertPath, caKeyPath, ""))
+
+	ca, err := ReadKeyPairFile(caCertPath, caKeyPath)
+	require.NoError(t, err)
+
+	rotated, err := RotateMTLSCerts(ca, []string{"localhost"}, []string{"127.0.0.1"}, time.Hour, keyTypeEd25519, 0)
+	require.NoError(t, err)
+	require.Equal(t, certs.CACert.Certificate, rotated.CACert.Certificate)
+	require.NotEqual(t, certs.ServerCert.Certificate, rotated.ServerCert.Certificate)
+
+	verifyLeafCert(t, ca, rotated.ServerCert, x509.ExtKeyUsageServerAuth)
+	verifyLeafCert(t, ca, rotated.ClientCert, x509.ExtKeyUsageClientAuth)
+
+	// Certificates never outlive the CA
+	rotated, err = RotateMTLSCerts(ca, []string{"localhost"}, []string{"127.0.0.1"}, 72*time.Hour, keyTypeRSA, 1024)
+	require.NoError(t, err)
+	require.True(t, rotated.caCert.NotAfter.Equal(rotated.clientCert.NotAfter))
+	require.Equal(t, certs.caCert.NotAfter.Unix(), rotated.clientCert.NotAfter.Unix())
+}
+
+// verifyLeafCert checks that the certificate is issued by the CA
+func verifyLeafCert(t *testing.T, ca, leaf *keyPair, usage x509.ExtKeyUsage) {
+	caCert, err := x509.ParseCertificate(ca.Certificate)
+	require.NoError(t, err)
+	leafCert, err := x509.ParseCertificate(leaf.Certificate)
+	require.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+	_, err = leafCert.Verify(x509.VerifyOptions{Roots: pool, KeyUsages: []x509.ExtKeyUsage{usage}})
+	require.NoError(t, err)
+}
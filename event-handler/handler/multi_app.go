@@ -0,0 +1,211 @@
+// Copyright 2024 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+
+	"github.com/gravitational/teleport/integrations/lib/logger"
+	"github.com/gravitational/trace"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MultiApp runs an independent App for every Teleport cluster. Every App has its own process, so a failing
+// cluster does not terminate the others.
+type MultiApp struct {
+	// apps is the list of apps, one per cluster
+	apps []*App
+	// metricsAddr is the address metrics are served on, shared by all clusters
+	metricsAddr string
+	// metrics is the registry shared by all clusters
+	metrics *prometheus.Registry
+}
+
+// NewMultiApp creates new MultiApp instance
+func NewMultiApp(configs []*StartCmdConfig) (*MultiApp, error) {
+	if err := checkClusterConfigs(configs); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	m := &MultiApp{metricsAddr: configs[0].MetricsAddr, metrics: prometheus.NewRegistry()}
+
+	for _, c := range configs {
+		// Metrics are served once for all the clusters
+		c.MetricsAddr = ""
+
+		app, err := NewApp(c)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		app.Metrics = m.metrics
+		app.metricsLabels = prometheus.Labels{"cluster": c.EventSource()}
+
+		m.apps = append(m.apps, app)
+	}
+
+	return m, nil
+}
+
+// checkClusterConfigs verifies that cluster configurations do not clash
+func checkClusterConfigs(configs []*StartCmdConfig) error {
+	if len(configs) == 0 {
+		return trace.BadParameter("no Teleport clusters configured")
+	}
+
+	storageDirs := make(map[string]struct{}, len(configs))
+	tailAddrs := make(map[string]struct{}, len(configs))
+	indexPaths := make(map[string]struct{}, len(configs))
+	for _, c := range configs {
+		// Live tail is served separately for every cluster
+		if c.TailAddr != "" {
+			if _, ok := tailAddrs[c.TailAddr]; ok {
+				return trace.BadParameter("tail-addr %v is configured for more than one Teleport cluster", c.TailAddr)
+			}
+			tailAddrs[c.TailAddr] = struct{}{}
+		}
+
+		// The index is opened by one cluster only
+		if c.IndexPath != "" {
+			path, err := filepath.Abs(c.IndexPath)
+			if err != nil {
+				return trace.Wrap(err)
+			}
+			if _, ok := indexPaths[path]; ok {
+				return trace.BadParameter("index-path %v is configured for more than one Teleport cluster", c.IndexPath)
+			}
+			indexPaths[path] = struct{}{}
+		}
+
+		// Storage is kept separately for every Teleport host and port, or data directory
+		dir, err := storageDirName(c)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		if _, ok := storageDirs[dir]; ok {
+			return trace.BadParameter("Teleport cluster %v is configured more than once", c.EventSource())
+		}
+		storageDirs[dir] = struct{}{}
+	}
+
+	return nil
+}
+
+// Run runs the apps and waits for all of them to finish
+func (m *MultiApp) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if m.metricsAddr != "" {
+		go func() {
+			if err := serveMetrics(ctx, m.metricsAddr, m.metrics); err != nil {
+				logger.Get(ctx).WithError(err).Error("Metrics server failed")
+			}
+		}()
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(m.apps))
+
+	for i, app := range m.apps {
+		wg.Add(1)
+		go func(i int, app *App) {
+			defer wg.Done()
+
+			ctx := logger.SetField(ctx, "cluster", app.Config().EventSource())
+
+			errs[i] = app.Run(ctx)
+			if errs[i] != nil {
+				logger.Get(ctx).WithError(errs[i]).Error("Cluster ingestion failed")
+			}
+		}(i, app)
+	}
+
+	wg.Wait()
+
+	return trace.NewAggregate(errs...)
+}
+
+// Shutdown gracefully terminates all the apps
+func (m *MultiApp) Shutdown(ctx context.Context) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(m.apps))
+
+	for i, app := range m.apps {
+		wg.Add(1)
+		go func(i int, app *App) {
+			defer wg.Done()
+			errs[i] = app.Shutdown(ctx)
+		}(i, app)
+	}
+
+	wg.Wait()
+
+	return trace.NewAggregate(errs...)
+}
+
+// Close terminates all the apps immediately
+func (m *MultiApp) Close() {
+	for _, app := range m.apps {
+		app.Close()
+	}
+}
+
+// Reload applies the configurations re-read at runtime to the apps of the respective clusters. Clusters can
+// not be added or removed at runtime.
+func (m *MultiApp) Reload(ctx context.Context, configs []*StartCmdConfig) error {
+	if err := checkClusterConfigs(configs); err != nil {
+		return trace.Wrap(err)
+	}
+
+	// The clusters are told apart by their storage directory names
+	byDir := make(map[string]*StartCmdConfig, len(configs))
+	for _, c := range configs {
+		dir, err := storageDirName(c)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		byDir[dir] = c
+	}
+
+	reloaded := make([]*StartCmdConfig, len(m.apps))
+	for i, app := range m.apps {
+		dir, err := storageDirName(app.Config())
+		if err != nil {
+			return trace.Wrap(err)
+		}
+
+		c, ok := byDir[dir]
+		if !ok || len(configs) != len(m.apps) {
+			return trace.BadParameter("Teleport clusters can not be added or removed at runtime, restart the handler to apply it")
+		}
+		reloaded[i] = c
+	}
+
+	var errs []error
+	for i, app := range m.apps {
+		c := reloaded[i]
+		// Metrics are served once for all the clusters
+		c.MetricsAddr = ""
+
+		ctx := logger.SetField(ctx, "cluster", c.EventSource())
+		if err := app.Reload(ctx, c); err != nil {
+			errs = append(errs, trace.Wrap(err))
+		}
+	}
+
+	return trace.NewAggregate(errs...)
+}
@@ -0,0 +1,556 @@
+// Copyright 2024 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gravitational/teleport/integrations/lib/backoff"
+	"github.com/gravitational/teleport/integrations/lib/logger"
+	"github.com/gravitational/trace"
+	"github.com/jonboulle/clockwork"
+	"github.com/prometheus/client_golang/prometheus"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// otlpProtocolHTTP is OTLP over HTTP with binary protobuf payloads
+	otlpProtocolHTTP = "http/protobuf"
+	// otlpProtocolGRPC is OTLP over gRPC
+	otlpProtocolGRPC = "grpc"
+
+	// otlpLogsPath is the default OTLP/HTTP logs path appended to the endpoint without a path
+	otlpLogsPath = "/v1/logs"
+
+	// otlpServiceName is the service.name resource attribute value
+	otlpServiceName = "teleport-event-handler"
+
+	// otlpBackoffBase is the initial delay of the export retries
+	otlpBackoffBase = 5 * time.Second
+	// otlpBackoffMax is the maximum delay between the export retries
+	otlpBackoffMax = 30 * time.Second
+	// otlpMaxElapsed is the time after which a batch which still fails to export is dropped
+	otlpMaxElapsed = time.Minute
+)
+
+// otlpTransport sends the export request to the receiver
+type otlpTransport interface {
+	// Export sends the request, returns the error wrapped with otlpRetryable if it can be retried
+	Export(ctx context.Context, req *collogspb.ExportLogsServiceRequest) error
+	// Close closes the connection
+	Close() error
+}
+
+// otlpRetryableError is the export error which can be retried
+type otlpRetryableError struct {
+	err error
+}
+
+// Error returns the error message
+func (e *otlpRetryableError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the original error
+func (e *otlpRetryableError) Unwrap() error {
+	return e.err
+}
+
+// otlpRetryable marks the error as retryable
+func otlpRetryable(err error) error {
+	return &otlpRetryableError{err: err}
+}
+
+// isOTLPRetryable returns true if the export can be retried
+func isOTLPRetryable(err error) bool {
+	var retryable *otlpRetryableError
+	return errors.As(err, &retryable)
+}
+
+// OTLPExporter exports events as OTLP log records. Records are batched the way the OpenTelemetry batch log
+// record processor does: a batch is exported once it's full or the batch delay has passed since the last
+// export. The export is best effort: the position of an event is saved once it is queued, so the records which
+// are dropped or still queued when the handler crashes are not exported again.
+type OTLPExporter struct {
+	// config is the exporter configuration
+	config OTLPConfig
+	// transport is the HTTP or gRPC transport
+	transport otlpTransport
+	// resource is the resource the records are exported with
+	resource *resourcepb.Resource
+	// queue is the queue of the records waiting to be exported
+	queue chan *logspb.LogRecord
+	// done is closed once the exporter has stopped
+	done chan struct{}
+	// clock is used for the retry backoff
+	clock clockwork.Clock
+	// exported counts log records accepted by the OTLP receiver
+	exported prometheus.Counter
+	// dropped counts log records which failed to export after all retries or were rejected by the receiver
+	dropped prometheus.Counter
+}
+
+// NewOTLPExporter creates new OTLPExporter
+func NewOTLPExporter(c *OTLPConfig) (*OTLPExporter, error) {
+	var (
+		transport otlpTransport
+		err       error
+	)
+
+	exported := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "otlp_log_records_exported_total",
+		Help:      "Number of log records exported to the OTLP receiver",
+	})
+	dropped := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "otlp_log_records_dropped_total",
+		Help:      "Number of log records dropped after failing to export to the OTLP receiver",
+	})
+
+	switch c.OTLPProtocol {
+	case otlpProtocolGRPC:
+		transport, err = newOTLPGRPCTransport(c, dropped)
+	default:
+		transport, err = newOTLPHTTPTransport(c, dropped)
+	}
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	return &OTLPExporter{
+		config:    *c,
+		transport: transport,
+		resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{
+			otlpStringAttr("service.name", otlpServiceName),
+			otlpStringAttr("service.version", Version),
+		}},
+		queue:    make(chan *logspb.LogRecord, c.OTLPQueueSize),
+		done:     make(chan struct{}),
+		clock:    clockwork.NewRealClock(),
+		exported: exported,
+		dropped:  dropped,
+	}, nil
+}
+
+// collectors returns the collectors of the exporter metrics
+func (x *OTLPExporter) collectors() []prometheus.Collector {
+	return []prometheus.Collector{x.exported, x.dropped}
+}
+
+// Export queues the event for export and returns before the receiver has accepted it. It blocks while the
+// queue is full, events are never dropped to make room for the new ones.
+func (x *OTLPExporter) Export(ctx context.Context, e *TeleportEvent, payload []byte) error {
+	r := newOTLPLogRecord(e, payload, time.Now())
+
+	select {
+	case <-x.done:
+		return trace.ConnectionProblem(nil, "OTLP exporter is stopped")
+	default:
+	}
+
+	select {
+	case x.queue <- r:
+		return nil
+	case <-x.done:
+		return trace.ConnectionProblem(nil, "OTLP exporter is stopped")
+	case <-ctx.Done():
+		return trace.Wrap(ctx.Err())
+	}
+}
+
+// Run exports the queued records until the context is canceled, then exports the records left in the queue.
+// Exports in progress are not interrupted by the cancellation, they are bound by the export timeout.
+func (x *OTLPExporter) Run(ctx context.Context) error {
+	defer close(x.done)
+	defer x.transport.Close()
+
+	exportCtx := context.WithoutCancel(ctx)
+
+	batch := make([]*logspb.LogRecord, 0, x.config.OTLPBatchSize)
+	timer := time.NewTimer(x.config.OTLPBatchDelay)
+	defer timer.Stop()
+
+	flush := func() {
+		if len(batch) > 0 {
+			x.exportBatch(exportCtx, batch)
+			batch = make([]*logspb.LogRecord, 0, x.config.OTLPBatchSize)
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(x.config.OTLPBatchDelay)
+	}
+
+	for {
+		select {
+		case r := <-x.queue:
+			batch = append(batch, r)
+			if len(batch) >= x.config.OTLPBatchSize {
+				flush()
+			}
+		case <-timer.C:
+			flush()
+		case <-ctx.Done():
+			// Export what's left in the queue
+		Drain:
+			for {
+				select {
+				case r := <-x.queue:
+					batch = append(batch, r)
+					if len(batch) >= x.config.OTLPBatchSize {
+						x.exportBatch(exportCtx, batch)
+						batch = make([]*logspb.LogRecord, 0, x.config.OTLPBatchSize)
+					}
+				default:
+					break Drain
+				}
+			}
+			if len(batch) > 0 {
+				x.exportBatch(exportCtx, batch)
+			}
+			return nil
+		}
+	}
+}
+
+// ExportNow exports the event right away, bypassing the queue, and returns the export error. The check command
+// uses it to verify the receiver settings.
+func (x *OTLPExporter) ExportNow(ctx context.Context, e *TeleportEvent, payload []byte) error {
+	req := x.newRequest([]*logspb.LogRecord{newOTLPLogRecord(e, payload, time.Now())})
+	return trace.Wrap(x.export(ctx, req))
+}
+
+// Close closes the connection to the receiver of the exporter which is not run
+func (x *OTLPExporter) Close() error {
+	return trace.Wrap(x.transport.Close())
+}
+
+// newRequest returns the export request of the batch
+func (x *OTLPExporter) newRequest(batch []*logspb.LogRecord) *collogspb.ExportLogsServiceRequest {
+	return &collogspb.ExportLogsServiceRequest{
+		ResourceLogs: []*logspb.ResourceLogs{{
+			Resource: x.resource,
+			ScopeLogs: []*logspb.ScopeLogs{{
+				Scope:      &commonpb.InstrumentationScope{Name: otlpServiceName, Version: Version},
+				LogRecords: batch,
+			}},
+		}},
+	}
+}
+
+// exportBatch exports the batch, retrying the retryable errors. The batch is dropped if it can't be exported:
+// the positions of its events are saved already, so the dropped records are lost.
+func (x *OTLPExporter) exportBatch(ctx context.Context, batch []*logspb.LogRecord) {
+	log := logger.Get(ctx)
+
+	req := x.newRequest(batch)
+
+	backoff := backoff.NewDecorr(otlpBackoffBase, otlpBackoffMax, x.clock)
+	deadline := x.clock.Now().Add(otlpMaxElapsed)
+
+	for {
+		err := x.export(ctx, req)
+		if err == nil {
+			x.exported.Add(float64(len(batch)))
+			log.WithField("records", len(batch)).Debug("Exported OTLP log records")
+			return
+		}
+
+		if !isOTLPRetryable(err) || x.clock.Now().After(deadline) || backoff.Do(ctx) != nil {
+			x.dropped.Add(float64(len(batch)))
+			log.WithError(err).WithField("records", len(batch)).Error("Failed to export OTLP log records, the batch is dropped")
+			return
+		}
+
+		log.WithError(err).Warn("Failed to export OTLP log records, retrying")
+	}
+}
+
+// export sends the request within the export timeout
+func (x *OTLPExporter) export(ctx context.Context, req *collogspb.ExportLogsServiceRequest) error {
+	ctx, cancel := context.WithTimeout(ctx, x.config.OTLPTimeout)
+	defer cancel()
+
+	return trace.Wrap(x.transport.Export(ctx, req))
+}
+
+// newOTLPLogRecord converts the event to the log record, the event payload is the body
+func newOTLPLogRecord(e *TeleportEvent, payload []byte, now time.Time) *logspb.LogRecord {
+	var fields struct {
+		User        string `json:"user"`
+		ClusterName string `json:"cluster_name"`
+	}
+	// The fields are optional, the payload is exported regardless
+	_ = json.Unmarshal(e.Event, &fields)
+
+	attrs := []*commonpb.KeyValue{
+		otlpStringAttr("event.name", e.Type),
+		otlpStringAttr("teleport.event.type", e.Type),
+		otlpStringAttr("teleport.event.id", e.ID),
+	}
+	if fields.User != "" {
+		attrs = append(attrs, otlpStringAttr("teleport.user", fields.User))
+	}
+	if fields.ClusterName != "" {
+		attrs = append(attrs, otlpStringAttr("teleport.cluster_name", fields.ClusterName))
+	}
+	if sid := eventSessionID(e); sid != "" {
+		attrs = append(attrs, otlpStringAttr("teleport.session_id", sid))
+	}
+	if e.IdempotencyKey != "" {
+		attrs = append(attrs, otlpStringAttr("teleport.idempotency_key", e.IdempotencyKey))
+	}
+
+	r := &logspb.LogRecord{
+		ObservedTimeUnixNano: uint64(now.UnixNano()),
+		SeverityNumber:       logspb.SeverityNumber_SEVERITY_NUMBER_INFO,
+		SeverityText:         "INFO",
+		Body:                 &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: string(payload)}},
+		Attributes:           attrs,
+	}
+	if !e.Time.IsZero() {
+		r.TimeUnixNano = uint64(e.Time.UnixNano())
+	}
+
+	return r
+}
+
+// otlpStringAttr returns the string attribute
+func otlpStringAttr(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}}
+}
+
+// otlpTLSConfig returns the TLS configuration trusting the configured CA, nil if no CA is set
+func otlpTLSConfig(c *OTLPConfig) (*tls.Config, error) {
+	if c.OTLPCA == "" {
+		return nil, nil
+	}
+
+	b, err := os.ReadFile(c.OTLPCA)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, trace.BadParameter("no certificates found in %v", c.OTLPCA)
+	}
+
+	return &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}, nil
+}
+
+// otlpHTTPTransport exports the logs over OTLP/HTTP with protobuf payloads
+type otlpHTTPTransport struct {
+	// client is the HTTP client
+	client *http.Client
+	// url is the logs endpoint URL
+	url string
+	// headers are the extra request headers
+	headers http.Header
+	// dropped counts the log records rejected by the receiver
+	dropped prometheus.Counter
+}
+
+// newOTLPHTTPTransport creates the OTLP/HTTP transport
+func newOTLPHTTPTransport(c *OTLPConfig, dropped prometheus.Counter) (*otlpHTTPTransport, error) {
+	u, err := url.Parse(c.OTLPEndpoint)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = otlpLogsPath
+	}
+
+	headers, err := c.Headers()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	tlsConfig, err := otlpTLSConfig(c)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	return &otlpHTTPTransport{
+		client:  &http.Client{Transport: transport},
+		url:     u.String(),
+		headers: headers,
+		dropped: dropped,
+	}, nil
+}
+
+// Export sends the request
+func (t *otlpHTTPTransport) Export(ctx context.Context, req *collogspb.ExportLogsServiceRequest) error {
+	b, err := proto.Marshal(req)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(b))
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	for name, values := range t.headers {
+		r.Header[name] = values
+	}
+	r.Header.Set("Content-Type", "application/x-protobuf")
+
+	resp, err := t.client.Do(r)
+	if err != nil {
+		return otlpRetryable(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return otlpRetryable(err)
+	}
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		var r collogspb.ExportLogsServiceResponse
+		if err := proto.Unmarshal(body, &r); err == nil && r.GetPartialSuccess().GetRejectedLogRecords() > 0 {
+			t.dropped.Add(float64(r.GetPartialSuccess().GetRejectedLogRecords()))
+			logger.Get(ctx).WithField("rejected", r.GetPartialSuccess().GetRejectedLogRecords()).
+				WithField("message", r.GetPartialSuccess().GetErrorMessage()).
+				Warn("OTLP receiver rejected some log records")
+		}
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests ||
+		resp.StatusCode == http.StatusBadGateway ||
+		resp.StatusCode == http.StatusServiceUnavailable ||
+		resp.StatusCode == http.StatusGatewayTimeout:
+		return otlpRetryable(trace.ConnectionProblem(nil, "OTLP receiver responded with %v", resp.Status))
+	default:
+		return trace.BadParameter("OTLP receiver responded with %v: %v", resp.Status, strings.TrimSpace(string(body)))
+	}
+}
+
+// Close closes idle connections
+func (t *otlpHTTPTransport) Close() error {
+	t.client.CloseIdleConnections()
+	return nil
+}
+
+// otlpGRPCTransport exports the logs over OTLP/gRPC
+type otlpGRPCTransport struct {
+	// conn is the gRPC connection
+	conn *grpc.ClientConn
+	// client is the logs service client
+	client collogspb.LogsServiceClient
+	// headers are sent as the request metadata
+	headers metadata.MD
+	// dropped counts the log records rejected by the receiver
+	dropped prometheus.Counter
+}
+
+// newOTLPGRPCTransport creates the OTLP/gRPC transport. The endpoint is host:port, http:// scheme disables TLS.
+func newOTLPGRPCTransport(c *OTLPConfig, dropped prometheus.Counter) (*otlpGRPCTransport, error) {
+	target := c.OTLPEndpoint
+	plaintext := c.OTLPInsecure
+	if u, err := url.Parse(target); err == nil && u.Host != "" && (u.Scheme == "http" || u.Scheme == "https") {
+		target = u.Host
+		plaintext = plaintext || u.Scheme == "http"
+	}
+
+	var creds credentials.TransportCredentials
+	if plaintext {
+		creds = insecure.NewCredentials()
+	} else {
+		tlsConfig, err := otlpTLSConfig(c)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+		creds = credentials.NewTLS(tlsConfig)
+	}
+
+	headers, err := c.Headers()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	md := metadata.MD{}
+	for name, values := range headers {
+		md.Append(strings.ToLower(name), values...)
+	}
+
+	conn, err := grpc.Dial(target, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	return &otlpGRPCTransport{conn: conn, client: collogspb.NewLogsServiceClient(conn), headers: md, dropped: dropped}, nil
+}
+
+// Export sends the request
+func (t *otlpGRPCTransport) Export(ctx context.Context, req *collogspb.ExportLogsServiceRequest) error {
+	if len(t.headers) > 0 {
+		ctx = metadata.NewOutgoingContext(ctx, t.headers)
+	}
+
+	resp, err := t.client.Export(ctx, req)
+	if err != nil {
+		switch status.Code(err) {
+		case codes.Unavailable, codes.DeadlineExceeded, codes.Aborted, codes.ResourceExhausted:
+			return otlpRetryable(err)
+		default:
+			return trace.Wrap(err)
+		}
+	}
+
+	if rejected := resp.GetPartialSuccess().GetRejectedLogRecords(); rejected > 0 {
+		t.dropped.Add(float64(rejected))
+		logger.Get(ctx).WithField("rejected", rejected).
+			WithField("message", resp.GetPartialSuccess().GetErrorMessage()).
+			Warn("OTLP receiver rejected some log records")
+	}
+
+	return nil
+}
+
+// Close closes the connection
+func (t *otlpGRPCTransport) Close() error {
+	return trace.Wrap(t.conn.Close())
+}
@@ -0,0 +1,273 @@
+// Copyright 2024 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/require"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+// fakeOTLPReceiver is a stand-in for the OTLP logs receiver, serving both HTTP and gRPC
+type fakeOTLPReceiver struct {
+	collogspb.UnimplementedLogsServiceServer
+
+	// requests receives the accepted export requests
+	requests chan *collogspb.ExportLogsServiceRequest
+	// headers receives the value of the X-Tenant header or metadata of the accepted requests
+	headers chan string
+	// failures is the number of requests to reject with the status before accepting
+	failures atomic.Int32
+	// status is the HTTP status the requests are rejected with
+	status int
+}
+
+// newFakeOTLPReceiver creates the receiver
+func newFakeOTLPReceiver() *fakeOTLPReceiver {
+	return &fakeOTLPReceiver{
+		requests: make(chan *collogspb.ExportLogsServiceRequest, 10),
+		headers:  make(chan string, 10),
+	}
+}
+
+// ServeHTTP handles OTLP/HTTP export requests
+func (r *fakeOTLPReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != otlpLogsPath || req.Header.Get("Content-Type") != "application/x-protobuf" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.failures.Add(-1) >= 0 {
+		w.WriteHeader(r.status)
+		return
+	}
+
+	b, err := io.ReadAll(req.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var export collogspb.ExportLogsServiceRequest
+	if err := proto.Unmarshal(b, &export); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	r.requests <- &export
+	r.headers <- req.Header.Get("X-Tenant")
+
+	resp, _ := proto.Marshal(&collogspb.ExportLogsServiceResponse{})
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Write(resp)
+}
+
+// Export handles OTLP/gRPC export requests
+func (r *fakeOTLPReceiver) Export(ctx context.Context, req *collogspb.ExportLogsServiceRequest) (*collogspb.ExportLogsServiceResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	r.requests <- req
+	r.headers <- firstOrEmpty(md.Get("x-tenant"))
+
+	return &collogspb.ExportLogsServiceResponse{}, nil
+}
+
+// firstOrEmpty returns the first value, empty if there is none
+func firstOrEmpty(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// newOTLPTestConfig returns the exporter configuration with the defaults
+func newOTLPTestConfig(endpoint, protocol string) *OTLPConfig {
+	return &OTLPConfig{
+		OTLPEndpoint:   endpoint,
+		OTLPProtocol:   protocol,
+		OTLPHeaders:    []string{"X-Tenant=audit"},
+		OTLPInsecure:   true,
+		OTLPTimeout:    5 * time.Second,
+		OTLPBatchSize:  2,
+		OTLPBatchDelay: time.Hour,
+		OTLPQueueSize:  10,
+	}
+}
+
+// newOTLPTestEvent returns the session event
+func newOTLPTestEvent(id string) (*TeleportEvent, []byte) {
+	payload := []byte(`{"event":"session.start","uid":"` + id + `","user":"alice","cluster_name":"example.com","sid":"session-1"}`)
+	e := &TeleportEvent{ID: id, Type: sessionStartType, Time: time.Unix(1700000000, 0), Event: payload, IdempotencyKey: id}
+
+	return e, payload
+}
+
+// receiveOTLP waits for the next export request
+func receiveOTLP(t *testing.T, r *fakeOTLPReceiver) *collogspb.ExportLogsServiceRequest {
+	select {
+	case req := <-r.requests:
+		require.Equal(t, "audit", <-r.headers)
+		return req
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "OTLP export request not received")
+		return nil
+	}
+}
+
+// otlpAttrs returns the string attributes as a map
+func otlpAttrs(attrs []*commonpb.KeyValue) map[string]string {
+	m := make(map[string]string, len(attrs))
+	for _, a := range attrs {
+		m[a.Key] = a.Value.GetStringValue()
+	}
+	return m
+}
+
+func TestOTLPExporterHTTP(t *testing.T) {
+	receiver := newFakeOTLPReceiver()
+	server := httptest.NewServer(receiver)
+	t.Cleanup(server.Close)
+
+	x, err := NewOTLPExporter(newOTLPTestConfig(server.URL, otlpProtocolHTTP))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- x.Run(ctx) }()
+
+	for _, id := range []string{"1", "2", "3"} {
+		e, payload := newOTLPTestEvent(id)
+		require.NoError(t, x.Export(ctx, e, payload))
+	}
+
+	// The full batch is exported right away
+	req := receiveOTLP(t, receiver)
+	require.Len(t, req.ResourceLogs, 1)
+	require.Equal(t, otlpServiceName, otlpAttrs(req.ResourceLogs[0].Resource.Attributes)["service.name"])
+
+	records := req.ResourceLogs[0].ScopeLogs[0].LogRecords
+	require.Len(t, records, 2)
+	require.Equal(t, map[string]string{
+		"event.name":               sessionStartType,
+		"teleport.event.type":      sessionStartType,
+		"teleport.event.id":        "1",
+		"teleport.user":            "alice",
+		"teleport.cluster_name":    "example.com",
+		"teleport.session_id":      "session-1",
+		"teleport.idempotency_key": "1",
+	}, otlpAttrs(records[0].Attributes))
+	require.Equal(t, uint64(time.Unix(1700000000, 0).UnixNano()), records[0].TimeUnixNano)
+
+	_, payload := newOTLPTestEvent("1")
+	require.Equal(t, string(payload), records[0].Body.GetStringValue())
+
+	// The rest of the queue is exported on shutdown
+	cancel()
+	req = receiveOTLP(t, receiver)
+	require.Len(t, req.ResourceLogs[0].ScopeLogs[0].LogRecords, 1)
+	require.NoError(t, <-done)
+
+	e, payload := newOTLPTestEvent("4")
+	require.Error(t, x.Export(context.Background(), e, payload))
+}
+
+func TestOTLPExporterGRPC(t *testing.T) {
+	receiver := newFakeOTLPReceiver()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := grpc.NewServer()
+	collogspb.RegisterLogsServiceServer(server, receiver)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	c := newOTLPTestConfig(listener.Addr().String(), otlpProtocolGRPC)
+	c.OTLPBatchSize = 10
+	c.OTLPBatchDelay = 10 * time.Millisecond
+
+	x, err := NewOTLPExporter(c)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go x.Run(ctx)
+
+	for _, id := range []string{"1", "2"} {
+		e, payload := newOTLPTestEvent(id)
+		require.NoError(t, x.Export(ctx, e, payload))
+	}
+
+	// The batch which is not full is exported after the delay
+	var records int
+	for records < 2 {
+		req := receiveOTLP(t, receiver)
+		records += len(req.ResourceLogs[0].ScopeLogs[0].LogRecords)
+	}
+	require.Equal(t, 2, records)
+}
+
+func TestOTLPExporterRetry(t *testing.T) {
+	receiver := newFakeOTLPReceiver()
+	receiver.status = http.StatusServiceUnavailable
+	receiver.failures.Store(1)
+	server := httptest.NewServer(receiver)
+	t.Cleanup(server.Close)
+
+	c := newOTLPTestConfig(server.URL+otlpLogsPath, otlpProtocolHTTP)
+	c.OTLPBatchSize = 1
+
+	x, err := NewOTLPExporter(c)
+	require.NoError(t, err)
+	clock := clockwork.NewFakeClock()
+	x.clock = clock
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go x.Run(ctx)
+
+	e, payload := newOTLPTestEvent("1")
+	require.NoError(t, x.Export(ctx, e, payload))
+
+	// Retryable failures are retried after the backoff
+	clock.BlockUntil(1)
+	clock.Advance(otlpBackoffMax)
+	req := receiveOTLP(t, receiver)
+	require.Len(t, req.ResourceLogs[0].ScopeLogs[0].LogRecords, 1)
+
+	// Other failures drop the batch
+	receiver.status = http.StatusBadRequest
+	receiver.failures.Store(1)
+
+	e, payload = newOTLPTestEvent("2")
+	require.NoError(t, x.Export(ctx, e, payload))
+	e, payload = newOTLPTestEvent("3")
+	require.NoError(t, x.Export(ctx, e, payload))
+
+	req = receiveOTLP(t, receiver)
+	require.Equal(t, "3", otlpAttrs(req.ResourceLogs[0].ScopeLogs[0].LogRecords[0].Attributes)["teleport.event.id"])
+}
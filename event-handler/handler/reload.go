@@ -0,0 +1,247 @@
+// Copyright 2024 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/gravitational/teleport/integrations/lib/logger"
+	"github.com/gravitational/trace"
+)
+
+// staticSetting is a setting which can not be changed without restart
+type staticSetting struct {
+	// name is the setting name
+	name string
+	// changed returns true if the setting differs
+	changed func(prev, next *StartCmdConfig) bool
+	// restore copies the setting value from prev to next
+	restore func(prev, next *StartCmdConfig)
+}
+
+// staticSettings is the list of settings which can not be changed without restart: they are used to
+// open the state and to create the clients, jobs and servers once on start
+var staticSettings = []staticSetting{
+	{
+		name:    "teleport-addr",
+		changed: func(p, n *StartCmdConfig) bool { return p.TeleportAddr != n.TeleportAddr },
+		restore: func(p, n *StartCmdConfig) { n.TeleportAddr = p.TeleportAddr },
+	},
+	{
+		name:    "teleport-data-dir",
+		changed: func(p, n *StartCmdConfig) bool { return p.TeleportDataDir != n.TeleportDataDir },
+		restore: func(p, n *StartCmdConfig) { n.TeleportDataDir = p.TeleportDataDir },
+	},
+	{
+		name: "teleport-identity, teleport-ca, teleport-cert, teleport-key, teleport-refresh-*",
+		changed: func(p, n *StartCmdConfig) bool {
+			return p.TeleportIdentityFile != n.TeleportIdentityFile ||
+				p.TeleportCA != n.TeleportCA ||
+				p.TeleportCert != n.TeleportCert ||
+				p.TeleportKey != n.TeleportKey ||
+				p.TeleportRefreshEnabled != n.TeleportRefreshEnabled ||
+				p.TeleportRefreshInterval != n.TeleportRefreshInterval
+		},
+		restore: func(p, n *StartCmdConfig) { n.TeleportConfig = p.TeleportConfig },
+	},
+	{
+		name: "fluentd-ca, fluentd-cert, fluentd-key",
+		changed: func(p, n *StartCmdConfig) bool {
+			return p.FluentdCA != n.FluentdCA || p.FluentdCert != n.FluentdCert || p.FluentdKey != n.FluentdKey
+		},
+		restore: func(p, n *StartCmdConfig) {
+			n.FluentdCA, n.FluentdCert, n.FluentdKey = p.FluentdCA, p.FluentdCert, p.FluentdKey
+		},
+	},
+	{
+		name: "fluentd-proxy, fluentd-header, fluentd-env-header, fluentd-bearer-token, fluentd-basic-auth-*, fluentd-timeout, fluentd-compression*",
+		changed: func(p, n *StartCmdConfig) bool {
+			return p.FluentdProxy != n.FluentdProxy ||
+				!slices.Equal(p.FluentdHeaders, n.FluentdHeaders) ||
+				!slices.Equal(p.FluentdEnvHeaders, n.FluentdEnvHeaders) ||
+				p.FluentdBearerToken != n.FluentdBearerToken ||
+				p.FluentdBasicAuthUser != n.FluentdBasicAuthUser ||
+				p.FluentdBasicAuthPassword != n.FluentdBasicAuthPassword ||
+				p.FluentdTimeout != n.FluentdTimeout ||
+				p.FluentdCompression != n.FluentdCompression ||
+				p.FluentdCompressionThreshold != n.FluentdCompressionThreshold
+		},
+		restore: func(p, n *StartCmdConfig) {
+			n.FluentdProxy = p.FluentdProxy
+			n.FluentdHeaders, n.FluentdEnvHeaders = p.FluentdHeaders, p.FluentdEnvHeaders
+			n.FluentdBearerToken = p.FluentdBearerToken
+			n.FluentdBasicAuthUser, n.FluentdBasicAuthPassword = p.FluentdBasicAuthUser, p.FluentdBasicAuthPassword
+			n.FluentdTimeout = p.FluentdTimeout
+			n.FluentdCompression, n.FluentdCompressionThreshold = p.FluentdCompression, p.FluentdCompressionThreshold
+		},
+	},
+	{
+		name:    "storage",
+		changed: func(p, n *StartCmdConfig) bool { return p.StorageDir != n.StorageDir },
+		restore: func(p, n *StartCmdConfig) { n.StorageDir = p.StorageDir },
+	},
+	{
+		name:    "start-time",
+		changed: func(p, n *StartCmdConfig) bool { return !equalTimePtr(p.StartTime, n.StartTime) },
+		restore: func(p, n *StartCmdConfig) { n.StartTime = p.StartTime },
+	},
+	{
+		name:    "dry-run",
+		changed: func(p, n *StartCmdConfig) bool { return p.DryRun != n.DryRun },
+		restore: func(p, n *StartCmdConfig) { n.DryRun = p.DryRun },
+	},
+	{
+		name:    "concurrency",
+		changed: func(p, n *StartCmdConfig) bool { return p.Concurrency != n.Concurrency },
+		restore: func(p, n *StartCmdConfig) { n.Concurrency = p.Concurrency },
+	},
+	{
+		name:    "dedup-window",
+		changed: func(p, n *StartCmdConfig) bool { return p.DedupWindow != n.DedupWindow },
+		restore: func(p, n *StartCmdConfig) { n.DedupWindow = p.DedupWindow },
+	},
+	{
+		name:    "drain-timeout",
+		changed: func(p, n *StartCmdConfig) bool { return p.DrainTimeout != n.DrainTimeout },
+		restore: func(p, n *StartCmdConfig) { n.DrainTimeout = p.DrainTimeout },
+	},
+	{
+		name: "checkpoint-events, checkpoint-interval",
+		changed: func(p, n *StartCmdConfig) bool {
+			return p.CheckpointEvents != n.CheckpointEvents || p.CheckpointInterval != n.CheckpointInterval
+		},
+		restore: func(p, n *StartCmdConfig) {
+			n.CheckpointEvents, n.CheckpointInterval = p.CheckpointEvents, p.CheckpointInterval
+		},
+	},
+	{
+		name:    "heartbeat-interval",
+		changed: func(p, n *StartCmdConfig) bool { return p.HeartbeatInterval != n.HeartbeatInterval },
+		restore: func(p, n *StartCmdConfig) { n.HeartbeatInterval = p.HeartbeatInterval },
+	},
+	{
+		name: "otlp-*",
+		changed: func(p, n *StartCmdConfig) bool {
+			return p.OTLPEndpoint != n.OTLPEndpoint ||
+				p.OTLPProtocol != n.OTLPProtocol ||
+				!slices.Equal(p.OTLPHeaders, n.OTLPHeaders) ||
+				p.OTLPCA != n.OTLPCA ||
+				p.OTLPInsecure != n.OTLPInsecure ||
+				p.OTLPTimeout != n.OTLPTimeout ||
+				p.OTLPBatchSize != n.OTLPBatchSize ||
+				p.OTLPBatchDelay != n.OTLPBatchDelay ||
+				p.OTLPQueueSize != n.OTLPQueueSize
+		},
+		restore: func(p, n *StartCmdConfig) { n.OTLPConfig = p.OTLPConfig },
+	},
+	{
+		name:    "metrics-addr",
+		changed: func(p, n *StartCmdConfig) bool { return p.MetricsAddr != n.MetricsAddr },
+		restore: func(p, n *StartCmdConfig) { n.MetricsAddr = p.MetricsAddr },
+	},
+	{
+		name: "tail-addr, tail-cert, tail-key",
+		changed: func(p, n *StartCmdConfig) bool {
+			return p.TailAddr != n.TailAddr || p.TailCert != n.TailCert || p.TailKey != n.TailKey
+		},
+		restore: func(p, n *StartCmdConfig) { n.TailAddr, n.TailCert, n.TailKey = p.TailAddr, p.TailCert, p.TailKey },
+	},
+	{
+		name:    "index-path",
+		changed: func(p, n *StartCmdConfig) bool { return p.IndexPath != n.IndexPath },
+		restore: func(p, n *StartCmdConfig) { n.IndexPath = p.IndexPath },
+	},
+	{
+		name:    "geoip-db, asn-db",
+		changed: func(p, n *StartCmdConfig) bool { return p.GeoConfig != n.GeoConfig },
+		restore: func(p, n *StartCmdConfig) { n.GeoConfig = p.GeoConfig },
+	},
+	{
+		name:    "session-export-dir, session-export-url, session-export-timeout",
+		changed: func(p, n *StartCmdConfig) bool { return p.SessionExportConfig != n.SessionExportConfig },
+		restore: func(p, n *StartCmdConfig) { n.SessionExportConfig = p.SessionExportConfig },
+	},
+}
+
+// equalTimePtr returns true if both times are nil or equal
+func equalTimePtr(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return a.Equal(*b)
+}
+
+// restoreStaticSettings keeps the values of the settings which can not be changed at runtime and returns
+// the names of the settings which were attempted to change
+func restoreStaticSettings(prev, next *StartCmdConfig) []string {
+	var rejected []string
+
+	for _, s := range staticSettings {
+		if s.changed(prev, next) {
+			s.restore(prev, next)
+			rejected = append(rejected, s.name)
+		}
+	}
+
+	return rejected
+}
+
+// Reload applies the configuration re-read at runtime. Settings which can't be changed at runtime keep their
+// current values. Nothing is applied if the new configuration is invalid.
+func (a *App) Reload(ctx context.Context, c *StartCmdConfig) error {
+	log := logger.Get(ctx)
+
+	// Static settings are restored first, so the configuration which is actually applied is validated
+	rejected := restoreStaticSettings(a.Config(), c)
+
+	if err := c.Validate(); err != nil {
+		return trace.Wrap(err)
+	}
+	if a.EventWatcher == nil && (c.LockEnabled || c.LockRulesFile != "") {
+		return trace.BadParameter("auto-locking requires the Auth API event source")
+	}
+
+	for _, name := range rejected {
+		log.WithField("setting", name).Warn("Setting can not be changed at runtime and is ignored, restart the handler to apply it")
+	}
+
+	var rules []*LockRule
+	if c.LockRulesFile != "" {
+		var err error
+		rules, err = LoadLockRules(c.LockRulesFile)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+	}
+
+	a.config.Store(c)
+	if a.Source != nil {
+		a.Source.SetConfig(c)
+	}
+	if a.LockRules != nil {
+		a.LockRules.SetRules(rules)
+	}
+	if a.Sampler != nil {
+		a.Sampler.SetPolicies(c.EventPolicies)
+	}
+
+	log.Info("Configuration reloaded")
+	c.Dump(ctx)
+
+	return nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2024 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newReloadTestConfig returns a valid start command configuration
+func newReloadTestConfig() *StartCmdConfig {
+	return &StartCmdConfig{
+		FluentdConfig: FluentdConfig{
+			FluentdURL:        "https://localhost:8888/test.log",
+			FluentdSessionURL: "https://localhost:8888/session",
+		},
+		TeleportConfig: TeleportConfig{
+			TeleportAddr:         "localhost:3025",
+			TeleportIdentityFile: "identity",
+		},
+		IngestConfig: IngestConfig{
+			StorageDir:  "storage",
+			BatchSize:   20,
+			Concurrency: 5,
+		},
+	}
+}
+
+func TestAppReload(t *testing.T) {
+	ctx := context.Background()
+
+	app, err := NewApp(newReloadTestConfig())
+	require.NoError(t, err)
+	app.EventWatcher = &TeleportEventsWatcher{}
+	app.Source = app.EventWatcher
+	app.EventWatcher.SetConfig(app.Config())
+	app.LockRules = NewLockRuleEngine(nil, nil, nil, false)
+
+	rulesPath := filepath.Join(t.TempDir(), "rules.toml")
+	require.NoError(t, os.WriteFile(rulesPath, []byte(`
+[[rule]]
+name = "exec"
+threshold = 1
+window = "1m"
+target = "node"
+`), 0600))
+
+	c := newReloadTestConfig()
+	c.BatchSize = 50
+	c.SkipEventTypesRaw = []string{"print"}
+	c.LockRulesFile = rulesPath
+	c.TeleportAddr = "example.com:3025"
+	c.StorageDir = "other"
+	require.NoError(t, app.Reload(ctx, c))
+
+	// Runtime settings are applied, static settings keep their values
+	require.Equal(t, 50, app.Config().BatchSize)
+	require.Equal(t, map[string]struct{}{"print": {}}, app.Config().SkipEventTypes)
+	require.Equal(t, "localhost:3025", app.Config().TeleportAddr)
+	require.Equal(t, "storage", app.Config().StorageDir)
+	require.Same(t, app.Config(), app.EventWatcher.config.Load())
+	require.Len(t, app.LockRules.rules, 1)
+
+	// Invalid configuration is not applied
+	c = newReloadTestConfig()
+	c.BatchSize = 10
+	c.EventPoliciesRaw = []string{"user.login=sample:0"}
+	require.Error(t, app.Reload(ctx, c))
+	require.Equal(t, 50, app.Config().BatchSize)
+
+	c = newReloadTestConfig()
+	c.BatchSize = 10
+	c.LockRulesFile = filepath.Join(t.TempDir(), "missing.toml")
+	require.Error(t, app.Reload(ctx, c))
+	require.Equal(t, 50, app.Config().BatchSize)
+}
+
+func TestAppReloadDataDirLocking(t *testing.T) {
+	ctx := context.Background()
+
+	start := newReloadTestConfig()
+	start.TeleportDataDir = t.TempDir()
+	app, err := NewApp(start)
+	require.NoError(t, err)
+	app.Source = &staticEventSource{}
+
+	// The data directory can not be dropped at runtime, so locking can not be enabled either
+	c := newReloadTestConfig()
+	c.BatchSize = 50
+	c.LockEnabled = true
+	require.Error(t, app.Reload(ctx, c))
+	require.Equal(t, 20, app.Config().BatchSize)
+	require.False(t, app.Config().LockEnabled)
+
+	// Locking is rejected for the custom event source too
+	app, err = NewApp(newReloadTestConfig())
+	require.NoError(t, err)
+	app.Source = &staticEventSource{}
+
+	c = newReloadTestConfig()
+	c.LockEnabled = true
+	require.Error(t, app.Reload(ctx, c))
+}
@@ -0,0 +1,108 @@
+// Copyright 2024 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gravitational/trace"
+)
+
+// Query builds the event index query from the command line arguments
+func (c *SearchCmdConfig) Query(now time.Time) (IndexQuery, error) {
+	if c.From != nil && c.Since > 0 {
+		return IndexQuery{}, trace.BadParameter("--from and --since can not be used together")
+	}
+	if c.Limit < 0 {
+		return IndexQuery{}, trace.BadParameter("--limit can not be negative")
+	}
+
+	q := IndexQuery{
+		Types:     c.Types,
+		User:      c.User,
+		Cluster:   c.Cluster,
+		SessionID: c.SessionID,
+		Login:     c.Login,
+		Limit:     c.Limit,
+	}
+	if c.From != nil {
+		q.From = *c.From
+	}
+	if c.Since > 0 {
+		q.From = now.Add(-c.Since)
+	}
+	if c.To != nil {
+		q.To = *c.To
+	}
+
+	return q, nil
+}
+
+// RunSearchCmd prints the events found in the event index
+func RunSearchCmd(c *SearchCmdConfig) error {
+	q, err := c.Query(time.Now())
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	x, err := OpenEventIndex(c.IndexPath)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer x.Close()
+
+	events, err := x.Search(context.Background(), q)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	if c.JSON {
+		return trace.Wrap(printIndexedEventsJSON(events, os.Stdout))
+	}
+
+	return trace.Wrap(printIndexedEvents(events, os.Stdout))
+}
+
+// printIndexedEvents writes the events table to w
+func printIndexedEvents(events []IndexedEvent, w io.Writer) error {
+	if len(events) == 0 {
+		fmt.Fprintln(w, "No events found")
+		return nil
+	}
+
+	t := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(t, "TIME\tTYPE\tUSER\tLOGIN\tCLUSTER\tSESSION")
+	for _, e := range events {
+		fmt.Fprintf(t, "%v\t%v\t%v\t%v\t%v\t%v\n", e.Time.Format(time.RFC3339), e.Type, e.User, e.Login, e.Cluster, e.SessionID)
+	}
+
+	return trace.Wrap(t.Flush())
+}
+
+// printIndexedEventsJSON writes the events to w, one JSON document per line
+func printIndexedEventsJSON(events []IndexedEvent, w io.Writer) error {
+	for _, e := range events {
+		if _, err := fmt.Fprintf(w, "%s\n", e.Event); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+
+	return nil
+}
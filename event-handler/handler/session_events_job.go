@@ -0,0 +1,535 @@
+// Copyright 2023 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gravitational/teleport/integrations/lib"
+	"github.com/gravitational/teleport/integrations/lib/backoff"
+	"github.com/gravitational/teleport/integrations/lib/logger"
+	"github.com/gravitational/trace"
+	"github.com/jonboulle/clockwork"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/semaphore"
+)
+
+const (
+	// sessionBackoffBase is an initial (minimum) backoff value.
+	sessionBackoffBase = 3 * time.Second
+	// sessionBackoffMax is a backoff threshold
+	sessionBackoffMax = 2 * time.Minute
+	// sessionBackoffNumTries is the maximum number of backoff tries
+	sessionBackoffNumTries = 5
+	// sessionRescanInterval is how often the state is checked for sessions released from quarantine
+	sessionRescanInterval = time.Minute
+)
+
+// session is the utility struct used for session ingestion
+type session struct {
+	// ID current ID
+	ID string
+	// Index current event index
+	Index int64
+}
+
+// SessionEventsJob incapsulates session events consumption logic
+type SessionEventsJob struct {
+	lib.ServiceJob
+	app       *App
+	sessions  chan session
+	semaphore *semaphore.Weighted
+
+	// mu protects active
+	mu sync.Mutex
+	// active is the set of sessions being queued or ingested
+	active map[string]struct{}
+	// metrics are the session ingestion metrics
+	metrics *sessionMetrics
+}
+
+// NewSessionEventsJob creates new EventsJob structure
+func NewSessionEventsJob(app *App) *SessionEventsJob {
+	j := &SessionEventsJob{
+		app:       app,
+		semaphore: semaphore.NewWeighted(int64(app.Config().Concurrency)),
+		sessions:  make(chan session),
+		active:    make(map[string]struct{}),
+		metrics:   newSessionMetrics(),
+	}
+
+	j.ServiceJob = lib.NewServiceJob(j.run)
+
+	return j
+}
+
+// run runs session consuming process
+func (j *SessionEventsJob) run(ctx context.Context) error {
+	log := logger.Get(ctx)
+
+	// Create cancellable context which handles app termination
+	process := lib.MustGetProcess(ctx)
+	ctx, cancel := context.WithCancel(ctx)
+	process.OnTerminate(func(_ context.Context) error {
+		cancel()
+		return nil
+	})
+
+	if err := j.restartPausedSessions(); err != nil {
+		log.WithError(err).Error("Restarting paused sessions")
+	}
+	j.updateQuarantineGauge(ctx)
+
+	rescan := time.NewTicker(sessionRescanInterval)
+	defer rescan.Stop()
+
+	j.SetReady(true)
+
+	for {
+		select {
+		case <-rescan.C:
+			// Pick up sessions released from quarantine by the sessions retry command
+			if err := j.restartPausedSessions(); err != nil {
+				log.WithError(err).Error("Restarting paused sessions")
+			}
+			j.updateQuarantineGauge(ctx)
+
+		case s := <-j.sessions:
+			if err := j.semaphore.Acquire(ctx, 1); err != nil {
+				log.WithError(err).Error("Failed to acquire semaphore")
+				continue
+			}
+
+			log.WithField("id", s.ID).WithField("index", s.Index).Info("Starting session ingest")
+
+			func(s session) {
+				j.app.SpawnCritical(func(ctx context.Context) error {
+					defer j.semaphore.Release(1)
+
+					// The session in progress is sent until the drain timeout passes
+					ctx, cancel := j.app.drainContext(ctx)
+					defer cancel()
+
+					backoff := backoff.NewDecorr(sessionBackoffBase, sessionBackoffMax, clockwork.NewRealClock())
+					backoffCount := sessionBackoffNumTries
+					log := logger.Get(ctx).WithField("id", s.ID).WithField("index", s.Index)
+
+					for {
+						retry, err := j.consumeSession(ctx, s)
+
+						// If sessions needs to retry
+						if err != nil && retry {
+							// The session is resumed from the saved index on the next start
+							if j.app.isDraining() {
+								log.WithError(err).Warn("Session ingestion error, stopping on shutdown")
+								return nil
+							}
+
+							log.WithError(err).WithField("n", backoffCount).Error("Session ingestion error, retrying")
+
+							// Sleep for required interval
+							bErr := backoff.Do(ctx)
+							if bErr != nil {
+								return trace.Wrap(bErr)
+							}
+
+							// Check if there are number of tries left
+							backoffCount--
+							if backoffCount < 0 {
+								log.WithField("err", err).Error("Session ingestion failed")
+								quarantined, qErr := j.recordFailure(ctx, s.ID, err)
+								if quarantined {
+									j.setInactive(s.ID)
+								}
+								return trace.Wrap(qErr)
+							}
+							continue
+						}
+
+						if err != nil {
+							if lib.IsCanceled(err) {
+								return err
+							}
+
+							log.WithField("err", err).Error("Session ingestion failed")
+							quarantined, qErr := j.recordFailure(ctx, s.ID, err)
+							if qErr != nil {
+								return trace.NewAggregate(err, qErr)
+							}
+							// The quarantined session does not need to stop the handler
+							if quarantined {
+								j.setInactive(s.ID)
+								return nil
+							}
+							return err
+						}
+
+						// No errors, we've finished with this session
+						if err := j.app.State.RemoveSessionAttempts(s.ID); err != nil {
+							log.WithError(err).Warn("Failed to reset session ingestion attempts")
+						}
+						j.setInactive(s.ID)
+						return nil
+					}
+				})
+			}(s)
+		case <-ctx.Done():
+			if lib.IsCanceled(ctx.Err()) {
+				return nil
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+// restartPausedSessions restarts sessions saved in state
+func (j *SessionEventsJob) restartPausedSessions() error {
+	sessions, err := j.app.State.GetSessions()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	if len(sessions) == 0 {
+		return nil
+	}
+
+	for id, idx := range sessions {
+		if !j.setActive(id) {
+			continue
+		}
+
+		func(id string, idx int64) {
+			j.app.SpawnCritical(func(ctx context.Context) error {
+				log.WithField("id", id).WithField("index", idx).Info("Restarting session ingestion")
+
+				s := session{ID: id, Index: idx}
+
+				select {
+				case j.sessions <- s:
+					return nil
+				case <-j.app.draining:
+					return nil
+				case <-ctx.Done():
+					if lib.IsCanceled(ctx.Err()) {
+						return nil
+					}
+
+					return ctx.Err()
+				}
+			})
+		}(id, idx)
+	}
+
+	return nil
+}
+
+// consumeSession ingests session
+func (j *SessionEventsJob) consumeSession(ctx context.Context, s session) (bool, error) {
+	log := logger.Get(ctx)
+
+	url := j.app.Config().FluentdSessionURL + "." + s.ID + ".log"
+
+	log.WithField("id", s.ID).WithField("index", s.Index).Info("Started session events ingest")
+	rec, err := j.openRecording(s.ID)
+	if err != nil {
+		return true, trace.Wrap(err)
+	}
+	defer rec.Close()
+
+	summary, err := j.openSummary(s.ID)
+	if err != nil {
+		return true, trace.Wrap(err)
+	}
+	// Keep the summary computed so far if the ingestion is interrupted
+	defer func() { j.saveSummary(ctx, s.ID, summary) }()
+
+	chEvt, chErr := j.app.Source.StreamUnstructuredSessionEvents(ctx, s.ID, s.Index)
+
+Loop:
+	for {
+		select {
+		case err := <-chErr:
+			return true, trace.Wrap(err)
+
+		case evt, ok := <-chEvt:
+			if !ok {
+				log.WithField("id", s.ID).Info("Finished session events ingest")
+				break Loop // Break the main loop
+			}
+
+			e, err := NewTeleportEvent(evt, "")
+			if err != nil {
+				return false, trace.Wrap(err)
+			}
+			e.SetSessionIdempotencyKey(s.ID)
+			e.Stream = streamSession
+
+			if rec != nil {
+				if err := rec.Write(e); err != nil {
+					return true, trace.Wrap(err)
+				}
+			}
+
+			if summary != nil {
+				if err := summary.Add(e); err != nil {
+					return false, trace.Wrap(err)
+				}
+			}
+
+			_, ok = j.app.Config().SkipSessionTypes[e.Type]
+			if !ok && j.app.Config().SessionSummary != sessionSummaryOnly {
+				err := j.app.SendEvent(ctx, url, e)
+
+				if err != nil && trace.IsConnectionProblem(err) {
+					return true, trace.Wrap(err)
+				}
+				if err != nil {
+					return false, trace.Wrap(err)
+				}
+			}
+
+			// Set session index
+			err = j.app.State.SetSessionIndex(s.ID, e.Index)
+			if err != nil {
+				return true, trace.Wrap(err)
+			}
+		case <-ctx.Done():
+			if lib.IsCanceled(ctx.Err()) {
+				return false, nil
+			}
+
+			return false, trace.Wrap(ctx.Err())
+		}
+	}
+
+	if rec != nil {
+		if err := rec.Close(); err != nil {
+			return true, trace.Wrap(err)
+		}
+		if err := j.app.SessionExporter.Finish(ctx, s.ID); err != nil {
+			return true, trace.Wrap(err)
+		}
+	}
+
+	if summary != nil {
+		retry, err := j.sendSummary(ctx, summary)
+		if err != nil {
+			return retry, trace.Wrap(err)
+		}
+		summary = nil
+	}
+
+	// We have finished ingestion and do not need session state anymore
+	err = j.app.State.RemoveSession(s.ID)
+	// If the session had no events, the file won't exist, so we ignore the error
+	if err != nil && !os.IsNotExist(err) {
+		return false, trace.Wrap(err)
+	}
+
+	return false, nil
+}
+
+// openRecording opens the session recording if session export is enabled
+func (j *SessionEventsJob) openRecording(id string) (*asciicastRecording, error) {
+	if j.app.SessionExporter == nil {
+		return nil, nil
+	}
+
+	// The persisted index is used instead of the one the session was started with because
+	// the latter is stale when ingestion is retried.
+	index, err := j.app.State.GetSessionIndex(id)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	rec, err := j.app.SessionExporter.Open(id, index)
+	return rec, trace.Wrap(err)
+}
+
+// openSummary restores or creates the session summary if session summaries are enabled
+func (j *SessionEventsJob) openSummary(id string) (*sessionSummarizer, error) {
+	if j.app.Config().SessionSummary == "" || j.app.Config().SessionSummary == sessionSummaryOff {
+		return nil, nil
+	}
+
+	index, err := j.app.State.GetSessionIndex(id)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	b, err := j.app.State.GetSessionSummary(id)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if b != nil {
+		summary, err := loadSessionSummarizer(b, index)
+		return summary, trace.Wrap(err)
+	}
+
+	return newSessionSummarizer(id, index), nil
+}
+
+// saveSummary saves the summary of the session which ingestion was not finished
+func (j *SessionEventsJob) saveSummary(ctx context.Context, id string, summary *sessionSummarizer) {
+	if summary == nil {
+		return
+	}
+
+	b, err := summary.Marshal()
+	if err == nil {
+		err = j.app.State.SetSessionSummary(id, b)
+	}
+	if err != nil {
+		logger.Get(ctx).WithError(err).WithField("id", id).Error("Failed to save session summary")
+	}
+}
+
+// sendSummary sends the session summary record and removes it from the state
+func (j *SessionEventsJob) sendSummary(ctx context.Context, summary *sessionSummarizer) (bool, error) {
+	e, err := summary.Event(time.Now())
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+
+	err = j.app.SendEvent(ctx, j.app.Config().FluentdSessionURL+"."+sessionSummaryTag+".log", e)
+	if err != nil {
+		return trace.IsConnectionProblem(err), trace.Wrap(err)
+	}
+
+	err = j.app.State.RemoveSessionSummary(summary.Summary.SessionID)
+	if err != nil && !os.IsNotExist(err) {
+		return false, trace.Wrap(err)
+	}
+
+	return false, nil
+}
+
+// setActive marks the session as being queued or ingested, returns false if it already is.
+// Sessions which failed ingestion stay active until restart, so they are not picked up by rescans.
+func (j *SessionEventsJob) setActive(id string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, ok := j.active[id]; ok {
+		return false
+	}
+	j.active[id] = struct{}{}
+
+	return true
+}
+
+// setInactive marks the session as no longer being ingested
+func (j *SessionEventsJob) setInactive(id string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	delete(j.active, id)
+}
+
+// recordFailure counts failed session ingestion attempt and moves the session to quarantine if
+// the number of attempts exceeds the limit. Returns true if the session has been quarantined.
+func (j *SessionEventsJob) recordFailure(ctx context.Context, id string, cause error) (bool, error) {
+	log := logger.Get(ctx).WithField("id", id)
+
+	j.metrics.ingestFailures.Inc()
+
+	attempts, err := j.app.State.IncSessionAttempts(id)
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+
+	maxAttempts := j.app.Config().SessionMaxAttempts
+	if maxAttempts <= 0 || attempts < maxAttempts {
+		log.WithField("attempts", attempts).Warn("Session ingestion will be retried on restart")
+		return false, nil
+	}
+
+	index, err := j.app.State.GetSessionIndex(id)
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+
+	q := QuarantinedSession{
+		ID:            id,
+		Index:         index,
+		Attempts:      attempts,
+		QuarantinedAt: time.Now().UTC(),
+	}
+	if cause != nil {
+		q.LastError = cause.Error()
+	}
+
+	if err := j.app.State.QuarantineSession(q); err != nil {
+		return false, trace.Wrap(err)
+	}
+
+	// The recording written so far is dropped along with the summary, the session is started over from the
+	// quarantined position if it is retried
+	if j.app.SessionExporter != nil {
+		if err := j.app.SessionExporter.Remove(id); err != nil {
+			return false, trace.Wrap(err)
+		}
+	}
+
+	j.metrics.quarantinedTotal.Inc()
+	j.updateQuarantineGauge(ctx)
+
+	log.WithField("attempts", attempts).WithField("index", index).WithField("err", q.LastError).
+		Error("Session ingestion failed too many times, session is quarantined")
+
+	return true, nil
+}
+
+// updateQuarantineGauge updates the number of quarantined sessions metric
+func (j *SessionEventsJob) updateQuarantineGauge(ctx context.Context) {
+	sessions, err := j.app.State.GetQuarantinedSessions()
+	if err != nil {
+		logger.Get(ctx).WithError(err).Error("Failed to read quarantined sessions")
+		return
+	}
+
+	j.metrics.quarantined.Set(float64(len(sessions)))
+}
+
+// Register starts session event ingestion
+func (j *SessionEventsJob) RegisterSession(ctx context.Context, e *TeleportEvent) error {
+	// The session may have been claimed by the rescan of the saved sessions already
+	if !j.setActive(e.SessionID) {
+		return nil
+	}
+
+	err := j.app.State.SetSessionIndex(e.SessionID, 0)
+	if err != nil {
+		j.setInactive(e.SessionID)
+		return trace.Wrap(err)
+	}
+
+	s := session{ID: e.SessionID, Index: 0}
+
+	go func() {
+		select {
+		case j.sessions <- s:
+			return
+		case <-ctx.Done():
+			log.Error(ctx.Err())
+			return
+		}
+	}()
+
+	return nil
+}
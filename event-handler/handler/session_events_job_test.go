@@ -0,0 +1,153 @@
+// Copyright 2023 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gravitational/teleport/api/client"
+	auditlogpb "github.com/gravitational/teleport/api/gen/proto/go/teleport/auditlog/v1"
+	"github.com/gravitational/trace"
+	"github.com/peterbourgon/diskv/v3"
+	"github.com/stretchr/testify/require"
+)
+
+// TestConsumeSessionNoEventsFound tests that the consumeSession method returns without error
+// if no events are found.
+func TestConsumeSessionNoEventsFound(t *testing.T) {
+	sessionID := "test"
+	app := &App{
+		Source: &TeleportEventsWatcher{
+			client: &mockClient{},
+		},
+		State: &State{
+			dv: diskv.New(diskv.Options{
+				BasePath: t.TempDir(),
+			}),
+		},
+	}
+	app.config.Store(&StartCmdConfig{})
+	j := &SessionEventsJob{app: app}
+	_, err := j.consumeSession(context.Background(), session{ID: sessionID})
+	require.NoError(t, err)
+}
+
+// TestRecordFailureQuarantine tests that the session is quarantined once it runs out of attempts
+func TestRecordFailureQuarantine(t *testing.T) {
+	state := &State{
+		dv: diskv.New(diskv.Options{
+			BasePath: t.TempDir(),
+		}),
+	}
+	exporter, err := NewSessionExporter(&SessionExportConfig{SessionExportDir: t.TempDir()})
+	require.NoError(t, err)
+	app := &App{State: state, SessionExporter: exporter}
+	app.config.Store(&StartCmdConfig{
+		IngestConfig: IngestConfig{SessionMaxAttempts: 2},
+	})
+	j := &SessionEventsJob{
+		app:     app,
+		active:  make(map[string]struct{}),
+		metrics: newSessionMetrics(),
+	}
+	ctx := context.Background()
+
+	require.NoError(t, state.SetSessionIndex("sid", 3))
+	require.NoError(t, state.SetSessionSummary("sid", []byte(`{}`)))
+	rec, err := exporter.Open("sid", 0)
+	require.NoError(t, err)
+	require.NoError(t, rec.Write(newRecordingEvent(t, printType, 1, time.Now(), map[string]interface{}{"data": []byte("hello")})))
+	require.NoError(t, rec.Close())
+
+	quarantined, err := j.recordFailure(ctx, "sid", trace.ConnectionProblem(nil, "unreachable"))
+	require.NoError(t, err)
+	require.False(t, quarantined)
+
+	quarantined, err = j.recordFailure(ctx, "sid", trace.ConnectionProblem(nil, "unreachable"))
+	require.NoError(t, err)
+	require.True(t, quarantined)
+
+	sessions, err := state.GetQuarantinedSessions()
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	require.Equal(t, int64(3), sessions[0].Index)
+	require.Equal(t, 2, sessions[0].Attempts)
+	require.Contains(t, sessions[0].LastError, "unreachable")
+
+	// The recording and the summary written so far are dropped
+	summary, err := state.GetSessionSummary("sid")
+	require.NoError(t, err)
+	require.Nil(t, summary)
+	_, err = os.Stat(filepath.Join(exporter.dir, "sid"+asciicastPartExt))
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(exporter.dir, "sid"+asciicastSizesExt))
+	require.True(t, os.IsNotExist(err))
+
+	var out bytes.Buffer
+	require.NoError(t, retryQuarantinedSessions(state, nil, true, &out))
+	require.Contains(t, out.String(), "sid")
+
+	active, err := state.GetSessions()
+	require.NoError(t, err)
+	require.Equal(t, map[string]int64{"sid": 3}, active)
+}
+
+// TestRegisterActiveSession tests that the session already being ingested is not registered again
+func TestRegisterActiveSession(t *testing.T) {
+	state := &State{
+		dv: diskv.New(diskv.Options{
+			BasePath: t.TempDir(),
+		}),
+	}
+	app := &App{State: state}
+	app.config.Store(&StartCmdConfig{})
+	j := &SessionEventsJob{
+		app:      app,
+		active:   make(map[string]struct{}),
+		sessions: make(chan session, 2),
+	}
+	ctx := context.Background()
+
+	require.NoError(t, state.SetSessionIndex("sid", 7))
+	require.True(t, j.setActive("sid"))
+
+	require.NoError(t, j.RegisterSession(ctx, &TeleportEvent{SessionID: "sid"}))
+	require.Empty(t, j.sessions)
+
+	index, err := state.GetSessionIndex("sid")
+	require.NoError(t, err)
+	require.Equal(t, int64(7), index)
+
+	require.NoError(t, j.RegisterSession(ctx, &TeleportEvent{SessionID: "new"}))
+	require.Equal(t, session{ID: "new"}, <-j.sessions)
+}
+
+type mockClient struct {
+	client.Client
+}
+
+// StreamSessionEvents overrides the client.Client method to return a closed channel
+// to ensure that the consumeSession method returns without error if no events are found.
+func (m *mockClient) StreamUnstructuredSessionEvents(ctx context.Context, sessionID string, startIndex int64) (chan *auditlogpb.EventUnstructured, chan error) {
+	c := make(chan *auditlogpb.EventUnstructured)
+	e := make(chan error)
+	close(c)
+	return c, e
+}
@@ -0,0 +1,484 @@
+// Copyright 2024 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	tlib "github.com/gravitational/teleport/integrations/lib"
+	"github.com/gravitational/trace"
+)
+
+const (
+	// sessionStartType represents type name for session start event
+	sessionStartType = "session.start"
+	// resizeType represents type name for terminal resize event
+	resizeType = "resize"
+	// printType represents type name for session print event
+	printType = "print"
+
+	// asciicastVersion is the asciicast format version produced by the exporter
+	asciicastVersion = 2
+	// asciicastExt is the file extension of the exported recording
+	asciicastExt = ".cast"
+	// asciicastPartExt is the file extension of the recording which is still being written
+	asciicastPartExt = ".cast.part"
+	// asciicastSizesExt is the file extension of the recording sizes after every event written, the recording is
+	// truncated to the size of the saved session position when it is resumed
+	asciicastSizesExt = ".cast.sizes"
+	// defaultTerminalSize is used when the session does not carry terminal size
+	defaultTerminalSize = "80:25"
+	// recordingFilePerms is the exported recording file permissions
+	recordingFilePerms = 0600
+)
+
+// SessionExportSink stores the finished asciicast recordings
+type SessionExportSink interface {
+	// Store stores the finished recording of the session located at path
+	Store(ctx context.Context, sessionID string, path string) error
+}
+
+// SessionExporter converts session events into asciicast v2 recordings
+type SessionExporter struct {
+	// dir is the directory where the recordings are written to
+	dir string
+	// sink is where the finished recordings are stored
+	sink SessionExportSink
+}
+
+// asciicastHeader is the first line of the asciicast v2 file
+type asciicastHeader struct {
+	Version   int    `json:"version"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+	Title     string `json:"title,omitempty"`
+}
+
+// recordingEvent holds the fields of session.start, resize and print events used by the exporter
+type recordingEvent struct {
+	// Size is the terminal size in W:H format
+	Size string `json:"size"`
+	// Data is the terminal output of the print event
+	Data []byte `json:"data"`
+	// DelayMilliseconds is the print event offset from the session start
+	DelayMilliseconds int64 `json:"ms"`
+	// User is the Teleport user
+	User string `json:"user"`
+	// Login is the OS login
+	Login string `json:"login"`
+	// ServerHostname is the name of the node
+	ServerHostname string `json:"server_hostname"`
+}
+
+// asciicastRecording is a single session recording being written
+type asciicastRecording struct {
+	// f is the recording file
+	f *os.File
+	// path is the recording file path
+	path string
+	// sizes is the file the recording size is appended to after every event written
+	sizes *os.File
+	// size is the recording file size
+	size int64
+	// start is the recording start time, the session start truncated to seconds, frame offsets are counted from it
+	start time.Time
+	// origin is the session start the print event offsets are counted from, zero until it is known
+	origin time.Time
+	// lastIndex is the index of the latest event written
+	lastIndex int64
+	// lastOffset is the offset of the latest frame written
+	lastOffset float64
+	// hasHeader is true when the header is already written
+	hasHeader bool
+}
+
+// NewSessionExporter creates new SessionExporter
+func NewSessionExporter(c *SessionExportConfig) (*SessionExporter, error) {
+	if err := os.MkdirAll(c.SessionExportDir, storageDirPerms); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	var sink SessionExportSink = &fileExportSink{}
+	if c.SessionExportURL != "" {
+		sink = &httpExportSink{
+			url:    strings.TrimSuffix(c.SessionExportURL, "/"),
+			client: &http.Client{Timeout: c.SessionExportTimeout},
+		}
+	}
+
+	return &SessionExporter{dir: c.SessionExportDir, sink: sink}, nil
+}
+
+// Open opens the recording of the session. index is the index of the latest event processed so far,
+// events up to this index are considered to be written, the frames of the later events are dropped. Zero index
+// starts the recording from scratch.
+func (e *SessionExporter) Open(id string, index int64) (*asciicastRecording, error) {
+	r := &asciicastRecording{
+		path:      filepath.Join(e.dir, id+asciicastPartExt),
+		lastIndex: -1,
+	}
+	sizesPath := filepath.Join(e.dir, id+asciicastSizesExt)
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if index > 0 {
+		if err := r.truncate(sizesPath, index); err != nil {
+			return nil, trace.Wrap(err)
+		}
+
+		header, err := readAsciicastHeader(r.path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, trace.Wrap(err)
+		}
+		if header != nil {
+			flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+			r.hasHeader = true
+			r.start = time.Unix(header.Timestamp, 0)
+		}
+		r.lastIndex = index
+	}
+
+	f, err := os.OpenFile(r.path, flags, recordingFilePerms)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	r.f = f
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, trace.Wrap(err)
+	}
+	r.size = info.Size()
+
+	r.sizes, err = os.OpenFile(sizesPath, flags, recordingFilePerms)
+	if err != nil {
+		f.Close()
+		return nil, trace.Wrap(err)
+	}
+
+	return r, nil
+}
+
+// truncate truncates the recording to the size it had after the event with the given index was written. The
+// recordings without the sizes, written by the earlier versions, are resumed as they are.
+func (r *asciicastRecording) truncate(sizesPath string, index int64) error {
+	b, err := os.ReadFile(sizesPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	var size, kept int64
+	for _, line := range strings.SplitAfter(string(b), "\n") {
+		var i, n int64
+		// The last line may be partially written
+		if !strings.HasSuffix(line, "\n") {
+			break
+		}
+		if _, err := fmt.Sscanf(line, "%d %d\n", &i, &n); err != nil || i > index {
+			break
+		}
+		size, kept = n, kept+int64(len(line))
+	}
+
+	if err := os.Truncate(r.path, size); err != nil && !os.IsNotExist(err) {
+		return trace.Wrap(err)
+	}
+
+	return trace.Wrap(os.Truncate(sizesPath, kept))
+}
+
+// Remove removes the recording which is still being written
+func (e *SessionExporter) Remove(id string) error {
+	for _, ext := range []string{asciicastPartExt, asciicastSizesExt} {
+		err := os.Remove(filepath.Join(e.dir, id+ext))
+		if err != nil && !os.IsNotExist(err) {
+			return trace.Wrap(err)
+		}
+	}
+
+	return nil
+}
+
+// Finish hands the complete recording over to the sink
+func (e *SessionExporter) Finish(ctx context.Context, id string) error {
+	path := filepath.Join(e.dir, id+asciicastPartExt)
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return trace.Wrap(err)
+	}
+
+	if err := e.sink.Store(ctx, id, path); err != nil {
+		return trace.Wrap(err)
+	}
+
+	return trace.Wrap(e.Remove(id))
+}
+
+// readAsciicastHeader reads the header of the partially written recording
+func readAsciicastHeader(path string) (*asciicastHeader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	if !s.Scan() {
+		return nil, trace.Wrap(s.Err())
+	}
+
+	var h asciicastHeader
+	if err := json.Unmarshal(s.Bytes(), &h); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	return &h, nil
+}
+
+// Write writes the event to the recording. Events other than session.start, resize and print are ignored.
+func (r *asciicastRecording) Write(e *TeleportEvent) error {
+	if e.Index <= r.lastIndex {
+		return nil
+	}
+
+	switch e.Type {
+	case sessionStartType, resizeType, printType:
+	default:
+		r.lastIndex = e.Index
+		return nil
+	}
+
+	var evt recordingEvent
+	if err := json.Unmarshal(e.Event, &evt); err != nil {
+		return trace.Wrap(err)
+	}
+
+	size := r.size
+
+	if !r.hasHeader {
+		if err := r.writeHeader(e, &evt); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+
+	switch e.Type {
+	case resizeType:
+		w, h, err := parseTerminalSize(evt.Size)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		err = r.writeFrame(r.frameOffset(e, &evt), "r", fmt.Sprintf("%dx%d", w, h))
+		if err != nil {
+			return trace.Wrap(err)
+		}
+	case printType:
+		err := r.writeFrame(r.frameOffset(e, &evt), "o", string(evt.Data))
+		if err != nil {
+			return trace.Wrap(err)
+		}
+	}
+
+	r.lastIndex = e.Index
+
+	// The size is appended after the frame, the frame which size is not saved is dropped on resume
+	if r.size != size {
+		if _, err := fmt.Fprintf(r.sizes, "%d %d\n", e.Index, r.size); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+
+	return nil
+}
+
+// writeHeader writes asciicast header using the first event of the recording
+func (r *asciicastRecording) writeHeader(e *TeleportEvent, evt *recordingEvent) error {
+	size := defaultTerminalSize
+	if e.Type == sessionStartType && evt.Size != "" {
+		size = evt.Size
+	}
+
+	w, h, err := parseTerminalSize(size)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	start := e.Time
+	if e.Type == printType {
+		start = e.Time.Add(-time.Duration(evt.DelayMilliseconds) * time.Millisecond)
+	}
+	if e.Type != resizeType {
+		r.origin = start
+	}
+	r.start = start.Truncate(time.Second)
+
+	header := asciicastHeader{
+		Version:   asciicastVersion,
+		Width:     w,
+		Height:    h,
+		Timestamp: r.start.Unix(),
+	}
+	if evt.Login != "" && evt.ServerHostname != "" {
+		header.Title = evt.Login + "@" + evt.ServerHostname
+	}
+
+	if err := r.writeLine(header); err != nil {
+		return trace.Wrap(err)
+	}
+
+	r.hasHeader = true
+
+	return nil
+}
+
+// frameOffset returns the offset of the frame from the recording start. Print events carry their offset from the
+// session start, the resize event offset is computed from the event time, so the print offsets are shifted by the
+// time the session started after the recording start to keep both on the same clock.
+func (r *asciicastRecording) frameOffset(e *TeleportEvent, evt *recordingEvent) float64 {
+	if e.Type != printType {
+		return e.Time.Sub(r.start).Seconds()
+	}
+
+	delay := time.Duration(evt.DelayMilliseconds) * time.Millisecond
+	// The session start is not saved in the resumed recording, it is found using the first print event
+	if r.origin.IsZero() {
+		r.origin = e.Time.Add(-delay)
+	}
+
+	return r.origin.Add(delay).Sub(r.start).Seconds()
+}
+
+// writeFrame writes a single asciicast event line
+func (r *asciicastRecording) writeFrame(offset float64, code string, data string) error {
+	// Frames must be ordered by time
+	if offset < r.lastOffset {
+		offset = r.lastOffset
+	}
+	r.lastOffset = offset
+
+	return r.writeLine([]interface{}{offset, code, data})
+}
+
+// writeLine writes JSON encoded value followed by the newline
+func (r *asciicastRecording) writeLine(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	n, err := r.f.Write(append(b, '\n'))
+	r.size += int64(n)
+
+	return trace.Wrap(err)
+}
+
+// Close closes the recording file, the recording stays on disk and could be resumed
+func (r *asciicastRecording) Close() error {
+	if r == nil || r.f == nil {
+		return nil
+	}
+
+	err := r.f.Close()
+	r.f = nil
+
+	return trace.NewAggregate(err, r.sizes.Close())
+}
+
+// parseTerminalSize parses terminal size in W:H format
+func parseTerminalSize(size string) (int, int, error) {
+	parts := strings.Split(size, ":")
+	if len(parts) != 2 {
+		return 0, 0, trace.BadParameter("invalid terminal size %q", size)
+	}
+
+	w, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, trace.BadParameter("invalid terminal width %q", size)
+	}
+
+	h, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, trace.BadParameter("invalid terminal height %q", size)
+	}
+
+	return w, h, nil
+}
+
+// fileExportSink keeps the finished recordings in the export directory
+type fileExportSink struct{}
+
+// Store renames the recording to its final name
+func (s *fileExportSink) Store(_ context.Context, sessionID string, path string) error {
+	target := filepath.Join(filepath.Dir(path), sessionID+asciicastExt)
+	return trace.Wrap(os.Rename(path, target))
+}
+
+// httpExportSink uploads the finished recordings to an object store using HTTP PUT
+type httpExportSink struct {
+	// url is the base upload URL, recordings are uploaded to <url>/<session-id>.cast
+	url string
+	// client is HTTP client used to upload recordings
+	client *http.Client
+}
+
+// Store uploads the recording and removes the local copy
+func (s *httpExportSink) Store(ctx context.Context, sessionID string, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.url+"/"+sessionID+asciicastExt, f)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	req.ContentLength = stat.Size()
+	req.Header.Set("Content-Type", "application/x-asciicast")
+
+	r, err := s.client.Do(req)
+	if err != nil {
+		if tlib.IsCanceled(ctx.Err()) {
+			return trace.Wrap(ctx.Err())
+		}
+		return trace.ConnectionProblem(err, "failed to upload session recording")
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		return trace.ConnectionProblem(nil, "failed to upload session recording (HTTP %v)", r.StatusCode)
+	}
+
+	return trace.Wrap(os.Remove(path))
+}
@@ -0,0 +1,208 @@
+// Copyright 2024 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newRecordingEvent creates a session event used by exporter tests
+func newRecordingEvent(t *testing.T, typ string, index int64, ts time.Time, fields map[string]interface{}) *TeleportEvent {
+	fields["event"] = typ
+	fields["ei"] = index
+	b, err := json.Marshal(fields)
+	require.NoError(t, err)
+
+	return &TeleportEvent{Type: typ, Index: index, Time: ts, Event: b}
+}
+
+func TestSessionExporter(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	exporter, err := NewSessionExporter(&SessionExportConfig{SessionExportDir: dir})
+	require.NoError(t, err)
+
+	rec, err := exporter.Open("sid", 0)
+	require.NoError(t, err)
+
+	events := []*TeleportEvent{
+		newRecordingEvent(t, sessionStartType, 0, start, map[string]interface{}{"size": "100:30", "login": "root", "server_hostname": "node"}),
+		newRecordingEvent(t, printType, 1, start.Add(time.Second), map[string]interface{}{"data": []byte("hello"), "ms": 1000}),
+		newRecordingEvent(t, "session.command", 2, start.Add(time.Second), map[string]interface{}{}),
+		newRecordingEvent(t, resizeType, 3, start.Add(2*time.Second), map[string]interface{}{"size": "120:40"}),
+	}
+	for _, e := range events {
+		require.NoError(t, rec.Write(e))
+	}
+	require.NoError(t, rec.Close())
+
+	// Resumed ingestion must not duplicate events already written
+	rec, err = exporter.Open("sid", 3)
+	require.NoError(t, err)
+	require.NoError(t, rec.Write(events[3]))
+	require.NoError(t, rec.Write(newRecordingEvent(t, printType, 4, start.Add(3*time.Second), map[string]interface{}{"data": []byte("bye"), "ms": 3000})))
+	require.NoError(t, rec.Close())
+
+	require.NoError(t, exporter.Finish(context.Background(), "sid"))
+
+	_, err = os.Stat(filepath.Join(dir, "sid"+asciicastPartExt))
+	require.True(t, os.IsNotExist(err))
+
+	b, err := os.ReadFile(filepath.Join(dir, "sid"+asciicastExt))
+	require.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	require.Len(t, lines, 4)
+	require.JSONEq(t, `{"version":2,"width":100,"height":30,"timestamp":1704067200,"title":"root@node"}`, lines[0])
+	require.JSONEq(t, `[1,"o","hello"]`, lines[1])
+	require.JSONEq(t, `[2,"r","120x40"]`, lines[2])
+	require.JSONEq(t, `[3,"o","bye"]`, lines[3])
+}
+
+// TestSessionExporterResume checks that the frames written after the saved session position are dropped on resume
+func TestSessionExporterResume(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	exporter, err := NewSessionExporter(&SessionExportConfig{SessionExportDir: dir})
+	require.NoError(t, err)
+
+	output := func(index int64, data string) *TeleportEvent {
+		return newRecordingEvent(t, printType, index, start.Add(time.Duration(index)*time.Second), map[string]interface{}{"data": []byte(data), "ms": index * 1000})
+	}
+
+	rec, err := exporter.Open("sid", 0)
+	require.NoError(t, err)
+	for i, data := range []string{"a", "b", "c"} {
+		require.NoError(t, rec.Write(output(int64(i+1), data)))
+	}
+	require.NoError(t, rec.Close())
+
+	// The size of the last event is partially written
+	f, err := os.OpenFile(filepath.Join(dir, "sid"+asciicastSizesExt), os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.WriteString("4 1")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// The handler crashed before the position of the events 2 and 3 was saved, they are resent
+	rec, err = exporter.Open("sid", 1)
+	require.NoError(t, err)
+	for i, data := range []string{"b", "c", "d"} {
+		require.NoError(t, rec.Write(output(int64(i+2), data)))
+	}
+	require.NoError(t, rec.Close())
+
+	require.NoError(t, exporter.Finish(context.Background(), "sid"))
+
+	_, err = os.Stat(filepath.Join(dir, "sid"+asciicastSizesExt))
+	require.True(t, os.IsNotExist(err))
+
+	b, err := os.ReadFile(filepath.Join(dir, "sid"+asciicastExt))
+	require.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	require.Len(t, lines, 5)
+	require.JSONEq(t, `[1,"o","a"]`, lines[1])
+	require.JSONEq(t, `[2,"o","b"]`, lines[2])
+	require.JSONEq(t, `[3,"o","c"]`, lines[3])
+	require.JSONEq(t, `[4,"o","d"]`, lines[4])
+}
+
+// TestSessionExporterClock checks that the print and resize frames are on the same clock when the session does not
+// start at a whole second
+func TestSessionExporterClock(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2024, 1, 1, 0, 0, 0, int(600*time.Millisecond), time.UTC)
+
+	exporter, err := NewSessionExporter(&SessionExportConfig{SessionExportDir: dir})
+	require.NoError(t, err)
+
+	rec, err := exporter.Open("sid", 0)
+	require.NoError(t, err)
+	require.NoError(t, rec.Write(newRecordingEvent(t, sessionStartType, 0, start, map[string]interface{}{"size": "100:30"})))
+	require.NoError(t, rec.Write(newRecordingEvent(t, resizeType, 1, start.Add(time.Second), map[string]interface{}{"size": "120:40"})))
+	require.NoError(t, rec.Write(newRecordingEvent(t, printType, 2, start.Add(1500*time.Millisecond), map[string]interface{}{"data": []byte("a"), "ms": 1500})))
+	require.NoError(t, rec.Close())
+
+	// The session start is found using the print event on resume
+	rec, err = exporter.Open("sid", 2)
+	require.NoError(t, err)
+	require.NoError(t, rec.Write(newRecordingEvent(t, printType, 3, start.Add(2*time.Second), map[string]interface{}{"data": []byte("b"), "ms": 2000})))
+	require.NoError(t, rec.Write(newRecordingEvent(t, resizeType, 4, start.Add(2500*time.Millisecond), map[string]interface{}{"size": "80:25"})))
+	require.NoError(t, rec.Close())
+
+	b, err := os.ReadFile(filepath.Join(dir, "sid"+asciicastPartExt))
+	require.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	require.Len(t, lines, 5)
+	require.JSONEq(t, `[1.6,"r","120x40"]`, lines[1])
+	require.JSONEq(t, `[2.1,"o","a"]`, lines[2])
+	require.JSONEq(t, `[2.6,"o","b"]`, lines[3])
+	require.JSONEq(t, `[3.1,"r","80x25"]`, lines[4])
+}
+
+func TestSessionExporterUploadTimeout(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+
+	exporter, err := NewSessionExporter(&SessionExportConfig{
+		SessionExportDir:     dir,
+		SessionExportURL:     server.URL,
+		SessionExportTimeout: 100 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	rec, err := exporter.Open("sid", 0)
+	require.NoError(t, err)
+	require.NoError(t, rec.Write(newRecordingEvent(t, sessionStartType, 0, start, map[string]interface{}{"size": "100:30"})))
+	require.NoError(t, rec.Close())
+
+	err = exporter.Finish(context.Background(), "sid")
+	require.Error(t, err)
+
+	// The recording is kept to be uploaded again
+	_, err = os.Stat(filepath.Join(dir, "sid"+asciicastPartExt))
+	require.NoError(t, err)
+}
+
+func TestParseTerminalSize(t *testing.T) {
+	w, h, err := parseTerminalSize("80:25")
+	require.NoError(t, err)
+	require.Equal(t, 80, w)
+	require.Equal(t, 25, h)
+
+	_, _, err = parseTerminalSize("80x25")
+	require.Error(t, err)
+}
@@ -0,0 +1,143 @@
+// Copyright 2024 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	apievents "github.com/gravitational/teleport/api/types/events"
+	"github.com/gravitational/trace"
+)
+
+const (
+	// recordingProtoVersion is the version of the session recording binary format
+	recordingProtoVersion = 1
+	// recordingMaxMessageSize is the maximum size of the session recording event
+	recordingMaxMessageSize = 64 * 1024
+)
+
+// sessionRecordingReader reads the events of the session recording. The recording consists of parts, each
+// part is the header (the format version, the part size and the padding size) followed by the gzipped
+// events, each event is the size followed by the protobuf encoded event.
+type sessionRecordingReader struct {
+	// r is the recording
+	r io.Reader
+	// part is the current part, nil if the next part header is to be read
+	part *gzip.Reader
+	// padding is the size of the padding following the current part
+	padding int64
+	// lastIndex is the index of the latest event read, the events recorded twice are skipped
+	lastIndex int64
+	// buf is the message buffer
+	buf []byte
+}
+
+// newSessionRecordingReader creates the session recording reader
+func newSessionRecordingReader(r io.Reader) *sessionRecordingReader {
+	return &sessionRecordingReader{r: r, lastIndex: -1, buf: make([]byte, recordingMaxMessageSize)}
+}
+
+// Read returns the next event of the recording, io.EOF once all the events are read
+func (r *sessionRecordingReader) Read() (apievents.AuditEvent, error) {
+	for {
+		if r.part == nil {
+			if err := r.nextPart(); err != nil {
+				return nil, err
+			}
+		}
+
+		var size [4]byte
+		_, err := io.ReadFull(r.part, size[:])
+		if errors.Is(err, io.EOF) {
+			if err := r.endPart(); err != nil {
+				return nil, trace.Wrap(err)
+			}
+			continue
+		}
+		if err != nil {
+			return nil, trace.ConvertSystemError(err)
+		}
+
+		n := binary.BigEndian.Uint32(size[:])
+		if n == 0 || n > recordingMaxMessageSize {
+			return nil, trace.BadParameter("unexpected session recording event size %v", n)
+		}
+		if _, err := io.ReadFull(r.part, r.buf[:n]); err != nil {
+			return nil, trace.ConvertSystemError(err)
+		}
+
+		var oneof apievents.OneOf
+		if err := oneof.Unmarshal(r.buf[:n]); err != nil {
+			return nil, trace.Wrap(err)
+		}
+		evt, err := apievents.FromOneOf(oneof)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+
+		if evt.GetIndex() <= r.lastIndex {
+			continue
+		}
+		r.lastIndex = evt.GetIndex()
+
+		return evt, nil
+	}
+}
+
+// nextPart reads the part header, returns io.EOF if there are no parts left
+func (r *sessionRecordingReader) nextPart() error {
+	var header [24]byte
+	if _, err := io.ReadFull(r.r, header[:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			return io.EOF
+		}
+		return trace.ConvertSystemError(err)
+	}
+
+	if v := binary.BigEndian.Uint64(header[:8]); v != recordingProtoVersion {
+		return trace.BadParameter("unsupported session recording format version %v", v)
+	}
+	size := binary.BigEndian.Uint64(header[8:16])
+	r.padding = int64(binary.BigEndian.Uint64(header[16:24]))
+
+	part, err := gzip.NewReader(io.LimitReader(r.r, int64(size)))
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	r.part = part
+
+	return nil
+}
+
+// endPart closes the current part and skips its padding
+func (r *sessionRecordingReader) endPart() error {
+	if err := r.part.Close(); err != nil {
+		return trace.Wrap(err)
+	}
+	r.part = nil
+
+	n, err := io.CopyN(io.Discard, r.r, r.padding)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return trace.ConvertSystemError(err)
+	}
+	if n != r.padding {
+		return trace.BadParameter("session recording is truncated, expected %v bytes of padding, got %v", r.padding, n)
+	}
+
+	return nil
+}
@@ -0,0 +1,269 @@
+// Copyright 2024 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"encoding/json"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/gravitational/trace"
+)
+
+const (
+	// sessionSummaryType represents type name of the session summary record
+	sessionSummaryType = "session.summary"
+	// sessionEndEventType represents type name for session end event
+	sessionEndEventType = "session.end"
+	// sessionJoinType represents type name for session join event
+	sessionJoinType = "session.join"
+	// sessionCommandType represents type name for enhanced recording command event
+	sessionCommandType = "session.command"
+	// sessionNetworkType represents type name for enhanced recording network event
+	sessionNetworkType = "session.network"
+	// sessionDiskType represents type name for enhanced recording file event
+	sessionDiskType = "session.disk"
+
+	// sessionSummaryTag is the Fluentd tag suffix the summary records are sent to
+	sessionSummaryTag = "summary"
+
+	// sessionSummaryOff disables session summary records
+	sessionSummaryOff = "off"
+	// sessionSummaryAlongside emits session summary records alongside the raw session events
+	sessionSummaryAlongside = "alongside"
+	// sessionSummaryOnly emits session summary records instead of the raw session events
+	sessionSummaryOnly = "only"
+)
+
+// sessionSummary is the record emitted once per session
+type sessionSummary struct {
+	// Type is the record type, always session.summary
+	Type string `json:"event"`
+	// Time is the time the record was produced
+	Time time.Time `json:"time"`
+	// SessionID is the session ID
+	SessionID string `json:"sid"`
+	// ClusterName is the name of the cluster the session belongs to
+	ClusterName string `json:"cluster_name,omitempty"`
+	// User is the user who started the session
+	User string `json:"user,omitempty"`
+	// Login is the OS login the session was started with
+	Login string `json:"login,omitempty"`
+	// ServerHostname is the name of the node the session was running on
+	ServerHostname string `json:"server_hostname,omitempty"`
+	// Participants is the list of session participants
+	Participants []string `json:"participants"`
+	// SessionStart is the session start time
+	SessionStart time.Time `json:"session_start,omitempty"`
+	// SessionStop is the session stop time
+	SessionStop time.Time `json:"session_stop,omitempty"`
+	// DurationMilliseconds is the session duration
+	DurationMilliseconds int64 `json:"duration_ms"`
+	// EventCount is the number of session events
+	EventCount int64 `json:"event_count"`
+	// BytesPrinted is the number of bytes printed to the terminal
+	BytesPrinted int64 `json:"bytes_printed"`
+	// CommandCount is the number of commands executed
+	CommandCount int64 `json:"command_count"`
+	// Programs is the list of distinct programs executed
+	Programs []string `json:"programs"`
+	// NetworkEventCount is the number of network events
+	NetworkEventCount int64 `json:"network_event_count"`
+	// DiskEventCount is the number of file events
+	DiskEventCount int64 `json:"disk_event_count"`
+	// EnhancedRecording is true when enhanced session recording was active
+	EnhancedRecording bool `json:"enhanced_recording"`
+	// Interactive is true when the session was interactive
+	Interactive bool `json:"interactive"`
+	// Partial is true when some of the session events were not accounted for
+	Partial bool `json:"partial,omitempty"`
+}
+
+// sessionSummarizer accumulates session summary from the session events
+type sessionSummarizer struct {
+	// Summary is the summary being computed
+	Summary sessionSummary `json:"summary"`
+	// LastIndex is the index of the latest event accounted for
+	LastIndex int64 `json:"last_index"`
+}
+
+// summaryEvent holds the session event fields used by the summarizer
+type summaryEvent struct {
+	ClusterName       string    `json:"cluster_name"`
+	User              string    `json:"user"`
+	Login             string    `json:"login"`
+	ServerHostname    string    `json:"server_hostname"`
+	Bytes             int64     `json:"bytes"`
+	Path              string    `json:"path"`
+	Participants      []string  `json:"participants"`
+	SessionStart      time.Time `json:"session_start"`
+	SessionStop       time.Time `json:"session_stop"`
+	EnhancedRecording bool      `json:"enhanced_recording"`
+	Interactive       bool      `json:"interactive"`
+}
+
+// newSessionSummarizer creates new sessionSummarizer. index is the index of the event the ingestion starts from.
+func newSessionSummarizer(id string, index int64) *sessionSummarizer {
+	return &sessionSummarizer{
+		Summary: sessionSummary{
+			Type:      sessionSummaryType,
+			SessionID: id,
+			Partial:   index > 0,
+		},
+		LastIndex: -1,
+	}
+}
+
+// loadSessionSummarizer restores sessionSummarizer saved by Marshal. index is the index of the event the
+// ingestion resumes from, the summary is partial if the events before it were not accounted.
+func loadSessionSummarizer(b []byte, index int64) (*sessionSummarizer, error) {
+	s := &sessionSummarizer{}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	if s.LastIndex+1 < index {
+		s.Summary.Partial = true
+	}
+
+	return s, nil
+}
+
+// Marshal serializes the summarizer so the ingestion could be resumed
+func (s *sessionSummarizer) Marshal() ([]byte, error) {
+	b, err := json.Marshal(s)
+	return b, trace.Wrap(err)
+}
+
+// Add accounts the event in the summary
+func (s *sessionSummarizer) Add(e *TeleportEvent) error {
+	if e.Index <= s.LastIndex {
+		return nil
+	}
+
+	var evt summaryEvent
+	if err := json.Unmarshal(e.Event, &evt); err != nil {
+		return trace.Wrap(err)
+	}
+
+	sum := &s.Summary
+	sum.EventCount++
+
+	if sum.ClusterName == "" {
+		sum.ClusterName = evt.ClusterName
+	}
+
+	switch e.Type {
+	case sessionStartType:
+		sum.User = evt.User
+		sum.Login = evt.Login
+		sum.ServerHostname = evt.ServerHostname
+		sum.SessionStart = e.Time
+		s.addParticipant(evt.User)
+	case sessionJoinType:
+		s.addParticipant(evt.User)
+	case printType:
+		sum.BytesPrinted += evt.Bytes
+	case sessionCommandType:
+		sum.CommandCount++
+		s.addProgram(evt.Path)
+	case sessionNetworkType:
+		sum.NetworkEventCount++
+	case sessionDiskType:
+		sum.DiskEventCount++
+	case sessionEndEventType:
+		for _, p := range evt.Participants {
+			s.addParticipant(p)
+		}
+		if !evt.SessionStart.IsZero() {
+			sum.SessionStart = evt.SessionStart
+		}
+		sum.SessionStop = evt.SessionStop
+		sum.EnhancedRecording = sum.EnhancedRecording || evt.EnhancedRecording
+		sum.Interactive = evt.Interactive
+	}
+
+	if e.Type == sessionCommandType || e.Type == sessionNetworkType || e.Type == sessionDiskType {
+		sum.EnhancedRecording = true
+	}
+
+	s.LastIndex = e.Index
+
+	return nil
+}
+
+// addParticipant adds the user to the participant list if it's not there yet
+func (s *sessionSummarizer) addParticipant(user string) {
+	if user == "" {
+		return
+	}
+
+	s.Summary.Participants = appendUnique(s.Summary.Participants, user)
+}
+
+// addProgram adds the program to the list of distinct programs executed
+func (s *sessionSummarizer) addProgram(p string) {
+	if p == "" {
+		return
+	}
+
+	s.Summary.Programs = appendUnique(s.Summary.Programs, path.Base(p))
+}
+
+// Event returns the summary record as TeleportEvent
+func (s *sessionSummarizer) Event(now time.Time) (*TeleportEvent, error) {
+	sum := s.Summary
+	sum.Time = now.UTC()
+
+	if !sum.SessionStart.IsZero() && !sum.SessionStop.IsZero() {
+		sum.DurationMilliseconds = sum.SessionStop.Sub(sum.SessionStart).Milliseconds()
+	}
+	if sum.Participants == nil {
+		sum.Participants = []string{}
+	}
+	if sum.Programs == nil {
+		sum.Programs = []string{}
+	}
+
+	b, err := json.Marshal(sum)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	return &TeleportEvent{
+		Event:          b,
+		ID:             sessionSummaryType + "-" + sum.SessionID,
+		IdempotencyKey: sessionSummaryType + "-" + sum.SessionID,
+		Type:           sessionSummaryType,
+		Time:           sum.Time,
+		SessionID:      sum.SessionID,
+		Stream:         streamSession,
+	}, nil
+}
+
+// appendUnique appends the value to the sorted slice of distinct values
+func appendUnique(s []string, v string) []string {
+	i := sort.SearchStrings(s, v)
+	if i < len(s) && s[i] == v {
+		return s
+	}
+
+	s = append(s, "")
+	copy(s[i+1:], s[i:])
+	s[i] = v
+
+	return s
+}
@@ -0,0 +1,96 @@
+// Copyright 2024 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionSummary(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	stop := start.Add(90 * time.Second)
+
+	events := []*TeleportEvent{
+		newRecordingEvent(t, sessionStartType, 0, start, map[string]interface{}{"user": "alice", "login": "root", "server_hostname": "node", "cluster_name": "root-cluster"}),
+		newRecordingEvent(t, printType, 1, start, map[string]interface{}{"bytes": 10}),
+		newRecordingEvent(t, sessionJoinType, 2, start, map[string]interface{}{"user": "bob"}),
+		newRecordingEvent(t, sessionCommandType, 3, start, map[string]interface{}{"path": "/usr/bin/ls"}),
+		newRecordingEvent(t, sessionCommandType, 4, start, map[string]interface{}{"path": "/bin/ls"}),
+		newRecordingEvent(t, sessionNetworkType, 5, start, map[string]interface{}{}),
+		newRecordingEvent(t, sessionDiskType, 6, start, map[string]interface{}{}),
+		newRecordingEvent(t, printType, 7, start, map[string]interface{}{"bytes": 5}),
+	}
+	end := newRecordingEvent(t, sessionEndEventType, 8, stop, map[string]interface{}{
+		"participants":  []string{"alice", "bob"},
+		"session_start": start,
+		"session_stop":  stop,
+		"interactive":   true,
+	})
+
+	s := newSessionSummarizer("sid", 0)
+	for _, e := range events {
+		require.NoError(t, s.Add(e))
+	}
+
+	// Emulate interrupted ingestion resumed from the saved state
+	b, err := s.Marshal()
+	require.NoError(t, err)
+	s, err = loadSessionSummarizer(b, 7)
+	require.NoError(t, err)
+
+	require.NoError(t, s.Add(events[7]))
+	require.NoError(t, s.Add(end))
+
+	e, err := s.Event(stop)
+	require.NoError(t, err)
+	require.Equal(t, sessionSummaryType, e.Type)
+	require.Equal(t, "sid", e.SessionID)
+
+	var sum sessionSummary
+	require.NoError(t, json.Unmarshal(e.Event, &sum))
+	require.Equal(t, []string{"alice", "bob"}, sum.Participants)
+	require.Equal(t, []string{"ls"}, sum.Programs)
+	require.Equal(t, int64(90000), sum.DurationMilliseconds)
+	require.Equal(t, int64(15), sum.BytesPrinted)
+	require.Equal(t, int64(2), sum.CommandCount)
+	require.Equal(t, int64(1), sum.NetworkEventCount)
+	require.Equal(t, int64(1), sum.DiskEventCount)
+	require.Equal(t, int64(9), sum.EventCount)
+	require.Equal(t, "root-cluster", sum.ClusterName)
+	require.True(t, sum.EnhancedRecording)
+	require.True(t, sum.Interactive)
+	require.False(t, sum.Partial)
+
+	// The summary which misses the events before the one the ingestion resumes from is partial
+	s, err = loadSessionSummarizer(b, 9)
+	require.NoError(t, err)
+	require.True(t, s.Summary.Partial)
+}
+
+func TestSessionSummaryPartial(t *testing.T) {
+	s := newSessionSummarizer("sid", 5)
+
+	e, err := s.Event(time.Now())
+	require.NoError(t, err)
+
+	var sum sessionSummary
+	require.NoError(t, json.Unmarshal(e.Event, &sum))
+	require.True(t, sum.Partial)
+	require.Empty(t, sum.Participants)
+}
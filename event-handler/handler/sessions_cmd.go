@@ -0,0 +1,120 @@
+// Copyright 2024 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gravitational/trace"
+)
+
+// NewState opens the plugin state
+func (c *StorageCmdConfig) NewState() (*State, error) {
+	s, err := NewState(&StartCmdConfig{
+		TeleportConfig: TeleportConfig{TeleportAddr: c.TeleportAddr},
+		IngestConfig:   IngestConfig{StorageDir: c.StorageDir},
+	})
+
+	return s, trace.Wrap(err)
+}
+
+// RunSessionsListCmd prints quarantined sessions
+func RunSessionsListCmd(c *SessionsListCmdConfig) error {
+	s, err := c.NewState()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	return trace.Wrap(listQuarantinedSessions(s, os.Stdout))
+}
+
+// RunSessionsRetryCmd moves quarantined sessions back to ingestion
+func RunSessionsRetryCmd(c *SessionsRetryCmdConfig) error {
+	if !c.All && len(c.IDs) == 0 {
+		return trace.BadParameter("specify IDs of the sessions to retry or --all")
+	}
+
+	s, err := c.NewState()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	return trace.Wrap(retryQuarantinedSessions(s, c.IDs, c.All, os.Stdout))
+}
+
+// listQuarantinedSessions writes quarantined sessions table to w
+func listQuarantinedSessions(s *State, w io.Writer) error {
+	sessions, err := s.GetQuarantinedSessions()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	if len(sessions) == 0 {
+		fmt.Fprintln(w, "No quarantined sessions")
+		return nil
+	}
+
+	t := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(t, "ID\tINDEX\tATTEMPTS\tQUARANTINED AT\tLAST ERROR")
+	for _, q := range sessions {
+		lastError := strings.ReplaceAll(q.LastError, "\n", " ")
+		fmt.Fprintf(t, "%v\t%v\t%v\t%v\t%v\n", q.ID, q.Index, q.Attempts, q.QuarantinedAt.Format(time.RFC3339), lastError)
+	}
+
+	return trace.Wrap(t.Flush())
+}
+
+// retryQuarantinedSessions releases quarantined sessions with given IDs or all of them
+func retryQuarantinedSessions(s *State, ids []string, all bool, w io.Writer) error {
+	sessions, err := s.GetQuarantinedSessions()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	byID := make(map[string]QuarantinedSession, len(sessions))
+	for _, q := range sessions {
+		byID[q.ID] = q
+	}
+
+	if all {
+		ids = make([]string, 0, len(sessions))
+		for _, q := range sessions {
+			ids = append(ids, q.ID)
+		}
+	}
+
+	var errs []error
+	for _, id := range ids {
+		q, ok := byID[id]
+		if !ok {
+			errs = append(errs, trace.NotFound("session %v is not quarantined", id))
+			continue
+		}
+
+		if err := s.ReleaseQuarantinedSession(q); err != nil {
+			errs = append(errs, trace.Wrap(err))
+			continue
+		}
+
+		fmt.Fprintf(w, "Session %v is queued for ingestion from index %v\n", q.ID, q.Index)
+	}
+
+	return trace.NewAggregate(errs...)
+}
@@ -0,0 +1,27 @@
+// Copyright 2024 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+)
+
+// Sink is a destination the events are sent to in addition to Fluentd. Send is called once per event, in the
+// order the events are read. An error stops the ingestion, so a sink is expected to retry transient failures on
+// its own.
+type Sink interface {
+	// Send sends the event. payload is the serialized event, wrapped with the envelope if enabled.
+	Send(ctx context.Context, e *TeleportEvent, payload []byte) error
+}
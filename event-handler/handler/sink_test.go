@@ -0,0 +1,320 @@
+// Copyright 2024 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	auditlogpb "github.com/gravitational/teleport/api/gen/proto/go/teleport/auditlog/v1"
+	"github.com/gravitational/teleport/integrations/lib/logger"
+	"github.com/gravitational/trace"
+	"github.com/prometheus/client_golang/prometheus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+)
+
+// staticEventSource is the event source returning the fixed list of events
+type staticEventSource struct {
+	events []*TeleportEvent
+}
+
+// Events returns the events and closes the channel
+func (s *staticEventSource) Events(ctx context.Context) (chan *TeleportEvent, chan error) {
+	ch := make(chan *TeleportEvent, len(s.events))
+	for _, e := range s.events {
+		ch <- e
+	}
+	close(ch)
+
+	return ch, make(chan error)
+}
+
+// StreamUnstructuredSessionEvents returns no session events
+func (s *staticEventSource) StreamUnstructuredSessionEvents(ctx context.Context, id string, index int64) (chan *auditlogpb.EventUnstructured, chan error) {
+	ch := make(chan *auditlogpb.EventUnstructured)
+	close(ch)
+
+	return ch, make(chan error)
+}
+
+// Drain does nothing, the events are already read
+func (s *staticEventSource) Drain() {}
+
+// SetConfig does nothing
+func (s *staticEventSource) SetConfig(c *StartCmdConfig) {}
+
+// recordingSink is the sink remembering the payloads sent
+type recordingSink struct {
+	payloads [][]byte
+}
+
+// Send records the payload
+func (s *recordingSink) Send(ctx context.Context, e *TeleportEvent, payload []byte) error {
+	s.payloads = append(s.payloads, payload)
+	return nil
+}
+
+func TestAppSinks(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	c := &StartCmdConfig{
+		TeleportConfig: TeleportConfig{TeleportAddr: "localhost:3025"},
+		IngestConfig: IngestConfig{
+			StorageDir:       t.TempDir(),
+			BatchSize:        20,
+			Concurrency:      1,
+			CheckpointEvents: 1,
+		},
+	}
+
+	app, err := NewApp(c)
+	require.NoError(t, err)
+
+	sink := &recordingSink{}
+	app.Source = &staticEventSource{events: []*TeleportEvent{
+		{Event: []byte(`{"event":"user.create","uid":"1"}`), ID: "1", Cursor: "c1", Type: "user.create"},
+		{Event: []byte(`{"event":"user.delete","uid":"2"}`), ID: "2", Cursor: "c2", Type: "user.delete"},
+	}}
+	app.Sinks = []Sink{sink}
+
+	require.NoError(t, app.Run(ctx))
+	require.Nil(t, app.Fluentd)
+	require.Len(t, sink.payloads, 2)
+
+	var payload map[string]any
+	require.NoError(t, json.Unmarshal(sink.payloads[1], &payload))
+	require.Equal(t, "user.delete", payload["event"])
+	require.NotEmpty(t, payload[idempotencyKeyField])
+
+	id, err := app.State.GetID()
+	require.NoError(t, err)
+	require.Equal(t, "2", id)
+
+	cursor, err := app.State.GetCursor()
+	require.NoError(t, err)
+	require.Equal(t, "c2", cursor)
+}
+
+// failingSink fails to send the events while err is set
+type failingSink struct {
+	err error
+}
+
+// Send returns the error
+func (s *failingSink) Send(ctx context.Context, e *TeleportEvent, payload []byte) error {
+	return s.err
+}
+
+// TestAppSinkFailure tests that the event accepted by Fluentd is not sent to it again once a sink fails
+func TestAppSinkFailure(t *testing.T) {
+	fd, err := NewFakeFluentd()
+	require.NoError(t, err)
+	fd.Start()
+	t.Cleanup(fd.Close)
+
+	c := &StartCmdConfig{
+		FluentdConfig:  fd.GetClientConfig(),
+		TeleportConfig: TeleportConfig{TeleportAddr: "localhost:3025"},
+		IngestConfig:   IngestConfig{StorageDir: t.TempDir(), DedupWindow: 10},
+	}
+	c.FluentdURL = fd.GetURL()
+
+	app, err := NewApp(c)
+	require.NoError(t, err)
+	app.State, err = NewState(c)
+	require.NoError(t, err)
+	app.Fluentd, err = NewFluentdClient(&c.FluentdConfig)
+	require.NoError(t, err)
+	sink := &failingSink{err: trace.ConnectionProblem(nil, "sink is unavailable")}
+	app.Sinks = []Sink{sink}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	e := &TeleportEvent{Event: []byte(`{"event":"user.create","uid":"1"}`), ID: "1", Type: "user.create"}
+	_, err = app.forwardEvent(ctx, c.FluentdURL, e)
+	require.Error(t, err)
+	_, err = fd.GetMessage(ctx)
+	require.NoError(t, err)
+
+	sink.err = nil
+	forwarded, err := app.forwardEvent(ctx, c.FluentdURL, e)
+	require.NoError(t, err)
+	require.True(t, forwarded)
+
+	noMessageCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	_, err = fd.GetMessage(noMessageCtx)
+	require.Error(t, err)
+}
+
+func TestAppCustomSourceLocking(t *testing.T) {
+	c := &StartCmdConfig{
+		TeleportConfig: TeleportConfig{TeleportAddr: "localhost:3025"},
+		IngestConfig:   IngestConfig{StorageDir: t.TempDir()},
+		LockConfig:     LockConfig{LockEnabled: true},
+	}
+
+	app, err := NewApp(c)
+	require.NoError(t, err)
+	app.Source = &staticEventSource{}
+
+	require.Error(t, app.Run(context.Background()))
+}
+
+func TestNewAppDefaults(t *testing.T) {
+	c := &StartCmdConfig{
+		TeleportConfig: TeleportConfig{TeleportAddr: "localhost:3025"},
+		IngestConfig:   IngestConfig{StorageDir: t.TempDir()},
+	}
+
+	app, err := NewApp(c)
+	require.NoError(t, err)
+	require.Equal(t, defaultBatchSize, app.Config().BatchSize)
+	require.Equal(t, defaultConcurrency, app.Config().Concurrency)
+
+	c.Concurrency = -1
+	_, err = NewApp(c)
+	require.Error(t, err)
+}
+
+func TestAppMetrics(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	newApp := func(addr string, metrics *prometheus.Registry) *App {
+		app, err := NewApp(&StartCmdConfig{
+			TeleportConfig: TeleportConfig{TeleportAddr: addr},
+			IngestConfig:   IngestConfig{StorageDir: t.TempDir()},
+		})
+		require.NoError(t, err)
+		app.Metrics = metrics
+		app.Source = &staticEventSource{}
+
+		return app
+	}
+
+	// Every app has its own metrics
+	metrics := prometheus.NewRegistry()
+	app := newApp("localhost:3025", metrics)
+	require.NoError(t, app.Run(ctx))
+	other := newApp("localhost:3026", prometheus.NewRegistry())
+	require.NoError(t, other.Run(ctx))
+
+	app.sessionEventsJob.metrics.quarantined.Set(2)
+	other.sessionEventsJob.metrics.quarantined.Set(3)
+
+	families, err := metrics.Gather()
+	require.NoError(t, err)
+
+	values := make(map[string]float64)
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			values[f.GetName()] = m.GetGauge().GetValue() + m.GetCounter().GetValue()
+		}
+	}
+	require.Contains(t, values, "go_goroutines")
+	require.Equal(t, float64(2), values[metricsNamespace+"_sessions_quarantined"])
+
+	// The app metrics are not shared silently
+	require.Error(t, newApp("localhost:3027", metrics).Run(ctx))
+}
+
+// TestMultiAppMetrics tests that the metrics of the clusters sharing the registry are labeled by cluster
+func TestMultiAppMetrics(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var configs []*StartCmdConfig
+	for _, dir := range []string{"/var/lib/teleport-east", "/var/lib/teleport-west"} {
+		configs = append(configs, &StartCmdConfig{
+			TeleportConfig: TeleportConfig{TeleportAddr: "localhost:3025", TeleportDataDir: dir},
+			IngestConfig:   IngestConfig{StorageDir: t.TempDir()},
+		})
+	}
+
+	m, err := NewMultiApp(configs)
+	require.NoError(t, err)
+	for _, app := range m.apps {
+		app.Source = &staticEventSource{}
+	}
+	require.NoError(t, m.Run(ctx))
+
+	m.apps[0].sessionEventsJob.metrics.quarantined.Set(2)
+	m.apps[1].sessionEventsJob.metrics.quarantined.Set(3)
+
+	families, err := m.metrics.Gather()
+	require.NoError(t, err)
+
+	values := make(map[string]float64)
+	for _, f := range families {
+		if f.GetName() != metricsNamespace+"_sessions_quarantined" {
+			continue
+		}
+		for _, metric := range f.GetMetric() {
+			for _, l := range metric.GetLabel() {
+				if l.GetName() == "cluster" {
+					values[l.GetValue()] = metric.GetGauge().GetValue()
+				}
+			}
+		}
+	}
+	require.Equal(t, map[string]float64{
+		"file:///var/lib/teleport-east": 2,
+		"file:///var/lib/teleport-west": 3,
+	}, values)
+}
+
+// TestAppDrainInTime tests that the drain finished in time is not reported as incomplete
+func TestAppDrainInTime(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	log, hook := logtest.NewNullLogger()
+	ctx = logger.WithLogger(ctx, log)
+
+	c := &StartCmdConfig{
+		TeleportConfig: TeleportConfig{TeleportAddr: "localhost:3025"},
+		IngestConfig:   IngestConfig{StorageDir: t.TempDir(), DrainTimeout: time.Minute},
+	}
+
+	app, err := NewApp(c)
+	require.NoError(t, err)
+	app.Source = &staticEventSource{events: []*TeleportEvent{
+		{Event: []byte(`{"event":"user.create","uid":"1"}`), ID: "1", Cursor: "c1", Type: "user.create"},
+	}}
+	app.Sinks = []Sink{&recordingSink{}}
+
+	require.NoError(t, app.Run(ctx))
+
+	messages := func() []string {
+		var r []string
+		for _, e := range hook.AllEntries() {
+			r = append(r, e.Message)
+		}
+		return r
+	}
+	require.Contains(t, messages(), "Stopped, progress is saved")
+	require.NotContains(t, messages(), "Drain phase was not completed in time")
+
+	// The drain timed out
+	app.drainTimedOut.Store(true)
+	app.reportPending(ctx)
+	require.Contains(t, messages(), "Drain phase was not completed in time")
+}
@@ -0,0 +1,868 @@
+/*
+Copyright 2015-2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gravitational/teleport/integrations/lib/logger"
+	"github.com/gravitational/trace"
+	"github.com/peterbourgon/diskv/v3"
+
+	"github.com/gravitational/teleport-plugins/event-handler/lib"
+)
+
+const (
+	// cacheSizeMaxBytes max memory cache
+	cacheSizeMaxBytes = 1024
+
+	// startTimeName is the start time variable name
+	startTimeName = "start_time"
+
+	// cursorName is the cursor variable name
+	cursorName = "cursor"
+
+	// idName is the id variable name
+	idName = "id"
+
+	// sessionPrefix is the session key prefix
+	sessionPrefix = "session"
+
+	// summaryPrefix is the session summary key prefix
+	summaryPrefix = "summary"
+
+	// attemptsPrefix is the failed session ingestion attempts key prefix
+	attemptsPrefix = "attempts"
+
+	// quarantinePrefix is the quarantined session key prefix
+	quarantinePrefix = "quarantine"
+
+	// lockEventsPrefix is the auto-locking counter key prefix
+	lockEventsPrefix = "lock_events"
+
+	// lockEventsLegacyWindow is the window of the counter events stored without one by the previous versions
+	lockEventsLegacyWindow = 24 * time.Hour
+
+	// lockRecordPrefix is the key prefix of the locks created by the plugin
+	lockRecordPrefix = "lock_record"
+
+	// dedupPrefix is the key prefix of the dedup window slots
+	dedupPrefix = "dedup"
+
+	// fileOffsetPrefix is the key prefix of the audit log file read offsets
+	fileOffsetPrefix = "offset"
+
+	// eventCountPrefix is the key prefix of the counters of the audit log events forwarded and dropped per bucket
+	eventCountPrefix = "event_count"
+
+	// eventCountBucket is the time span of the event counter bucket
+	eventCountBucket = time.Hour
+
+	// eventCountKeyFormat is the format of the bucket start time in the event counter key
+	eventCountKeyFormat = "20060102T150405Z"
+
+	// storageDirPerms is storage directory permissions when created
+	storageDirPerms = 0755
+)
+
+// State manages the plugin persistent state. It is stored on disk as a simple key-value database.
+type State struct {
+	// dv is a diskv instance
+	dv *diskv.Diskv
+	// dedup is the window of the latest sent event keys, nil if duplicate suppression is disabled
+	dedup *dedupWindow
+	// checkpoint is the progress kept in memory, nil if the progress is saved on every update
+	checkpoint *checkpoint
+}
+
+// QuarantinedSession represents the session which ingestion was given up after too many failed attempts
+type QuarantinedSession struct {
+	// ID is the session ID
+	ID string `json:"id"`
+	// Index is the index of the latest event ingested
+	Index int64 `json:"index"`
+	// Attempts is the number of failed ingestion attempts
+	Attempts int `json:"attempts"`
+	// LastError is the error the latest attempt failed with
+	LastError string `json:"last_error"`
+	// QuarantinedAt is the time the session was quarantined
+	QuarantinedAt time.Time `json:"quarantined_at"`
+}
+
+// LockEvent is the audit log event recorded by the auto-locking counter
+type LockEvent struct {
+	// ID is the event ID, used to skip the events replayed after restart
+	ID string `json:"id"`
+	// Type is the event type
+	Type string `json:"type,omitempty"`
+	// Time is the event time
+	Time time.Time `json:"time"`
+	// Window is the window of the counter the event is recorded in, the counter is removed once all its events
+	// are out of their windows
+	Window time.Duration `json:"window,omitempty"`
+}
+
+// LockRecord represents the lock created by the plugin along with the events which triggered it
+type LockRecord struct {
+	// Name is the lock name
+	Name string `json:"name"`
+	// Rule is the name of the rule which created the lock
+	Rule string `json:"rule"`
+	// Key is the auto-locking counter key of the rule and the event group
+	Key string `json:"key,omitempty"`
+	// CreatedAt is the time the lock was created
+	CreatedAt time.Time `json:"created_at"`
+	// Events are the events which triggered the lock
+	Events []LockEvent `json:"events"`
+}
+
+// NewCursor creates new cursor instance
+func NewState(c *StartCmdConfig) (*State, error) {
+	// Simplest transform function: put all the data files into the base dir.
+	flatTransform := func(s string) []string { return []string{} }
+
+	dir, err := createStorageDir(c)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	dv := diskv.New(diskv.Options{
+		BasePath:     dir,
+		Transform:    flatTransform,
+		CacheSizeMax: cacheSizeMaxBytes,
+	})
+
+	s := State{dv: dv}
+
+	if c.CheckpointEvents > 1 || c.CheckpointInterval > 0 {
+		s.checkpoint = newCheckpoint(c.CheckpointEvents)
+	}
+
+	if c.DedupWindow > 0 {
+		s.dedup, err = loadDedupWindow(dv, c.DedupWindow, s.checkpoint != nil)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+	}
+
+	return &s, nil
+}
+
+// createStorageDir is used to calculate storage dir path and create dir if it does not exits
+func createStorageDir(c *StartCmdConfig) (string, error) {
+	log := logger.Standard()
+
+	dir, err := storageDirName(c)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+
+	if c.DryRun {
+		rs, err := lib.RandomString(32)
+		if err != nil {
+			return "", trace.Wrap(err)
+		}
+
+		dir = path.Join(dir, "dry_run", rs)
+	}
+
+	dir = path.Join(c.StorageDir, dir)
+
+	_, err = os.Stat(dir)
+	if os.IsNotExist(err) {
+		err = os.MkdirAll(dir, storageDirPerms)
+		if err != nil {
+			return "", trace.Errorf("Can not create storage directory %v : %w", dir, err)
+		}
+
+		log.WithField("dir", dir).Info("Created storage directory")
+	} else {
+		log.WithField("dir", dir).Info("Using existing storage directory")
+	}
+
+	return dir, nil
+}
+
+// storageDirName returns the name of the storage directory of the events source
+func storageDirName(c *StartCmdConfig) (string, error) {
+	// The file audit log position is not compatible with the Auth API cursor
+	if c.TeleportDataDir != "" {
+		dir, err := filepath.Abs(c.TeleportDataDir)
+		if err != nil {
+			return "", trace.Wrap(err)
+		}
+		return "file_" + strings.ReplaceAll(strings.Trim(dir, string(filepath.Separator)), string(filepath.Separator), "_"), nil
+	}
+
+	host, port, err := net.SplitHostPort(c.TeleportAddr)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+
+	dir := strings.TrimSpace(host + "_" + port)
+	if dir == "_" {
+		return "", trace.Errorf("Can not generate cursor name from Teleport host %s", c.TeleportAddr)
+	}
+
+	return dir, nil
+}
+
+// GetStartTime gets current start time
+func (s *State) GetStartTime() (*time.Time, error) {
+	if !s.dv.Has(startTimeName) {
+		return nil, nil
+	}
+
+	b, err := s.dv.Read(startTimeName)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	// No previous start time exist
+	if string(b) == "" {
+		return nil, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, string(b))
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	t = t.Truncate(time.Second)
+
+	return &t, nil
+}
+
+// SetStartTime sets current start time
+func (s *State) SetStartTime(t *time.Time) error {
+	if t == nil {
+		return s.dv.Write(startTimeName, []byte(""))
+	}
+
+	v := t.Truncate(time.Second).Format(time.RFC3339)
+	return s.dv.Write(startTimeName, []byte(v))
+}
+
+// GetCursor gets current cursor value
+func (s *State) GetCursor() (string, error) {
+	if c := s.checkpoint; c != nil {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.cursor != nil {
+			return *c.cursor, nil
+		}
+	}
+
+	return s.getStringValue(cursorName)
+}
+
+// SetCursor sets cursor value
+func (s *State) SetCursor(v string) error {
+	return s.setStringValue(cursorName, v)
+}
+
+// GetID gets current ID value
+func (s *State) GetID() (string, error) {
+	if c := s.checkpoint; c != nil {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.id != nil {
+			return *c.id, nil
+		}
+	}
+
+	return s.getStringValue(idName)
+}
+
+// SetID sets cursor value
+func (s *State) SetID(v string) error {
+	return s.setStringValue(idName, v)
+}
+
+// getStringValue gets a string value
+func (s *State) getStringValue(name string) (string, error) {
+	if !s.dv.Has(name) {
+		return "", nil
+	}
+
+	b, err := s.dv.Read(name)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+
+	return string(b), err
+}
+
+// setStringValue sets string value
+func (s *State) setStringValue(name string, value string) error {
+	err := s.dv.Write(name, []byte(value))
+	return trace.Wrap(err)
+}
+
+// GetSessions get active sessions (map[id]index)
+func (s *State) GetSessions() (map[string]int64, error) {
+	r := make(map[string]int64)
+
+	for key := range s.dv.KeysPrefix(sessionPrefix, nil) {
+		b, err := s.dv.Read(key)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+
+		id := key[len(sessionPrefix):]
+		r[id] = int64(binary.BigEndian.Uint64(b))
+	}
+
+	if c := s.checkpoint; c != nil {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for id, index := range c.sessions {
+			r[id] = index
+		}
+	}
+
+	return r, nil
+}
+
+// GetFileOffsets gets the read offsets of the audit log files (map[file]offset)
+func (s *State) GetFileOffsets() (map[string]int64, error) {
+	r := make(map[string]int64)
+
+	for key := range s.dv.KeysPrefix(fileOffsetPrefix, nil) {
+		b, err := s.dv.Read(key)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+
+		file, err := url.PathUnescape(key[len(fileOffsetPrefix):])
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		r[file] = int64(binary.BigEndian.Uint64(b))
+	}
+
+	if c := s.checkpoint; c != nil {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for file, offset := range c.files {
+			r[file] = offset
+		}
+	}
+
+	return r, nil
+}
+
+// SetFileOffset writes the read offset of the audit log file into state
+func (s *State) SetFileOffset(file string, offset int64) error {
+	c := s.checkpoint
+	if c == nil {
+		return s.writeFileOffset(file, offset)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.files[file] = offset
+
+	return trace.Wrap(s.update())
+}
+
+// writeFileOffset writes the audit log file read offset to the storage
+func (s *State) writeFileOffset(file string, offset int64) error {
+	var b = make([]byte, 8)
+
+	binary.BigEndian.PutUint64(b, uint64(offset))
+
+	return s.dv.Write(fileOffsetPrefix+url.PathEscape(file), b)
+}
+
+// GetSessionIndex gets current session index, zero if the session is unknown
+func (s *State) GetSessionIndex(id string) (int64, error) {
+	if c := s.checkpoint; c != nil {
+		c.mu.Lock()
+		index, ok := c.sessions[id]
+		c.mu.Unlock()
+		if ok {
+			return index, nil
+		}
+	}
+
+	if !s.dv.Has(sessionPrefix + id) {
+		return 0, nil
+	}
+
+	b, err := s.dv.Read(sessionPrefix + id)
+	if err != nil {
+		return 0, trace.Wrap(err)
+	}
+
+	return int64(binary.BigEndian.Uint64(b)), nil
+}
+
+// SetSessionIndex writes current session index into state
+func (s *State) SetSessionIndex(id string, index int64) error {
+	c := s.checkpoint
+	if c == nil {
+		return s.writeSessionIndex(id, index)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.sessions[id] = index
+
+	return trace.Wrap(s.update())
+}
+
+// writeSessionIndex writes the session index to the storage
+func (s *State) writeSessionIndex(id string, index int64) error {
+	var b = make([]byte, 8)
+
+	binary.BigEndian.PutUint64(b, uint64(index))
+
+	return s.dv.Write(sessionPrefix+id, b)
+}
+
+// RemoveSession removes session from the state
+func (s *State) RemoveSession(id string) error {
+	if c := s.checkpoint; c != nil {
+		c.mu.Lock()
+		delete(c.sessions, id)
+		c.mu.Unlock()
+	}
+
+	if !s.dv.Has(sessionPrefix + id) {
+		return nil
+	}
+
+	return s.dv.Erase(sessionPrefix + id)
+}
+
+// GetSessionSummary gets the saved session summary, nil if there is none
+func (s *State) GetSessionSummary(id string) ([]byte, error) {
+	if !s.dv.Has(summaryPrefix + id) {
+		return nil, nil
+	}
+
+	b, err := s.dv.Read(summaryPrefix + id)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	return b, nil
+}
+
+// SetSessionSummary saves the session summary computed so far
+func (s *State) SetSessionSummary(id string, b []byte) error {
+	return s.dv.Write(summaryPrefix+id, b)
+}
+
+// RemoveSessionSummary removes session summary from the state
+func (s *State) RemoveSessionSummary(id string) error {
+	return s.dv.Erase(summaryPrefix + id)
+}
+
+// IncSessionAttempts increments the number of failed session ingestion attempts and returns the new value
+func (s *State) IncSessionAttempts(id string) (int, error) {
+	var n uint64
+
+	if s.dv.Has(attemptsPrefix + id) {
+		b, err := s.dv.Read(attemptsPrefix + id)
+		if err != nil {
+			return 0, trace.Wrap(err)
+		}
+		n = binary.BigEndian.Uint64(b)
+	}
+
+	n++
+
+	var b = make([]byte, 8)
+	binary.BigEndian.PutUint64(b, n)
+
+	return int(n), trace.Wrap(s.dv.Write(attemptsPrefix+id, b))
+}
+
+// RemoveSessionAttempts resets the number of failed session ingestion attempts
+func (s *State) RemoveSessionAttempts(id string) error {
+	if !s.dv.Has(attemptsPrefix + id) {
+		return nil
+	}
+
+	return s.dv.Erase(attemptsPrefix + id)
+}
+
+// QuarantineSession moves the session from the active set to the quarantined set, the summary computed so far
+// is dropped
+func (s *State) QuarantineSession(q QuarantinedSession) error {
+	b, err := json.Marshal(q)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	if err := s.dv.Write(quarantinePrefix+q.ID, b); err != nil {
+		return trace.Wrap(err)
+	}
+
+	if err := s.RemoveSessionAttempts(q.ID); err != nil {
+		return trace.Wrap(err)
+	}
+
+	if s.dv.Has(summaryPrefix + q.ID) {
+		if err := s.RemoveSessionSummary(q.ID); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+
+	return trace.Wrap(s.RemoveSession(q.ID))
+}
+
+// GetQuarantinedSessions returns quarantined sessions
+func (s *State) GetQuarantinedSessions() ([]QuarantinedSession, error) {
+	var r []QuarantinedSession
+
+	for key := range s.dv.KeysPrefix(quarantinePrefix, nil) {
+		b, err := s.dv.Read(key)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+
+		var q QuarantinedSession
+		if err := json.Unmarshal(b, &q); err != nil {
+			return nil, trace.Wrap(err)
+		}
+
+		r = append(r, q)
+	}
+
+	return r, nil
+}
+
+// ReleaseQuarantinedSession moves the quarantined session back to the active set
+func (s *State) ReleaseQuarantinedSession(q QuarantinedSession) error {
+	if err := s.SetSessionIndex(q.ID, q.Index); err != nil {
+		return trace.Wrap(err)
+	}
+
+	return s.dv.Erase(quarantinePrefix + q.ID)
+}
+
+// EventCount is the number of the audit log events handled in a bucket
+type EventCount struct {
+	// Forwarded is the number of the events sent to the destinations
+	Forwarded int64
+	// Dropped is the number of the events dropped by the event type policies
+	Dropped int64
+}
+
+// add adds the counts of n
+func (c *EventCount) add(n EventCount) {
+	c.Forwarded += n.Forwarded
+	c.Dropped += n.Dropped
+}
+
+// AddEventCount counts the audit log event forwarded or dropped by the event type policies in the bucket of the
+// event time. The counter kept in memory is saved along with the next progress checkpoint.
+func (s *State) AddEventCount(ts time.Time, forwarded bool) error {
+	bucket := eventCountBucketStart(ts)
+
+	var n EventCount
+	if forwarded {
+		n.Forwarded = 1
+	} else {
+		n.Dropped = 1
+	}
+
+	c := s.checkpoint
+	if c == nil {
+		return trace.Wrap(s.addEventCount(bucket, n))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	count := c.counts[bucket]
+	count.add(n)
+	c.counts[bucket] = count
+
+	return nil
+}
+
+// addEventCount adds n to the event counter of the bucket in the storage
+func (s *State) addEventCount(bucket time.Time, n EventCount) error {
+	key := eventCountPrefix + bucket.Format(eventCountKeyFormat)
+
+	var count EventCount
+	if s.dv.Has(key) {
+		b, err := s.dv.Read(key)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		count = decodeEventCount(b)
+	}
+	count.add(n)
+
+	var b = make([]byte, 16)
+
+	binary.BigEndian.PutUint64(b, uint64(count.Forwarded))
+	binary.BigEndian.PutUint64(b[8:], uint64(count.Dropped))
+
+	return s.dv.Write(key, b)
+}
+
+// decodeEventCount decodes the stored event counter
+func decodeEventCount(b []byte) EventCount {
+	var count EventCount
+	if len(b) >= 8 {
+		count.Forwarded = int64(binary.BigEndian.Uint64(b))
+	}
+	if len(b) >= 16 {
+		count.Dropped = int64(binary.BigEndian.Uint64(b[8:]))
+	}
+
+	return count
+}
+
+// GetEventCounts returns the event counters of the buckets which start in [from, to) by the bucket start time
+func (s *State) GetEventCounts(from, to time.Time) (map[time.Time]EventCount, error) {
+	r := make(map[time.Time]EventCount)
+
+	for key := range s.dv.KeysPrefix(eventCountPrefix, nil) {
+		bucket, err := time.Parse(eventCountKeyFormat, key[len(eventCountPrefix):])
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		if bucket.Before(from) || !bucket.Before(to) {
+			continue
+		}
+
+		b, err := s.dv.Read(key)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		r[bucket] = decodeEventCount(b)
+	}
+
+	if c := s.checkpoint; c != nil {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for bucket, n := range c.counts {
+			if !bucket.Before(from) && bucket.Before(to) {
+				count := r[bucket]
+				count.add(n)
+				r[bucket] = count
+			}
+		}
+	}
+
+	return r, nil
+}
+
+// eventCountBucketStart returns the start time of the event counter bucket the time belongs to
+func eventCountBucketStart(ts time.Time) time.Time {
+	return ts.UTC().Truncate(eventCountBucket)
+}
+
+// IsEventSent returns true if the event with the idempotency key is in the dedup window
+func (s *State) IsEventSent(key string) bool {
+	if s.dedup == nil || key == "" {
+		return false
+	}
+
+	return s.dedup.Has(key)
+}
+
+// SetEventSent adds the idempotency key of the sent event to the dedup window
+func (s *State) SetEventSent(key string) error {
+	if s.dedup == nil || key == "" {
+		return nil
+	}
+
+	return trace.Wrap(s.dedup.Add(key))
+}
+
+// AddLockEvent records the auto-locking counter event and returns the distinct events recorded for the key
+// within the window ending at the event time. Events with IDs recorded already are not counted twice.
+func (s *State) AddLockEvent(key string, e LockEvent, window time.Duration) ([]LockEvent, error) {
+	name := lockEventsKey(key)
+
+	events, err := s.readLockEvents(name)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	seen := false
+	for _, prev := range events {
+		if e.ID != "" && prev.ID == e.ID {
+			seen = true
+			break
+		}
+	}
+	if !seen {
+		e.Time = e.Time.UTC()
+		events = append(events, e)
+	}
+
+	// Drop the events which are out of the window, the window is stored with the events for pruning
+	since := e.Time.Add(-window)
+	i := 0
+	for _, prev := range events {
+		if prev.Time.After(since) {
+			prev.Window = window
+			events[i] = prev
+			i++
+		}
+	}
+	events = events[:i]
+
+	b, err := json.Marshal(events)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	return events, trace.Wrap(s.dv.Write(name, b))
+}
+
+// readLockEvents reads the auto-locking counter events stored under the given name
+func (s *State) readLockEvents(name string) ([]LockEvent, error) {
+	if !s.dv.Has(name) {
+		return nil, nil
+	}
+
+	b, err := s.dv.Read(name)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	var events []LockEvent
+	if err := json.Unmarshal(b, &events); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	return events, nil
+}
+
+// PruneLockEvents removes the auto-locking counters which events are all out of their windows at the given time,
+// and returns the number of the counters removed
+func (s *State) PruneLockEvents(now time.Time) (int, error) {
+	var names []string
+	for name := range s.dv.KeysPrefix(lockEventsPrefix, nil) {
+		names = append(names, name)
+	}
+
+	var n int
+	for _, name := range names {
+		events, err := s.readLockEvents(name)
+		if err != nil {
+			return n, trace.Wrap(err)
+		}
+
+		stale := true
+		for _, e := range events {
+			window := e.Window
+			if window <= 0 {
+				window = lockEventsLegacyWindow
+			}
+			if e.Time.Add(window).After(now) {
+				stale = false
+				break
+			}
+		}
+		if !stale {
+			continue
+		}
+
+		if err := s.dv.Erase(name); err != nil {
+			return n, trace.Wrap(err)
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+// ResetLockEvents removes the auto-locking counter events recorded for the key
+func (s *State) ResetLockEvents(key string) error {
+	name := lockEventsKey(key)
+	if !s.dv.Has(name) {
+		return nil
+	}
+
+	return s.dv.Erase(name)
+}
+
+// lockEventsKey returns the storage key of the auto-locking counter. Counter keys contain arbitrary
+// event field values, so they are hashed to get a valid file name.
+func lockEventsKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return lockEventsPrefix + hex.EncodeToString(h[:])
+}
+
+// SetLockRecord saves the record of the lock created by the plugin
+func (s *State) SetLockRecord(r LockRecord) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	return s.dv.Write(lockRecordKey(r.Name), b)
+}
+
+// GetLockRecord returns the record of the lock created by the plugin, nil if there is no record
+func (s *State) GetLockRecord(name string) (*LockRecord, error) {
+	key := lockRecordKey(name)
+	if !s.dv.Has(key) {
+		return nil, nil
+	}
+
+	b, err := s.dv.Read(key)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	var r LockRecord
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	return &r, nil
+}
+
+// RemoveLockRecord removes the record of the lock created by the plugin
+func (s *State) RemoveLockRecord(name string) error {
+	key := lockRecordKey(name)
+	if !s.dv.Has(key) {
+		return nil
+	}
+
+	return s.dv.Erase(key)
+}
+
+// lockRecordKey returns the storage key of the lock record
+func lockRecordKey(name string) string {
+	h := sha256.Sum256([]byte(name))
+	return lockRecordPrefix + hex.EncodeToString(h[:])
+}
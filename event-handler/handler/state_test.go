@@ -0,0 +1,329 @@
+/*
+Copyright 2015-2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	// storagePath is a path to test storage dir
+	storagePath = "./tmp"
+
+	// osAndPort is teleport host and port
+	osAndPort = "localhost:888"
+
+	// currentTime is current time
+	currentTime = time.Now().UTC().Truncate(time.Second)
+
+	// startCmd represents required config
+	startC = &StartCmdConfig{
+		TeleportConfig: TeleportConfig{
+			TeleportAddr: osAndPort,
+		},
+		IngestConfig: IngestConfig{
+			StartTime:  &currentTime,
+			StorageDir: storagePath,
+		},
+	}
+)
+
+// setup cleans up state directory
+func setup(t *testing.T) {
+	err := os.RemoveAll(storagePath)
+	require.NoError(t, err)
+}
+
+// TestStatePersist checks that state is persisted when StartTime stays constant
+func TestStatePersist(t *testing.T) {
+	setup(t)
+
+	state, err := NewState(startC)
+	require.NoError(t, err)
+
+	startTime, errt := state.GetStartTime()
+	cursor, errc := state.GetCursor()
+	id, erri := state.GetID()
+
+	require.NoError(t, errt)
+	require.NoError(t, errc)
+	require.NoError(t, erri)
+
+	assert.Nil(t, startTime)
+	assert.Equal(t, "", cursor)
+	assert.Equal(t, "", id)
+
+	errc = state.SetCursor("testCursor")
+	erri = state.SetID("testId")
+	errt = state.SetStartTime(&currentTime)
+	require.NoError(t, errc)
+	require.NoError(t, erri)
+	require.NoError(t, errt)
+
+	state, err = NewState(startC)
+	require.NoError(t, err)
+
+	startTime, errt = state.GetStartTime()
+	require.NoError(t, errt)
+	assert.NotNil(t, startTime)
+	assert.Equal(t, currentTime, *startTime)
+
+	cursor, errc = state.GetCursor()
+	id, erri = state.GetID()
+
+	require.NoError(t, errc)
+	require.NoError(t, erri)
+
+	assert.Equal(t, "testCursor", cursor)
+	assert.Equal(t, "testId", id)
+}
+
+// TestStateQuarantine checks that sessions are moved to quarantine and back
+func TestStateQuarantine(t *testing.T) {
+	setup(t)
+
+	state, err := NewState(startC)
+	require.NoError(t, err)
+
+	require.NoError(t, state.SetSessionIndex("sid", 10))
+
+	n, err := state.IncSessionAttempts("sid")
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	n, err = state.IncSessionAttempts("sid")
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	err = state.QuarantineSession(QuarantinedSession{ID: "sid", Index: 10, Attempts: 2, LastError: "boom"})
+	require.NoError(t, err)
+
+	sessions, err := state.GetSessions()
+	require.NoError(t, err)
+	require.Empty(t, sessions)
+
+	quarantined, err := state.GetQuarantinedSessions()
+	require.NoError(t, err)
+	require.Len(t, quarantined, 1)
+	require.Equal(t, "boom", quarantined[0].LastError)
+
+	// Attempts are reset once the session is quarantined
+	n, err = state.IncSessionAttempts("sid")
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	require.NoError(t, state.ReleaseQuarantinedSession(quarantined[0]))
+
+	sessions, err = state.GetSessions()
+	require.NoError(t, err)
+	require.Equal(t, map[string]int64{"sid": 10}, sessions)
+
+	quarantined, err = state.GetQuarantinedSessions()
+	require.NoError(t, err)
+	require.Empty(t, quarantined)
+}
+
+// TestStateLockEvents checks that auto-locking counters survive restarts and replays
+func TestStateLockEvents(t *testing.T) {
+	setup(t)
+
+	state, err := NewState(startC)
+	require.NoError(t, err)
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	events, err := state.AddLockEvent("failed-login/root", LockEvent{ID: "1", Time: start}, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+
+	// Replayed event is not counted twice
+	events, err = state.AddLockEvent("failed-login/root", LockEvent{ID: "1", Time: start}, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+
+	// Counter is restored after restart
+	state, err = NewState(startC)
+	require.NoError(t, err)
+
+	events, err = state.AddLockEvent("failed-login/root", LockEvent{ID: "2", Time: start.Add(30 * time.Second)}, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+
+	// Events out of the window are dropped
+	events, err = state.AddLockEvent("failed-login/root", LockEvent{ID: "3", Time: start.Add(70 * time.Second)}, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+
+	require.NoError(t, state.ResetLockEvents("failed-login/root"))
+
+	events, err = state.AddLockEvent("failed-login/root", LockEvent{ID: "4", Time: start.Add(80 * time.Second)}, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+
+	// The counters of the groups not seen within their windows are removed
+	_, err = state.AddLockEvent("failed-login/bob", LockEvent{ID: "5", Time: start}, time.Minute)
+	require.NoError(t, err)
+	_, err = state.AddLockEvent("rule/failed-logins/bob", LockEvent{ID: "5", Time: start}, time.Hour)
+	require.NoError(t, err)
+
+	n, err := state.PruneLockEvents(start.Add(30 * time.Second))
+	require.NoError(t, err)
+	require.Zero(t, n)
+
+	n, err = state.PruneLockEvents(start.Add(70 * time.Second))
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	n, err = state.PruneLockEvents(start.Add(70 * time.Second))
+	require.NoError(t, err)
+	require.Zero(t, n)
+
+	// The counter with the longer window is kept
+	n, err = state.PruneLockEvents(start.Add(2*time.Minute + 30*time.Second))
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	n, err = state.PruneLockEvents(start.Add(time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+}
+
+// TestStateLockRecords checks lock records persistence
+func TestStateLockRecords(t *testing.T) {
+	setup(t)
+
+	state, err := NewState(startC)
+	require.NoError(t, err)
+
+	r, err := state.GetLockRecord("event-handler-auto-lock-alice-root")
+	require.NoError(t, err)
+	require.Nil(t, r)
+
+	record := LockRecord{
+		Name:      "event-handler-auto-lock-alice-root",
+		Rule:      "failed-login",
+		CreatedAt: currentTime,
+		Events:    []LockEvent{{ID: "1", Type: "user.login", Time: currentTime}},
+	}
+	require.NoError(t, state.SetLockRecord(record))
+
+	r, err = state.GetLockRecord(record.Name)
+	require.NoError(t, err)
+	require.Equal(t, record, *r)
+
+	require.NoError(t, state.RemoveLockRecord(record.Name))
+
+	r, err = state.GetLockRecord(record.Name)
+	require.NoError(t, err)
+	require.Nil(t, r)
+}
+
+// TestStateDedup checks that the sent event keys survive restart and that the window is bounded
+func TestStateDedup(t *testing.T) {
+	setup(t)
+
+	c := *startC
+	c.DedupWindow = 3
+
+	state, err := NewState(&c)
+	require.NoError(t, err)
+
+	require.False(t, state.IsEventSent("a"))
+	for _, key := range []string{"a", "b", "c", "a"} {
+		require.NoError(t, state.SetEventSent(key))
+	}
+	require.True(t, state.IsEventSent("a"))
+
+	state, err = NewState(&c)
+	require.NoError(t, err)
+	require.True(t, state.IsEventSent("a"))
+	require.True(t, state.IsEventSent("c"))
+
+	// The oldest key is evicted
+	require.NoError(t, state.SetEventSent("d"))
+	require.False(t, state.IsEventSent("a"))
+	require.True(t, state.IsEventSent("b"))
+
+	state, err = NewState(&c)
+	require.NoError(t, err)
+	require.False(t, state.IsEventSent("a"))
+	require.True(t, state.IsEventSent("d"))
+
+	// Window can be shrunk between restarts
+	c.DedupWindow = 2
+	state, err = NewState(&c)
+	require.NoError(t, err)
+	require.NoError(t, state.SetEventSent("e"))
+	require.True(t, state.IsEventSent("e"))
+
+	// Duplicate suppression can be disabled
+	c.DedupWindow = 0
+	state, err = NewState(&c)
+	require.NoError(t, err)
+	require.False(t, state.IsEventSent("e"))
+}
+
+// TestStateEventCounts checks that the event counters are kept per hour and saved along with the progress
+func TestStateEventCounts(t *testing.T) {
+	setup(t)
+
+	ts := time.Date(2024, 1, 2, 10, 30, 0, 0, time.FixedZone("CET", 3600))
+	bucket := time.Date(2024, 1, 2, 9, 0, 0, 0, time.UTC)
+
+	state, err := NewState(startC)
+	require.NoError(t, err)
+	require.NoError(t, state.AddEventCount(ts, true))
+	require.NoError(t, state.AddEventCount(ts.Add(29*time.Minute), true))
+	require.NoError(t, state.AddEventCount(ts.Add(30*time.Minute), true))
+	require.NoError(t, state.AddEventCount(ts.Add(31*time.Minute), false))
+
+	counts, err := state.GetEventCounts(bucket, bucket.Add(2*time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, map[time.Time]EventCount{bucket: {Forwarded: 2}, bucket.Add(time.Hour): {Forwarded: 1, Dropped: 1}}, counts)
+
+	counts, err = state.GetEventCounts(bucket.Add(time.Hour), bucket.Add(2*time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, map[time.Time]EventCount{bucket.Add(time.Hour): {Forwarded: 1, Dropped: 1}}, counts)
+
+	// The counters kept in memory are added to the saved ones on flush
+	c := *startC
+	c.CheckpointInterval = time.Minute
+	state, err = NewState(&c)
+	require.NoError(t, err)
+	require.NoError(t, state.AddEventCount(ts, true))
+
+	counts, err = state.GetEventCounts(bucket, bucket.Add(time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, map[time.Time]EventCount{bucket: {Forwarded: 3}}, counts)
+
+	saved, err := NewState(startC)
+	require.NoError(t, err)
+	counts, err = saved.GetEventCounts(bucket, bucket.Add(time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, map[time.Time]EventCount{bucket: {Forwarded: 2}}, counts)
+
+	require.NoError(t, state.Flush())
+	saved, err = NewState(startC)
+	require.NoError(t, err)
+	counts, err = saved.GetEventCounts(bucket, bucket.Add(time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, map[time.Time]EventCount{bucket: {Forwarded: 3}}, counts)
+}
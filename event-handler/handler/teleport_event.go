@@ -14,10 +14,14 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
-package main
+package handler
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"strconv"
 	"time"
 
 	auditlogpb "github.com/gravitational/teleport/api/gen/proto/go/teleport/auditlog/v1"
@@ -30,6 +34,8 @@ const (
 	sessionEndType = "session.upload"
 	// loginType represents type name for user login event
 	loginType = "user.login"
+	// idempotencyKeyField is the name of the payload field carrying the idempotency key
+	idempotencyKeyField = "idempotency_key"
 )
 
 // TeleportEvent represents helper struct around main audit log event
@@ -46,10 +52,14 @@ type TeleportEvent struct {
 	Time time.Time
 	// Index is an event index within session
 	Index int64
+	// IdempotencyKey is the stable event key sent along with the event, the same event always gets the same key
+	IdempotencyKey string
 	// IsSessionEnd is true when this event is session.end
 	IsSessionEnd bool
 	// SessionID is the session ID this event belongs to
 	SessionID string
+	// Stream is audit or session, audit if empty
+	Stream string
 	// IsFailedLogin is true when this event is the failed login event
 	IsFailedLogin bool
 	// FailedLoginData represents failed login user data
@@ -77,6 +87,7 @@ func NewTeleportEvent(e *auditlogpb.EventUnstructured, cursor string) (*Teleport
 		ID:     e.Id,
 		Event:  payload,
 	}
+	evt.IdempotencyKey = eventIdempotencyKey(evt.ID, payload)
 
 	switch e.GetType() {
 	case sessionEndType:
@@ -122,3 +133,54 @@ func (e *TeleportEvent) setLoginData(evt *auditlogpb.EventUnstructured) error {
 	e.FailedLoginData.ClusterName = loginEvent.ClusterName
 	return nil
 }
+
+// SetSessionIdempotencyKey sets the idempotency key of the session event. Session events are identified by
+// the session ID and the event index.
+func (e *TeleportEvent) SetSessionIdempotencyKey(sid string) {
+	e.IdempotencyKey = sid + ":" + strconv.FormatInt(e.Index, 10)
+}
+
+// Payload returns the event payload which is sent to fluentd, with the idempotency key added
+func (e *TeleportEvent) Payload() ([]byte, error) {
+	key := e.IdempotencyKey
+	if key == "" {
+		key = eventIdempotencyKey(e.ID, e.Event)
+	}
+
+	return addPayloadField(e.Event, idempotencyKeyField, key)
+}
+
+// eventIdempotencyKey returns the event ID, or the hash of the payload if the event has no ID
+func eventIdempotencyKey(id string, payload []byte) string {
+	if id != "" {
+		return id
+	}
+
+	h := sha256.Sum256(payload)
+	return hex.EncodeToString(h[:])
+}
+
+// addPayloadField adds the field to the beginning of the JSON object
+func addPayloadField(payload []byte, name string, value interface{}) ([]byte, error) {
+	payload = bytes.TrimSpace(payload)
+	if len(payload) < 2 || payload[0] != '{' {
+		return nil, trace.BadParameter("event payload is not a JSON object")
+	}
+
+	field, err := json.Marshal(map[string]interface{}{name: value})
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	rest := bytes.TrimSpace(payload[1:])
+	if len(rest) == 1 && rest[0] == '}' {
+		return field, nil
+	}
+
+	r := make([]byte, 0, len(field)+len(payload))
+	r = append(r, field[:len(field)-1]...)
+	r = append(r, ',')
+	r = append(r, rest...)
+
+	return r, nil
+}
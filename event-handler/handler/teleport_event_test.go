@@ -14,11 +14,12 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
-package main
+package handler
 
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"testing"
 
 	auditlogpb "github.com/gravitational/teleport/api/gen/proto/go/teleport/auditlog/v1"
@@ -119,6 +120,41 @@ func TestSuccessLogin(t *testing.T) {
 	assert.False(t, event.IsFailedLogin)
 }
 
+func TestIdempotencyKey(t *testing.T) {
+	e := &events.SessionPrint{
+		Metadata: events.Metadata{
+			Type: "print",
+		},
+		ChunkIndex: 5,
+	}
+
+	protoEvent, err := eventToProto(events.AuditEvent(e))
+	require.NoError(t, err)
+
+	first, err := NewTeleportEvent(protoEvent, "cursor")
+	require.NoError(t, err)
+	second, err := NewTeleportEvent(protoEvent, "")
+	require.NoError(t, err)
+	require.NotEmpty(t, first.IdempotencyKey)
+	require.Equal(t, first.IdempotencyKey, second.IdempotencyKey)
+
+	first.Index = 5
+	first.SetSessionIdempotencyKey("sid")
+	require.Equal(t, "sid:5", first.IdempotencyKey)
+
+	payload, err := first.Payload()
+	require.NoError(t, err)
+
+	var m map[string]interface{}
+	require.NoError(t, json.Unmarshal(payload, &m))
+	require.Equal(t, "sid:5", m[idempotencyKeyField])
+	require.Equal(t, "print", m["event"])
+
+	payload, err = (&TeleportEvent{ID: "id", Event: []byte(" {} ")}).Payload()
+	require.NoError(t, err)
+	require.JSONEq(t, `{"idempotency_key":"id"}`, string(payload))
+}
+
 func eventToProto(e events.AuditEvent) (*auditlogpb.EventUnstructured, error) {
 	data, err := lib.FastMarshal(e)
 	if err != nil {
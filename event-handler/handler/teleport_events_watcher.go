@@ -14,11 +14,13 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
-package main
+package handler
 
 import (
 	"context"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gravitational/teleport/api/client"
@@ -36,6 +38,12 @@ import (
 const (
 	// lockMessage represents a message added to Lock when user is auto-locked
 	lockMessage = "User is locked due to too many failed login attempts"
+	// lockNamePrefix is the name prefix of the locks created by the plugin
+	lockNamePrefix = "event-handler-auto-lock-"
+	// lockRuleLabel is the label holding the name of the rule which created the lock
+	lockRuleLabel = "event-handler.teleport.dev/rule"
+	// failedLoginLockRule is the rule name of the locks created after too many failed logins
+	failedLoginLockRule = "failed-login"
 )
 
 // TeleportSearchEventsClient is an interface for client.Client, required for testing
@@ -67,10 +75,14 @@ type TeleportEventsWatcher struct {
 	pos int
 	// batch current events batch
 	batch []*TeleportEvent
-	// config is teleport config
-	config *StartCmdConfig
+	// config is teleport config, replaced on reload
+	config atomic.Pointer[StartCmdConfig]
 	// startTime is event time frame start
 	startTime time.Time
+	// drain is closed once the watcher must stop fetching new pages
+	drain chan struct{}
+	// drainOnce closes drain
+	drainOnce sync.Once
 }
 
 // NewTeleportEventsWatcher builds Teleport client instance
@@ -81,6 +93,46 @@ func NewTeleportEventsWatcher(
 	cursor string,
 	id string,
 ) (*TeleportEventsWatcher, error) {
+	teleportClient, err := newTeleportClient(ctx, &c.TeleportConfig)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	tc := TeleportEventsWatcher{
+		client:    teleportClient,
+		pos:       -1,
+		cursor:    cursor,
+		id:        id,
+		startTime: startTime,
+		drain:     make(chan struct{}),
+	}
+	tc.config.Store(c)
+
+	return &tc, nil
+}
+
+// newTeleportClient builds Teleport client instance
+func newTeleportClient(ctx context.Context, c *TeleportConfig) (*client.Client, error) {
+	creds, err := teleportCredentials(ctx, c)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	if validCred, err := credentials.CheckIfExpired(creds); err != nil {
+		log.Warn(err)
+		if !validCred {
+			return nil, trace.BadParameter(
+				"No valid credentials found, this likely means credentials are expired. In this case, please sign new credentials and increase their TTL if needed.",
+			)
+		}
+		log.Info("At least one non-expired credential has been found, continuing startup")
+	}
+
+	return dialTeleport(ctx, c, creds)
+}
+
+// teleportCredentials loads the configured Teleport credentials
+func teleportCredentials(ctx context.Context, c *TeleportConfig) ([]client.Credentials, error) {
 	var creds []client.Credentials
 	switch {
 	case c.TeleportIdentityFile != "" && !c.TeleportRefreshEnabled:
@@ -97,16 +149,11 @@ func NewTeleportEventsWatcher(
 		return nil, trace.BadParameter("no credentials configured")
 	}
 
-	if validCred, err := credentials.CheckIfExpired(creds); err != nil {
-		log.Warn(err)
-		if !validCred {
-			return nil, trace.BadParameter(
-				"No valid credentials found, this likely means credentials are expired. In this case, please sign new credentials and increase their TTL if needed.",
-			)
-		}
-		log.Info("At least one non-expired credential has been found, continuing startup")
-	}
+	return creds, nil
+}
 
+// dialTeleport connects to Teleport using the given credentials
+func dialTeleport(ctx context.Context, c *TeleportConfig, creds []client.Credentials) (*client.Client, error) {
 	config := client.Config{
 		Addrs:       []string{c.TeleportAddr},
 		Credentials: creds,
@@ -117,16 +164,12 @@ func NewTeleportEventsWatcher(
 		return nil, trace.Wrap(err)
 	}
 
-	tc := TeleportEventsWatcher{
-		client:    teleportClient,
-		pos:       -1,
-		cursor:    cursor,
-		config:    c,
-		id:        id,
-		startTime: startTime,
-	}
+	return teleportClient, nil
+}
 
-	return &tc, nil
+// SetConfig replaces the configuration, it is used starting from the next batch
+func (t *TeleportEventsWatcher) SetConfig(c *StartCmdConfig) {
+	t.config.Store(c)
 }
 
 // Close closes connection to Teleport
@@ -134,6 +177,25 @@ func (t *TeleportEventsWatcher) Close() {
 	t.client.Close()
 }
 
+// Drain makes Events send the events of the fetched page and stop instead of fetching the next one
+func (t *TeleportEventsWatcher) Drain() {
+	t.drainOnce.Do(func() {
+		if t.drain != nil {
+			close(t.drain)
+		}
+	})
+}
+
+// draining returns true if the watcher must stop fetching new pages
+func (t *TeleportEventsWatcher) draining() bool {
+	select {
+	case <-t.drain:
+		return true
+	default:
+		return false
+	}
+}
+
 // flipPage flips the current page
 func (t *TeleportEventsWatcher) flipPage() bool {
 	if t.nextCursor == "" {
@@ -175,7 +237,7 @@ func (t *TeleportEventsWatcher) fetch(ctx context.Context) error {
 
 	// Convert batch to TeleportEvent
 	for _, e := range b {
-		if _, ok := t.config.SkipEventTypes[e.Type]; ok {
+		if _, ok := t.config.Load().SkipEventTypes[e.Type]; ok {
 			log.WithField("event", e).Debug("Skipping event")
 			continue
 		}
@@ -212,8 +274,8 @@ func (t *TeleportEventsWatcher) getEvents(ctx context.Context) ([]*auditlogpb.Ev
 		t.startTime,
 		time.Now().UTC(),
 		"default",
-		t.config.Types,
-		t.config.BatchSize,
+		t.config.Load().Types,
+		t.config.Load().BatchSize,
 		types.EventOrderAscending,
 		t.cursor,
 	)
@@ -222,12 +284,14 @@ func (t *TeleportEventsWatcher) getEvents(ctx context.Context) ([]*auditlogpb.Ev
 // pause sleeps for timeout seconds
 func (t *TeleportEventsWatcher) pause(ctx context.Context) error {
 	log := logger.Get(ctx)
-	log.Debugf("No new events, pause for %v seconds", t.config.Timeout)
+	log.Debugf("No new events, pause for %v seconds", t.config.Load().Timeout)
 
 	select {
 	case <-ctx.Done():
 		return ctx.Err()
-	case <-time.After(t.config.Timeout):
+	case <-t.drain:
+		return nil
+	case <-time.After(t.config.Load().Timeout):
 		return nil
 	}
 }
@@ -244,6 +308,11 @@ func (t *TeleportEventsWatcher) Events(ctx context.Context) (chan *TeleportEvent
 		for {
 			// If there is nothing in the batch, request
 			if len(t.batch) == 0 {
+				if t.draining() {
+					log.Info("Stopped fetching events")
+					break
+				}
+
 				err := t.fetch(ctx)
 				if err != nil {
 					e <- trace.Wrap(err)
@@ -252,7 +321,7 @@ func (t *TeleportEventsWatcher) Events(ctx context.Context) (chan *TeleportEvent
 
 				// If there is still nothing, sleep
 				if len(t.batch) == 0 {
-					if t.config.ExitOnLastEvent {
+					if t.config.Load().ExitOnLastEvent {
 						log.Info("All events are processed, exiting...")
 						break
 					}
@@ -269,6 +338,11 @@ func (t *TeleportEventsWatcher) Events(ctx context.Context) (chan *TeleportEvent
 
 			// If we processed the last event on a page
 			if t.pos >= len(t.batch) {
+				if t.draining() {
+					log.Info("Stopped fetching events")
+					break
+				}
+
 				// If there is next page, flip page
 				if t.flipPage() {
 					continue
@@ -283,7 +357,7 @@ func (t *TeleportEventsWatcher) Events(ctx context.Context) (chan *TeleportEvent
 
 				// If there is still nothing new on current page, sleep
 				if t.pos >= len(t.batch) {
-					if t.config.ExitOnLastEvent {
+					if t.config.Load().ExitOnLastEvent {
 						log.Info("All events are processed, exiting...")
 						break
 					}
@@ -321,6 +395,21 @@ func (t *TeleportEventsWatcher) StreamUnstructuredSessionEvents(ctx context.Cont
 
 // UpsertLock upserts user lock
 func (t *TeleportEventsWatcher) UpsertLock(ctx context.Context, user string, login string, period time.Duration) error {
+	target := types.LockTarget{
+		Login: login,
+		User:  user,
+	}
+
+	return t.UpsertLockTarget(ctx, failedLoginLockName(user, login), failedLoginLockRule, target, lockMessage, period)
+}
+
+// failedLoginLockName returns the name of the lock created after too many failed logins
+func failedLoginLockName(user string, login string) string {
+	return fmt.Sprintf("%v%v-%v", lockNamePrefix, user, login)
+}
+
+// UpsertLockTarget upserts the lock of an arbitrary target, rule is the name of the rule which created the lock
+func (t *TeleportEventsWatcher) UpsertLockTarget(ctx context.Context, name string, rule string, target types.LockTarget, message string, period time.Duration) error {
 	var expires *time.Time
 
 	if period > 0 {
@@ -331,15 +420,14 @@ func (t *TeleportEventsWatcher) UpsertLock(ctx context.Context, user string, log
 
 	lock := &types.LockV2{
 		Metadata: types.Metadata{
-			Name: fmt.Sprintf("event-handler-auto-lock-%v-%v", user, login),
+			Name:   name,
+			Labels: map[string]string{lockRuleLabel: rule},
 		},
 		Spec: types.LockSpecV2{
-			Target: types.LockTarget{
-				Login: login,
-				User:  user,
-			},
-			Message: lockMessage,
-			Expires: expires,
+			Target:    target,
+			Message:   message,
+			Expires:   expires,
+			CreatedAt: time.Now().UTC(),
 		},
 	}
 
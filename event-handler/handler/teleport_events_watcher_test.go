@@ -14,7 +14,7 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
-package main
+package handler
 
 import (
 	"strconv"
@@ -124,13 +124,13 @@ func newTeleportEventWatcher(t *testing.T, eventsClient TeleportSearchEventsClie
 	client := &TeleportEventsWatcher{
 		client: eventsClient,
 		pos:    -1,
-		config: &StartCmdConfig{
-			IngestConfig: IngestConfig{
-				BatchSize:       5,
-				ExitOnLastEvent: true,
-			},
-		},
 	}
+	client.config.Store(&StartCmdConfig{
+		IngestConfig: IngestConfig{
+			BatchSize:       5,
+			ExitOnLastEvent: true,
+		},
+	})
 
 	return client
 }
@@ -216,6 +216,47 @@ func TestEvents(t *testing.T) {
 	}
 }
 
+// TestEventsDrain checks that the events of the fetched page are sent once the watcher is drained
+func TestEventsDrain(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	testAuditEvents := make([]events.AuditEvent, 20)
+	for i := 0; i < 20; i++ {
+		testAuditEvents[i] = &events.UserCreate{
+			Metadata: events.Metadata{
+				ID: strconv.Itoa(i),
+			},
+		}
+	}
+
+	client := newTeleportEventWatcher(t, &mockTeleportEventWatcher{events: testAuditEvents})
+	client.drain = make(chan struct{})
+
+	chEvt, chErr := client.Events(ctx)
+
+	var ids []string
+	for {
+		select {
+		case event, ok := <-chEvt:
+			if !ok {
+				// The rest of the first page is sent, the next page is not fetched
+				require.Equal(t, []string{"0", "1", "2", "3", "4"}, ids)
+				return
+			}
+			ids = append(ids, event.ID)
+			if len(ids) == 2 {
+				client.Drain()
+			}
+		case err, ok := <-chErr:
+			require.False(t, ok, "Received unexpected error from error channel: %v", err)
+			chErr = nil
+		case <-time.After(time.Second):
+			t.Fatalf("No events received within deadline")
+		}
+	}
+}
+
 func TestUpdatePage(t *testing.T) {
 	ctx := context.Background()
 
@@ -233,7 +274,7 @@ func TestUpdatePage(t *testing.T) {
 
 	mockEventWatcher := &mockTeleportEventWatcher{}
 	client := newTeleportEventWatcher(t, mockEventWatcher)
-	client.config.ExitOnLastEvent = false
+	client.config.Load().ExitOnLastEvent = false
 
 	// Start the events goroutine
 	chEvt, chErr := client.Events(ctx)
@@ -347,59 +388,42 @@ func TestValidateConfig(t *testing.T) {
 		{
 			name: "Identity file configured",
 			cfg: StartCmdConfig{
-				FluentdConfig{},
-				TeleportConfig{
+				TeleportConfig: TeleportConfig{
 					TeleportIdentityFile: "not_empty_string",
 				},
-				IngestConfig{},
-				LockConfig{},
 			},
 			wantError: false,
 		}, {
 			name: "Cert, key, ca files configured",
 			cfg: StartCmdConfig{
-				FluentdConfig{},
-				TeleportConfig{
+				TeleportConfig: TeleportConfig{
 					TeleportCA:   "not_empty_string",
 					TeleportCert: "not_empty_string",
 					TeleportKey:  "not_empty_string",
 				},
-				IngestConfig{},
-				LockConfig{},
 			},
 			wantError: false,
 		}, {
 			name: "Identity and teleport cert/ca/key files configured",
 			cfg: StartCmdConfig{
-				FluentdConfig{},
-				TeleportConfig{
+				TeleportConfig: TeleportConfig{
 					TeleportIdentityFile: "not_empty_string",
 					TeleportCA:           "not_empty_string",
 					TeleportCert:         "not_empty_string",
 					TeleportKey:          "not_empty_string",
 				},
-				IngestConfig{},
-				LockConfig{},
 			},
 			wantError: true,
 		}, {
-			name: "None set",
-			cfg: StartCmdConfig{
-				FluentdConfig{},
-				TeleportConfig{},
-				IngestConfig{},
-				LockConfig{},
-			},
+			name:      "None set",
+			cfg:       StartCmdConfig{},
 			wantError: true,
 		}, {
 			name: "Some of teleport cert/key/ca unset",
 			cfg: StartCmdConfig{
-				FluentdConfig{},
-				TeleportConfig{
+				TeleportConfig: TeleportConfig{
 					TeleportCA: "not_empty_string",
 				},
-				IngestConfig{},
-				LockConfig{},
 			},
 			wantError: true,
 		},
@@ -0,0 +1,206 @@
+// Copyright 2024 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	auditlogpb "github.com/gravitational/teleport/api/gen/proto/go/teleport/auditlog/v1"
+	"github.com/gravitational/teleport/api/types"
+	"github.com/gravitational/trace"
+
+	"github.com/gravitational/teleport-plugins/event-handler/lib"
+)
+
+// verifyClient is the Teleport client interface used by the verify command
+type verifyClient interface {
+	// SearchUnstructuredEvents searches for events in the audit log and returns them using an unstructured representation (structpb.Struct).
+	SearchUnstructuredEvents(ctx context.Context, fromUTC, toUTC time.Time, namespace string, eventTypes []string, limit int, order types.EventOrder, startKey string) ([]*auditlogpb.EventUnstructured, string, error)
+}
+
+// verifyBucket is the number of the events of the bucket in the audit log and the numbers forwarded and dropped
+type verifyBucket struct {
+	// Start is the bucket start time
+	Start time.Time
+	// Teleport is the number of the events in the Teleport audit log
+	Teleport int64
+	// Forwarded is the number of the events forwarded by the handler
+	Forwarded int64
+	// Dropped is the number of the events dropped by the handler event type policies
+	Dropped int64
+}
+
+// Diff returns the number of the events the handler has counted in excess of the audit log, negative if missing
+func (b verifyBucket) Diff() int64 {
+	return b.Forwarded + b.Dropped - b.Teleport
+}
+
+// Status returns the bucket verification status
+func (b verifyBucket) Status() string {
+	switch {
+	case b.Diff() < 0:
+		return "missing"
+	case b.Diff() > 0:
+		return "extra"
+	default:
+		return "ok"
+	}
+}
+
+// Validate validates verify command arguments
+func (c *VerifyCmdConfig) Validate() error {
+	if c.TeleportDataDir != "" {
+		return trace.BadParameter("verify requires the Auth API and can not be used with teleport-data-dir")
+	}
+	if c.BatchSize < 1 {
+		return trace.BadParameter("batch must be positive")
+	}
+
+	return trace.Wrap(c.TeleportConfig.Check())
+}
+
+// Range returns the verified time range, aligned to the event counter buckets
+func (c *VerifyCmdConfig) Range(now time.Time) (time.Time, time.Time, error) {
+	to := eventCountBucketStart(now)
+	if c.To != nil {
+		to = eventCountBucketStart(*c.To)
+	}
+
+	from := eventCountBucketStart(now.Add(-c.Since))
+	if c.From != nil {
+		from = eventCountBucketStart(*c.From)
+	}
+
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, trace.BadParameter("the verified time range %v - %v is empty", from, to)
+	}
+
+	return from, to, nil
+}
+
+// RunVerifyCmd compares the events counted by the handler with the Teleport audit log bucket by bucket, and
+// returns an error if some buckets do not match
+func RunVerifyCmd(c *VerifyCmdConfig) error {
+	if err := c.Validate(); err != nil {
+		return trace.Wrap(err)
+	}
+
+	from, to, err := c.Range(time.Now())
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	ctx := context.Background()
+
+	client, err := newTeleportClient(ctx, &c.TeleportConfig)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer client.Close()
+
+	s, err := NewState(&StartCmdConfig{
+		TeleportConfig: TeleportConfig{TeleportAddr: c.TeleportAddr},
+		IngestConfig:   IngestConfig{StorageDir: c.StorageDir},
+	})
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	buckets, err := verifyEventCounts(ctx, client, s, c, from, to)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	return trace.Wrap(printVerifyBuckets(buckets, os.Stdout))
+}
+
+// verifyEventCounts recounts the audit log events of [from, to) per bucket and returns the buckets along with
+// the handler counters. The event types are filtered the same way the start command does.
+func verifyEventCounts(ctx context.Context, client verifyClient, s *State, c *VerifyCmdConfig, from, to time.Time) ([]verifyBucket, error) {
+	teleport := make(map[time.Time]int64)
+	skip := lib.SliceToAnonymousMap(c.SkipEventTypesRaw)
+
+	var startKey string
+	for {
+		events, next, err := client.SearchUnstructuredEvents(ctx, from, to, "default", c.Types, c.BatchSize, types.EventOrderAscending, startKey)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+
+		for _, e := range events {
+			if _, ok := skip[e.Type]; ok {
+				continue
+			}
+			ts := e.Time.AsTime()
+			if ts.Before(from) || !ts.Before(to) {
+				continue
+			}
+			teleport[eventCountBucketStart(ts)]++
+		}
+
+		if next == "" {
+			break
+		}
+		startKey = next
+	}
+
+	handler, err := s.GetEventCounts(from, to)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	var buckets []verifyBucket
+	for start := from; start.Before(to); start = start.Add(eventCountBucket) {
+		n := handler[start]
+		buckets = append(buckets, verifyBucket{Start: start, Teleport: teleport[start], Forwarded: n.Forwarded, Dropped: n.Dropped})
+	}
+
+	return buckets, nil
+}
+
+// printVerifyBuckets writes the buckets table to w, returns an error if some buckets do not match
+func printVerifyBuckets(buckets []verifyBucket, w io.Writer) error {
+	var teleport, forwarded, dropped int64
+	var mismatched int
+
+	t := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(t, "BUCKET\tTELEPORT\tFORWARDED\tDROPPED\tDIFF\tSTATUS")
+	for _, b := range buckets {
+		fmt.Fprintf(t, "%v\t%v\t%v\t%v\t%+d\t%v\n", b.Start.Format(time.RFC3339), b.Teleport, b.Forwarded, b.Dropped, b.Diff(), b.Status())
+
+		teleport += b.Teleport
+		forwarded += b.Forwarded
+		dropped += b.Dropped
+		if b.Diff() != 0 {
+			mismatched++
+		}
+	}
+	if err := t.Flush(); err != nil {
+		return trace.Wrap(err)
+	}
+
+	fmt.Fprintf(w, "\nTeleport: %v, forwarded: %v, dropped: %v, buckets verified: %v, mismatched: %v\n", teleport, forwarded, dropped, len(buckets), mismatched)
+
+	if mismatched > 0 {
+		return trace.CompareFailed("%v of %v buckets do not match the Teleport audit log", mismatched, len(buckets))
+	}
+
+	return nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2024 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	auditlogpb "github.com/gravitational/teleport/api/gen/proto/go/teleport/auditlog/v1"
+	"github.com/gravitational/teleport/api/types"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// pagedVerifyClient returns the audit log events page by page
+type pagedVerifyClient struct {
+	events []*auditlogpb.EventUnstructured
+	pages  int
+}
+
+func (c *pagedVerifyClient) SearchUnstructuredEvents(_ context.Context, from, to time.Time, _ string, _ []string, limit int, _ types.EventOrder, startKey string) ([]*auditlogpb.EventUnstructured, string, error) {
+	c.pages++
+
+	var r []*auditlogpb.EventUnstructured
+	for _, e := range c.events {
+		if ts := e.Time.AsTime(); !ts.Before(from) && !ts.After(to) {
+			r = append(r, e)
+		}
+	}
+
+	start := 0
+	if startKey != "" {
+		start, _ = strconv.Atoi(startKey)
+	}
+	r = r[start:]
+	if len(r) <= limit {
+		return r, "", nil
+	}
+
+	return r[:limit], strconv.Itoa(start + limit), nil
+}
+
+func TestVerifyEventCounts(t *testing.T) {
+	setup(t)
+
+	ctx := context.Background()
+	from := time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC)
+	to := from.Add(3 * time.Hour)
+
+	event := func(typ string, ts time.Time) *auditlogpb.EventUnstructured {
+		return &auditlogpb.EventUnstructured{Type: typ, Time: timestamppb.New(ts)}
+	}
+	client := &pagedVerifyClient{events: []*auditlogpb.EventUnstructured{
+		event("user.login", from.Add(-time.Minute)),
+		event("user.login", from),
+		event("user.login", from.Add(10*time.Minute)),
+		event("cert.create", from.Add(20*time.Minute)),
+		event("user.login", from.Add(time.Hour+time.Minute)),
+		event("user.login", from.Add(2*time.Hour+time.Minute)),
+		event("user.login", to),
+	}}
+
+	state, err := NewState(startC)
+	require.NoError(t, err)
+	for _, ts := range []time.Time{from, from.Add(time.Hour), from.Add(time.Hour + time.Second)} {
+		require.NoError(t, state.AddEventCount(ts, true))
+	}
+	require.NoError(t, state.AddEventCount(from.Add(10*time.Minute), false))
+
+	c := &VerifyCmdConfig{SkipEventTypesRaw: []string{"cert.create"}, BatchSize: 2}
+	buckets, err := verifyEventCounts(ctx, client, state, c, from, to)
+	require.NoError(t, err)
+	require.Greater(t, client.pages, 1)
+	require.Equal(t, []verifyBucket{
+		{Start: from, Teleport: 2, Forwarded: 1, Dropped: 1},
+		{Start: from.Add(time.Hour), Teleport: 1, Forwarded: 2},
+		{Start: from.Add(2 * time.Hour), Teleport: 1},
+	}, buckets)
+
+	var buf bytes.Buffer
+	err = printVerifyBuckets(buckets, &buf)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "2 of 3 buckets")
+	require.Contains(t, buf.String(), "DROPPED")
+	require.Contains(t, buf.String(), "missing")
+	require.Contains(t, buf.String(), "extra")
+
+	buf.Reset()
+	require.NoError(t, printVerifyBuckets(buckets[:1], &buf))
+	require.Contains(t, buf.String(), "mismatched: 0")
+}
+
+func TestVerifyCmdRange(t *testing.T) {
+	now := time.Date(2024, 1, 2, 10, 30, 0, 0, time.UTC)
+
+	from, to, err := (&VerifyCmdConfig{Since: 24 * time.Hour}).Range(now)
+	require.NoError(t, err)
+	require.Equal(t, now.Add(-24*time.Hour).Truncate(time.Hour), from)
+	require.Equal(t, now.Truncate(time.Hour), to)
+
+	start := now.Add(-90 * time.Minute)
+	from, to, err = (&VerifyCmdConfig{From: &start, To: &now, Since: 24 * time.Hour}).Range(now)
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2024, 1, 2, 9, 0, 0, 0, time.UTC), from)
+	require.Equal(t, time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC), to)
+
+	_, _, err = (&VerifyCmdConfig{From: &now, Since: 24 * time.Hour}).Range(now)
+	require.Error(t, err)
+}
@@ -14,11 +14,19 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
-package main
+package handler
+
+const (
+	// PluginName is the plugin name
+	PluginName = "Teleport event handler"
+
+	// PluginDescription is the plugin description
+	PluginDescription = "Forwards Teleport AuditLog to external sources"
+)
 
 var (
 	// Version package version, specified in Makefile using ldflags
-	Version = `Not specified, use --ldflags "-X main.Version "1.0.0""`
+	Version = `Not specified, use --ldflags "-X github.com/gravitational/teleport-plugins/event-handler/handler.Version "1.0.0""`
 
 	// Gitref variable is specified in Makefile using ldflags
 	Gitref string
@@ -20,25 +20,23 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/alecthomas/kong"
 	"github.com/gravitational/teleport/integrations/lib"
 	"github.com/gravitational/teleport/integrations/lib/logger"
 	"github.com/gravitational/trace"
+
+	"github.com/gravitational/teleport-plugins/event-handler/handler"
 )
 
 // cli is CLI configuration
-var cli CLI
+var cli handler.CLI
 
 const (
-	// pluginName is the plugin name
-	pluginName = "Teleport event handler"
-
-	// pluginDescription is the plugin description
-	pluginDescription = "Forwards Teleport AuditLog to external sources"
-
 	// gracefulShutdownTimeout is the graceful shutdown timeout
 	gracefulShutdownTimeout = 5 * time.Second
 )
@@ -49,9 +47,9 @@ func main() {
 	ctx := kong.Parse(
 		&cli,
 		kong.UsageOnError(),
-		kong.Configuration(KongTOMLResolver),
-		kong.Name(pluginName),
-		kong.Description(pluginDescription),
+		kong.Configuration(handler.KongTOMLResolver),
+		kong.Name(handler.PluginName),
+		kong.Description(handler.PluginDescription),
 	)
 
 	if cli.Debug {
@@ -64,13 +62,70 @@ func main() {
 
 	switch {
 	case ctx.Command() == "version":
-		lib.PrintVersion(pluginName, Version, Gitref)
+		lib.PrintVersion(handler.PluginName, handler.Version, handler.Gitref)
+	case strings.HasPrefix(ctx.Command(), "configure rotate"):
+		err := handler.RunConfigureRotateCmd(&cli.Configure.Rotate)
+		if err != nil {
+			fmt.Println(trace.DebugReport(err))
+			os.Exit(-1)
+		}
 	case strings.HasPrefix(ctx.Command(), "configure"):
-		err := RunConfigureCmd(&cli.Configure)
+		err := handler.RunConfigureCmd(&cli.Configure.Generate)
 		if err != nil {
 			fmt.Println(trace.DebugReport(err))
 			os.Exit(-1)
 		}
+	case strings.HasPrefix(ctx.Command(), "sessions list"):
+		err := handler.RunSessionsListCmd(&cli.Sessions.List)
+		if err != nil {
+			fmt.Println(trace.DebugReport(err))
+			os.Exit(-1)
+		}
+	case strings.HasPrefix(ctx.Command(), "sessions retry"):
+		err := handler.RunSessionsRetryCmd(&cli.Sessions.Retry)
+		if err != nil {
+			fmt.Println(trace.DebugReport(err))
+			os.Exit(-1)
+		}
+	case strings.HasPrefix(ctx.Command(), "locks list"):
+		err := handler.RunLocksListCmd(&cli.Locks.List)
+		if err != nil {
+			fmt.Println(trace.DebugReport(err))
+			os.Exit(-1)
+		}
+	case strings.HasPrefix(ctx.Command(), "locks show"):
+		err := handler.RunLocksShowCmd(&cli.Locks.Show)
+		if err != nil {
+			fmt.Println(trace.DebugReport(err))
+			os.Exit(-1)
+		}
+	case strings.HasPrefix(ctx.Command(), "locks release"):
+		err := handler.RunLocksReleaseCmd(&cli.Locks.Release)
+		if err != nil {
+			fmt.Println(trace.DebugReport(err))
+			os.Exit(-1)
+		}
+	case ctx.Command() == "search":
+		err := handler.RunSearchCmd(&cli.Search)
+		if err != nil {
+			fmt.Println(trace.DebugReport(err))
+			os.Exit(-1)
+		}
+	case ctx.Command() == "verify":
+		if err := handler.RunVerifyCmd(&cli.Verify); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	case ctx.Command() == "check":
+		configs, err := loadClusterConfigs()
+		if err != nil {
+			fmt.Println(trace.DebugReport(err))
+			os.Exit(-1)
+		}
+		if err := handler.RunCheckCmd(configs); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
 	case ctx.Command() == "start":
 		err := start()
 
@@ -84,14 +139,143 @@ func main() {
 
 // start spawns the main process
 func start() error {
-	app, err := NewApp(&cli.Start)
+	clusters, err := countClusters(string(cli.Config))
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	if clusters > 1 {
+		return trace.Wrap(startMultiCluster())
+	}
+
+	app, err := handler.NewApp(&cli.Start)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	go lib.ServeSignals(app, shutdownTimeout(&cli.Start))
+	go serveReloadSignal(func(ctx context.Context) error {
+		c, err := loadStartConfig(0)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		return trace.Wrap(app.Reload(ctx, c))
+	})
+
+	return trace.Wrap(
+		app.Run(context.Background()),
+	)
+}
+
+// startMultiCluster spawns the process ingesting events from every cluster defined in the configuration file
+func startMultiCluster() error {
+	configs, err := loadClusterConfigs()
 	if err != nil {
 		return trace.Wrap(err)
 	}
 
-	go lib.ServeSignals(app, gracefulShutdownTimeout)
+	app, err := handler.NewMultiApp(configs)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	go lib.ServeSignals(app, shutdownTimeout(configs...))
+	go serveReloadSignal(func(ctx context.Context) error {
+		configs, err := loadClusterConfigs()
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		return trace.Wrap(app.Reload(ctx, configs))
+	})
 
 	return trace.Wrap(
 		app.Run(context.Background()),
 	)
 }
+
+// countClusters returns the number of [[teleport]] blocks in the configuration file, zero if there is no file
+func countClusters(path string) (int, error) {
+	if path == "" {
+		return 0, nil
+	}
+
+	n, err := handler.CountClusterBlocks(path)
+	return n, trace.Wrap(err)
+}
+
+// loadClusterConfigs reads start command configuration of every cluster defined in the configuration file
+func loadClusterConfigs() ([]*handler.StartCmdConfig, error) {
+	n, err := countClusters(string(cli.Config))
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if n == 0 {
+		n = 1
+	}
+
+	configs := make([]*handler.StartCmdConfig, 0, n)
+	for i := 0; i < n; i++ {
+		c, err := loadStartConfig(i)
+		if err != nil {
+			return nil, trace.Wrap(err, "cluster %v", i)
+		}
+		configs = append(configs, c)
+	}
+
+	return configs, nil
+}
+
+// loadStartConfig reads start or check command configuration of the cluster with the given index from the
+// command line arguments, the environment and the configuration file
+func loadStartConfig(cluster int) (*handler.StartCmdConfig, error) {
+	var c handler.CLI
+
+	parser, err := kong.New(
+		&c,
+		kong.Configuration(handler.NewKongTOMLClusterResolver(cluster)),
+		kong.Name(handler.PluginName),
+		kong.Description(handler.PluginDescription),
+	)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	ctx, err := parser.Parse(os.Args[1:])
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	if ctx.Command() == "check" {
+		return &c.Check, nil
+	}
+
+	return &c.Start, nil
+}
+
+// shutdownTimeout returns the time given to the graceful shutdown, the drain phase included
+func shutdownTimeout(configs ...*handler.StartCmdConfig) time.Duration {
+	var drain time.Duration
+	for _, c := range configs {
+		drain = max(drain, c.DrainTimeout)
+	}
+
+	return drain + gracefulShutdownTimeout
+}
+
+// serveReloadSignal calls reload every time SIGHUP is received
+func serveReloadSignal(reload func(ctx context.Context) error) {
+	sigC := make(chan os.Signal, 1)
+	signal.Notify(sigC, syscall.SIGHUP)
+	defer signal.Stop(sigC)
+
+	ctx := context.Background()
+	log := logger.Get(ctx)
+
+	for range sigC {
+		log.Info("Received SIGHUP, reloading configuration")
+
+		if err := reload(ctx); err != nil {
+			log.WithError(err).Error("Failed to reload configuration, the current configuration is kept")
+		}
+	}
+}